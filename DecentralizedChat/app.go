@@ -156,6 +156,9 @@ func (a *App) OnStartup(ctx context.Context) {
 				a.addStartupError(fmt.Errorf("init storage failed: %w", err))
 			} else {
 				slog.Info("✅ SQLite storage initialized")
+				if err := a.unlockStorageWithSeed(); err != nil {
+					a.addStartupError(fmt.Errorf("unlock storage failed: %w", err))
+				}
 			}
 		} else {
 			a.addStartupError(fmt.Errorf("create sqlite directory failed: %w", err))
@@ -176,6 +179,12 @@ func (a *App) OnStartup(ctx context.Context) {
 	// 把storage实例传给chat服务
 	a.chatSvc = chat.NewService(a.natsSvc, a.storage)
 
+	// 签名上线的时间：首次以签名模式启动时记录下来，随启动时的配置一起保存，之后保持不变
+	if a.config.UnsignedCutover.IsZero() {
+		a.config.UnsignedCutover = time.Now().UTC()
+	}
+	a.chatSvc.SetUnsignedCutover(a.config.UnsignedCutover)
+
 	// 从配置加载用户昵称
 	if a.config.User.Nickname != "" {
 		a.chatSvc.SetUser(a.config.User.Nickname)
@@ -194,6 +203,11 @@ func (a *App) OnStartup(ctx context.Context) {
 		})
 	})
 
+	// 其他事件（群邀请等）按事件名原样推送给前端
+	a.chatSvc.OnEvent(func(name string, payload any) {
+		runtime.EventsEmit(a.ctx, name, payload)
+	})
+
 	// 自动加载NSC密钥用于聊天加密
 	if a.config.Keys.UserSeedPath != "" {
 		seed, err := a.getNSCUserSeed()
@@ -208,22 +222,10 @@ func (a *App) OnStartup(ctx context.Context) {
 		}
 	}
 
-	// 初始化离线消息同步（所有依赖都准备就绪：LeafNode已连接、NATS客户端已连接、密钥已加载）
-	if a.chatSvc != nil && a.config.LeafNode.EnableJetStream {
-		go func() {
-			// 等待3秒确保LeafNode和Hub的连接完全稳定
-			time.Sleep(3 * time.Second)
-			if err := a.chatSvc.InitOfflineSync(); err != nil {
-				slog.Error("初始化离线同步失败", "error", err)
-				// 异步初始化的错误推送到前端
-				runtime.EventsEmit(a.ctx, "message:error", map[string]any{
-					"error":     fmt.Sprintf("离线同步初始化失败: %v", err),
-					"timestamp": fmt.Sprintf("%d", time.Now().Unix()),
-				})
-			} else {
-				slog.Info("✅ 离线消息同步初始化成功")
-			}
-		}()
+	// 用口令加密的数据库要等前端解锁之后再开始同步
+	storageLocked := a.storage != nil && a.storage.Locked()
+	if !storageLocked {
+		go a.startBackground()
 	}
 
 	if err := config.SaveConfig(a.config); err != nil {
@@ -236,6 +238,10 @@ func (a *App) OnStartup(ctx context.Context) {
 	startupErrs := a.startupErrs
 	a.mu.Unlock()
 
+	if storageLocked {
+		runtime.EventsEmit(a.ctx, "storage:locked", nil)
+	}
+
 	if len(startupErrs) > 0 {
 		// 把所有启动错误合并成一条消息推送给前端
 		errMsg := "启动过程中出现以下错误:\n"
@@ -248,52 +254,126 @@ func (a *App) OnStartup(ctx context.Context) {
 		})
 	}
 
-	// 自动恢复所有会话（异步执行，不阻塞启动）
-	if a.storage != nil && a.chatSvc != nil {
-		go func() {
-			// 等待1秒确保服务完全稳定
-			time.Sleep(1 * time.Second)
+	// 自动恢复所有会话（异步执行，不阻塞启动）；用口令加密的数据库等解锁之后再恢复
+	if !storageLocked {
+		go a.restoreConversations()
+	}
 
-			// 恢复好友会话
-			friends, err := a.storage.GetAllFriends()
-			if err != nil {
-				slog.Warn("failed to get friends list", "error", err)
+	slog.Info("DChat application started (LeafNode mode)")
+}
+
+// restoreConversations 重新订阅所有好友和群聊会话（跳过主动离开的），离线同步也随之拉取这些会话。
+// 好友公钥和群密钥是加密列，必须在数据库解锁之后调用
+func (a *App) restoreConversations() {
+	if a.storage == nil || a.chatSvc == nil {
+		return
+	}
+	// 等待1秒确保服务完全稳定
+	time.Sleep(1 * time.Second)
+
+	// 用户主动离开的会话不再自动订阅
+	left, err := a.storage.GetLeftConversations()
+	if err != nil {
+		slog.Warn("failed to get left conversations", "error", err)
+	}
+
+	// 恢复好友会话
+	friends, err := a.storage.GetAllFriends()
+	if err != nil {
+		slog.Warn("failed to get friends list", "error", err)
+	} else {
+		successCount := 0
+		for _, peerID := range friends {
+			if left[a.chatSvc.GetConversationID(peerID)] {
+				continue
+			}
+			if err := a.chatSvc.JoinDirect(peerID); err != nil {
+				slog.Warn("failed to rejoin direct chat", "peer", peerID, "error", err)
 			} else {
-				successCount := 0
-				for _, peerID := range friends {
-					if err := a.chatSvc.JoinDirect(peerID); err != nil {
-						slog.Warn("failed to rejoin direct chat", "peer", peerID, "error", err)
-					} else {
-						successCount++
-					}
-				}
-				slog.Info("direct chats restored", "total", len(friends), "success", successCount)
+				successCount++
 			}
+		}
+		slog.Info("direct chats restored", "total", len(friends), "success", successCount)
+	}
 
-			// 恢复群聊会话
-			groups, err := a.storage.GetAllGroups()
-			if err != nil {
-				slog.Warn("failed to get groups list", "error", err)
+	// 恢复群聊会话
+	groups, err := a.storage.GetAllGroups()
+	if err != nil {
+		slog.Warn("failed to get groups list", "error", err)
+	} else {
+		successCount := 0
+		for _, gid := range groups {
+			if left[gid] {
+				continue
+			}
+			if err := a.chatSvc.JoinGroup(gid); err != nil {
+				slog.Warn("failed to rejoin group chat", "gid", gid, "error", err)
 			} else {
-				successCount := 0
-				for _, gid := range groups {
-					if err := a.chatSvc.JoinGroup(gid); err != nil {
-						slog.Warn("failed to rejoin group chat", "gid", gid, "error", err)
-					} else {
-						successCount++
-					}
-				}
-				slog.Info("group chats restored", "total", len(groups), "success", successCount)
+				successCount++
 			}
-		}()
+		}
+		slog.Info("group chats restored", "total", len(groups), "success", successCount)
 	}
+}
 
-	slog.Info("DChat application started (LeafNode mode)")
+// startBackground 初始化离线消息同步，发布预密钥和在线状态
+// （所有依赖都准备就绪：LeafNode已连接、NATS客户端已连接、密钥已加载、数据库已解锁）
+func (a *App) startBackground() {
+	if a.chatSvc == nil || !a.config.LeafNode.EnableJetStream {
+		return
+	}
+	// 等待3秒确保LeafNode和Hub的连接完全稳定
+	time.Sleep(3 * time.Second)
+	if err := a.chatSvc.InitOfflineSync(); err != nil {
+		slog.Error("初始化离线同步失败", "error", err)
+		// 异步初始化的错误推送到前端
+		runtime.EventsEmit(a.ctx, "message:error", map[string]any{
+			"error":     fmt.Sprintf("离线同步初始化失败: %v", err),
+			"timestamp": fmt.Sprintf("%d", time.Now().Unix()),
+		})
+	} else {
+		slog.Info("✅ 离线消息同步初始化成功")
+	}
+	// 发布预密钥，离线时好友也能直接建立前向保密会话
+	if err := a.chatSvc.PublishPrekeys(); err != nil {
+		slog.Warn("发布预密钥失败", "error", err)
+	}
+	if err := a.chatSvc.SetPresence(chat.PresenceOnline); err != nil {
+		slog.Warn("发布在线状态失败", "error", err)
+	}
+}
+
+// unlockStorageWithSeed 用 NSC seed 解锁本地数据库；还没加密的数据库用 seed 派生的密钥开启静态加密。
+// 用口令加密的数据库保持锁定，等前端调用 UnlockStorage
+func (a *App) unlockStorageWithSeed() error {
+	kind := a.storage.EncryptionKind()
+	if kind == storage.KeyPassphrase {
+		slog.Info("本地数据库已用口令加密，等待解锁")
+		return nil
+	}
+	seed, err := a.getNSCUserSeed()
+	if err != nil {
+		return err
+	}
+	if kind == "" {
+		slog.Info("开启本地数据库静态加密")
+		return a.storage.EnableEncryption(storage.SeedKey(seed))
+	}
+	return a.storage.Unlock(storage.SeedKey(seed))
 }
 
 // OnShutdown is called when the app stops
 func (a *App) OnShutdown(ctx context.Context) {
-	// 先停止离线消息同步
+	// 尽量通知好友自己已离线，失败时对方按心跳超时判定
+	if a.chatSvc != nil {
+		_ = a.chatSvc.SetPresence(chat.PresenceOffline)
+	}
+	// 先退订所有会话、停止离线消息同步，再断开连接
+	if a.chatSvc != nil {
+		if err := a.chatSvc.Close(); err != nil {
+			slog.Warn("close chat service", "error", err)
+		}
+	}
 	if a.natsSvc != nil {
 		a.natsSvc.StopSync()
 		a.natsSvc.Close()
@@ -340,6 +420,31 @@ func (a *App) AddGroupKey(gid, symB64 string) error {
 	return nil
 }
 
+// RotateGroupKey 轮换群密钥，新密钥只通过私聊发给 remainingMembers，返回新纪元
+func (a *App) RotateGroupKey(gid string, remainingMembers []string) (uint32, error) {
+	if a.chatSvc == nil {
+		return 0, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.RotateGroupKey(gid, remainingMembers)
+}
+
+// SetForwardSecrecy 开关私聊的双棘轮会话（默认开启）
+func (a *App) SetForwardSecrecy(enabled bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	a.chatSvc.SetForwardSecrecy(enabled)
+	return nil
+}
+
+// PublishPrekeys 重新发布自己的预密钥包，补足一次性预密钥（登录时已自动调用）
+func (a *App) PublishPrekeys() error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.PublishPrekeys()
+}
+
 func (a *App) JoinDirect(peerID string) error {
 	if a.chatSvc == nil {
 		return fmt.Errorf("chat service not initialized")
@@ -347,6 +452,22 @@ func (a *App) JoinDirect(peerID string) error {
 	return a.chatSvc.JoinDirect(peerID)
 }
 
+// LeaveDirect 退订私聊会话，好友公钥和聊天记录保留
+func (a *App) LeaveDirect(peerID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.LeaveDirect(peerID)
+}
+
+// LeaveGroup 退订群聊，群密钥和聊天记录保留
+func (a *App) LeaveGroup(gid string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.LeaveGroup(gid)
+}
+
 // 旧方法已废弃，请使用带groupKey参数的JoinGroup
 
 func (a *App) SendDirect(peerID, content string) error {
@@ -363,6 +484,46 @@ func (a *App) SendGroup(gid, content string) error {
 	return a.chatSvc.SendGroup(gid, content)
 }
 
+// RetrySend 立即重试发件箱里没发出去的消息
+func (a *App) RetrySend(msgID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.RetrySend(msgID)
+}
+
+// CancelSend 取消发件箱里没发出去的消息
+func (a *App) CancelSend(msgID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.CancelSend(msgID)
+}
+
+// GetOutbox 获取发件箱里还没发出去的消息
+func (a *App) GetOutbox() ([]*storage.OutboxEntry, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetOutbox()
+}
+
+// SendFile 加密上传文件并发送附件消息，cidOrGid 可以是好友ID、会话ID或群ID
+func (a *App) SendFile(cidOrGid, path string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.SendFile(cidOrGid, path)
+}
+
+// DownloadAttachment 下载并解密消息附件到 dest（文件路径或已存在的目录）
+func (a *App) DownloadAttachment(msgID, dest string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.DownloadAttachment(msgID, dest)
+}
+
 // GetUser returns current user info
 func (a *App) GetUser() (chat.User, error) {
 	if a.chatSvc == nil {
@@ -403,6 +564,118 @@ func (a *App) MarkAsRead(conversationID string, before time.Time) error {
 	return a.chatSvc.MarkAsRead(conversationID, before)
 }
 
+// GetQuarantinedMessages 获取离线同步中解密失败、仍在隔离的消息
+func (a *App) GetQuarantinedMessages() ([]*storage.QuarantinedMessage, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetQuarantinedMessages()
+}
+
+// GetMessageReceipts 获取自己发出的消息的逐人送达/已读回执
+func (a *App) GetMessageReceipts(msgID string) ([]*storage.MessageReceipt, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetMessageReceipts(msgID)
+}
+
+// SendReply 回复一条消息，发送到原消息所在的会话
+func (a *App) SendReply(parentMsgID, content string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.SendReply(parentMsgID, content)
+}
+
+// GetThread 获取话题的根消息和全部回复
+func (a *App) GetThread(rootMsgID string) ([]*storage.StoredMessage, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetThread(rootMsgID)
+}
+
+// GetThreadUnreadCounts 获取会话里每个话题的未读回复数
+func (a *App) GetThreadUnreadCounts(cid string) (map[string]int, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetThreadUnreadCounts(cid)
+}
+
+// MarkThreadAsRead 把话题里的回复标记为已读
+func (a *App) MarkThreadAsRead(rootMsgID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.MarkThreadAsRead(rootMsgID)
+}
+
+// React 对消息添加表情回应
+func (a *App) React(msgID, emoji string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.React(msgID, emoji)
+}
+
+// Unreact 取消自己的表情回应
+func (a *App) Unreact(msgID, emoji string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.Unreact(msgID, emoji)
+}
+
+// GetReactions 获取消息当前的表情回应明细
+func (a *App) GetReactions(msgID string) ([]*storage.Reaction, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetReactions(msgID)
+}
+
+// EditMessage 编辑自己发出的文本消息
+func (a *App) EditMessage(msgID, newText string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.EditMessage(msgID, newText)
+}
+
+// DeleteMessage 删除消息；forEveryone 为 true 时撤回自己发出的消息，否则只删除本地记录
+func (a *App) DeleteMessage(msgID string, forEveryone bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.DeleteMessage(msgID, forEveryone)
+}
+
+// SetPresence 设置自己的在线状态（online / away / offline）并通知好友
+func (a *App) SetPresence(status string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.SetPresence(status)
+}
+
+// GetPresence 获取好友最近的在线状态
+func (a *App) GetPresence(uid string) (*chat.Presence, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetPresence(uid), nil
+}
+
+// SendTyping 发送正在输入状态，输入期间每隔几秒重发一次
+func (a *App) SendTyping(cidOrGid string, active bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.SendTyping(cidOrGid, active)
+}
+
 // GetConversation 获取会话信息
 func (a *App) GetConversation(conversationID string) (*storage.StoredConversation, error) {
 	if a.chatSvc == nil {
@@ -411,6 +684,58 @@ func (a *App) GetConversation(conversationID string) (*storage.StoredConversatio
 	return a.chatSvc.GetConversation(conversationID)
 }
 
+// PinConversation 置顶或取消置顶会话
+func (a *App) PinConversation(conversationID string, pinned bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.PinConversation(conversationID, pinned)
+}
+
+// ArchiveConversation 归档或取消归档会话
+func (a *App) ArchiveConversation(conversationID string, archived bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.ArchiveConversation(conversationID, archived)
+}
+
+// MuteConversation 开启免打扰，until 为空表示一直免打扰
+func (a *App) MuteConversation(conversationID string, until *time.Time) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	var t time.Time
+	if until != nil {
+		t = *until
+	}
+	return a.chatSvc.MuteConversation(conversationID, t)
+}
+
+// UnmuteConversation 取消免打扰
+func (a *App) UnmuteConversation(conversationID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.UnmuteConversation(conversationID)
+}
+
+// ClearConversation 清空会话的聊天记录
+func (a *App) ClearConversation(conversationID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.ClearConversation(conversationID)
+}
+
+// DeleteConversation 删除会话并退订（群聊即退群），dropKeys 为 true 时同时删除好友公钥或群密钥
+func (a *App) DeleteConversation(conversationID string, dropKeys bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.DeleteConversation(conversationID, dropKeys)
+}
+
 // CreateGroup 创建新群聊，返回群ID和群密钥
 func (a *App) CreateGroup() (*CreateGroupResult, error) {
 	if a.chatSvc == nil {
@@ -437,6 +762,91 @@ func (a *App) JoinGroup(gid, groupKey string) error {
 	return a.chatSvc.JoinGroup(gid)
 }
 
+// SetGroupName 修改群名称并同步给群成员（仅管理员）
+func (a *App) SetGroupName(gid, name string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	// 只改名称，简介保持不变
+	var description string
+	if info, err := a.chatSvc.GetGroupInfo(gid); err == nil {
+		description = info.Description
+	}
+	return a.chatSvc.UpdateGroupInfo(gid, name, description)
+}
+
+// InviteToGroup 通过私聊邀请好友入群，无需手动分享群密钥
+func (a *App) InviteToGroup(gid, friendUID string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.InviteToGroup(gid, friendUID)
+}
+
+// ListPendingInvites 获取待处理的群邀请
+func (a *App) ListPendingInvites() ([]*storage.GroupInvite, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.ListPendingInvites()
+}
+
+// AcceptInvite 接受群邀请并加入群聊
+func (a *App) AcceptInvite(gid string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.AcceptInvite(gid)
+}
+
+// DeclineInvite 拒绝群邀请
+func (a *App) DeclineInvite(gid string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.DeclineInvite(gid)
+}
+
+// GetGroupInfo 获取群信息
+func (a *App) GetGroupInfo(gid string) (*storage.GroupInfo, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.GetGroupInfo(gid)
+}
+
+// ListGroupMembers 获取群成员名单
+func (a *App) ListGroupMembers(gid string) ([]*storage.GroupMember, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.ListGroupMembers(gid)
+}
+
+// UpdateGroupInfo 修改群名称和简介（仅管理员）
+func (a *App) UpdateGroupInfo(gid, name, description string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.UpdateGroupInfo(gid, name, description)
+}
+
+// SetGroupAdmin 设置或取消群管理员（仅管理员）
+func (a *App) SetGroupAdmin(gid, uid string, admin bool) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.SetGroupAdmin(gid, uid, admin)
+}
+
+// RemoveGroupMember 移除群成员并轮换群密钥（仅管理员）
+func (a *App) RemoveGroupMember(gid, uid string) error {
+	if a.chatSvc == nil {
+		return fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.RemoveGroupMember(gid, uid)
+}
+
 // SearchMessages 搜索消息
 func (a *App) SearchMessages(query string, limit int) ([]*storage.StoredMessage, error) {
 	if a.chatSvc == nil {
@@ -445,6 +855,14 @@ func (a *App) SearchMessages(query string, limit int) ([]*storage.StoredMessage,
 	return a.chatSvc.SearchMessages(query, limit)
 }
 
+// Search 全文搜索消息，可按会话、发送者和时间范围过滤，结果带高亮摘要
+func (a *App) Search(opts storage.SearchOptions) ([]*storage.SearchResult, error) {
+	if a.chatSvc == nil {
+		return nil, fmt.Errorf("chat service not initialized")
+	}
+	return a.chatSvc.Search(opts)
+}
+
 // GetStartupStatus 获取启动状态和错误信息
 func (a *App) GetStartupStatus() (map[string]any, error) {
 	a.mu.RLock()
@@ -456,11 +874,47 @@ func (a *App) GetStartupStatus() (map[string]any, error) {
 	}
 
 	return map[string]any{
-		"initialized": a.initialized,
-		"errors":      errStrs,
+		"initialized":    a.initialized,
+		"errors":         errStrs,
+		"storage_locked": a.storage != nil && a.storage.Locked(),
 	}, nil
 }
 
+// UnlockStorage 用口令解锁本地数据库，解锁后恢复会话订阅并开始离线同步
+func (a *App) UnlockStorage(passphrase string) error {
+	if a.storage == nil {
+		return fmt.Errorf("storage not initialized")
+	}
+	if !a.storage.Locked() {
+		return nil
+	}
+	if err := a.storage.Unlock(storage.PassphraseKey(passphrase)); err != nil {
+		return err
+	}
+	go a.restoreConversations()
+	go a.startBackground()
+	return nil
+}
+
+// SetStoragePassphrase 更换本地数据库的加密口令并轮换数据密钥；口令为空时改回用 NSC seed 派生的密钥
+func (a *App) SetStoragePassphrase(passphrase string) error {
+	if a.storage == nil {
+		return fmt.Errorf("storage not initialized")
+	}
+	key := storage.PassphraseKey(passphrase)
+	if passphrase == "" {
+		seed, err := a.getNSCUserSeed()
+		if err != nil {
+			return err
+		}
+		key = storage.SeedKey(seed)
+	}
+	if a.storage.EncryptionKind() == "" {
+		return a.storage.EnableEncryption(key)
+	}
+	return a.storage.Rekey(key)
+}
+
 // GetAllConversations 获取所有会话列表，按最后消息时间倒序排列
 func (a *App) GetAllConversations() ([]*storage.StoredConversation, error) {
 	if a.storage == nil {
@@ -469,6 +923,14 @@ func (a *App) GetAllConversations() ([]*storage.StoredConversation, error) {
 	return a.storage.GetAllConversations()
 }
 
+// GetConversationSummaries 获取会话列表摘要：显示名称、未读数、最后一条消息预览、置顶和免打扰状态
+func (a *App) GetConversationSummaries() ([]*storage.ConversationSummary, error) {
+	if a.storage == nil {
+		return nil, fmt.Errorf("storage not initialized")
+	}
+	return a.storage.GetConversationSummaries()
+}
+
 // GetUserNSCPublicKey 获取当前用户的NSC公钥（U开头）
 func (a *App) GetUserNSCPublicKey() (string, error) {
 	if a.config == nil {
@@ -0,0 +1,375 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+// 附件存放在 Hub 的对象存储桶里，内容用每个文件独立的随机密钥分块加密
+const (
+	fileBucket    = "DChatFiles"
+	fileChunkSize = 64 << 10  // 每块明文大小，每块单独 AES-GCM 加密
+	maxFileSize   = 100 << 20 // 单个附件上限
+	maxChunkSize  = 1 << 20   // 接收时允许的最大分块，防止恶意载荷占用内存
+)
+
+// 附件传输方向
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// ErrFileTooLarge 附件超过 maxFileSize
+var ErrFileTooLarge = errors.New("file too large")
+
+// FileAttachment kind=file 消息体里的附件引用，解密密钥只出现在加密的消息体里
+type FileAttachment struct {
+	Object string `json:"object"` // DChatFiles 桶里的对象名
+	Name   string `json:"name"`
+	Mime   string `json:"mime,omitempty"`
+	Size   int64  `json:"size"`  // 明文字节数
+	Key    string `json:"key"`   // AES-256 密钥（base64）
+	Chunk  int    `json:"chunk"` // 每块明文大小
+}
+
+// FileProgress 附件上传/下载进度，随 EventFileProgress 推送
+type FileProgress struct {
+	MessageID string `json:"message_id,omitempty"` // 上传时消息还未保存，为空
+	CID       string `json:"cid"`
+	FileName  string `json:"file_name"`
+	Direction string `json:"direction"` // TransferUpload / TransferDownload
+	Done      int64  `json:"done"`
+	Total     int64  `json:"total"`
+}
+
+// SendFile 加密并上传文件，然后向私聊（好友ID或会话ID）或群聊发送附件消息
+func (s *Service) SendFile(cidOrGid, path string) error {
+	if cidOrGid == "" || path == "" {
+		return errors.New("cid/path empty")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if st.Size() > maxFileSize {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrFileTooLarge, st.Size(), maxFileSize)
+	}
+
+	// 先确定发送目标，避免上传后才发现无法发送
+	cid := cidOrGid
+	if _, _, groupErr := s.currentGroupKey(cidOrGid); groupErr != nil {
+		peerID, _, err := s.resolvePeer(cidOrGid)
+		if err != nil {
+			return err
+		}
+		cid = s.GetConversationID(peerID)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	att := &FileAttachment{
+		Object: "att_" + randomID() + randomID(),
+		Name:   filepath.Base(path),
+		Mime:   mime.TypeByExtension(filepath.Ext(path)),
+		Size:   st.Size(),
+		Key:    B64(key),
+		Chunk:  fileChunkSize,
+	}
+	if att.Mime == "" {
+		att.Mime = "application/octet-stream"
+	}
+
+	progress := s.progressReporter(&FileProgress{CID: cid, FileName: att.Name, Direction: TransferUpload, Total: att.Size})
+	sealer, err := newFileSealer(f, att, progress)
+	if err != nil {
+		return err
+	}
+	if _, err := s.nats.PutObject(fileBucket, att.Object, sealer); err != nil {
+		slog.Error("上传附件失败", "file", att.Name, "error", err)
+		return fmt.Errorf("upload attachment: %w", err)
+	}
+
+	now := time.Now()
+	msgID := newMessageID()
+	wire, isGroup, seq, err := s.sendBody(cidOrGid, KindFile, &MessageBody{ID: msgID, File: att}, now)
+	if err != nil {
+		return err
+	}
+
+	s.saveOutgoing(msgID, wire, now, att.Name, isGroup, seq, "", storage.DeliverySent)
+	if s.storage != nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		a := attachmentRecord(msgID, cid, att, now)
+		a.LocalPath = path
+		if err := s.storage.SaveAttachment(a); err != nil {
+			slog.Error("保存附件记录失败", "error", err)
+		}
+	}
+	return nil
+}
+
+// DownloadAttachment 下载并解密消息的附件到 dest；dest 是已存在的目录时按原文件名保存在其中
+func (s *Service) DownloadAttachment(msgID, dest string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	a, err := s.storage.GetAttachment(msgID)
+	if err != nil {
+		return fmt.Errorf("load attachment: %w", err)
+	}
+	if a == nil {
+		return fmt.Errorf("message %s has no attachment", msgID)
+	}
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(a.FileName))
+	}
+
+	obj, err := s.nats.GetObject(a.Bucket, a.ObjectName)
+	if err != nil {
+		return fmt.Errorf("get attachment object: %w", err)
+	}
+	defer obj.Close()
+
+	// 先写临时文件，完整解密校验后再改名，避免留下半截文件
+	tmp := dest + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	progress := s.progressReporter(&FileProgress{
+		MessageID: msgID, CID: a.ConversationID, FileName: a.FileName, Direction: TransferDownload, Total: a.Size,
+	})
+	n, err := openFileStream(out, obj, a, progress)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != a.Size {
+		err = fmt.Errorf("attachment size mismatch: got %d, want %d", n, a.Size)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("decrypt attachment: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := s.storage.SetAttachmentLocalPath(msgID, dest); err != nil {
+		slog.Warn("记录附件本地路径失败", "msg_id", msgID, "error", err)
+	}
+	return nil
+}
+
+// attachmentRecord 把消息体里的附件引用转换成存储记录
+func attachmentRecord(msgID, cid string, att *FileAttachment, at time.Time) *storage.Attachment {
+	return &storage.Attachment{
+		MessageID:      msgID,
+		ConversationID: cid,
+		Bucket:         fileBucket,
+		ObjectName:     att.Object,
+		FileName:       att.Name,
+		MimeType:       att.Mime,
+		Size:           att.Size,
+		FileKey:        att.Key,
+		ChunkSize:      att.Chunk,
+		CreatedAt:      at,
+	}
+}
+
+// validate 检查收到的附件引用，拒绝无法安全下载的载荷
+func (att *FileAttachment) validate() error {
+	if att.Object == "" || att.Name == "" {
+		return errors.New("attachment without object or name")
+	}
+	if att.Size < 0 || att.Size > maxFileSize {
+		return fmt.Errorf("%w: %d bytes", ErrFileTooLarge, att.Size)
+	}
+	if att.Chunk <= 0 || att.Chunk > maxChunkSize {
+		return fmt.Errorf("invalid attachment chunk size %d", att.Chunk)
+	}
+	if key, err := B64Dec(att.Key); err != nil || len(key) != 32 {
+		return errors.New("invalid attachment key")
+	}
+	return nil
+}
+
+// progressReporter 返回累加进度的回调，进度百分比变化或完成时推送 EventFileProgress
+func (s *Service) progressReporter(p *FileProgress) func(n int) {
+	lastPct := int64(-1)
+	return func(n int) {
+		p.Done += int64(n)
+		pct := int64(100)
+		if p.Total > 0 {
+			pct = p.Done * 100 / p.Total
+		}
+		if pct == lastPct && p.Done < p.Total {
+			return
+		}
+		lastPct = pct
+		snapshot := *p
+		s.dispatchEvent(EventFileProgress, &snapshot)
+	}
+}
+
+// fileAEAD 附件内容的 AES-256-GCM
+func fileAEAD(keyB64 string) (cipher.AEAD, error) {
+	key, err := B64Dec(keyB64)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid attachment key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce 每个文件的密钥只用一次，按块序号构造 nonce 即可
+func chunkNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+// chunkAD 附加认证数据绑定对象名、块序号和是否最后一块，防止分块被调换或截断
+func chunkAD(object string, index uint64, final bool) []byte {
+	flag := "0"
+	if final {
+		flag = "1"
+	}
+	return []byte("dchat-file\n" + object + "\n" + strconv.FormatUint(index, 10) + "\n" + flag)
+}
+
+// fileSealer 边读明文边加密的 io.Reader，交给对象存储分块上传
+type fileSealer struct {
+	src      *bufio.Reader
+	aead     cipher.AEAD
+	object   string
+	plain    []byte
+	pending  []byte
+	index    uint64
+	done     bool
+	progress func(n int)
+}
+
+func newFileSealer(r io.Reader, att *FileAttachment, progress func(n int)) (*fileSealer, error) {
+	aead, err := fileAEAD(att.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSealer{
+		src:      bufio.NewReaderSize(r, att.Chunk),
+		aead:     aead,
+		object:   att.Object,
+		plain:    make([]byte, att.Chunk),
+		progress: progress,
+	}, nil
+}
+
+func (f *fileSealer) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// sealNext 读取并加密下一块；空文件也会产生一个只有认证标签的最后一块
+func (f *fileSealer) sealNext() error {
+	n, err := io.ReadFull(f.src, f.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := n < len(f.plain)
+	if !final {
+		if _, err := f.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	f.pending = f.aead.Seal(nil, chunkNonce(f.index), f.plain[:n], chunkAD(f.object, f.index, final))
+	f.index++
+	f.done = final
+	if f.progress != nil {
+		f.progress(n)
+	}
+	return nil
+}
+
+// openFileStream 逐块解密附件写入 dst，返回写入的明文字节数
+func openFileStream(dst io.Writer, src io.Reader, a *storage.Attachment, progress func(n int)) (int64, error) {
+	if a.ChunkSize <= 0 || a.ChunkSize > maxChunkSize {
+		return 0, fmt.Errorf("invalid attachment chunk size %d", a.ChunkSize)
+	}
+	aead, err := fileAEAD(a.FileKey)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, a.ChunkSize+aead.Overhead())
+	br := bufio.NewReaderSize(src, len(buf))
+	var total int64
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err == io.EOF {
+			return total, errors.New("attachment truncated")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return total, err
+		}
+		final := n < len(buf)
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return total, err
+			}
+		}
+		plain, err := aead.Open(buf[:0], chunkNonce(index), buf[:n], chunkAD(a.ObjectName, index, final))
+		if err != nil {
+			return total, fmt.Errorf("chunk %d: %w", index, err)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return total, err
+		}
+		total += int64(len(plain))
+		if progress != nil {
+			progress(len(plain))
+		}
+		if final {
+			return total, nil
+		}
+	}
+}
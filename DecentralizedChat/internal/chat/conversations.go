@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+// PinConversation 置顶或取消置顶会话
+func (s *Service) PinConversation(cid string, pinned bool) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	return s.storage.SetConversationPinned(cid, pinned)
+}
+
+// ArchiveConversation 归档或取消归档会话
+func (s *Service) ArchiveConversation(cid string, archived bool) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	return s.storage.SetConversationArchived(cid, archived)
+}
+
+// MuteConversation 开启免打扰直到 until，零值表示一直免打扰。
+// 免打扰期间消息照常保存，只是不再回调 OnDecrypted
+func (s *Service) MuteConversation(cid string, until time.Time) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	if until.IsZero() {
+		until = storage.MuteForever
+	}
+	return s.storage.SetConversationMuted(cid, &until)
+}
+
+// UnmuteConversation 取消免打扰
+func (s *Service) UnmuteConversation(cid string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	return s.storage.SetConversationMuted(cid, nil)
+}
+
+// ClearConversation 清空会话的聊天记录，会话和设置保留
+func (s *Service) ClearConversation(cid string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	return s.storage.ClearConversation(cid, time.Now())
+}
+
+// DeleteConversation 删除会话和全部聊天记录，同时退订该会话（群聊即退出群）。
+// dropKeys 为 true 时一并删除好友公钥或群密钥，之后不再能解密这个会话的消息；
+// 保留密钥时可以再次 JoinDirect/JoinGroup 回到会话
+func (s *Service) DeleteConversation(cid string, dropKeys bool) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	conv, err := s.storage.GetConversation(cid)
+	if err != nil {
+		return err
+	}
+	inGroup := s.joined(cid, true)
+	isGroup := inGroup || (conv != nil && conv.Type == "group")
+	if conv == nil && !inGroup {
+		if _, _, keyErr := s.currentGroupKey(cid); keyErr == nil {
+			isGroup = true
+		}
+	}
+
+	if err := s.leave(cid, isGroup); err != nil {
+		slog.Warn("退订会话失败", "cid", cid, "error", err)
+	}
+	if err := s.storage.DeleteConversation(cid); err != nil {
+		return err
+	}
+	if !dropKeys {
+		return nil
+	}
+	if isGroup {
+		return s.dropGroupKeys(cid)
+	}
+	peerID := ""
+	if conv != nil {
+		peerID = conv.PeerID
+	}
+	if peerID == "" {
+		peerID = s.directPeer(cid)
+	}
+	if peerID == "" {
+		return fmt.Errorf("peer not found for cid %s", cid)
+	}
+	return s.dropFriendKey(peerID)
+}
+
+// dropGroupKeys 删除群密钥的缓存和持久化记录
+func (s *Service) dropGroupKeys(gid string) error {
+	s.mu.Lock()
+	delete(s.groupKeys, gid)
+	s.mu.Unlock()
+	return s.storage.DeleteGroupKeys(gid)
+}
+
+// dropFriendKey 删除好友公钥和双棘轮会话的缓存和持久化记录
+func (s *Service) dropFriendKey(peerID string) error {
+	s.mu.Lock()
+	delete(s.friendPubKeys, peerID)
+	s.mu.Unlock()
+	s.ratchetMu.Lock()
+	delete(s.ratchetSessions, peerID)
+	s.ratchetMu.Unlock()
+	return s.storage.DeleteFriendPubKey(peerID)
+}
+
+// conversationMuted 会话当前是否处于免打扰
+func (s *Service) conversationMuted(cid string, now time.Time) bool {
+	if s.storage == nil {
+		return false
+	}
+	conv, err := s.storage.GetConversation(cid)
+	if err != nil {
+		slog.Warn("读取会话免打扰状态失败", "cid", cid, "error", err)
+		return false
+	}
+	return conv != nil && conv.MutedUntil != nil && now.Before(*conv.MutedUntil)
+}
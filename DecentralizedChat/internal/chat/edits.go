@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+var (
+	// ErrMessageNotFound 本地没有这条消息
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrNotMessageSender 只有消息的发送方可以编辑或撤回
+	ErrNotMessageSender = errors.New("only the sender can edit or delete this message")
+)
+
+// MessageUpdate 消息被编辑或撤回，随 EventMessageUpdated 推送
+type MessageUpdate struct {
+	CID       string      `json:"cid"`
+	MessageID string      `json:"message_id"`
+	Kind      MessageKind `json:"kind"` // KindEdit / KindDelete
+	Text      string      `json:"text,omitempty"`
+	EditedAt  time.Time   `json:"edited_at"`
+	Deleted   bool        `json:"deleted"`
+}
+
+// EditMessage 修改自己发出的文本消息，对方收到后改写本地记录
+func (s *Service) EditMessage(msgID, newText string) error {
+	if msgID == "" || newText == "" {
+		return errors.New("msgID/text empty")
+	}
+	msg, err := s.ownMessage(msgID)
+	if err != nil {
+		return err
+	}
+	if msg.Deleted {
+		return fmt.Errorf("message %s already deleted", msgID)
+	}
+	if a, err := s.storage.GetAttachment(msgID); err != nil {
+		return fmt.Errorf("load attachment: %w", err)
+	} else if a != nil {
+		return errors.New("attachment messages cannot be edited")
+	}
+
+	now := time.Now()
+	if _, _, _, err := s.sendBody(msg.ConversationID, KindEdit, &MessageBody{Ref: msgID, Text: newText}, now); err != nil {
+		return err
+	}
+	changed, err := s.storage.EditMessage(msgID, newText, now)
+	if err != nil {
+		return fmt.Errorf("save edit: %w", err)
+	}
+	if changed {
+		s.dispatchEvent(EventMessageUpdated, &MessageUpdate{
+			CID: msg.ConversationID, MessageID: msgID, Kind: KindEdit, Text: newText, EditedAt: now,
+		})
+	}
+	return nil
+}
+
+// DeleteMessage 删除消息：forEveryone 时撤回自己发出的消息，各端只保留墓碑；否则只从本地删除
+func (s *Service) DeleteMessage(msgID string, forEveryone bool) error {
+	if msgID == "" {
+		return errors.New("msgID empty")
+	}
+	if !forEveryone {
+		if s.storage == nil {
+			return errors.New("storage not initialized")
+		}
+		return s.storage.DeleteMessage(msgID)
+	}
+
+	msg, err := s.ownMessage(msgID)
+	if err != nil {
+		return err
+	}
+	if msg.Deleted {
+		return nil
+	}
+	now := time.Now()
+	if _, _, _, err := s.sendBody(msg.ConversationID, KindDelete, &MessageBody{Ref: msgID}, now); err != nil {
+		return err
+	}
+	changed, err := s.storage.TombstoneMessage(msgID, now)
+	if err != nil {
+		return fmt.Errorf("save tombstone: %w", err)
+	}
+	if changed {
+		s.dispatchEvent(EventMessageUpdated, &MessageUpdate{
+			CID: msg.ConversationID, MessageID: msgID, Kind: KindDelete, EditedAt: now, Deleted: true,
+		})
+	}
+	return nil
+}
+
+// ownMessage 加载自己发出的消息
+func (s *Service) ownMessage(msgID string) (*storage.StoredMessage, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	msg, err := s.storage.GetMessage(msgID)
+	if err != nil {
+		return nil, fmt.Errorf("load message: %w", err)
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, msgID)
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	if msg.SenderID != self {
+		return nil, ErrNotMessageSender
+	}
+	return msg, nil
+}
+
+// handleMessageUpdate 处理编辑/撤回：签名校验过、且签名者就是原消息发送方时才改写本地记录
+func (s *Service) handleMessageUpdate(in *inboundMessage) error {
+	ref := in.body.Ref
+	if ref == "" {
+		return fmt.Errorf("%s message without ref", in.kind)
+	}
+	if s.storage == nil {
+		return nil
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	// 自己的回显本地已经处理过
+	if in.wire.Sender == self {
+		return nil
+	}
+	if !in.verified {
+		slog.Warn("忽略未签名的编辑/撤回", "kind", in.kind, "sender", in.wire.Sender, "ref", ref)
+		return nil
+	}
+
+	msg, err := s.storage.GetMessage(ref)
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if msg == nil {
+		slog.Debug("编辑/撤回的消息本地不存在", "kind", in.kind, "ref", ref)
+		return nil
+	}
+	if msg.SenderID != in.wire.Sender || msg.ConversationID != in.wire.CID {
+		slog.Warn("拒绝非发送方的编辑/撤回", "kind", in.kind, "sender", in.wire.Sender, "owner", msg.SenderID, "ref", ref)
+		return nil
+	}
+
+	at := time.Unix(in.wire.TS, 0)
+	// 同一条消息多次编辑时按发送时间取最新的，离线同步晚到的旧编辑不覆盖
+	if in.kind == KindEdit && msg.EditedAt != nil && (at.Before(*msg.EditedAt) || msg.Content == in.body.Text) {
+		return nil
+	}
+	update := &MessageUpdate{CID: msg.ConversationID, MessageID: ref, Kind: in.kind, EditedAt: at}
+	var changed bool
+	if in.kind == KindEdit {
+		if in.body.Text == "" {
+			return errors.New("edit message without text")
+		}
+		update.Text = in.body.Text
+		changed, err = s.storage.EditMessage(ref, in.body.Text, at)
+	} else {
+		update.Deleted = true
+		changed, err = s.storage.TombstoneMessage(ref, at)
+	}
+	if err != nil {
+		return fmt.Errorf("apply %s: %w", in.kind, err)
+	}
+	if changed {
+		s.dispatchEvent(EventMessageUpdated, update)
+	}
+	return nil
+}
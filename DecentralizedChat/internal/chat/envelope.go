@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// WireVersion 当前载荷版本
+// v0: 早期格式，没有 v/kind 字段，密文解出来就是纯文本
+// v1: 带类型的信封，密文解出来是 MessageBody 的 JSON
+const WireVersion = 1
+
+// MessageKind 消息类型，明文放在 EncWire.Kind 里，便于接收方路由
+type MessageKind string
+
+const (
+	KindText     MessageKind = "text"     // 普通文本
+	KindReaction MessageKind = "reaction" // 表情回应
+	KindEdit     MessageKind = "edit"     // 编辑消息
+	KindDelete   MessageKind = "delete"   // 删除消息
+	KindReceipt  MessageKind = "receipt"  // 送达/已读回执
+	KindTyping   MessageKind = "typing"   // 正在输入
+	KindSystem   MessageKind = "system"   // 系统消息（群信息、密钥分发等）
+	KindFile     MessageKind = "file"     // 文件/图片
+)
+
+// MessageBody 加密前的结构化消息体（v1 起）
+type MessageBody struct {
+	ID       string          `json:"id,omitempty"`  // 发送方生成的消息ID，回执等控制消息据此引用
+	Ref      string          `json:"ref,omitempty"` // kind=edit/delete/reaction：引用的消息ID
+	Text     string          `json:"text,omitempty"`
+	ReplyTo  string          `json:"reply_to,omitempty"` // 回复的消息ID
+	System   *SystemBody     `json:"system,omitempty"`   // kind=system
+	File     *FileAttachment `json:"file,omitempty"`     // kind=file
+	Receipt  *Receipt        `json:"receipt,omitempty"`  // kind=receipt
+	Reaction *ReactionBody   `json:"reaction,omitempty"` // kind=reaction
+	Typing   *Typing         `json:"typing,omitempty"`   // kind=typing，只走 core NATS
+	Prekey   *PrekeyAdvert   `json:"prekey,omitempty"`   // 私聊静态 box 消息附带的预密钥，见 PrekeyAdvert
+}
+
+// SystemType 系统消息子类型
+type SystemType string
+
+const (
+	SystemGroupKey       SystemType = "group_key"        // 群密钥轮换，见 GroupKeyGrant
+	SystemGroupInvite    SystemType = "group_invite"     // 群邀请，见 GroupInvite
+	SystemGroupMeta      SystemType = "group_meta"       // 群信息和成员名单，见 GroupMeta
+	SystemGroupKeyActive SystemType = "group_key_active" // 管理员启用新的群密钥纪元，用新纪元加密，没有附加字段
+)
+
+// SystemBody 系统消息内容，按 Type 读取对应字段
+type SystemBody struct {
+	Type        SystemType     `json:"type"`
+	GroupKey    *GroupKeyGrant `json:"group_key,omitempty"`
+	GroupInvite *GroupInvite   `json:"group_invite,omitempty"`
+	GroupMeta   *GroupMeta     `json:"group_meta,omitempty"`
+}
+
+// encodeBody 序列化消息体，结果作为明文交给 EncryptDirect/EncryptGroup
+func encodeBody(body *MessageBody) ([]byte, error) {
+	if body == nil {
+		body = &MessageBody{}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal message body: %w", err)
+	}
+	return data, nil
+}
+
+// decodeBody 按载荷版本解析明文
+// v0 载荷没有结构，整段明文当作文本消息处理，保证旧历史仍能正常显示
+func decodeBody(w *EncWire, plain []byte) (MessageKind, *MessageBody, error) {
+	if w.V == 0 {
+		return KindText, &MessageBody{Text: string(plain)}, nil
+	}
+	body := &MessageBody{}
+	if err := json.Unmarshal(plain, body); err != nil {
+		return "", nil, fmt.Errorf("unmarshal message body: %w", err)
+	}
+	kind := w.Kind
+	if kind == "" {
+		kind = KindText
+	}
+	return kind, body, nil
+}
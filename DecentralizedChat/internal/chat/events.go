@@ -0,0 +1,39 @@
+package chat
+
+// 推送给前端的事件名，App 通过 runtime.EventsEmit 原样转发
+const (
+	EventGroupInvite    = "group:invite"       // 收到群邀请，payload: *storage.GroupInvite
+	EventGroupUpdated   = "group:updated"      // 群信息或成员变化，payload: *GroupMeta
+	EventFileProgress   = "file:progress"      // 附件上传/下载进度，payload: *FileProgress
+	EventMessageReceipt = "message:receipt"    // 自己发出的消息收到送达/已读回执，payload: *ReceiptUpdate
+	EventPresence       = "presence:update"    // 好友在线状态变化（含心跳超时转为离线），payload: *Presence
+	EventTyping         = "typing:update"      // 好友开始/停止输入，payload: *TypingUpdate
+	EventMessageUpdated = "message:updated"    // 消息被编辑或撤回，payload: *MessageUpdate
+	EventReaction       = "message:reaction"   // 表情回应变化，payload: *ReactionUpdate
+	EventSyncProgress   = "sync:progress"      // 离线同步追赶进度，payload: *SyncProgress
+	EventSyncGap        = "sync:gap"           // 离线同步检测到缺口，payload: *SyncGap
+	EventSendState      = "message:send_state" // 发件箱消息的发送状态变化，payload: *SendStateUpdate
+)
+
+// OnEvent 注册通用事件回调（邀请、回执、在线状态等非聊天消息的通知）
+func (s *Service) OnEvent(h func(name string, payload any)) {
+	if h == nil {
+		return
+	}
+	s.mu.Lock()
+	s.eventHandlers = append(s.eventHandlers, h)
+	s.mu.Unlock()
+}
+
+// dispatchEvent 分发通用事件（不 panic；不中断后续消息处理）
+func (s *Service) dispatchEvent(name string, payload any) {
+	s.mu.RLock()
+	handlers := s.eventHandlers
+	s.mu.RUnlock()
+	for _, h := range handlers {
+		func() {
+			defer func() { _ = recover() }()
+			h(name, payload)
+		}()
+	}
+}
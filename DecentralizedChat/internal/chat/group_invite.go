@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+// GroupInvite 通过私聊发给好友的群邀请（kind=system, type=group_invite）
+type GroupInvite struct {
+	GID         string     `json:"gid"`
+	Name        string     `json:"name,omitempty"`
+	Key         string     `json:"key"`   // 当前纪元的群密钥（base64）
+	Epoch       uint32     `json:"epoch"` // 群密钥纪元
+	Inviter     string     `json:"inviter"`
+	InviterName string     `json:"inviter_name,omitempty"`
+	Meta        *GroupMeta `json:"meta,omitempty"` // 邀请时的群信息和成员名单（已包含被邀请人）
+}
+
+// saveLocalGroupName 只在本地记录群名称，用于没有群信息快照的旧邀请
+func (s *Service) saveLocalGroupName(gid, name string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	info, err := s.storage.GetGroupInfo(gid)
+	if err != nil {
+		return fmt.Errorf("get group info: %w", err)
+	}
+	if info == nil {
+		info = &storage.GroupInfo{GroupID: gid, CreatedAt: time.Now()}
+	}
+	info.Name = name
+	return s.storage.SaveGroupInfo(info)
+}
+
+// groupName 本地保存的群名称，没有时为空
+func (s *Service) groupName(gid string) string {
+	if s.storage == nil {
+		return ""
+	}
+	info, err := s.storage.GetGroupInfo(gid)
+	if err != nil || info == nil {
+		return ""
+	}
+	return info.Name
+}
+
+// InviteToGroup 通过与好友的私聊通道发送群邀请，附带群信息和当前纪元的群密钥。
+// 只有管理员可以邀请，被邀请人先加入成员名单并同步给现有成员
+func (s *Service) InviteToGroup(gid, friendUID string) error {
+	if gid == "" || friendUID == "" {
+		return errors.New("gid/friendUID empty")
+	}
+
+	sym, epoch, err := s.currentGroupKey(gid)
+	if err != nil {
+		return fmt.Errorf("group key not available: %w", err)
+	}
+	peerPub, err := s.getFriendKey(friendUID)
+	if err != nil {
+		return fmt.Errorf("friend pub key not available: %w", err)
+	}
+	meta, err := s.updateGroupMeta(gid, func(meta *GroupMeta) error {
+		meta.Members = append(meta.Members, friendUID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	self := s.user.ID
+	nickname := s.user.Nickname
+	s.mu.RUnlock()
+
+	invite := &GroupInvite{
+		GID:         gid,
+		Name:        meta.Name,
+		Key:         sym,
+		Epoch:       epoch,
+		Inviter:     self,
+		InviterName: nickname,
+		Meta:        meta,
+	}
+	body := &MessageBody{System: &SystemBody{Type: SystemGroupInvite, GroupInvite: invite}}
+	wire, err := s.sealDirect(friendUID, peerPub, KindSystem, body, time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err := s.publishWire(directSubject(wire.CID), wire, ""); err != nil {
+		return err
+	}
+	slog.Info("已发送群邀请", "gid", gid, "friend", friendUID)
+	return nil
+}
+
+// receiveGroupInvite 保存收到的群邀请，等待用户接受或拒绝
+func (s *Service) receiveGroupInvite(in *inboundMessage, invite *GroupInvite) error {
+	if invite.GID == "" || invite.Key == "" {
+		return errors.New("invalid group invite")
+	}
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	// 已经在群里了，不需要再提示
+	if _, _, err := s.currentGroupKey(invite.GID); err == nil {
+		slog.Debug("忽略已加入群的邀请", "gid", invite.GID, "sender", in.wire.Sender)
+		return nil
+	}
+
+	var metaJSON string
+	if invite.Meta != nil && invite.Meta.GID == invite.GID {
+		data, err := json.Marshal(invite.Meta)
+		if err != nil {
+			return fmt.Errorf("marshal group meta: %w", err)
+		}
+		metaJSON = string(data)
+	}
+
+	inviterName := invite.InviterName
+	if inviterName == "" {
+		inviterName = in.wire.Nickname
+	}
+	stored := &storage.GroupInvite{
+		GroupID:   invite.GID,
+		GroupName: invite.Name,
+		SymKey:    invite.Key,
+		KeyEpoch:  invite.Epoch,
+		// 以签名校验过的发送者为准，不信任载荷里的 inviter 字段
+		InviterID:       in.wire.Sender,
+		InviterNickname: inviterName,
+		Status:          storage.InvitePending,
+		Meta:            metaJSON,
+		ReceivedAt:      time.Unix(in.wire.TS, 0),
+	}
+	if err := s.storage.SaveGroupInvite(stored); err != nil {
+		return fmt.Errorf("save group invite: %w", err)
+	}
+	slog.Info("收到群邀请", "gid", invite.GID, "inviter", in.wire.Sender)
+	s.dispatchEvent(EventGroupInvite, stored)
+	return nil
+}
+
+// ListPendingInvites 列出待处理的群邀请
+func (s *Service) ListPendingInvites() ([]*storage.GroupInvite, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetPendingGroupInvites()
+}
+
+// pendingInvite 读取一条待处理的群邀请
+func (s *Service) pendingInvite(gid string) (*storage.GroupInvite, error) {
+	if gid == "" {
+		return nil, errors.New("gid empty")
+	}
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	inv, err := s.storage.GetGroupInvite(gid)
+	if err != nil {
+		return nil, fmt.Errorf("get group invite: %w", err)
+	}
+	if inv == nil || inv.Status != storage.InvitePending {
+		return nil, fmt.Errorf("no pending invite for group %s", gid)
+	}
+	return inv, nil
+}
+
+// AcceptInvite 接受群邀请：保存群密钥和群信息并订阅群消息
+func (s *Service) AcceptInvite(gid string) error {
+	inv, err := s.pendingInvite(gid)
+	if err != nil {
+		return err
+	}
+
+	// 和 AddGroupKey 一样保存密钥，只是纪元以邀请里的为准
+	s.installGroupKey(gid, inv.KeyEpoch, inv.SymKey, inv.ReceivedAt, true)
+	if inv.Meta != "" {
+		var meta GroupMeta
+		if err := json.Unmarshal([]byte(inv.Meta), &meta); err != nil {
+			slog.Warn("解析群信息失败", "gid", gid, "error", err)
+		} else if err := s.applyGroupMeta(inv.InviterID, &meta); err != nil {
+			slog.Warn("保存群信息失败", "gid", gid, "error", err)
+		}
+	} else if inv.GroupName != "" {
+		if err := s.saveLocalGroupName(gid, inv.GroupName); err != nil {
+			slog.Warn("保存群名称失败", "gid", gid, "error", err)
+		}
+	}
+	if err := s.JoinGroup(gid); err != nil {
+		return fmt.Errorf("join group: %w", err)
+	}
+	return s.storage.UpdateGroupInviteStatus(gid, storage.InviteAccepted)
+}
+
+// DeclineInvite 拒绝群邀请
+func (s *Service) DeclineInvite(gid string) error {
+	if _, err := s.pendingInvite(gid); err != nil {
+		return err
+	}
+	return s.storage.UpdateGroupInviteStatus(gid, storage.InviteDeclined)
+}
@@ -0,0 +1,433 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrRetiredGroupKey 消息使用了已退役的群密钥纪元，且发送时间晚于退役时间
+var ErrRetiredGroupKey = errors.New("message encrypted with retired group key")
+
+// errGroupKeyEpochMissing 消息使用的群密钥纪元本地还没有（新纪元的密钥还没收到）
+var errGroupKeyEpochMissing = errors.New("group key epoch not available")
+
+// GroupKeyGrant 通过私聊下发给成员的群密钥纪元（kind=system, type=group_key）
+type GroupKeyGrant struct {
+	GID       string `json:"gid"`
+	Epoch     uint32 `json:"epoch"`
+	Key       string `json:"key"`        // base64 AES-256 密钥
+	RotatedAt int64  `json:"rotated_at"` // 轮换时间（秒），只作记录；接收方在新纪元启用时退役更早的纪元
+	// 轮换后的成员名单，和新密钥一起到达，避免新纪元的群信息先于密钥到达而无法解密
+	Meta *GroupMeta `json:"meta,omitempty"`
+}
+
+// pendingRotation 没有全部送达的群密钥轮换，重试时沿用同一纪元和密钥
+type pendingRotation struct {
+	grant   *GroupKeyGrant
+	members []string // 发送过这把密钥的成员
+}
+
+// groupKeyring 一个群的全部密钥纪元，current 是发送时使用的纪元。
+// 收到但还没启用的新纪元也在 epochs 里，可以解密，但不用于发送
+type groupKeyring struct {
+	current uint32
+	epochs  map[uint32]*storage.GroupKeyEpoch
+}
+
+// loadGroupKeyring 获取群密钥环，优先从内存缓存，如果没有则从本地SQLite加载
+func (s *Service) loadGroupKeyring(gid string) (*groupKeyring, error) {
+	if gid == "" {
+		return nil, errors.New("gid empty")
+	}
+
+	s.mu.RLock()
+	ring, exists := s.groupKeys[gid]
+	s.mu.RUnlock()
+	if exists {
+		return ring, nil
+	}
+
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	epochs, err := s.storage.GetGroupKeyEpochs(gid)
+	if err != nil {
+		return nil, fmt.Errorf("load group key epochs: %w", err)
+	}
+	if len(epochs) == 0 {
+		return nil, fmt.Errorf("group sym key not found: %s", gid)
+	}
+
+	// 当前纪元是最早一个没有退役的纪元，更新的纪元还在等待启用
+	ring = &groupKeyring{epochs: make(map[uint32]*storage.GroupKeyEpoch, len(epochs))}
+	active := false
+	for _, e := range epochs {
+		ring.epochs[e.Epoch] = e
+		if !active && (e.RetiredAt == nil || e.Epoch > ring.current) {
+			ring.current = e.Epoch
+			active = e.RetiredAt == nil
+		}
+	}
+
+	s.mu.Lock()
+	// 并发加载时以先写入的为准
+	if cached, ok := s.groupKeys[gid]; ok {
+		ring = cached
+	} else {
+		s.groupKeys[gid] = ring
+	}
+	s.mu.Unlock()
+	return ring, nil
+}
+
+// currentGroupKey 返回群当前纪元的密钥
+func (s *Service) currentGroupKey(gid string) (string, uint32, error) {
+	ring, err := s.loadGroupKeyring(gid)
+	if err != nil {
+		return "", 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ring.epochs[ring.current].SymKey, ring.current, nil
+}
+
+// groupKeyEpoch 返回群指定纪元的密钥
+func (s *Service) groupKeyEpoch(gid string, epoch uint32) (*storage.GroupKeyEpoch, error) {
+	ring, err := s.loadGroupKeyring(gid)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := ring.epochs[epoch]
+	if !ok {
+		return nil, fmt.Errorf("%w: group %s epoch %d", errGroupKeyEpochMissing, gid, epoch)
+	}
+	return e, nil
+}
+
+// installGroupKey 保存一个群密钥纪元，createdAt 是该纪元生效（上一纪元退役）的时间。
+// activate 时纪元比当前新就切换为当前纪元并退役更早的纪元；否则新纪元只保存、等待启用（见 activateGroupKey）。
+// 同一纪元已存在时保持原密钥不变
+func (s *Service) installGroupKey(gid string, epoch uint32, symB64 string, createdAt time.Time, activate bool) {
+	if gid == "" || symB64 == "" {
+		return
+	}
+	createdAt = createdAt.Truncate(time.Second)
+
+	ring, err := s.loadGroupKeyring(gid)
+	if err != nil {
+		ring = &groupKeyring{current: epoch, epochs: make(map[uint32]*storage.GroupKeyEpoch)}
+	}
+
+	s.mu.Lock()
+	if cached, ok := s.groupKeys[gid]; ok {
+		ring = cached
+	} else {
+		s.groupKeys[gid] = ring
+	}
+	e, exists := ring.epochs[epoch]
+	if !exists {
+		e = &storage.GroupKeyEpoch{GroupID: gid, Epoch: epoch, SymKey: symB64, CreatedAt: createdAt}
+		ring.epochs[epoch] = e
+	}
+	promoted := activate && epoch >= ring.current
+	if promoted {
+		ring.current = epoch
+		for _, old := range ring.epochs {
+			if old.Epoch < epoch && old.RetiredAt == nil {
+				at := createdAt
+				old.RetiredAt = &at
+			}
+		}
+	} else if !exists && epoch < ring.current {
+		// 补收到的旧纪元，在紧随其后的纪元生效时退役
+		for next := epoch + 1; next <= ring.current; next++ {
+			if newer, ok := ring.epochs[next]; ok {
+				at := newer.CreatedAt
+				e.RetiredAt = &at
+				break
+			}
+		}
+	}
+	stored := *e
+	s.mu.Unlock()
+
+	if !exists {
+		// 重试因为缺少这个群密钥而隔离的离线消息
+		go s.retryQuarantined(storage.QuarantineGroupKey, gid)
+	}
+
+	// 持久化到本地SQLite（最佳努力，失败不影响内存缓存）
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.SaveGroupKeyEpoch(&stored); err != nil {
+		s.dispatchError(fmt.Errorf("failed to persist group key: %w", err))
+		return
+	}
+	if promoted {
+		if err := s.storage.SaveGroupSymKey(gid, stored.SymKey); err != nil {
+			s.dispatchError(fmt.Errorf("failed to persist group key: %w", err))
+		}
+		if err := s.storage.RetireGroupKeyEpochs(gid, epoch, createdAt); err != nil {
+			s.dispatchError(fmt.Errorf("failed to retire group key epochs: %w", err))
+		}
+	}
+}
+
+// activateGroupKey 启用已经收到的新纪元：切换为当前纪元，at 之后旧纪元的消息被拒绝。
+// 纪元没有收到或不比当前新时不做任何事
+func (s *Service) activateGroupKey(gid string, epoch uint32, at time.Time) {
+	ring, err := s.loadGroupKeyring(gid)
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	e, ok := ring.epochs[epoch]
+	stale := !ok || epoch <= ring.current
+	var sym string
+	if ok {
+		sym = e.SymKey
+	}
+	s.mu.RUnlock()
+	if stale {
+		return
+	}
+	s.installGroupKey(gid, epoch, sym, at, true)
+	slog.Info("群密钥新纪元已启用", "gid", gid, "epoch", epoch)
+}
+
+// activateOnAdminUse 管理员用比当前新的纪元发来群消息时启用该纪元。
+// 管理员要等轮换的密钥全部送达才切换，所以收到授权时不能退役旧纪元，否则没收到的成员会和其他人分裂
+func (s *Service) activateOnAdminUse(in *inboundMessage) {
+	gid, epoch := in.wire.CID, in.wire.KeyID
+	ring, err := s.loadGroupKeyring(gid)
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	newer := epoch > ring.current
+	s.mu.RUnlock()
+	if !newer {
+		return
+	}
+	if err := s.checkGrantSender(gid, in.wire.Sender); err != nil {
+		slog.Debug("非管理员使用了未启用的纪元，不启用", "gid", gid, "epoch", epoch, "sender", in.wire.Sender)
+		return
+	}
+	s.activateGroupKey(gid, epoch, in.receivedAt)
+}
+
+// openGroup 按载荷里的纪元选择群密钥解密，拒绝退役后仍使用旧纪元加密的消息。
+// at 是 Hub 保存消息的时间（离线同步）或本地收到的时间，不用发送方自己填的 ts，被移除的成员改不了它
+func (s *Service) openGroup(w *EncWire, at time.Time) ([]byte, error) {
+	e, err := s.groupKeyEpoch(w.CID, w.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	retiredAt := e.RetiredAt
+	s.mu.RUnlock()
+	// 退役时间精确到秒
+	if retiredAt != nil && at.Truncate(time.Second).After(*retiredAt) {
+		return nil, fmt.Errorf("%w: group %s epoch %d retired at %s", ErrRetiredGroupKey, w.CID, w.KeyID, retiredAt.Format(time.RFC3339))
+	}
+	return DecryptGroup(e.SymKey, w.Nonce, w.Cipher)
+}
+
+// RotateGroupKey 为群生成新纪元的密钥，并通过私聊发给 remainingMembers（不含自己也可以）。
+// 不在列表里的成员拿不到新密钥，轮换之后他们用旧纪元发的消息会被其他成员拒绝。
+// 有群信息时只有管理员可以轮换，成员名单同时更新为自己加 remainingMembers。
+// 所有成员的密钥都被 Hub 确认后才切换到新纪元，并在群里发一条新纪元加密的启用消息；
+// 有发送失败时返回错误、不切换，已经收到的成员也继续用旧纪元。
+// 再次调用时只要没有去掉上次的成员，就沿用同一纪元和密钥重发，已经收到的成员保持一致
+func (s *Service) RotateGroupKey(gid string, remainingMembers []string) (uint32, error) {
+	_, current, err := s.currentGroupKey(gid)
+	if err != nil {
+		return 0, fmt.Errorf("group key not available: %w", err)
+	}
+
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+
+	var meta *GroupMeta
+	if s.storage != nil {
+		meta, err = s.nextGroupMeta(gid, func(meta *GroupMeta) error {
+			members := append([]string{self}, remainingMembers...)
+			meta.Members = members
+			meta.Admins = slices.DeleteFunc(meta.Admins, func(a string) bool { return !slices.Contains(members, a) })
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var recipients []string
+	for _, member := range remainingMembers {
+		if member != "" && member != self && !slices.Contains(recipients, member) {
+			recipients = append(recipients, member)
+		}
+	}
+	now := time.Now()
+	grant, err := s.rotationGrant(gid, current, recipients, now)
+	if err != nil {
+		return 0, err
+	}
+	grant.Meta = meta
+
+	// 先为每个成员加密好新密钥，任何一个成员的公钥不可用都不轮换
+	type pending struct {
+		member string
+		wire   *EncWire
+	}
+	var outbox []pending
+	for _, member := range recipients {
+		peerPub, err := s.getFriendKey(member)
+		if err != nil {
+			return 0, fmt.Errorf("friend pub key not available for %s: %w", member, err)
+		}
+		body := &MessageBody{System: &SystemBody{Type: SystemGroupKey, GroupKey: grant}}
+		wire, err := s.sealDirect(member, peerPub, KindSystem, body, now)
+		if err != nil {
+			return 0, fmt.Errorf("seal group key for %s: %w", member, err)
+		}
+		outbox = append(outbox, pending{member: member, wire: wire})
+	}
+
+	// 成员多时逐个等确认太慢，异步发布后统一等待
+	var errs []error
+	acks := make([]nats.PubAckFuture, len(outbox))
+	for i, p := range outbox {
+		if acks[i], err = s.publishWireAsync(directSubject(p.wire.CID), p.wire, ""); err != nil {
+			errs = append(errs, fmt.Errorf("send group key to %s: %w", p.member, err))
+		}
+	}
+	for i, ack := range acks {
+		if ack == nil {
+			continue
+		}
+		select {
+		case <-ack.Ok():
+		case err := <-ack.Err():
+			errs = append(errs, fmt.Errorf("send group key to %s: %w", outbox[i].member, err))
+		}
+	}
+	if len(errs) > 0 {
+		s.mu.Lock()
+		s.pendingRotations[gid] = &pendingRotation{grant: grant, members: recipients}
+		s.mu.Unlock()
+		slog.Warn("群密钥没有全部送达，暂不切换纪元", "gid", gid, "epoch", grant.Epoch, "failed", len(errs))
+		return 0, errors.Join(errs...)
+	}
+	s.mu.Lock()
+	delete(s.pendingRotations, gid)
+	s.mu.Unlock()
+
+	s.installGroupKey(gid, grant.Epoch, grant.Key, now, true)
+	slog.Info("群密钥已轮换", "gid", gid, "epoch", grant.Epoch, "members", len(outbox))
+
+	// 成员收到启用消息（或之后任何一条新纪元的消息）才切换，这条没发出去也不影响轮换结果
+	if err := s.publishGroupKeyActive(gid); err != nil {
+		slog.Warn("发送群密钥启用消息失败", "gid", gid, "epoch", grant.Epoch, "error", err)
+	}
+
+	// 新名单已随密钥发给剩余成员，这里只更新本地
+	if meta != nil {
+		if err := s.saveGroupMeta(meta, self); err != nil {
+			return grant.Epoch, err
+		}
+		s.dispatchEvent(EventGroupUpdated, meta)
+	}
+	return grant.Epoch, nil
+}
+
+// publishGroupKeyActive 在群主题上发一条用当前纪元加密的启用消息，成员据此启用新纪元
+func (s *Service) publishGroupKeyActive(gid string) error {
+	body := &MessageBody{System: &SystemBody{Type: SystemGroupKeyActive}}
+	wire, err := s.sealGroup(gid, KindSystem, body, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = s.publishWire(groupSubject(gid), wire, "")
+	return err
+}
+
+// rotationGrant 生成新纪元的密钥。上次轮换没有全部送达、这次的成员又包含了上次的全部成员时沿用上次的纪元和密钥；
+// 去掉了上次的成员时他可能已经收到那把密钥，跳过那个纪元重新生成
+func (s *Service) rotationGrant(gid string, current uint32, members []string, now time.Time) (*GroupKeyGrant, error) {
+	s.mu.RLock()
+	last := s.pendingRotations[gid]
+	s.mu.RUnlock()
+
+	epoch := current + 1
+	if last != nil && last.grant.Epoch > current {
+		if !slices.ContainsFunc(last.members, func(m string) bool { return !slices.Contains(members, m) }) {
+			grant := *last.grant
+			return &grant, nil
+		}
+		epoch = last.grant.Epoch + 1
+	}
+	key, err := GenerateGroupKey()
+	if err != nil {
+		return nil, fmt.Errorf("generate group key: %w", err)
+	}
+	return &GroupKeyGrant{GID: gid, Epoch: epoch, Key: key, RotatedAt: now.Unix()}, nil
+}
+
+// applyGroupKeyGrant 处理通过私聊收到的新群密钥
+func (s *Service) applyGroupKeyGrant(in *inboundMessage, grant *GroupKeyGrant) error {
+	if grant.GID == "" || grant.Key == "" {
+		return errors.New("invalid group key grant")
+	}
+	// 只接受已加入的群的密钥轮换
+	if _, _, err := s.currentGroupKey(grant.GID); err != nil {
+		slog.Debug("忽略未加入群的密钥", "gid", grant.GID, "sender", in.wire.Sender)
+		return nil
+	}
+	if err := s.checkGrantSender(grant.GID, in.wire.Sender); err != nil {
+		return err
+	}
+	// 先保存不启用：管理员可能还没把密钥发给所有成员，等管理员用新纪元发消息时再退役旧纪元
+	s.installGroupKey(grant.GID, grant.Epoch, grant.Key, in.receivedAt, false)
+	slog.Info("收到新的群密钥", "gid", grant.GID, "epoch", grant.Epoch, "sender", in.wire.Sender)
+	if grant.Meta != nil && grant.Meta.GID == grant.GID {
+		return s.applyGroupMeta(in.wire.Sender, grant.Meta)
+	}
+	return nil
+}
+
+// checkGrantSender 只接受能确认是管理员发来的密钥轮换：有群信息时按管理员名单；
+// 没有群信息（旧版本的邀请）时只接受邀请我们入群的人；都确认不了（线下分享密钥加入的群）时拒绝
+func (s *Service) checkGrantSender(gid, sender string) error {
+	if s.storage == nil {
+		return fmt.Errorf("%w: no admin known for %s", ErrNotGroupAdmin, gid)
+	}
+	meta, err := s.loadGroupMeta(gid)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		if !meta.isAdmin(sender) {
+			return fmt.Errorf("%w: %s rotated key of %s", ErrNotGroupAdmin, sender, gid)
+		}
+		return nil
+	}
+	inv, err := s.storage.GetGroupInvite(gid)
+	if err != nil {
+		return fmt.Errorf("get group invite: %w", err)
+	}
+	if inv == nil || inv.Status != storage.InviteAccepted || inv.InviterID != sender {
+		return fmt.Errorf("%w: %s rotated key of %s", ErrNotGroupAdmin, sender, gid)
+	}
+	return nil
+}
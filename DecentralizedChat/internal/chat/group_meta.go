@@ -0,0 +1,323 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+// ErrNotGroupAdmin 只有群主和管理员可以修改群信息和成员
+var ErrNotGroupAdmin = errors.New("not a group admin")
+
+// GroupMeta 群信息快照，通过群主题上的系统消息同步（kind=system, type=group_meta）
+// 每次修改递增 Version，接收方只接受更高版本且由管理员签名发出的快照
+type GroupMeta struct {
+	GID         string   `json:"gid"`
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Creator     string   `json:"creator"`
+	Admins      []string `json:"admins"`
+	Members     []string `json:"members"`
+	Version     uint64   `json:"version"`
+	UpdatedAt   int64    `json:"updated_at"`
+}
+
+// isAdmin 群主和管理员都可以管理群
+func (m *GroupMeta) isAdmin(uid string) bool {
+	return uid != "" && (uid == m.Creator || slices.Contains(m.Admins, uid))
+}
+
+// normalize 去重并保证群主和管理员都在成员名单里
+func (m *GroupMeta) normalize() {
+	var members []string
+	seen := make(map[string]bool)
+	add := func(uid string) {
+		if uid != "" && !seen[uid] {
+			seen[uid] = true
+			members = append(members, uid)
+		}
+	}
+	add(m.Creator)
+	for _, uid := range m.Admins {
+		add(uid)
+	}
+	for _, uid := range m.Members {
+		add(uid)
+	}
+	m.Members = members
+
+	var admins []string
+	for _, uid := range m.Admins {
+		if uid != m.Creator && !slices.Contains(admins, uid) {
+			admins = append(admins, uid)
+		}
+	}
+	m.Admins = admins
+}
+
+// loadGroupMeta 从本地存储读取群信息快照，没有时返回 nil
+func (s *Service) loadGroupMeta(gid string) (*GroupMeta, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	info, err := s.storage.GetGroupInfo(gid)
+	if err != nil {
+		return nil, fmt.Errorf("get group info: %w", err)
+	}
+	if info == nil || info.Version == 0 {
+		return nil, nil
+	}
+	members, err := s.storage.GetGroupMembers(gid)
+	if err != nil {
+		return nil, fmt.Errorf("get group members: %w", err)
+	}
+
+	meta := &GroupMeta{
+		GID:         gid,
+		Name:        info.Name,
+		Description: info.Description,
+		Creator:     info.CreatorID,
+		Version:     info.Version,
+		UpdatedAt:   info.UpdatedAt.Unix(),
+	}
+	for _, m := range members {
+		meta.Members = append(meta.Members, m.UserID)
+		if m.Role == storage.RoleAdmin {
+			meta.Admins = append(meta.Admins, m.UserID)
+		}
+	}
+	return meta, nil
+}
+
+// saveGroupMeta 把群信息快照写入本地存储
+func (s *Service) saveGroupMeta(meta *GroupMeta, updatedBy string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	info, err := s.storage.GetGroupInfo(meta.GID)
+	if err != nil {
+		return fmt.Errorf("get group info: %w", err)
+	}
+	if info == nil {
+		info = &storage.GroupInfo{GroupID: meta.GID, CreatedAt: time.Now()}
+	}
+	info.Name = meta.Name
+	info.Description = meta.Description
+	info.CreatorID = meta.Creator
+	info.Version = meta.Version
+	info.UpdatedBy = updatedBy
+	info.UpdatedAt = time.Unix(meta.UpdatedAt, 0)
+	if err := s.storage.SaveGroupInfo(info); err != nil {
+		return fmt.Errorf("save group info: %w", err)
+	}
+
+	members := make([]*storage.GroupMember, 0, len(meta.Members))
+	for _, uid := range meta.Members {
+		role := storage.RoleMember
+		switch {
+		case uid == meta.Creator:
+			role = storage.RoleOwner
+		case slices.Contains(meta.Admins, uid):
+			role = storage.RoleAdmin
+		}
+		members = append(members, &storage.GroupMember{GroupID: meta.GID, UserID: uid, Role: role})
+	}
+	if err := s.storage.SaveGroupMembers(meta.GID, members); err != nil {
+		return fmt.Errorf("save group members: %w", err)
+	}
+	return nil
+}
+
+// publishGroupMeta 用群密钥加密并签名后在群主题上广播群信息
+func (s *Service) publishGroupMeta(meta *GroupMeta) error {
+	body := &MessageBody{System: &SystemBody{Type: SystemGroupMeta, GroupMeta: meta}}
+	wire, err := s.sealGroup(meta.GID, KindSystem, body, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = s.publishWire(groupSubject(meta.GID), wire, "")
+	return err
+}
+
+// nextGroupMeta 在本地群信息上应用修改并递增版本，只有管理员可以调用；结果还没有保存。
+// 没有群信息的旧群（线下分享密钥建的群）由第一个修改的成员成为群主
+func (s *Service) nextGroupMeta(gid string, mutate func(meta *GroupMeta) error) (*GroupMeta, error) {
+	if gid == "" {
+		return nil, errors.New("gid empty")
+	}
+	if _, _, err := s.currentGroupKey(gid); err != nil {
+		return nil, fmt.Errorf("group key not available: %w", err)
+	}
+
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+
+	meta, err := s.loadGroupMeta(gid)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = &GroupMeta{GID: gid, Creator: self, Name: s.groupName(gid)}
+	}
+	if !meta.isAdmin(self) {
+		return nil, fmt.Errorf("%w: %s", ErrNotGroupAdmin, gid)
+	}
+
+	if err := mutate(meta); err != nil {
+		return nil, err
+	}
+	meta.normalize()
+	meta.Version++
+	meta.UpdatedAt = time.Now().Unix()
+	return meta, nil
+}
+
+// commitGroupMeta 保存自己修改的群信息并广播给群成员
+func (s *Service) commitGroupMeta(meta *GroupMeta) error {
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+
+	if err := s.saveGroupMeta(meta, self); err != nil {
+		return err
+	}
+	s.dispatchEvent(EventGroupUpdated, meta)
+	if err := s.publishGroupMeta(meta); err != nil {
+		return fmt.Errorf("publish group meta: %w", err)
+	}
+	return nil
+}
+
+// updateGroupMeta 修改群信息、保存并广播
+func (s *Service) updateGroupMeta(gid string, mutate func(meta *GroupMeta) error) (*GroupMeta, error) {
+	meta, err := s.nextGroupMeta(gid, mutate)
+	if err != nil {
+		return nil, err
+	}
+	return meta, s.commitGroupMeta(meta)
+}
+
+// applyGroupMeta 应用从群主题收到或随邀请附带的群信息快照
+func (s *Service) applyGroupMeta(sender string, meta *GroupMeta) error {
+	if meta == nil || meta.GID == "" || meta.Creator == "" {
+		return errors.New("invalid group meta")
+	}
+	local, err := s.loadGroupMeta(meta.GID)
+	if err != nil {
+		return err
+	}
+	if local != nil {
+		if meta.Version <= local.Version {
+			slog.Debug("忽略旧版本的群信息", "gid", meta.GID, "version", meta.Version, "local", local.Version)
+			return nil
+		}
+		// 只有本地名单里的管理员可以修改群信息，群主不能被替换
+		if !local.isAdmin(sender) || meta.Creator != local.Creator {
+			slog.Warn("忽略非管理员发布的群信息", "gid", meta.GID, "sender", sender)
+			return fmt.Errorf("%w: %s in %s", ErrNotGroupAdmin, sender, meta.GID)
+		}
+	} else if !meta.isAdmin(sender) {
+		// 第一次收到群信息：发布者至少要是快照里的管理员
+		slog.Warn("忽略非管理员发布的群信息", "gid", meta.GID, "sender", sender)
+		return fmt.Errorf("%w: %s in %s", ErrNotGroupAdmin, sender, meta.GID)
+	}
+
+	meta.normalize()
+	if err := s.saveGroupMeta(meta, sender); err != nil {
+		return err
+	}
+	slog.Info("群信息已更新", "gid", meta.GID, "version", meta.Version, "sender", sender)
+	s.dispatchEvent(EventGroupUpdated, meta)
+	return nil
+}
+
+// requireGroupAdmin 有群信息的群只允许管理员执行成员管理操作
+func (s *Service) requireGroupAdmin(gid, uid string) (*GroupMeta, error) {
+	meta, err := s.loadGroupMeta(gid)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+	if !meta.isAdmin(uid) {
+		return nil, fmt.Errorf("%w: %s", ErrNotGroupAdmin, gid)
+	}
+	return meta, nil
+}
+
+// UpdateGroupInfo 修改群名称和简介，并同步给群成员
+func (s *Service) UpdateGroupInfo(gid, name, description string) error {
+	_, err := s.updateGroupMeta(gid, func(meta *GroupMeta) error {
+		meta.Name = name
+		meta.Description = description
+		return nil
+	})
+	return err
+}
+
+// SetGroupAdmin 设置或取消管理员，群主不能被取消
+func (s *Service) SetGroupAdmin(gid, uid string, admin bool) error {
+	if uid == "" {
+		return errors.New("uid empty")
+	}
+	_, err := s.updateGroupMeta(gid, func(meta *GroupMeta) error {
+		if uid == meta.Creator {
+			return errors.New("cannot change the group owner's role")
+		}
+		if !slices.Contains(meta.Members, uid) {
+			return fmt.Errorf("%s is not a member of %s", uid, gid)
+		}
+		meta.Admins = slices.DeleteFunc(meta.Admins, func(a string) bool { return a == uid })
+		if admin {
+			meta.Admins = append(meta.Admins, uid)
+		}
+		return nil
+	})
+	return err
+}
+
+// RemoveGroupMember 移除群成员：轮换群密钥，新密钥只发给剩余成员
+func (s *Service) RemoveGroupMember(gid, uid string) error {
+	if uid == "" {
+		return errors.New("uid empty")
+	}
+	meta, err := s.loadGroupMeta(gid)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return fmt.Errorf("group %s has no member list", gid)
+	}
+	if uid == meta.Creator {
+		return errors.New("cannot remove the group owner")
+	}
+	remaining := slices.DeleteFunc(slices.Clone(meta.Members), func(m string) bool { return m == uid })
+	_, err = s.RotateGroupKey(gid, remaining)
+	return err
+}
+
+// GetGroupInfo 获取群信息
+func (s *Service) GetGroupInfo(gid string) (*storage.GroupInfo, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	info, err := s.storage.GetGroupInfo(gid)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("group not found: %s", gid)
+	}
+	return info, nil
+}
+
+// ListGroupMembers 获取群成员名单
+func (s *Service) ListGroupMembers(gid string) ([]*storage.GroupMember, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetGroupMembers(gid)
+}
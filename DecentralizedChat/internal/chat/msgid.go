@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// 消息ID由发送方生成，放在加密的消息体里，所有设备用同一个ID保存。
+// 格式为 ULID：48 位毫秒时间戳 + 80 位随机数，Crockford Base32 编码成 26 个字符，按字典序即按时间排序
+const (
+	ulidLen         = 26
+	maxMessageIDLen = 64 // 兼容旧客户端的 msg_ 前缀ID，超长的拒绝
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulidGen struct {
+	sync.Mutex
+	lastMS  uint64
+	entropy [10]byte
+}
+
+// newMessageID 生成 ULID；同一毫秒内随机部分递增，保证同一发送方的ID严格递增
+func newMessageID() string {
+	ms := uint64(time.Now().UnixMilli())
+
+	ulidGen.Lock()
+	if ms <= ulidGen.lastMS {
+		ms = ulidGen.lastMS
+		incrementEntropy(&ulidGen.entropy)
+	} else {
+		ulidGen.lastMS = ms
+		if _, err := rand.Read(ulidGen.entropy[:]); err != nil {
+			binary.BigEndian.PutUint64(ulidGen.entropy[2:], uint64(time.Now().UnixNano()))
+		}
+	}
+	var raw [16]byte
+	raw[0] = byte(ms >> 40)
+	raw[1] = byte(ms >> 32)
+	raw[2] = byte(ms >> 24)
+	raw[3] = byte(ms >> 16)
+	raw[4] = byte(ms >> 8)
+	raw[5] = byte(ms)
+	copy(raw[6:], ulidGen.entropy[:])
+	ulidGen.Unlock()
+
+	return encodeULID(raw)
+}
+
+// incrementEntropy 随机部分加一；溢出极不可能，溢出时回绕
+func incrementEntropy(e *[10]byte) {
+	for i := len(e) - 1; i >= 0; i-- {
+		e[i]++
+		if e[i] != 0 {
+			return
+		}
+	}
+}
+
+// encodeULID 128 位按 5 位一组编码，首字符只有 3 位
+func encodeULID(raw [16]byte) string {
+	hi := binary.BigEndian.Uint64(raw[:8])
+	lo := binary.BigEndian.Uint64(raw[8:])
+	out := make([]byte, ulidLen)
+	for i := ulidLen - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// validMessageID 检查对方带来的消息ID：ULID 或旧版本的 msg_ 前缀ID，只允许字母数字、下划线和连字符
+func validMessageID(id string) bool {
+	if id == "" || len(id) > maxMessageIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// legacyMessageID 没有带消息ID的旧载荷按会话、发送方和 nonce 派生确定的ID，
+// 实时订阅和离线同步收到同一条消息时得到相同的ID
+func legacyMessageID(w *EncWire) string {
+	sum := sha256.Sum256([]byte(w.CID + "\n" + w.Sender + "\n" + w.Nonce))
+	return "msg_" + hex.EncodeToString(sum[:16])
+}
@@ -182,3 +182,33 @@ func GenerateGroupKey() (string, error) {
 	}
 	return base64.StdEncoding.EncodeToString(key), nil
 }
+
+// PublicKey 返回NSC用户公钥（U开头），作为消息签名者身份
+func (km *NSCKeyManager) PublicKey() string {
+	return km.userPubKey
+}
+
+// Sign 使用NSC Ed25519用户私钥签名
+func (km *NSCKeyManager) Sign(data []byte) ([]byte, error) {
+	userKey, err := nkeys.FromSeed([]byte(km.userSeed))
+	if err != nil {
+		return nil, fmt.Errorf("parse nkey from seed: %w", err)
+	}
+	sig, err := userKey.Sign(data)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	return sig, nil
+}
+
+// VerifyNSCSignature 使用NSC用户公钥（U开头）校验Ed25519签名
+func VerifyNSCSignature(nscPubKey string, data, sig []byte) error {
+	if !strings.HasPrefix(nscPubKey, "U") {
+		return errors.New("invalid NSC user public key format")
+	}
+	pub, err := nkeys.FromPublicKey(nscPubKey)
+	if err != nil {
+		return fmt.Errorf("parse NSC public key: %w", err)
+	}
+	return pub.Verify(data, sig)
+}
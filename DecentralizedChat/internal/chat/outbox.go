@@ -0,0 +1,304 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SendCancelled 发件箱里的消息被 CancelSend 取消，只出现在 EventSendState 里
+const SendCancelled = "cancelled"
+
+// SendStateUpdate 发件箱消息的发送状态变化，随 EventSendState 推送
+type SendStateUpdate struct {
+	CID       string `json:"cid"`
+	MessageID string `json:"message_id"`
+	State     string `json:"state"` // storage.DeliveryPending / DeliverySent / DeliveryFailed / SendCancelled
+	Attempts  int    `json:"attempts"`
+	Error     string `json:"error,omitempty"` // 最近一次发布失败的原因
+}
+
+// outboxPollInterval 发件箱循环检查到期消息的间隔
+const outboxPollInterval = time.Second
+
+// outboxBackoff 第 n 次发布失败后等待 outboxBackoff[n-1] 再试，之后一直按最后一档重试
+var outboxBackoff = []time.Duration{time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second}
+
+// queueOutgoing 保存自己发送的消息（pending）并放进发件箱，通知后台循环马上发出，不等待发布结果。
+// 断开 Hub 时消息留在发件箱里，由后台循环在恢复后按顺序发出
+func (s *Service) queueOutgoing(msgID, subj string, wire *EncWire, now time.Time, content string, isGroup bool, replyTo string) error {
+	if s.storage == nil {
+		// 没有本地存储时无处排队，直接发布
+		seq, err := s.publishWire(subj, wire, msgID)
+		if err != nil {
+			return err
+		}
+		s.saveOutgoing(msgID, wire, now, content, isGroup, seq, replyTo, storage.DeliverySent)
+		return nil
+	}
+	data, err := json.Marshal(wire)
+	if err != nil {
+		return fmt.Errorf("marshal wire: %w", err)
+	}
+
+	s.outboxMu.Lock()
+	err = s.storage.EnqueueOutbox(&storage.OutboxEntry{
+		MessageID:      msgID,
+		ConversationID: wire.CID,
+		Subject:        subj,
+		Payload:        data,
+		State:          storage.DeliveryPending,
+		CreatedAt:      now,
+		NextAttemptAt:  now,
+	})
+	if err == nil {
+		s.saveOutgoing(msgID, wire, now, content, isGroup, 0, replyTo, storage.DeliveryPending)
+	}
+	s.outboxMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("enqueue outbox: %w", err)
+	}
+
+	s.dispatchEvent(EventSendState, &SendStateUpdate{CID: wire.CID, MessageID: msgID, State: storage.DeliveryPending})
+	s.startOutboxLoop()
+	s.kickOutbox()
+	return nil
+}
+
+// RetrySend 立即重试发件箱里的消息（包括发送失败的），由后台循环发出
+func (s *Service) RetrySend(msgID string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	s.outboxMu.Lock()
+	e, err := s.storage.GetOutboxEntry(msgID)
+	if err == nil && e == nil {
+		err = fmt.Errorf("message %s not in outbox", msgID)
+	}
+	if err == nil {
+		now := time.Now()
+		e.State, e.Attempts, e.LastError, e.NextAttemptAt = storage.DeliveryPending, 0, "", now
+		err = s.storage.UpdateOutbox(e)
+		if err == nil {
+			err = s.storage.SetDeliveryState(msgID, storage.DeliveryPending, now)
+		}
+	}
+	s.outboxMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.dispatchEvent(EventSendState, &SendStateUpdate{CID: e.ConversationID, MessageID: msgID, State: storage.DeliveryPending})
+	s.startOutboxLoop()
+	s.kickOutbox()
+	return nil
+}
+
+// CancelSend 取消还在发件箱里的消息，同时从本地删除；已经发出的消息不能取消
+func (s *Service) CancelSend(msgID string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	s.outboxMu.Lock()
+	e, err := s.storage.GetOutboxEntry(msgID)
+	if err == nil && e == nil {
+		err = fmt.Errorf("message %s not in outbox", msgID)
+	}
+	if err == nil {
+		err = s.storage.DeleteOutbox(msgID)
+	}
+	if err == nil {
+		err = s.storage.DeleteMessage(msgID)
+	}
+	s.outboxMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.dispatchEvent(EventSendState, &SendStateUpdate{CID: e.ConversationID, MessageID: msgID, State: SendCancelled, Attempts: e.Attempts})
+	return nil
+}
+
+// GetOutbox 发件箱里还没发出的消息，按发送的先后排列
+func (s *Service) GetOutbox() ([]*storage.OutboxEntry, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetOutbox()
+}
+
+// startOutboxLoop 启动后台循环：定时和重连后发出到期的发件箱消息
+func (s *Service) startOutboxLoop() {
+	s.outboxOnce.Do(func() {
+		if s.nats != nil {
+			s.nats.OnReconnect(s.kickOutbox)
+		}
+		go func() {
+			ticker := time.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-ticker.C:
+				case <-s.outboxKick:
+				}
+				s.flushOutbox()
+			}
+		}()
+	})
+}
+
+// kickOutbox 让发件箱循环马上检查一次
+func (s *Service) kickOutbox() {
+	select {
+	case s.outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+// flushOutbox 按放入的先后发布到期的发件箱消息。同一会话前面还有没发出的消息时后面的先不发，
+// 保证对方按发送顺序收到（双棘轮消息也是按这个顺序加密的）；没有连接时不尝试，不计入失败次数
+func (s *Service) flushOutbox() {
+	if s.storage == nil || s.nats == nil || !s.nats.IsConnected() {
+		return
+	}
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+
+	entries, err := s.storage.GetOutbox()
+	if err != nil {
+		slog.Warn("读取发件箱失败", "error", err)
+		return
+	}
+	blocked := make(map[string]bool)
+	for _, e := range entries {
+		if e.State != storage.DeliveryPending {
+			continue
+		}
+		now := time.Now()
+		if blocked[e.ConversationID] || now.Before(e.NextAttemptAt) {
+			blocked[e.ConversationID] = true
+			continue
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err := s.resealGroupOutbox(e, now); err != nil {
+			s.outboxFailed(e, err, now)
+			blocked[e.ConversationID] = true
+			continue
+		}
+		// 用消息ID去重：上次发布其实已经成功、只是没收到确认时，Hub 不会再存一份
+		msg := nats.NewMsg(e.Subject)
+		msg.Data = e.Payload
+		msg.Header.Set(nats.MsgIdHdr, e.MessageID)
+		seq, err := s.nats.PublishJetStreamMsg(msg)
+		if err != nil {
+			s.outboxFailed(e, err, now)
+			blocked[e.ConversationID] = true
+			continue
+		}
+		s.outboxSent(e, seq, now)
+	}
+}
+
+// resealGroupOutbox 排队期间群密钥轮换过时，用当前纪元和当前时间重新加密群消息，旧纪元的消息发出去会被成员拒绝。
+// 消息体（含消息ID）不变，新载荷写回发件箱，之后的重试沿用
+func (s *Service) resealGroupOutbox(e *storage.OutboxEntry, now time.Time) error {
+	if !strings.HasPrefix(e.Subject, "dchat.grp.") {
+		return nil
+	}
+	var w EncWire
+	if err := json.Unmarshal(e.Payload, &w); err != nil {
+		return fmt.Errorf("unmarshal outbox payload: %w", err)
+	}
+	_, current, err := s.currentGroupKey(w.CID)
+	if err != nil {
+		return fmt.Errorf("group key not available: %w", err)
+	}
+	if w.KeyID == current {
+		return nil
+	}
+	old, err := s.groupKeyEpoch(w.CID, w.KeyID)
+	if err != nil {
+		return err
+	}
+	plain, err := DecryptGroup(old.SymKey, w.Nonce, w.Cipher)
+	if err != nil {
+		return fmt.Errorf("decrypt outbox payload: %w", err)
+	}
+	kind, body, err := decodeBody(&w, plain)
+	if err != nil {
+		return err
+	}
+	wire, err := s.sealGroup(w.CID, kind, body, now)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(wire)
+	if err != nil {
+		return fmt.Errorf("marshal wire: %w", err)
+	}
+	e.Payload = data
+	if err := s.storage.SetOutboxPayload(e.MessageID, data); err != nil {
+		return fmt.Errorf("update outbox: %w", err)
+	}
+	slog.Info("群密钥已轮换，重新加密发件箱消息", "message_id", e.MessageID, "gid", w.CID, "from", w.KeyID, "to", wire.KeyID)
+	return nil
+}
+
+// outboxSent 发布成功：移出发件箱，补上流序列号，送达状态改为 sent
+func (s *Service) outboxSent(e *storage.OutboxEntry, seq uint64, now time.Time) {
+	if err := s.storage.DeleteOutbox(e.MessageID); err != nil {
+		slog.Warn("移出发件箱失败", "message_id", e.MessageID, "error", err)
+	}
+	if err := s.storage.SetMessageNatsSeq(e.MessageID, seq); err != nil {
+		slog.Warn("保存消息序列ID失败", "message_id", e.MessageID, "error", err)
+	}
+	if err := s.storage.SetDeliveryState(e.MessageID, storage.DeliverySent, now); err != nil {
+		slog.Error("保存送达状态失败", "error", err)
+	}
+	s.dispatchEvent(EventSendState, &SendStateUpdate{CID: e.ConversationID, MessageID: e.MessageID, State: storage.DeliverySent, Attempts: e.Attempts + 1})
+}
+
+// outboxFailed 发布失败：连不上 Hub 这类暂时的失败退避后重试，其余的标记为 failed，等用户手动重试或取消
+func (s *Service) outboxFailed(e *storage.OutboxEntry, cause error, now time.Time) {
+	e.Attempts++
+	e.LastError = cause.Error()
+	if publishUnavailable(cause) {
+		e.NextAttemptAt = now.Add(outboxBackoff[min(e.Attempts, len(outboxBackoff))-1])
+		slog.Warn("发件箱消息暂时发不出去，稍后重试", "message_id", e.MessageID, "attempts", e.Attempts, "next", e.NextAttemptAt, "error", cause)
+	} else {
+		e.State = storage.DeliveryFailed
+		slog.Error("发件箱消息发送失败", "message_id", e.MessageID, "error", cause)
+		if err := s.storage.SetDeliveryState(e.MessageID, storage.DeliveryFailed, now); err != nil {
+			slog.Error("保存送达状态失败", "error", err)
+		}
+	}
+	if err := s.storage.UpdateOutbox(e); err != nil {
+		slog.Warn("更新发件箱失败", "message_id", e.MessageID, "error", err)
+	}
+	s.dispatchEvent(EventSendState, &SendStateUpdate{CID: e.ConversationID, MessageID: e.MessageID, State: e.State, Attempts: e.Attempts, Error: e.LastError})
+}
+
+// publishUnavailable 发布失败是否因为暂时连不上 Hub（断线、重连中、叶子节点和 Hub 之间断开导致超时或没有响应）
+func publishUnavailable(err error) bool {
+	for _, target := range []error{
+		nats.ErrTimeout, context.DeadlineExceeded, nats.ErrNoResponders, nats.ErrNoStreamResponse,
+		nats.ErrConnectionClosed, nats.ErrDisconnected, nats.ErrConnectionReconnecting,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+
+	"github.com/nats-io/nats.go"
+)
+
+// 预密钥目录：Hub 上的 KV 桶，离线的好友也能据此建立双棘轮会话
+const (
+	prekeyBucket        = "DChatPrekeys"
+	oneTimePrekeyTarget = 20                 // KV 里保持的一次性预密钥数量
+	signedPrekeyMaxAge  = 7 * 24 * time.Hour // 签名预密钥轮换周期
+	signedPrekeyGrace   = signedPrekeyMaxAge // 被替换的签名预密钥再保留的时间，期间用旧预密钥包发起的会话仍能建立
+	prekeyMissTTL       = 10 * time.Minute   // 查不到预密钥包的好友，这段时间内不再查询
+)
+
+// 预密钥签名的种类
+const (
+	prekeyKindSigned  = "signed"
+	prekeyKindOneTime = "one-time"
+)
+
+// ErrNoPrekeyBundle 对方没有发布预密钥包
+var ErrNoPrekeyBundle = errors.New("prekey bundle not published")
+
+// PrekeyBundle 发布在 KV 里的预密钥包，key 为 <uid>.bundle
+type PrekeyBundle struct {
+	UID          string       `json:"uid"`
+	IdentityKey  string       `json:"ik"`  // 身份公钥（X25519，base64），由 NSC 公钥派生
+	SignerKey    string       `json:"nsc"` // NSC 用户公钥（U开头），签名用
+	SignedPrekey PrekeyAdvert `json:"spk"`
+	Sig          string       `json:"sig"` // 对签名预密钥的 Ed25519 签名
+	UpdatedAt    int64        `json:"updated_at"`
+
+	// OneTimePrekey 获取时领取到的一次性预密钥，没有剩余时为 nil；不写入 KV
+	OneTimePrekey *PrekeyAdvert `json:"otk,omitempty"`
+}
+
+// oneTimePrekeyEntry 一次性预密钥在 KV 里的值，key 为 <uid>.otk.<id>
+type oneTimePrekeyEntry struct {
+	ID  uint32 `json:"id"`
+	Pub string `json:"pub"`
+	Sig string `json:"sig"`
+}
+
+// prekeySigningPayload 预密钥签名原文，绑定用户ID、种类和编号，防止被挪作他用
+func prekeySigningPayload(kind, uid string, adv PrekeyAdvert) []byte {
+	return []byte(strings.Join([]string{
+		"dchat-prekey", kind, uid, strconv.FormatUint(uint64(adv.ID), 10), adv.Pub,
+	}, "\n"))
+}
+
+func bundleKey(uid string) string { return uid + ".bundle" }
+
+func oneTimePrekeyKey(uid string, id uint32) string {
+	return uid + ".otk." + strconv.FormatUint(uint64(id), 10)
+}
+
+// PublishPrekeys 把自己的签名预密钥和一次性预密钥发布到 Hub 的 KV 桶。
+// 签名预密钥过期时先轮换；一次性预密钥补足到 oneTimePrekeyTarget 个。登录后调用一次即可
+func (s *Service) PublishPrekeys() error {
+	if !s.ratchetEnabled() {
+		return errors.New("forward secrecy disabled or storage not initialized")
+	}
+	s.mu.RLock()
+	km := s.nscKeyManager
+	uid := s.user.ID
+	pubB64 := s.userPubB64
+	s.mu.RUnlock()
+	if km == nil {
+		return errors.New("NSC signing key not loaded")
+	}
+
+	spk, err := s.rotateSignedPrekey()
+	if err != nil {
+		return err
+	}
+	adv := PrekeyAdvert{ID: spk.ID, Pub: spk.PubKey}
+	sig, err := km.Sign(prekeySigningPayload(prekeyKindSigned, uid, adv))
+	if err != nil {
+		return fmt.Errorf("sign prekey: %w", err)
+	}
+	bundle, err := json.Marshal(&PrekeyBundle{
+		UID:          uid,
+		IdentityKey:  pubB64,
+		SignerKey:    km.PublicKey(),
+		SignedPrekey: adv,
+		Sig:          B64(sig),
+		UpdatedAt:    time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.nats.KVPut(prekeyBucket, bundleKey(uid), bundle); err != nil {
+		return fmt.Errorf("publish prekey bundle: %w", err)
+	}
+
+	// 补足一次性预密钥：先存本地私钥再发布公钥，保证发出去的都能解开
+	keys, err := s.nats.KVKeys(prekeyBucket, uid+".otk.*")
+	if err != nil {
+		return fmt.Errorf("list one-time prekeys: %w", err)
+	}
+	nextID, err := s.storage.GetMaxOneTimePrekeyID()
+	if err != nil {
+		return fmt.Errorf("load one-time prekeys: %w", err)
+	}
+	for range oneTimePrekeyTarget - len(keys) {
+		nextID++
+		priv, pub, err := newX25519()
+		if err != nil {
+			return fmt.Errorf("generate one-time prekey: %w", err)
+		}
+		if err := s.storage.SaveOneTimePrekey(&storage.RatchetPrekey{
+			ID: nextID, PrivKey: B64(priv), PubKey: B64(pub), CreatedAt: time.Now(),
+		}); err != nil {
+			return fmt.Errorf("save one-time prekey: %w", err)
+		}
+		otk := PrekeyAdvert{ID: nextID, Pub: B64(pub)}
+		sig, err := km.Sign(prekeySigningPayload(prekeyKindOneTime, uid, otk))
+		if err != nil {
+			return fmt.Errorf("sign one-time prekey: %w", err)
+		}
+		data, err := json.Marshal(&oneTimePrekeyEntry{ID: otk.ID, Pub: otk.Pub, Sig: B64(sig)})
+		if err != nil {
+			return err
+		}
+		if _, err := s.nats.KVPut(prekeyBucket, oneTimePrekeyKey(uid, otk.ID), data); err != nil {
+			return fmt.Errorf("publish one-time prekey: %w", err)
+		}
+	}
+	slog.Info("预密钥已发布", "prekey_id", spk.ID, "one_time", max(len(keys), oneTimePrekeyTarget))
+	return nil
+}
+
+// rotateSignedPrekey 签名预密钥超过轮换周期时生成新的一把。被替换的旧预密钥在宽限期内保留，
+// 用它发起的会话仍能建立；当前预密钥生效超过宽限期后删除更旧的私钥，泄露本地数据也解不开更早的会话
+func (s *Service) rotateSignedPrekey() (*storage.RatchetPrekey, error) {
+	pk, err := s.ownPrekey()
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(pk.CreatedAt) >= signedPrekeyGrace {
+		if err := s.storage.DeleteRatchetPrekeysBefore(pk.ID); err != nil {
+			return nil, fmt.Errorf("delete superseded prekeys: %w", err)
+		}
+	}
+	if time.Since(pk.CreatedAt) < signedPrekeyMaxAge {
+		return pk, nil
+	}
+	priv, pub, err := newX25519()
+	if err != nil {
+		return nil, fmt.Errorf("generate prekey: %w", err)
+	}
+	next := &storage.RatchetPrekey{ID: pk.ID + 1, PrivKey: B64(priv), PubKey: B64(pub), CreatedAt: time.Now()}
+	if err := s.storage.SaveRatchetPrekey(next); err != nil {
+		return nil, fmt.Errorf("save prekey: %w", err)
+	}
+	s.mu.Lock()
+	s.prekey = next
+	s.mu.Unlock()
+	slog.Info("签名预密钥已轮换", "prekey_id", next.ID)
+	return next, nil
+}
+
+// FetchPrekeyBundle 获取好友的预密钥包并领取一把一次性预密钥（领取后从 KV 删除，每把只用一次）。
+// 签名或身份不符的预密钥包会被拒绝
+func (s *Service) FetchPrekeyBundle(uid string) (*PrekeyBundle, error) {
+	data, _, err := s.nats.KVGet(prekeyBucket, bundleKey(uid))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNoPrekeyBundle, uid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get prekey bundle: %w", err)
+	}
+	bundle := &PrekeyBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, fmt.Errorf("decode prekey bundle: %w", err)
+	}
+	if err := s.verifyPrekeyBundle(uid, bundle); err != nil {
+		return nil, err
+	}
+	bundle.OneTimePrekey = s.claimOneTimePrekey(bundle)
+	return bundle, nil
+}
+
+// verifyPrekeyBundle 确认预密钥包由 uid 本人签名，且身份公钥与已知的好友公钥一致
+func (s *Service) verifyPrekeyBundle(uid string, b *PrekeyBundle) error {
+	chatPub, err := GetChatPubKeyFromNSCPub(b.SignerKey)
+	if err != nil {
+		return fmt.Errorf("%w: prekey bundle signer: %v", ErrBadSignature, err)
+	}
+	if b.UID != uid || chatPub != b.IdentityKey || deriveUserIDFromPubKey(chatPub) != uid {
+		return fmt.Errorf("%w: prekey bundle of %s", ErrSenderMismatch, uid)
+	}
+	if known, err := s.getFriendKey(uid); err == nil && known != b.IdentityKey {
+		return fmt.Errorf("%w: prekey bundle identity differs from friend key", ErrSenderMismatch)
+	}
+	if err := verifyPrekeySig(b.SignerKey, prekeyKindSigned, uid, b.SignedPrekey, b.Sig); err != nil {
+		return err
+	}
+	if raw, err := B64Dec(b.SignedPrekey.Pub); err != nil || len(raw) != 32 {
+		return errors.New("invalid signed prekey")
+	}
+	return nil
+}
+
+func verifyPrekeySig(signer, kind, uid string, adv PrekeyAdvert, sigB64 string) error {
+	sig, err := B64Dec(sigB64)
+	if err != nil {
+		return fmt.Errorf("%w: %s prekey", ErrBadSignature, kind)
+	}
+	if err := VerifyNSCSignature(signer, prekeySigningPayload(kind, uid, adv), sig); err != nil {
+		return fmt.Errorf("%w: %s prekey", ErrBadSignature, kind)
+	}
+	return nil
+}
+
+// claimOneTimePrekey 按编号从小到大尝试领取一次性预密钥；删除带版本号条件，并发领取时只有一方成功
+func (s *Service) claimOneTimePrekey(b *PrekeyBundle) *PrekeyAdvert {
+	keys, err := s.nats.KVKeys(prekeyBucket, b.UID+".otk.*")
+	if err != nil {
+		slog.Warn("列出一次性预密钥失败", "peer", b.UID, "error", err)
+		return nil
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data, rev, err := s.nats.KVGet(prekeyBucket, key)
+		if err != nil {
+			continue
+		}
+		if err := s.nats.KVDelete(prekeyBucket, key, rev); err != nil {
+			continue
+		}
+		entry := &oneTimePrekeyEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			continue
+		}
+		otk := PrekeyAdvert{ID: entry.ID, Pub: entry.Pub}
+		if key != oneTimePrekeyKey(b.UID, otk.ID) {
+			continue
+		}
+		if err := verifyPrekeySig(b.SignerKey, prekeyKindOneTime, b.UID, otk, entry.Sig); err != nil {
+			slog.Warn("丢弃签名无效的一次性预密钥", "peer", b.UID, "key", key)
+			continue
+		}
+		return &otk
+	}
+	return nil
+}
+
+// lookupPrekeyBundle 发起会话时查询好友的预密钥包；查不到的结果缓存一段时间，避免每条消息都访问 KV
+func (s *Service) lookupPrekeyBundle(uid string) *PrekeyBundle {
+	s.mu.RLock()
+	missedAt, missed := s.prekeyMisses[uid]
+	s.mu.RUnlock()
+	if missed && time.Since(missedAt) < prekeyMissTTL {
+		return nil
+	}
+
+	bundle, err := s.FetchPrekeyBundle(uid)
+	if err != nil {
+		if !errors.Is(err, ErrNoPrekeyBundle) {
+			slog.Warn("获取预密钥包失败", "peer", uid, "error", err)
+		}
+		s.mu.Lock()
+		s.prekeyMisses[uid] = time.Now()
+		s.mu.Unlock()
+		return nil
+	}
+	return bundle
+}
@@ -0,0 +1,431 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// 在线状态和正在输入走 core NATS，不进 JetStream，也不写本地存储
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+const (
+	defaultPresenceInterval = 30 * time.Second // 在线时重发状态的间隔
+	presenceTTLFactor       = 3                // 超过 间隔*3 没有收到心跳视为离线
+	presenceReplyThrottle   = 2 * time.Second  // 好友上线时回发自己状态的最小间隔
+	typingTTL               = 6 * time.Second  // 正在输入的有效期，发送方应每隔几秒重发
+	signalMaxSkew           = 30 * time.Second // 拒绝时间戳偏差过大的信号，防止重放
+	presenceSweepInterval   = time.Second
+)
+
+// Presence 好友的在线状态
+type Presence struct {
+	UID      string    `json:"uid"`
+	Status   string    `json:"status"` // PresenceOnline / PresenceAway / PresenceOffline
+	LastSeen time.Time `json:"last_seen"`
+
+	expiresAt time.Time
+}
+
+// TypingUpdate 正在输入状态变化，随 EventTyping 推送；超过 typingTTL 没有更新时自动推送 Active=false
+type TypingUpdate struct {
+	CID     string `json:"cid"`
+	UserID  string `json:"user_id"`
+	IsGroup bool   `json:"is_group"`
+	Active  bool   `json:"active"`
+
+	expiresAt time.Time
+}
+
+// Typing kind=typing 消息体
+type Typing struct {
+	Active bool `json:"active"`
+}
+
+// presenceWire dchat.presence.<uid> 上的载荷：只签名不加密，任何知道 uid 的人都能看到在线状态
+type presenceWire struct {
+	V         int    `json:"v"`
+	UID       string `json:"uid"`
+	Status    string `json:"status"`
+	TTL       int64  `json:"ttl_ms"` // 超过这么多毫秒没有新的心跳，接收方视为离线
+	TS        int64  `json:"ts"`
+	SignerKey string `json:"spk"`
+	Sig       string `json:"sig"`
+}
+
+func (p *presenceWire) signingPayload() []byte {
+	return []byte(strings.Join([]string{
+		"dchat-presence",
+		strconv.Itoa(p.V),
+		p.UID,
+		p.Status,
+		strconv.FormatInt(p.TTL, 10),
+		strconv.FormatInt(p.TS, 10),
+		p.SignerKey,
+	}, "\n"))
+}
+
+// presenceSubject 用户在线状态主题
+func presenceSubject(uid string) string {
+	return "dchat.presence." + uid
+}
+
+// typingSubject 正在输入主题，和消息主题同一棵树但不被流匹配
+func typingSubject(cid string, isGroup bool) string {
+	if isGroup {
+		return fmt.Sprintf("dchat.grp.%s.typing", cid)
+	}
+	return fmt.Sprintf("dchat.dm.%s.typing", cid)
+}
+
+// SetPresenceInterval 设置在线心跳间隔（默认30秒），好友在 3 倍间隔内没收到心跳就视为离线
+func (s *Service) SetPresenceInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultPresenceInterval
+	}
+	s.presenceMu.Lock()
+	s.presenceInterval = d
+	s.presenceMu.Unlock()
+}
+
+// SetPresence 发布自己的在线状态；online/away 会定期重发，offline 停止心跳
+func (s *Service) SetPresence(status string) error {
+	switch status {
+	case PresenceOnline, PresenceAway, PresenceOffline:
+	default:
+		return fmt.Errorf("invalid presence status %q", status)
+	}
+	s.presenceMu.Lock()
+	s.selfPresence = status
+	s.presenceMu.Unlock()
+
+	s.startPresenceLoop()
+	return s.publishPresence()
+}
+
+// GetPresence 返回好友的在线状态，没有收到过时为 offline
+func (s *Service) GetPresence(uid string) *Presence {
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+	if p, ok := s.presence[uid]; ok {
+		out := *p
+		return &out
+	}
+	return &Presence{UID: uid, Status: PresenceOffline}
+}
+
+// SendTyping 通知私聊（好友ID或会话ID）或群聊的对方自己正在输入/停止输入，不保存
+func (s *Service) SendTyping(cidOrGid string, active bool) error {
+	if cidOrGid == "" {
+		return errors.New("cid empty")
+	}
+	s.mu.RLock()
+	from := s.user.ID
+	priv := s.userPrivB64
+	s.mu.RUnlock()
+
+	plain, err := encodeBody(&MessageBody{Typing: &Typing{Active: active}})
+	if err != nil {
+		return err
+	}
+	wire := &EncWire{V: WireVersion, Kind: KindTyping, Sender: from, TS: time.Now().Unix()}
+
+	// 私聊固定用静态 box，丢失的信号不应推进双棘轮状态
+	isGroup := false
+	if sym, epoch, err := s.currentGroupKey(cidOrGid); err == nil {
+		isGroup = true
+		wire.CID = cidOrGid
+		wire.KeyID = epoch
+		if wire.Nonce, wire.Cipher, err = EncryptGroup(sym, plain); err != nil {
+			return err
+		}
+	} else {
+		peerID, peerPub, err := s.resolvePeer(cidOrGid)
+		if err != nil {
+			return err
+		}
+		wire.CID = deriveCID(from, peerID)
+		if wire.Nonce, wire.Cipher, err = EncryptDirect(priv, peerPub, plain); err != nil {
+			return err
+		}
+	}
+	if err := s.signWire(wire); err != nil {
+		return err
+	}
+	data, err := json.Marshal(wire)
+	if err != nil {
+		return err
+	}
+	return s.nats.Publish(typingSubject(wire.CID, isGroup), data)
+}
+
+// subscribeSignals 订阅会话的正在输入主题；私聊同时订阅对方的在线状态。
+// 返回成功建立的订阅，离开会话时一起退订
+func (s *Service) subscribeSignals(cid, peerID string, isGroup bool) []*nats.Subscription {
+	var subs []*nats.Subscription
+	subj := typingSubject(cid, isGroup)
+	if sub, err := s.nats.Subscribe(subj, func(m *nats.Msg) { s.handleTyping(subj, m) }); err != nil {
+		slog.Warn("订阅正在输入失败", "subject", subj, "error", err)
+	} else {
+		subs = append(subs, sub)
+	}
+	if peerID != "" {
+		subj := presenceSubject(peerID)
+		if sub, err := s.nats.Subscribe(subj, func(m *nats.Msg) { s.handlePresence(peerID, m) }); err != nil {
+			slog.Warn("订阅在线状态失败", "subject", subj, "error", err)
+		} else {
+			subs = append(subs, sub)
+		}
+	}
+	s.startPresenceLoop()
+	return subs
+}
+
+// publishPresence 签名并发布自己的当前状态
+func (s *Service) publishPresence() error {
+	s.mu.RLock()
+	km := s.nscKeyManager
+	uid := s.user.ID
+	s.mu.RUnlock()
+	if km == nil {
+		return errors.New("NSC signing key not loaded")
+	}
+
+	now := time.Now()
+	s.presenceMu.Lock()
+	status := s.selfPresence
+	interval := s.presenceInterval
+	s.lastPresenceSent = now
+	s.presenceMu.Unlock()
+	if status == "" {
+		return nil
+	}
+
+	w := &presenceWire{
+		V:         WireVersion,
+		UID:       uid,
+		Status:    status,
+		TTL:       (interval * presenceTTLFactor).Milliseconds(),
+		TS:        now.Unix(),
+		SignerKey: km.PublicKey(),
+	}
+	sig, err := km.Sign(w.signingPayload())
+	if err != nil {
+		return fmt.Errorf("sign presence: %w", err)
+	}
+	w.Sig = B64(sig)
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return s.nats.Publish(presenceSubject(uid), data)
+}
+
+// handlePresence 校验并缓存好友的在线状态
+func (s *Service) handlePresence(peerID string, m *nats.Msg) {
+	var w presenceWire
+	if err := json.Unmarshal(m.Data, &w); err != nil {
+		slog.Debug("忽略无法解析的在线状态", "peer", peerID, "error", err)
+		return
+	}
+	if err := verifyPresence(&w, peerID); err != nil {
+		slog.Warn("在线状态签名校验失败", "peer", peerID, "error", err)
+		return
+	}
+	now := time.Now()
+	ts := time.Unix(w.TS, 0)
+	if ts.Before(now.Add(-signalMaxSkew)) || ts.After(now.Add(signalMaxSkew)) {
+		return
+	}
+
+	// 最后在线时间取最近一次收到状态的时间，离线时保持不变
+	p := &Presence{UID: w.UID, Status: w.Status, LastSeen: now}
+	if p.Status != PresenceOffline {
+		p.expiresAt = now.Add(time.Duration(max(w.TTL, 1)) * time.Millisecond)
+	}
+
+	s.presenceMu.Lock()
+	old := s.presence[w.UID]
+	s.presence[w.UID] = p
+	// 好友刚上线时还不知道我们的状态，立即回发一次，不用等下次心跳
+	reply := (old == nil || old.Status == PresenceOffline) && p.Status != PresenceOffline &&
+		s.selfPresence != "" && s.selfPresence != PresenceOffline &&
+		now.Sub(s.lastPresenceSent) > presenceReplyThrottle
+	// 心跳只刷新有效期，状态变化时才推送；解锁后 p 可能被 sweepPresence 替换，在锁内取副本
+	changed := old == nil || old.Status != p.Status
+	out := *p
+	s.presenceMu.Unlock()
+
+	if reply {
+		if err := s.publishPresence(); err != nil {
+			slog.Debug("回发在线状态失败", "error", err)
+		}
+	}
+	if changed {
+		s.dispatchEvent(EventPresence, &out)
+	}
+}
+
+// verifyPresence 确认在线状态由主题对应的用户签名
+func verifyPresence(w *presenceWire, uid string) error {
+	if w.UID != uid {
+		return ErrSenderMismatch
+	}
+	switch w.Status {
+	case PresenceOnline, PresenceAway, PresenceOffline:
+	default:
+		return fmt.Errorf("invalid presence status %q", w.Status)
+	}
+	sig, err := B64Dec(w.Sig)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if err := VerifyNSCSignature(w.SignerKey, w.signingPayload(), sig); err != nil {
+		return ErrBadSignature
+	}
+	chatPub, err := GetChatPubKeyFromNSCPub(w.SignerKey)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if deriveUserIDFromPubKey(chatPub) != uid {
+		return ErrSenderMismatch
+	}
+	return nil
+}
+
+// handleTyping 解密正在输入信号并推送事件
+func (s *Service) handleTyping(subject string, m *nats.Msg) {
+	var w EncWire
+	if err := json.Unmarshal(m.Data, &w); err != nil {
+		return
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	priv := s.userPrivB64
+	s.mu.RUnlock()
+	if w.Sender == self || w.Kind != KindTyping {
+		return
+	}
+	// 信号必须带签名，旧版本载荷不接受
+	if verified, err := verifyWire(&w, subject); err != nil || !verified {
+		slog.Debug("忽略未签名的正在输入信号", "sender", w.Sender, "error", err)
+		return
+	}
+	now := time.Now()
+	ts := time.Unix(w.TS, 0)
+	if ts.Before(now.Add(-signalMaxSkew)) || ts.After(now.Add(signalMaxSkew)) {
+		return
+	}
+
+	isGroup := strings.HasPrefix(subject, "dchat.grp.")
+	var pt []byte
+	var err error
+	if isGroup {
+		pt, err = s.openGroup(&w, now)
+	} else {
+		if w.CID != deriveCID(self, w.Sender) {
+			return
+		}
+		var peerPub string
+		if peerPub, err = s.getFriendKey(w.Sender); err == nil {
+			pt, err = DecryptDirect(priv, peerPub, w.Nonce, w.Cipher)
+		}
+	}
+	if err != nil {
+		slog.Debug("正在输入信号解密失败", "sender", w.Sender, "error", err)
+		return
+	}
+	_, body, err := decodeBody(&w, pt)
+	if err != nil || body.Typing == nil {
+		return
+	}
+
+	key := w.CID + "\n" + w.Sender
+	s.presenceMu.Lock()
+	_, wasTyping := s.typing[key]
+	if body.Typing.Active {
+		s.typing[key] = &TypingUpdate{CID: w.CID, UserID: w.Sender, IsGroup: isGroup, expiresAt: now.Add(typingTTL)}
+	} else {
+		delete(s.typing, key)
+	}
+	s.presenceMu.Unlock()
+
+	// 持续输入时的重发不重复推送
+	if body.Typing.Active && wasTyping {
+		return
+	}
+	if !body.Typing.Active && !wasTyping {
+		return
+	}
+	s.dispatchEvent(EventTyping, &TypingUpdate{CID: w.CID, UserID: w.Sender, IsGroup: isGroup, Active: body.Typing.Active})
+}
+
+// startPresenceLoop 启动后台循环：过期好友状态和正在输入，按间隔重发自己的状态
+func (s *Service) startPresenceLoop() {
+	s.presenceOnce.Do(func() {
+		s.presenceMu.Lock()
+		period := min(presenceSweepInterval, s.presenceInterval/3)
+		s.presenceMu.Unlock()
+		go func() {
+			ticker := time.NewTicker(period)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-ticker.C:
+					s.sweepPresence()
+				}
+			}
+		}()
+	})
+}
+
+// sweepPresence 一次过期检查和心跳
+func (s *Service) sweepPresence() {
+	now := time.Now()
+	var expired []*Presence
+	var stopped []*TypingUpdate
+
+	s.presenceMu.Lock()
+	for uid, p := range s.presence {
+		if p.Status != PresenceOffline && !p.expiresAt.IsZero() && now.After(p.expiresAt) {
+			// 换成新的记录，不修改其他地方可能还拿着的旧记录
+			off := &Presence{UID: p.UID, Status: PresenceOffline, LastSeen: p.LastSeen}
+			s.presence[uid] = off
+			out := *off
+			expired = append(expired, &out)
+		}
+	}
+	for key, t := range s.typing {
+		if now.After(t.expiresAt) {
+			delete(s.typing, key)
+			stopped = append(stopped, &TypingUpdate{CID: t.CID, UserID: t.UserID, IsGroup: t.IsGroup})
+		}
+	}
+	heartbeat := s.selfPresence != "" && s.selfPresence != PresenceOffline &&
+		now.Sub(s.lastPresenceSent) >= s.presenceInterval
+	s.presenceMu.Unlock()
+
+	for _, p := range expired {
+		s.dispatchEvent(EventPresence, p)
+	}
+	for _, t := range stopped {
+		s.dispatchEvent(EventTyping, t)
+	}
+	if heartbeat {
+		if err := s.publishPresence(); err != nil {
+			slog.Debug("发送在线心跳失败", "error", err)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package chat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EncRatchet 私聊载荷使用双棘轮会话加密（EncWire.Enc），为空时是静态 box
+const EncRatchet = "dr"
+
+// 双棘轮会话的限制
+const (
+	maxSkippedKeys = 1000 // 最多缓存的跳过消息密钥，防止恶意的大序号耗尽内存
+	maxPrevChains  = 16   // 记住的旧接收链数量，用于识别重放
+)
+
+// 双棘轮解密失败的原因
+var (
+	ErrNoRatchetSession = errors.New("ratchet session not found")
+	errRatchetReplay    = errors.New("ratchet message already processed")
+)
+
+// RatchetHeader 双棘轮消息头，明文放在 EncWire.Ratchet 里并参与签名
+type RatchetHeader struct {
+	SID  string       `json:"sid"`            // 会话ID，由发起方的临时公钥派生
+	DH   string       `json:"dh"`             // 发送方当前的棘轮公钥（base64）
+	PN   uint32       `json:"pn"`             // 上一条发送链的消息数
+	N    uint32       `json:"n"`              // 本条在发送链中的序号
+	Init *RatchetInit `json:"init,omitempty"` // 发起方在收到回复前每条都带上，供对方建立会话
+}
+
+// RatchetInit X3DH 握手参数
+type RatchetInit struct {
+	EK        string `json:"ek"`            // 发起方临时公钥（base64）
+	PrekeyID  uint32 `json:"pkid"`          // 使用的对方预密钥ID
+	OneTimeID uint32 `json:"otk,omitempty"` // 从 KV 领取的对方一次性预密钥ID，0 表示没有
+}
+
+// PrekeyAdvert 在静态 box 加密的私聊消息体里告知对方自己的预密钥，表示支持双棘轮
+type PrekeyAdvert struct {
+	ID  uint32 `json:"id"`
+	Pub string `json:"pub"` // X25519 公钥（base64）
+}
+
+// String 签名原文里使用的消息头表示，nil 为空串
+func (h *RatchetHeader) String() string {
+	if h == nil {
+		return ""
+	}
+	fields := []string{h.SID, h.DH, strconv.FormatUint(uint64(h.PN), 10), strconv.FormatUint(uint64(h.N), 10)}
+	if h.Init != nil {
+		fields = append(fields, h.Init.EK, strconv.FormatUint(uint64(h.Init.PrekeyID), 10))
+		if h.Init.OneTimeID != 0 {
+			fields = append(fields, strconv.FormatUint(uint64(h.Init.OneTimeID), 10))
+		}
+	}
+	return strings.Join(fields, ":")
+}
+
+// ratchetState 一个双棘轮会话的全部状态，序列化后保存在 ratchet_sessions 表
+type ratchetState struct {
+	SID       string            `json:"sid"`
+	RK        []byte            `json:"rk"`
+	DHsPriv   []byte            `json:"dhs_priv"`
+	DHsPub    []byte            `json:"dhs_pub"`
+	DHr       []byte            `json:"dhr,omitempty"`
+	CKs       []byte            `json:"cks,omitempty"`
+	CKr       []byte            `json:"ckr,omitempty"`
+	Ns        uint32            `json:"ns"`
+	Nr        uint32            `json:"nr"`
+	PN        uint32            `json:"pn"`
+	Skipped   map[string][]byte `json:"skipped,omitempty"` // "dh:n" -> 消息密钥
+	PrevDHr   []string          `json:"prev_dhr,omitempty"`
+	Init      *RatchetInit      `json:"init,omitempty"` // 发起方未收到回复前保留
+	Confirmed bool              `json:"confirmed"`      // 已经收到过对方在本会话的消息
+	LastRecv  int64             `json:"last_recv"`      // 最后收到的消息的发送时间（秒）
+}
+
+// newX25519 生成一对 X25519 密钥
+func newX25519() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// dh 计算 X25519 共享密钥
+func dh(priv, pub []byte) ([]byte, error) {
+	return curve25519.X25519(priv, pub)
+}
+
+// ratchetSessionID 由发起方临时公钥派生会话ID
+func ratchetSessionID(ek []byte) string {
+	h := sha256.Sum256(ek)
+	return hex.EncodeToString(h[:])[:16]
+}
+
+// x3dhSecret 把三次（带一次性预密钥时四次）DH 的结果派生成初始根密钥
+func x3dhSecret(dh1, dh2, dh3, dh4 []byte) ([]byte, error) {
+	ikm := make([]byte, 0, 32*5)
+	ikm = append(ikm, slices.Repeat([]byte{0xFF}, 32)...)
+	ikm = append(ikm, dh1...)
+	ikm = append(ikm, dh2...)
+	ikm = append(ikm, dh3...)
+	ikm = append(ikm, dh4...)
+	sk := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, make([]byte, 32), []byte("dchat-x3dh")), sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// x3dhInitiate 发起方：用自己的身份私钥和对方的身份公钥、预密钥建立会话，oneTime 为 nil 时不使用一次性预密钥
+func x3dhInitiate(selfIdentityPriv, peerIdentityPub, peerPrekeyPub []byte, prekeyID uint32, oneTime *PrekeyAdvert) (*ratchetState, error) {
+	ekPriv, ekPub, err := newX25519()
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := dh(selfIdentityPriv, peerPrekeyPub)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(ekPriv, peerIdentityPub)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(ekPriv, peerPrekeyPub)
+	if err != nil {
+		return nil, err
+	}
+	init := &RatchetInit{EK: B64(ekPub), PrekeyID: prekeyID}
+	var dh4 []byte
+	if oneTime != nil {
+		otkPub, err := B64Dec(oneTime.Pub)
+		if err != nil || len(otkPub) != curve25519.PointSize {
+			return nil, errors.New("invalid one-time prekey")
+		}
+		if dh4, err = dh(ekPriv, otkPub); err != nil {
+			return nil, err
+		}
+		init.OneTimeID = oneTime.ID
+	}
+	sk, err := x3dhSecret(dh1, dh2, dh3, dh4)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &ratchetState{
+		SID:  ratchetSessionID(ekPub),
+		DHr:  peerPrekeyPub,
+		Init: init,
+	}
+	if st.DHsPriv, st.DHsPub, err = newX25519(); err != nil {
+		return nil, err
+	}
+	shared, err := dh(st.DHsPriv, st.DHr)
+	if err != nil {
+		return nil, err
+	}
+	st.RK, st.CKs = kdfRoot(sk, shared)
+	return st, nil
+}
+
+// x3dhRespond 接收方：用自己的身份私钥、预密钥（和发起方领取的一次性预密钥）与发起方的临时公钥建立会话
+func x3dhRespond(selfIdentityPriv, prekeyPriv, prekeyPub, oneTimePriv, peerIdentityPub []byte, init *RatchetInit) (*ratchetState, error) {
+	ek, err := B64Dec(init.EK)
+	if err != nil || len(ek) != curve25519.PointSize {
+		return nil, errors.New("invalid ratchet ephemeral key")
+	}
+	dh1, err := dh(prekeyPriv, peerIdentityPub)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(selfIdentityPriv, ek)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(prekeyPriv, ek)
+	if err != nil {
+		return nil, err
+	}
+	var dh4 []byte
+	if oneTimePriv != nil {
+		if dh4, err = dh(oneTimePriv, ek); err != nil {
+			return nil, err
+		}
+	}
+	sk, err := x3dhSecret(dh1, dh2, dh3, dh4)
+	if err != nil {
+		return nil, err
+	}
+	// 接收方的第一把棘轮密钥就是预密钥，收到第一条消息时完成第一次 DH 棘轮
+	return &ratchetState{
+		SID:     ratchetSessionID(ek),
+		RK:      sk,
+		DHsPriv: slices.Clone(prekeyPriv),
+		DHsPub:  slices.Clone(prekeyPub),
+	}, nil
+}
+
+// kdfRoot 根链：RK, DH 输出 -> 新 RK 和链密钥
+func kdfRoot(rk, dhOut []byte) (newRK, ck []byte) {
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rk, []byte("dchat-ratchet")), out); err != nil {
+		panic(err) // 64 字节远小于 HKDF 上限，不会失败
+	}
+	return out[:32], out[32:]
+}
+
+// kdfChain 对称链：链密钥 -> 下一个链密钥和消息密钥
+func kdfChain(ck []byte) (nextCK, mk []byte) {
+	m := hmac.New(sha256.New, ck)
+	m.Write([]byte{0x01})
+	mk = m.Sum(nil)
+	m = hmac.New(sha256.New, ck)
+	m.Write([]byte{0x02})
+	return m.Sum(nil), mk
+}
+
+// clone 深拷贝状态，解密在副本上进行，失败时原状态不变
+func (st *ratchetState) clone() *ratchetState {
+	c := *st
+	c.RK = slices.Clone(st.RK)
+	c.DHsPriv = slices.Clone(st.DHsPriv)
+	c.DHsPub = slices.Clone(st.DHsPub)
+	c.DHr = slices.Clone(st.DHr)
+	c.CKs = slices.Clone(st.CKs)
+	c.CKr = slices.Clone(st.CKr)
+	c.PrevDHr = slices.Clone(st.PrevDHr)
+	if st.Init != nil {
+		init := *st.Init
+		c.Init = &init
+	}
+	c.Skipped = make(map[string][]byte, len(st.Skipped))
+	for k, v := range st.Skipped {
+		c.Skipped[k] = v
+	}
+	return &c
+}
+
+// encrypt 用发送链的下一个消息密钥加密，ad 是需要一起认证的附加数据
+func (st *ratchetState) encrypt(plain, ad []byte) (*RatchetHeader, string, string, error) {
+	if st.CKs == nil {
+		return nil, "", "", errors.New("ratchet session cannot send yet")
+	}
+	var mk []byte
+	st.CKs, mk = kdfChain(st.CKs)
+	hdr := &RatchetHeader{SID: st.SID, DH: B64(st.DHsPub), PN: st.PN, N: st.Ns, Init: st.Init}
+	st.Ns++
+
+	nonce, sealed, err := sealRatchet(mk, plain, ratchetAD(ad, hdr))
+	if err != nil {
+		return nil, "", "", err
+	}
+	return hdr, nonce, sealed, nil
+}
+
+// decrypt 按消息头推进接收链并解密，必要时执行 DH 棘轮
+func (st *ratchetState) decrypt(hdr *RatchetHeader, nonce, sealed string, ad []byte) ([]byte, error) {
+	ad = ratchetAD(ad, hdr)
+	key := skippedKey(hdr.DH, hdr.N)
+	if mk, ok := st.Skipped[key]; ok {
+		pt, err := openRatchet(mk, nonce, sealed, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(st.Skipped, key)
+		st.Confirmed = true
+		st.Init = nil
+		return pt, nil
+	}
+
+	dhPub, err := B64Dec(hdr.DH)
+	if err != nil || len(dhPub) != curve25519.PointSize {
+		return nil, errors.New("invalid ratchet header")
+	}
+	current := st.DHr != nil && hmac.Equal(dhPub, st.DHr)
+	if (current && hdr.N < st.Nr) || slices.Contains(st.PrevDHr, hdr.DH) {
+		return nil, errRatchetReplay
+	}
+
+	if !current {
+		if err := st.skipUntil(hdr.PN); err != nil {
+			return nil, err
+		}
+		if err := st.dhRatchet(dhPub); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.skipUntil(hdr.N); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	st.CKr, mk = kdfChain(st.CKr)
+	st.Nr++
+
+	pt, err := openRatchet(mk, nonce, sealed, ad)
+	if err != nil {
+		return nil, err
+	}
+	st.Confirmed = true
+	st.Init = nil
+	return pt, nil
+}
+
+// skipUntil 为接收链上 until 之前还没收到的消息缓存密钥，乱序到达时使用
+func (st *ratchetState) skipUntil(until uint32) error {
+	if st.CKr == nil {
+		return nil
+	}
+	if until > st.Nr && int(until-st.Nr)+len(st.Skipped) > maxSkippedKeys {
+		return fmt.Errorf("too many skipped ratchet messages: %d", until-st.Nr)
+	}
+	dhr := B64(st.DHr)
+	for st.Nr < until {
+		var mk []byte
+		st.CKr, mk = kdfChain(st.CKr)
+		if st.Skipped == nil {
+			st.Skipped = make(map[string][]byte)
+		}
+		st.Skipped[skippedKey(dhr, st.Nr)] = mk
+		st.Nr++
+	}
+	return nil
+}
+
+// dhRatchet 对方换了棘轮公钥：推进根链，生成新的接收链和发送链
+func (st *ratchetState) dhRatchet(dhPub []byte) error {
+	if st.DHr != nil {
+		st.PrevDHr = append(st.PrevDHr, B64(st.DHr))
+		if len(st.PrevDHr) > maxPrevChains {
+			st.PrevDHr = st.PrevDHr[len(st.PrevDHr)-maxPrevChains:]
+		}
+	}
+	st.PN = st.Ns
+	st.Ns, st.Nr = 0, 0
+	st.DHr = dhPub
+
+	shared, err := dh(st.DHsPriv, st.DHr)
+	if err != nil {
+		return err
+	}
+	st.RK, st.CKr = kdfRoot(st.RK, shared)
+	if st.DHsPriv, st.DHsPub, err = newX25519(); err != nil {
+		return err
+	}
+	if shared, err = dh(st.DHsPriv, st.DHr); err != nil {
+		return err
+	}
+	st.RK, st.CKs = kdfRoot(st.RK, shared)
+	return nil
+}
+
+func skippedKey(dhB64 string, n uint32) string {
+	return dhB64 + ":" + strconv.FormatUint(uint64(n), 10)
+}
+
+// ratchetAD 附加数据：调用方提供的上下文加上消息头
+func ratchetAD(ad []byte, hdr *RatchetHeader) []byte {
+	out := slices.Clone(ad)
+	out = append(out, '\n')
+	return append(out, hdr.String()...)
+}
+
+// sealRatchet 用消息密钥做 AES-256-GCM 加密
+func sealRatchet(mk, plain, ad []byte) (nonceB64, cipherB64 string, err error) {
+	block, err := aes.NewCipher(mk)
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+	return B64(nonce), B64(gcm.Seal(nil, nonce, plain, ad)), nil
+}
+
+// openRatchet 解密 sealRatchet 的输出
+func openRatchet(mk []byte, nonceB64, cipherB64 string, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := B64Dec(nonceB64)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid ratchet nonce")
+	}
+	sealed, err := B64Dec(cipherB64)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := gcm.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, fmt.Errorf("ratchet decrypt failed: %w", err)
+	}
+	return pt, nil
+}
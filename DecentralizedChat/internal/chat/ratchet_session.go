@@ -0,0 +1,361 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+// SetForwardSecrecy 开关私聊的双棘轮会话（默认开启）。
+// 关闭后新消息只用静态 box 加密，也不再告知对方预密钥；已有会话仍然用于解密
+func (s *Service) SetForwardSecrecy(enabled bool) {
+	s.mu.Lock()
+	s.ratchetDisabled = !enabled
+	s.mu.Unlock()
+}
+
+// ratchetEnabled 双棘轮会话需要本地存储保存状态
+func (s *Service) ratchetEnabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.storage != nil && !s.ratchetDisabled
+}
+
+// ownPrekey 返回自己的预密钥，第一次使用时生成
+func (s *Service) ownPrekey() (*storage.RatchetPrekey, error) {
+	s.mu.RLock()
+	pk := s.prekey
+	s.mu.RUnlock()
+	if pk != nil {
+		return pk, nil
+	}
+
+	pk, err := s.storage.GetLatestRatchetPrekey()
+	if err != nil {
+		return nil, fmt.Errorf("load prekey: %w", err)
+	}
+	if pk == nil {
+		priv, pub, err := newX25519()
+		if err != nil {
+			return nil, fmt.Errorf("generate prekey: %w", err)
+		}
+		pk = &storage.RatchetPrekey{ID: 1, PrivKey: B64(priv), PubKey: B64(pub), CreatedAt: time.Now()}
+		if err := s.storage.SaveRatchetPrekey(pk); err != nil {
+			return nil, fmt.Errorf("save prekey: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	if s.prekey == nil {
+		s.prekey = pk
+	}
+	pk = s.prekey
+	s.mu.Unlock()
+	return pk, nil
+}
+
+// prekeyAdvert 静态 box 消息里附带的预密钥，未开启双棘轮时为 nil
+func (s *Service) prekeyAdvert() *PrekeyAdvert {
+	if !s.ratchetEnabled() {
+		return nil
+	}
+	pk, err := s.ownPrekey()
+	if err != nil {
+		slog.Warn("获取预密钥失败，本条消息不告知预密钥", "error", err)
+		return nil
+	}
+	return &PrekeyAdvert{ID: pk.ID, Pub: pk.PubKey}
+}
+
+// rememberPeerPrekey 保存好友告知的预密钥，下次发消息时据此建立双棘轮会话。sentAt 是携带它的消息的发送时间
+func (s *Service) rememberPeerPrekey(peerID string, adv *PrekeyAdvert, sentAt int64) error {
+	if s.storage == nil || adv.Pub == "" {
+		return nil
+	}
+	if raw, err := B64Dec(adv.Pub); err != nil || len(raw) != 32 {
+		return errors.New("invalid prekey advert")
+	}
+
+	s.ratchetMu.Lock()
+	defer s.ratchetMu.Unlock()
+
+	// 对方在会话里给我们发过消息之后又改用静态 box，说明对方丢失了会话状态，需要重新握手
+	sessions, err := s.loadRatchetSessions(peerID)
+	if err != nil {
+		return err
+	}
+	for _, st := range sessions {
+		if st.Confirmed && sentAt > st.LastRecv {
+			slog.Info("好友的双棘轮会话已失效，重新握手", "peer", peerID)
+			if err := s.storage.DeleteRatchetSessions(peerID); err != nil {
+				return fmt.Errorf("delete ratchet sessions: %w", err)
+			}
+			delete(s.ratchetSessions, peerID)
+			break
+		}
+	}
+
+	old, err := s.storage.GetPeerPrekey(peerID)
+	if err != nil {
+		return fmt.Errorf("load peer prekey: %w", err)
+	}
+	if old != nil && old.PrekeyID == adv.ID && old.PubKey == adv.Pub {
+		return nil
+	}
+	return s.storage.SavePeerPrekey(&storage.PeerPrekey{
+		PeerID:    peerID,
+		PrekeyID:  adv.ID,
+		PubKey:    adv.Pub,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// loadRatchetSessions 读取和好友的双棘轮会话，调用方需持有 ratchetMu
+func (s *Service) loadRatchetSessions(peerID string) (map[string]*ratchetState, error) {
+	if sessions, ok := s.ratchetSessions[peerID]; ok {
+		return sessions, nil
+	}
+	stored, err := s.storage.GetRatchetSessions(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("load ratchet sessions: %w", err)
+	}
+	sessions := make(map[string]*ratchetState, len(stored))
+	for _, sess := range stored {
+		st := &ratchetState{}
+		if err := json.Unmarshal([]byte(sess.State), st); err != nil {
+			slog.Warn("跳过无法解析的双棘轮会话", "peer", peerID, "sid", sess.SessionID, "error", err)
+			continue
+		}
+		sessions[sess.SessionID] = st
+	}
+	s.ratchetSessions[peerID] = sessions
+	return sessions, nil
+}
+
+// storeRatchetSession 更新会话缓存并持久化，调用方需持有 ratchetMu
+func (s *Service) storeRatchetSession(peerID string, st *ratchetState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal ratchet session: %w", err)
+	}
+	now := time.Now()
+	if err := s.storage.SaveRatchetSession(&storage.RatchetSession{
+		PeerID:    peerID,
+		SessionID: st.SID,
+		State:     string(data),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}); err != nil {
+		return fmt.Errorf("save ratchet session: %w", err)
+	}
+	s.ratchetSessions[peerID][st.SID] = st
+	return nil
+}
+
+// sendingSession 选择发送用的会话：双方同时发起握手时都会选 SID 最小的，最终收敛到同一个会话
+func sendingSession(sessions map[string]*ratchetState) *ratchetState {
+	var best *ratchetState
+	for _, st := range sessions {
+		if st.CKs == nil {
+			continue
+		}
+		if best == nil || st.SID < best.SID {
+			best = st
+		}
+	}
+	return best
+}
+
+// ratchetContext 双棘轮加密的附加认证数据
+func ratchetContext(w *EncWire) []byte {
+	return []byte("dchat-dr\n" + w.CID + "\n" + w.Sender)
+}
+
+// identityKeys 解码自己的身份私钥和好友的身份公钥
+func (s *Service) identityKeys(peerID string) (selfPriv, peerPub []byte, err error) {
+	s.mu.RLock()
+	privB64 := s.userPrivB64
+	s.mu.RUnlock()
+	if privB64 == "" {
+		return nil, nil, errors.New("local priv key empty")
+	}
+	peerPubB64, err := s.getFriendKey(peerID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("friend pub key not available: %w", err)
+	}
+	if selfPriv, err = B64Dec(privB64); err != nil {
+		return nil, nil, fmt.Errorf("decode priv: %w", err)
+	}
+	if peerPub, err = B64Dec(peerPubB64); err != nil {
+		return nil, nil, fmt.Errorf("decode friend pub: %w", err)
+	}
+	return selfPriv, peerPub, nil
+}
+
+// encryptRatchet 用双棘轮会话加密私聊消息并填写载荷。
+// 没有会话时用对方告知过的预密钥或 KV 里的预密钥包发起握手，都没有时返回 false，调用方改用静态 box
+func (s *Service) encryptRatchet(peerID string, wire *EncWire, plain []byte) (bool, error) {
+	if !s.ratchetEnabled() {
+		return false, nil
+	}
+
+	s.ratchetMu.Lock()
+	defer s.ratchetMu.Unlock()
+
+	sessions, err := s.loadRatchetSessions(peerID)
+	if err != nil {
+		return false, err
+	}
+	st := sendingSession(sessions)
+	if st == nil {
+		peerPrekey, err := s.storage.GetPeerPrekey(peerID)
+		if err != nil {
+			return false, fmt.Errorf("load peer prekey: %w", err)
+		}
+		var oneTime *PrekeyAdvert
+		if peerPrekey == nil {
+			bundle := s.lookupPrekeyBundle(peerID)
+			if bundle == nil {
+				return false, nil
+			}
+			peerPrekey = &storage.PeerPrekey{PeerID: peerID, PrekeyID: bundle.SignedPrekey.ID, PubKey: bundle.SignedPrekey.Pub}
+			oneTime = bundle.OneTimePrekey
+		}
+		selfPriv, peerPub, err := s.identityKeys(peerID)
+		if err != nil {
+			return false, err
+		}
+		prekeyPub, err := B64Dec(peerPrekey.PubKey)
+		if err != nil {
+			return false, fmt.Errorf("decode peer prekey: %w", err)
+		}
+		if st, err = x3dhInitiate(selfPriv, peerPub, prekeyPub, peerPrekey.PrekeyID, oneTime); err != nil {
+			return false, fmt.Errorf("start ratchet session: %w", err)
+		}
+		slog.Info("发起双棘轮会话", "peer", peerID, "sid", st.SID)
+	}
+
+	next := st.clone()
+	hdr, nonce, sealed, err := next.encrypt(plain, ratchetContext(wire))
+	if err != nil {
+		return false, err
+	}
+	if err := s.storeRatchetSession(peerID, next); err != nil {
+		return false, err
+	}
+
+	wire.Enc = EncRatchet
+	wire.Ratchet = hdr
+	wire.Nonce = nonce
+	wire.Cipher = sealed
+	return true, nil
+}
+
+// decryptRatchet 用双棘轮会话解密好友发来的私聊消息，带握手参数的第一条消息会建立会话
+func (s *Service) decryptRatchet(w *EncWire) ([]byte, error) {
+	hdr := w.Ratchet
+	if hdr == nil || hdr.SID == "" {
+		return nil, errors.New("ratchet message without header")
+	}
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+
+	s.ratchetMu.Lock()
+	defer s.ratchetMu.Unlock()
+
+	sessions, err := s.loadRatchetSessions(w.Sender)
+	if err != nil {
+		return nil, err
+	}
+	st := sessions[hdr.SID]
+	var usedOneTime uint32
+	if st == nil {
+		if hdr.Init == nil {
+			return nil, fmt.Errorf("%w: %s from %s", ErrNoRatchetSession, hdr.SID, w.Sender)
+		}
+		prekey, err := s.storage.GetRatchetPrekey(hdr.Init.PrekeyID)
+		if err != nil {
+			return nil, fmt.Errorf("load prekey: %w", err)
+		}
+		if prekey == nil {
+			return nil, fmt.Errorf("%w: unknown prekey %d", ErrNoRatchetSession, hdr.Init.PrekeyID)
+		}
+		selfPriv, peerPub, err := s.identityKeys(w.Sender)
+		if err != nil {
+			return nil, err
+		}
+		prekeyPriv, err := B64Dec(prekey.PrivKey)
+		if err != nil {
+			return nil, fmt.Errorf("decode prekey: %w", err)
+		}
+		prekeyPub, err := B64Dec(prekey.PubKey)
+		if err != nil {
+			return nil, fmt.Errorf("decode prekey: %w", err)
+		}
+		var oneTimePriv []byte
+		if id := hdr.Init.OneTimeID; id != 0 {
+			otk, err := s.storage.GetOneTimePrekey(id)
+			if err != nil {
+				return nil, fmt.Errorf("load one-time prekey: %w", err)
+			}
+			if otk == nil {
+				return nil, fmt.Errorf("%w: unknown one-time prekey %d", ErrNoRatchetSession, id)
+			}
+			if oneTimePriv, err = B64Dec(otk.PrivKey); err != nil {
+				return nil, fmt.Errorf("decode one-time prekey: %w", err)
+			}
+			usedOneTime = id
+		}
+		if st, err = x3dhRespond(selfPriv, prekeyPriv, prekeyPub, oneTimePriv, peerPub, hdr.Init); err != nil {
+			return nil, fmt.Errorf("accept ratchet session: %w", err)
+		}
+		if st.SID != hdr.SID {
+			return nil, errors.New("ratchet session id mismatch")
+		}
+		slog.Info("接受双棘轮会话", "peer", w.Sender, "sid", st.SID)
+	}
+
+	next := st.clone()
+	pt, err := next.decrypt(hdr, w.Nonce, w.Cipher, ratchetContext(w))
+	if err != nil {
+		return nil, err
+	}
+	next.LastRecv = max(next.LastRecv, w.TS)
+	if err := s.storeRatchetSession(w.Sender, next); err != nil {
+		return nil, err
+	}
+	// 一次性预密钥建立会话后即删除，之后无法再用它解出握手
+	if usedOneTime != 0 {
+		if err := s.storage.DeleteOneTimePrekey(usedOneTime); err != nil {
+			slog.Warn("删除一次性预密钥失败", "id", usedOneTime, "error", err)
+		}
+	}
+	return pt, nil
+}
+
+// rememberRatchetEcho 缓存自己发出的双棘轮消息明文：发送链的密钥用后即弃，自己的回显无法解密
+func (s *Service) rememberRatchetEcho(nonce string, plain []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ratchetEcho) >= maxDispatchedCache {
+		s.ratchetEcho = make(map[string][]byte)
+	}
+	s.ratchetEcho[nonce] = plain
+}
+
+// ratchetEchoPlain 取出自己消息回显的明文，缓存里没有时按重复消息忽略
+func (s *Service) ratchetEchoPlain(w *EncWire) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plain, ok := s.ratchetEcho[w.Nonce]
+	if !ok {
+		return nil, errRatchetReplay
+	}
+	delete(s.ratchetEcho, w.Nonce)
+	return plain, nil
+}
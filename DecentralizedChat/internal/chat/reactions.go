@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"DecentralizedChat/internal/storage"
+)
+
+const maxEmojiLen = 32 // 单个表情的最大字节数（组合表情由多个码点组成）
+
+// ReactionBody kind=reaction 消息体，被回应的消息ID放在 MessageBody.Ref，操作ID放在 MessageBody.ID
+type ReactionBody struct {
+	Emoji  string `json:"emoji"`
+	Remove bool   `json:"remove,omitempty"` // true 表示取消回应
+}
+
+// ReactionUpdate 表情回应变化，随 EventReaction 推送
+type ReactionUpdate struct {
+	CID       string `json:"cid"`
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Emoji     string `json:"emoji"`
+	Active    bool   `json:"active"` // false 表示取消回应
+}
+
+// React 对一条消息添加表情回应，重复回应同一个表情不会重复计数
+func (s *Service) React(msgID, emoji string) error {
+	return s.sendReaction(msgID, emoji, false)
+}
+
+// Unreact 取消自己对一条消息的表情回应
+func (s *Service) Unreact(msgID, emoji string) error {
+	return s.sendReaction(msgID, emoji, true)
+}
+
+// GetReactions 获取一条消息当前的表情回应
+func (s *Service) GetReactions(msgID string) ([]*storage.Reaction, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetReactions(msgID)
+}
+
+func (s *Service) sendReaction(msgID, emoji string, remove bool) error {
+	if msgID == "" || !validEmoji(emoji) {
+		return errors.New("msgID empty or invalid emoji")
+	}
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	msg, err := s.storage.GetMessage(msgID)
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if msg == nil {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, msgID)
+	}
+	if msg.Deleted {
+		return fmt.Errorf("message %s already deleted", msgID)
+	}
+
+	now := time.Now()
+	opID := newMessageID()
+	body := &MessageBody{ID: opID, Ref: msgID, Reaction: &ReactionBody{Emoji: emoji, Remove: remove}}
+	wire, _, _, err := s.sendBody(msg.ConversationID, KindReaction, body, now)
+	if err != nil {
+		return err
+	}
+	return s.applyReaction(msg.ConversationID, msgID, wire.Sender, opID, body.Reaction, now)
+}
+
+// handleReaction 处理收到的表情回应；实时订阅和离线同步重复送达时按操作ID去重
+func (s *Service) handleReaction(in *inboundMessage) error {
+	r := in.body.Reaction
+	if r == nil || in.body.Ref == "" {
+		return errors.New("reaction message without payload")
+	}
+	if s.storage == nil {
+		return nil
+	}
+	// 回应者身份来自 wire.Sender，只接受签名校验过的
+	if !in.verified {
+		slog.Warn("忽略未签名的表情回应", "sender", in.wire.Sender, "ref", in.body.Ref)
+		return nil
+	}
+	if !validEmoji(r.Emoji) || !validMessageID(in.body.ID) {
+		slog.Debug("忽略无效的表情回应", "sender", in.wire.Sender, "ref", in.body.Ref)
+		return nil
+	}
+	msg, err := s.storage.GetMessage(in.body.Ref)
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if msg == nil || msg.Deleted || msg.ConversationID != in.wire.CID {
+		return nil
+	}
+	return s.applyReaction(msg.ConversationID, msg.ID, in.wire.Sender, in.body.ID, r, time.Unix(in.wire.TS, 0))
+}
+
+// applyReaction 保存回应操作，可见状态变化时推送事件
+func (s *Service) applyReaction(cid, msgID, userID, opID string, r *ReactionBody, at time.Time) error {
+	changed, err := s.storage.SaveReaction(&storage.Reaction{
+		MessageID: msgID,
+		UserID:    userID,
+		Emoji:     r.Emoji,
+		Removed:   r.Remove,
+		OpID:      opID,
+		UpdatedAt: at,
+	})
+	if err != nil {
+		return fmt.Errorf("save reaction: %w", err)
+	}
+	if changed {
+		s.dispatchEvent(EventReaction, &ReactionUpdate{
+			CID: cid, MessageID: msgID, UserID: userID, Emoji: r.Emoji, Active: !r.Remove,
+		})
+	}
+	return nil
+}
+
+// validEmoji 表情非空、长度有限、不含控制字符
+func validEmoji(e string) bool {
+	if e == "" || len(e) > maxEmojiLen || !utf8.ValidString(e) {
+		return false
+	}
+	for _, r := range e {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
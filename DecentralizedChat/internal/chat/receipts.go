@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DecentralizedChat/internal/storage"
+)
+
+const (
+	receiptBatchDelay = 300 * time.Millisecond // 送达回执攒一小段时间再发，同一会话合并成一条
+	maxReceiptIDs     = 200                    // 每条回执最多引用的消息数
+)
+
+// Receipt kind=receipt 消息体：对一批消息的送达或已读回执
+type Receipt struct {
+	State string   `json:"state"` // storage.DeliveryDelivered / storage.DeliveryRead
+	IDs   []string `json:"ids"`   // 被回执的消息ID（发送方生成的ID）
+}
+
+// ReceiptUpdate 自己发出的消息收到回执，随 EventMessageReceipt 推送
+type ReceiptUpdate struct {
+	CID       string `json:"cid"`
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`  // 发回执的接收者
+	State     string `json:"state"`    // 该接收者的状态
+	Delivery  string `json:"delivery"` // 按全部接收者汇总后的送达状态
+}
+
+// GetMessageReceipts 获取自己发出的消息的逐人回执（群聊里显示谁已读）
+func (s *Service) GetMessageReceipts(msgID string) ([]*storage.MessageReceipt, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetMessageReceipts(msgID)
+}
+
+// queueDeliveryReceipt 新收到别人的消息后排队发送送达回执
+func (s *Service) queueDeliveryReceipt(in *inboundMessage, msgID string) {
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	if in.wire.Sender == self {
+		return
+	}
+
+	cid := in.wire.CID
+	s.receiptMu.Lock()
+	defer s.receiptMu.Unlock()
+	pending, scheduled := s.pendingReceipts[cid]
+	s.pendingReceipts[cid] = append(pending, msgID)
+	if !scheduled {
+		time.AfterFunc(receiptBatchDelay, func() { s.flushDeliveryReceipts(cid) })
+	}
+}
+
+// flushDeliveryReceipts 把会话里排队的送达回执合并发送
+func (s *Service) flushDeliveryReceipts(cid string) {
+	s.receiptMu.Lock()
+	ids := s.pendingReceipts[cid]
+	delete(s.pendingReceipts, cid)
+	s.receiptMu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return
+	}
+	if err := s.sendReceipt(cid, storage.DeliveryDelivered, ids); err != nil {
+		slog.Warn("发送送达回执失败", "cid", cid, "error", err)
+	}
+}
+
+// sendReceipt 向私聊或群聊发送回执，消息较多时拆成多条
+func (s *Service) sendReceipt(cid, state string, ids []string) error {
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), maxReceiptIDs)]
+		ids = ids[len(batch):]
+		body := &MessageBody{Receipt: &Receipt{State: state, IDs: batch}}
+		if _, _, _, err := s.sendBody(cid, KindReceipt, body, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleReceipt 处理别人对自己消息的回执，更新送达状态并通知UI
+func (s *Service) handleReceipt(in *inboundMessage) error {
+	r := in.body.Receipt
+	if r == nil {
+		return errors.New("receipt message without payload")
+	}
+	if s.storage == nil {
+		return nil
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	// 回执只接受签名校验过的，自己的回显忽略
+	if in.wire.Sender == self || !in.verified {
+		return nil
+	}
+	if r.State != storage.DeliveryDelivered && r.State != storage.DeliveryRead {
+		slog.Debug("忽略未知的回执状态", "state", r.State, "sender", in.wire.Sender)
+		return nil
+	}
+	if len(r.IDs) > maxReceiptIDs {
+		r.IDs = r.IDs[:maxReceiptIDs]
+	}
+
+	now := time.Now()
+	for _, id := range r.IDs {
+		msg, err := s.storage.GetMessage(id)
+		if err != nil {
+			return fmt.Errorf("load message: %w", err)
+		}
+		// 只处理自己在这个会话里发出的消息
+		if msg == nil || msg.SenderID != self || msg.ConversationID != in.wire.CID {
+			continue
+		}
+		changed, err := s.storage.SaveMessageReceipt(&storage.MessageReceipt{
+			MessageID: id,
+			UserID:    in.wire.Sender,
+			State:     r.State,
+			UpdatedAt: now,
+		})
+		if err != nil {
+			return fmt.Errorf("save receipt: %w", err)
+		}
+		if !changed {
+			continue
+		}
+		delivery, err := s.aggregateDelivery(msg, in.wire.Sender)
+		if err != nil {
+			return err
+		}
+		if delivery != msg.DeliveryState {
+			if err := s.storage.SetDeliveryState(id, delivery, now); err != nil {
+				return fmt.Errorf("save delivery state: %w", err)
+			}
+		}
+		s.dispatchEvent(EventMessageReceipt, &ReceiptUpdate{
+			CID:       msg.ConversationID,
+			MessageID: id,
+			UserID:    in.wire.Sender,
+			State:     r.State,
+			Delivery:  delivery,
+		})
+	}
+	return nil
+}
+
+// aggregateDelivery 汇总消息的送达状态：全部接收者都已读才算 read，都已送达才算 delivered。
+// 私聊的接收者就是对方；群聊按本地成员名单，没有名单时按已收到的回执中最低的状态
+func (s *Service) aggregateDelivery(msg *storage.StoredMessage, peerID string) (string, error) {
+	receipts, err := s.storage.GetMessageReceipts(msg.ID)
+	if err != nil {
+		return "", fmt.Errorf("load receipts: %w", err)
+	}
+	states := make(map[string]string, len(receipts))
+	for _, r := range receipts {
+		states[r.UserID] = r.State
+	}
+
+	recipients := []string{peerID}
+	if msg.IsGroup {
+		members, err := s.storage.GetGroupMembers(msg.ConversationID)
+		if err != nil {
+			return "", fmt.Errorf("load group members: %w", err)
+		}
+		recipients = recipients[:0]
+		for _, m := range members {
+			if m.UserID != msg.SenderID {
+				recipients = append(recipients, m.UserID)
+			}
+		}
+		if len(recipients) == 0 {
+			for uid := range states {
+				recipients = append(recipients, uid)
+			}
+		}
+	}
+
+	delivery := storage.DeliveryRead
+	for _, uid := range recipients {
+		switch states[uid] {
+		case storage.DeliveryRead:
+		case storage.DeliveryDelivered:
+			delivery = storage.DeliveryDelivered
+		default:
+			return storage.DeliverySent, nil
+		}
+	}
+	return delivery, nil
+}
@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"DecentralizedChat/internal/storage"
+)
+
+const replySnippetLen = 80 // 引用预览最多显示的字符数
+
+// ReplyPreview 被回复消息的预览，随 DecryptedMessage 推送
+type ReplyPreview struct {
+	ID             string `json:"id"`
+	SenderID       string `json:"sender_id,omitempty"`
+	SenderNickname string `json:"sender_nickname,omitempty"`
+	Snippet        string `json:"snippet,omitempty"`
+	Deleted        bool   `json:"deleted,omitempty"`
+	Missing        bool   `json:"missing,omitempty"` // 本地没有被回复的消息（例如加入群之前发的）
+}
+
+// SendReply 回复一条消息，发送到原消息所在的私聊或群聊
+func (s *Service) SendReply(parentMsgID, content string) error {
+	if parentMsgID == "" || content == "" {
+		return errors.New("parentMsgID/content empty")
+	}
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	parent, err := s.storage.GetMessage(parentMsgID)
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if parent == nil {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, parentMsgID)
+	}
+
+	now := time.Now()
+	msgID := newMessageID()
+	body := &MessageBody{ID: msgID, Text: content, ReplyTo: parentMsgID}
+	wire, isGroup, subj, err := s.sealBody(parent.ConversationID, KindText, body, now)
+	if err != nil {
+		return err
+	}
+	return s.queueOutgoing(msgID, subj, wire, now, content, isGroup, parentMsgID)
+}
+
+// GetThread 获取话题：根消息和全部（多层）回复，按时间正序
+func (s *Service) GetThread(rootMsgID string) ([]*storage.StoredMessage, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetThread(rootMsgID)
+}
+
+// GetThreadUnreadCounts 会话里每个话题的未读回复数，key 为根消息ID
+func (s *Service) GetThreadUnreadCounts(cid string) (map[string]int, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	return s.storage.GetThreadUnreadCounts(cid, self)
+}
+
+// MarkThreadAsRead 把话题里的未读回复标记为已读并发送已读回执，不影响会话里的其他消息
+func (s *Service) MarkThreadAsRead(rootMsgID string) error {
+	if s.storage == nil {
+		return errors.New("storage not initialized")
+	}
+	root, err := s.storage.GetMessage(rootMsgID)
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if root == nil {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, rootMsgID)
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	unread, err := s.storage.GetThreadUnreadIDs(rootMsgID, self)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.MarkMessagesRead(unread); err != nil {
+		return err
+	}
+	if err := s.sendReceipt(root.ConversationID, storage.DeliveryRead, unread); err != nil {
+		slog.Warn("发送已读回执失败", "cid", root.ConversationID, "error", err)
+	}
+	return nil
+}
+
+// replyPreview 生成被回复消息的预览；只引用同一会话里的消息
+func (s *Service) replyPreview(cid, parentID string) *ReplyPreview {
+	p := &ReplyPreview{ID: parentID, Missing: true}
+	if s.storage == nil {
+		return p
+	}
+	parent, err := s.storage.GetMessage(parentID)
+	if err != nil || parent == nil || parent.ConversationID != cid {
+		return p
+	}
+	p.Missing = false
+	p.SenderID = parent.SenderID
+	p.SenderNickname = parent.SenderNickname
+	p.Deleted = parent.Deleted
+	p.Snippet = snippet(parent.Content, replySnippetLen)
+	return p
+}
+
+// snippet 按字符截断，超出时加省略号
+func snippet(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:n]) + "…"
+}
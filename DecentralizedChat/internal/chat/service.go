@@ -28,25 +28,38 @@ type User struct {
 	Nickname string `json:"nickname"`
 }
 
-// EncWire 最小载荷（见 README）：{cid,sender,ts,nonce,cipher,nickname}
+// EncWire 线上载荷（见 README）：{v,kind,cid,sender,ts,kid,enc,rh,nonce,cipher,nickname,spk,sig}
+// v0 载荷没有 v/kind 字段，按纯文本解析
 type EncWire struct {
-	CID      string `json:"cid"`
-	Sender   string `json:"sender"`
-	TS       int64  `json:"ts"`
-	Nonce    string `json:"nonce"`
-	Cipher   string `json:"cipher"`
-	Nickname string `json:"nickname,omitempty"` // 发送者昵称，可选
+	V         int         `json:"v,omitempty"`    // 载荷版本，见 WireVersion
+	Kind      MessageKind `json:"kind,omitempty"` // 消息类型，v0 为空
+	CID       string      `json:"cid"`
+	Sender    string      `json:"sender"`
+	TS        int64       `json:"ts"`
+	KeyID     uint32      `json:"kid,omitempty"` // 群密钥纪元，私聊和纪元0为空
+	Enc       string         `json:"enc,omitempty"` // 私聊加密方式：空为静态 box，EncRatchet 为双棘轮会话
+	Ratchet   *RatchetHeader `json:"rh,omitempty"`  // 双棘轮消息头
+	Nonce     string      `json:"nonce"`
+	Cipher    string      `json:"cipher"`
+	Nickname  string      `json:"nickname,omitempty"` // 发送者昵称，可选
+	SignerKey string      `json:"spk,omitempty"`      // 签名者NSC用户公钥（U开头）
+	Sig       string      `json:"sig,omitempty"`      // Ed25519 签名（base64），见 signingPayload
 }
 
 // DecryptedMessage 统一回调结构
 type DecryptedMessage struct {
-	CID     string    // 会话 cid 或 群 gid
-	Sender  string    // 发送者 uid
-	TS      time.Time // 原始发送秒级时间戳转时间
-	Plain   string    // 解密后明文
-	IsGroup bool      // 是否群聊
-	RawWire EncWire   // 原始载荷
-	Subject string    // 原始 NATS subject
+	CID     string      // 会话 cid 或 群 gid
+	Sender  string      // 发送者 uid
+	TS      time.Time   // 原始发送秒级时间戳转时间
+	Plain   string      // 解密后明文
+	Kind     MessageKind // 消息类型
+	IsGroup  bool        // 是否群聊
+	Verified bool        // 签名已校验（v0 旧载荷没有签名）
+	RawWire  EncWire     // 原始载荷
+	Subject string      // 原始 NATS subject
+	ID         string              // 发送方生成的消息ID，各端相同
+	Attachment *storage.Attachment // kind=file 的附件，用 ID 调用 DownloadAttachment 下载
+	ReplyTo    *ReplyPreview       // 回复的消息及其预览，不是回复时为 nil
 }
 
 // Service 支持私聊/群聊加密收发和本地消息存储
@@ -65,17 +78,55 @@ type Service struct {
 
 	// key caches
 	friendPubKeys map[string]string // uid -> pub (b64)
-	groupSymKeys  map[string]string // gid -> sym (b64)
+	groupKeys     map[string]*groupKeyring // gid -> 密钥纪元
+	pendingRotations map[string]*pendingRotation // gid -> 没有全部送达的群密钥轮换
+
+	// 签名上线的时间：Hub 在这之前保存的未签名 v0 历史消息仍可读取，标记为未认证
+	unsignedCutover time.Time
+
+	// 私聊双棘轮会话，加解密都在 ratchetMu 下进行
+	ratchetMu       sync.Mutex
+	ratchetDisabled bool
+	ratchetSessions map[string]map[string]*ratchetState // peer uid -> sid -> 会话
+	ratchetEcho     map[string][]byte                   // nonce -> 自己发出的明文，用于回显
+	prekey          *storage.RatchetPrekey
+	prekeyMisses    map[string]time.Time // uid -> 上次查不到预密钥包的时间
 
 	// active subscriptions
-	directSubs map[string]*nats.Subscription // cid -> sub
-	groupSubs  map[string]*nats.Subscription // gid -> sub
+	directSubs map[string][]*nats.Subscription // cid -> 消息、正在输入、对端在线状态的订阅
+	groupSubs  map[string][]*nats.Subscription // gid -> 消息、正在输入的订阅
+	left       map[string]struct{}             // 离开的会话（持久保存，InitOfflineSync 时载入），离线同步跳过它们的消息
+
+	// 在线状态和正在输入（只在内存里）
+	presenceMu       sync.Mutex
+	presenceOnce     sync.Once
+	presence         map[string]*Presence     // uid -> 好友状态
+	typing           map[string]*TypingUpdate // cid + "\n" + uid -> 正在输入
+	selfPresence     string
+	lastPresenceSent time.Time
+	presenceInterval time.Duration
+
+	// 待发送的送达回执：cid -> 消息ID，定时合并发送
+	receiptMu       sync.Mutex
+	pendingReceipts map[string][]string
+
+	// 离线同步的检查点缓存和追赶进度
+	syncMu          sync.Mutex
+	syncCheckpoints map[string]uint64                   // cid -> 已处理的流序列号
+	syncProgress    map[string]natsservice.SyncProgress // "group" / "direct" -> 本轮进度
+	syncCatchingUp  bool
+
+	// 发件箱：发布和重试、取消互斥，保证同一会话按顺序发出
+	outboxMu   sync.Mutex
+	outboxOnce sync.Once
+	outboxKick chan struct{}
 
 	// 消息分发去重缓存，避免同一消息被实时订阅和离线同步双重推送
-	dispatchedSeqs map[string]struct{} // key: "subject:natsSeq"
+	dispatchedSeqs map[string]struct{} // key: 消息ID
 
-	handlers    []func(*DecryptedMessage)
-	errHandlers []func(error)
+	handlers      []func(*DecryptedMessage)
+	errHandlers   []func(error)
+	eventHandlers []func(name string, payload any)
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -92,10 +143,22 @@ func NewService(n *natsservice.Service, s *storage.Storage) *Service {
 		storage:       s,
 		user:          &User{ID: generateUserID(), Nickname: "Anonymous"},
 		friendPubKeys: make(map[string]string),
-		groupSymKeys:  make(map[string]string),
-		directSubs:    make(map[string]*nats.Subscription),
-		groupSubs:     make(map[string]*nats.Subscription),
+		groupKeys:     make(map[string]*groupKeyring),
+		pendingRotations: make(map[string]*pendingRotation),
+		ratchetSessions: make(map[string]map[string]*ratchetState),
+		ratchetEcho:     make(map[string][]byte),
+		prekeyMisses:    make(map[string]time.Time),
+		pendingReceipts: make(map[string][]string),
+		presence:         make(map[string]*Presence),
+		typing:           make(map[string]*TypingUpdate),
+		presenceInterval: defaultPresenceInterval,
+		directSubs:    make(map[string][]*nats.Subscription),
+		groupSubs:     make(map[string][]*nats.Subscription),
+		left:          make(map[string]struct{}),
 		dispatchedSeqs: make(map[string]struct{}),
+		syncCheckpoints: make(map[string]uint64),
+		syncProgress:    make(map[string]natsservice.SyncProgress),
+		outboxKick:      make(chan struct{}, 1),
 		handlers:      make([]func(*DecryptedMessage), 0),
 		errHandlers:   make([]func(error), 0),
 		ctx:           ctx,
@@ -199,34 +262,12 @@ func (s *Service) getFriendKey(uid string) (string, error) {
 	return pubKey, nil
 }
 
-// getGroupKey 获取群组对称密钥，优先从内存缓存，如果没有则从本地SQLite查询
+// getGroupKey 获取群组当前纪元的对称密钥，优先从内存缓存，如果没有则从本地SQLite查询
 func (s *Service) getGroupKey(gid string) (string, error) {
-	if gid == "" {
-		return "", errors.New("gid empty")
-	}
-
-	// 1. 先检查内存缓存
-	s.mu.RLock()
-	if symKey, exists := s.groupSymKeys[gid]; exists && symKey != "" {
-		s.mu.RUnlock()
-		return symKey, nil
-	}
-	s.mu.RUnlock()
-
-	// 2. 内存中没有，从本地SQLite查询
-	if s.storage == nil {
-		return "", errors.New("storage not initialized")
-	}
-	symKey, err := s.storage.GetGroupSymKey(gid)
+	symKey, _, err := s.currentGroupKey(gid)
 	if err != nil {
 		return "", fmt.Errorf("group key not found: %w", err)
 	}
-
-	// 3. 查询成功后缓存到内存
-	s.mu.Lock()
-	s.groupSymKeys[gid] = symKey
-	s.mu.Unlock()
-
 	return symKey, nil
 }
 
@@ -257,15 +298,25 @@ func (s *Service) GetUser() User {
 func (s *Service) InitOfflineSync() error {
 	userID := s.user.ID
 
+	if err := s.loadSyncCheckpoints(); err != nil {
+		return err
+	}
+	if err := s.loadLeft(); err != nil {
+		return err
+	}
+
 	// 配置同步回调
 	cfg := &natsservice.OfflineSyncConfig{
 		UserID: userID,
 		MessageHandler: func(msg *nats.Msg) error {
-			return s.processOfflineMessage(msg)
+			return s.handleSyncMessage(msg)
 		},
 		ErrorHandler: func(err error) {
 			s.dispatchError(err)
 		},
+		Checkpoint:      s.syncCheckpoint,
+		GapHandler:      s.handleSyncGap,
+		ProgressHandler: s.handleSyncProgress,
 	}
 
 	// 初始化镜像
@@ -273,21 +324,43 @@ func (s *Service) InitOfflineSync() error {
 		return err
 	}
 
+	// 上次没发出去的消息由发件箱循环接着发
+	s.startOutboxLoop()
+
 	// 启动同步
 	return s.nats.StartSync()
 }
 
 // processOfflineMessage 处理同步下来的离线消息
 func (s *Service) processOfflineMessage(msg *nats.Msg) error {
+	// 获取NATS消息序列ID用于去重
+	natsSeq := uint64(0)
+	var storedAt time.Time
+	if meta, err := msg.Metadata(); err == nil {
+		natsSeq, storedAt = meta.Sequence.Stream, meta.Timestamp
+		slog.Debug("获取NATS消息序列ID", "seq", natsSeq)
+	}
+	return s.processOfflinePayload(msg.Subject, msg.Data, natsSeq, storedAt)
+}
+
+// processOfflinePayload 解密并路由一条离线消息，也用于重试隔离的消息。storedAt 是 Hub 保存消息的时间（流元数据）。
+// 缺少密钥时返回 *missingKeyError，解密失败的错误都包装 errUndecryptable
+func (s *Service) processOfflinePayload(subject string, data []byte, natsSeq uint64, storedAt time.Time) error {
 	// 1. 解密：复用现有消息解密逻辑，和实时消息处理完全一致
 	var w EncWire
-	if err := json.Unmarshal(msg.Data, &w); err != nil {
+	if err := json.Unmarshal(data, &w); err != nil {
 		slog.Error("反序列化离线消息失败", "error", err)
 		return fmt.Errorf("unmarshal offline message: %w", err)
 	}
 
 	slog.Debug("收到离线消息", "sender", w.Sender, "cid", w.CID, "nonce", w.Nonce)
 
+	// 已经离开的会话不再同步
+	if s.hasLeft(subjectCID(subject)) {
+		slog.Debug("忽略已离开会话的离线消息", "cid", w.CID)
+		return nil
+	}
+
 	// 忽略自己发送的离线消息（避免重复存储）
 	s.mu.RLock()
 	selfID := s.user.ID
@@ -298,18 +371,48 @@ func (s *Service) processOfflineMessage(msg *nats.Msg) error {
 		return nil
 	}
 
+	// 校验发送者签名，防止群成员冒充他人；只有签名上线前保存的 v0 历史消息可以不带签名
+	verified, err := verifyWire(&w, subject)
+	if errors.Is(err, ErrUnsignedMessage) && s.acceptUnsigned(&w, storedAt) {
+		err = nil
+	}
+	if err != nil {
+		slog.Warn("离线消息签名校验失败", "sender", w.Sender, "cid", w.CID, "error", err)
+		s.dispatchError(err)
+		return err
+	}
+
 	var (
 		pt      []byte
-		err     error
 		isGroup bool
 	)
+	receivedAt := storedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
 
 	// 先尝试作为群聊解密
-	sym, groupKeyErr := s.getGroupKey(w.CID)
+	_, groupKeyErr := s.getGroupKey(w.CID)
 	if groupKeyErr == nil {
-		slog.Debug("尝试群聊解密", "gid", w.CID)
-		pt, err = DecryptGroup(sym, w.Nonce, w.Cipher)
+		slog.Debug("尝试群聊解密", "gid", w.CID, "epoch", w.KeyID)
+		pt, err = s.openGroup(&w, receivedAt)
 		isGroup = true
+		if errors.Is(err, errGroupKeyEpochMissing) {
+			err = &missingKeyError{kind: storage.QuarantineGroupKey, id: w.CID, err: err}
+		}
+	} else if strings.HasPrefix(subject, "dchat.grp.") {
+		// 群消息先于群密钥到达
+		err = &missingKeyError{kind: storage.QuarantineGroupKey, id: w.CID, err: groupKeyErr}
+		isGroup = true
+	} else if _, friendKeyErr := s.getFriendKey(w.Sender); friendKeyErr != nil {
+		slog.Debug("好友密钥不存在，暂时无法解密", "friend_id", w.Sender, "error", friendKeyErr)
+		err = &missingKeyError{kind: storage.QuarantineFriendKey, id: w.Sender, err: friendKeyErr}
+	} else if w.Enc == EncRatchet {
+		pt, err = s.decryptRatchet(&w)
+		if errors.Is(err, errRatchetReplay) {
+			slog.Debug("忽略已处理的双棘轮消息", "cid", w.CID, "sender", w.Sender)
+			return nil
+		}
 	} else {
 		slog.Debug("群聊密钥不存在，尝试私聊解密", "friend_id", w.Sender, "group_err", groupKeyErr)
 		// 尝试作为私聊解密
@@ -317,12 +420,7 @@ func (s *Service) processOfflineMessage(msg *nats.Msg) error {
 			slog.Error("本地私钥缺失")
 			return errors.New("local private key missing")
 		}
-		peerPub, friendKeyErr := s.getFriendKey(w.Sender)
-		if friendKeyErr != nil {
-			slog.Debug("好友密钥不存在，丢弃消息", "friend_id", w.Sender, "error", friendKeyErr)
-			// 没有对应密钥的消息直接丢弃
-			return nil
-		}
+		peerPub, _ := s.getFriendKey(w.Sender)
 		slog.Debug("使用好友公钥解密", "friend_pub", peerPub[:10] + "...")
 		pt, err = DecryptDirect(priv, peerPub, w.Nonce, w.Cipher)
 		isGroup = false
@@ -330,79 +428,27 @@ func (s *Service) processOfflineMessage(msg *nats.Msg) error {
 
 	if err != nil {
 		slog.Debug("解密离线消息失败", "error", err, "is_group", isGroup)
-		return fmt.Errorf("decrypt offline message: %w", err)
-	}
-	slog.Debug("离线消息解密成功", "content", string(pt))
-
-	// 获取NATS消息序列ID用于去重
-	natsSeq := uint64(0)
-	if meta, err := msg.Metadata(); err == nil {
-		natsSeq = meta.Sequence.Stream
-		slog.Debug("获取NATS消息序列ID", "seq", natsSeq)
-	}
-
-	// 构造统一的解密消息结构
-	decrypted := &DecryptedMessage{
-		CID:     w.CID,
-		Sender:  w.Sender,
-		TS:      time.Unix(w.TS, 0),
-		Plain:   string(pt),
-		IsGroup: isGroup,
-		RawWire: w,
-		Subject: msg.Subject,
-	}
-
-	// 2. 存储：复用现有SQLite存储逻辑
-	if s.storage != nil {
-		storedMsg := &storage.StoredMessage{
-			ID:             generateMessageID(),
-			ConversationID: w.CID,
-			SenderID:       w.Sender,
-			SenderNickname: w.Nickname, // 优先使用消息里的昵称
-			Content:        string(pt),
-			Timestamp:      time.Unix(w.TS, 0),
-			IsRead:         false, // 离线消息默认未读
-			IsGroup:        isGroup,
-			NatsSeq:        natsSeq,
-		}
-		// 昵称空的话fallback到用户ID
-		if storedMsg.SenderNickname == "" {
-			storedMsg.SenderNickname = w.Sender
-		}
-		if err := s.storage.SaveMessage(storedMsg); err != nil {
-			slog.Error("保存离线消息失败", "error", err)
-			return fmt.Errorf("save offline message: %w", err)
-		}
-		slog.Info("离线消息保存成功", "cid", w.CID, "sender", w.Sender, "content", string(pt))
-		// 更新会话列表
-		convType := "dm"
-		if isGroup {
-			convType = "group"
-		}
-		conv, _ := s.storage.GetConversation(w.CID)
-		now := time.Now()
-		if conv == nil {
-			conv = &storage.StoredConversation{
-				ID:            w.CID,
-				Type:          convType,
-				LastMessageAt: time.Unix(w.TS, 0),
-				CreatedAt:     now,
-			}
-		} else {
-			conv.LastMessageAt = time.Unix(w.TS, 0)
-		}
-		_ = s.storage.SaveConversation(conv)
-	}
-
-	// 防重：实时订阅路径已用 Nonce 标记，离线同步不重复推送
-	if s.hasDispatched(msg.Subject, w.Nonce) {
-		return nil
+		return fmt.Errorf("%w: %w", errUndecryptable, err)
 	}
 
-	// 3. 分发：复用现有消息分发逻辑，通知UI更新
-	s.dispatchDecrypted(decrypted)
-
-	return nil
+	kind, body, err := decodeBody(&w, pt)
+	if err != nil {
+		slog.Debug("解析离线消息体失败", "error", err, "version", w.V)
+		return fmt.Errorf("decode offline message: %w", err)
+	}
+	slog.Debug("离线消息解密成功", "kind", kind, "version", w.V)
+
+	// 2. 按消息类型路由：存储、更新会话、通知UI
+	return s.routeInbound(&inboundMessage{
+		wire:     w,
+		kind:     kind,
+		body:     body,
+		isGroup:  isGroup,
+		verified: verified,
+		subject:  subject,
+		natsSeq:  natsSeq,
+		receivedAt: receivedAt,
+	})
 }
 
 // SetKeyPair 设置本地密钥对
@@ -430,23 +476,14 @@ func (s *Service) AddFriendKey(uid, pubB64 string) {
 			s.dispatchError(fmt.Errorf("failed to persist friend key: %w", err))
 		}
 	}
+	// 重试因为缺少这个好友公钥而隔离的离线消息
+	go s.retryQuarantined(storage.QuarantineFriendKey, uid)
 }
 
 // AddGroupKey 缓存群对称密钥并持久化到本地SQLite存储
+// 线下分享的群密钥按纪元0保存，之后的纪元通过 RotateGroupKey 下发
 func (s *Service) AddGroupKey(gid, symB64 string) {
-	if gid == "" || symB64 == "" {
-		return
-	}
-	s.mu.Lock()
-	s.groupSymKeys[gid] = symB64
-	s.mu.Unlock()
-
-	// 持久化到本地SQLite（最佳努力，失败不影响内存缓存）
-	if s.storage != nil {
-		if err := s.storage.SaveGroupSymKey(gid, symB64); err != nil {
-			s.dispatchError(fmt.Errorf("failed to persist group key: %w", err))
-		}
-	}
+	s.installGroupKey(gid, 0, symB64, time.Now(), true)
 }
 
 // CreateGroup 创建新群聊，返回群ID和群密钥
@@ -465,6 +502,17 @@ func (s *Service) CreateGroup() (gid string, groupKey string, err error) {
 	// 3. 本地存储群密钥
 	s.AddGroupKey(gid, groupKey)
 
+	// 创建者是群主，群信息随邀请和后续修改同步给成员
+	if s.storage != nil {
+		s.mu.RLock()
+		self := s.user.ID
+		s.mu.RUnlock()
+		meta := &GroupMeta{GID: gid, Creator: self, Members: []string{self}, Version: 1, UpdatedAt: time.Now().Unix()}
+		if err := s.saveGroupMeta(meta, self); err != nil {
+			return "", "", fmt.Errorf("save group meta: %w", err)
+		}
+	}
+
 	// 4. 自动订阅群主题
 	err = s.JoinGroup(gid)
 	if err != nil {
@@ -550,26 +598,24 @@ func (s *Service) JoinDirect(peerID string) error {
 	s.mu.RUnlock()
 
 	cid := deriveCID(self, peerID)
-	s.mu.RLock()
-	if _, exists := s.directSubs[cid]; exists {
-		s.mu.RUnlock()
+	if s.joined(cid, false) {
 		return nil
 	}
-	s.mu.RUnlock()
 
-	subj := fmt.Sprintf("dchat.dm.%s.msg", cid)
-	if err := s.nats.Subscribe(
+	subj := directSubject(cid)
+	sub, err := s.nats.Subscribe(
 		subj,
 		func(m *nats.Msg) {
 			// inline handler kept small; delegates to unified decrypt/dispatch
 			s.handleEncrypted(subj, m)
 		},
-	); err != nil {
+	)
+	if err != nil {
 		return err
 	}
-	s.mu.Lock()
-	s.directSubs[cid] = nil
-	s.mu.Unlock()
+	subs := append([]*nats.Subscription{sub}, s.subscribeSignals(cid, peerID, false)...)
+	s.addSubs(s.directSubs, cid, subs)
+	s.trackSync(subj, true)
 	return nil
 }
 
@@ -585,26 +631,24 @@ func (s *Service) JoinGroup(gid string) error {
 		return fmt.Errorf("group key not available: %w", err)
 	}
 
-	s.mu.RLock()
-	if _, exists := s.groupSubs[gid]; exists {
-		s.mu.RUnlock()
+	if s.joined(gid, true) {
 		return nil
 	}
-	s.mu.RUnlock()
 
-	subj := fmt.Sprintf("dchat.grp.%s.msg", gid)
-	if err := s.nats.Subscribe(
+	subj := groupSubject(gid)
+	sub, err := s.nats.Subscribe(
 		subj,
 		func(m *nats.Msg) {
 			// group message handler -> decrypt path
 			s.handleEncrypted(subj, m)
 		},
-	); err != nil {
+	)
+	if err != nil {
 		return err
 	}
-	s.mu.Lock()
-	s.groupSubs[gid] = nil
-	s.mu.Unlock()
+	subs := append([]*nats.Subscription{sub}, s.subscribeSignals(gid, "", true)...)
+	s.addSubs(s.groupSubs, gid, subs)
+	s.trackSync(subj, true)
 	return nil
 }
 
@@ -614,105 +658,111 @@ func (s *Service) SendDirect(peerIDOrCID, content string) error {
 		return errors.New("peerID/content empty")
 	}
 
-	s.mu.RLock()
-	priv := s.userPrivB64
-	from := s.user.ID
-	s.mu.RUnlock()
+	peerID, peerPub, err := s.resolvePeer(peerIDOrCID)
+	if err != nil {
+		return err
+	}
 
-	if priv == "" {
-		slog.Error("发送私聊失败：本地私钥为空")
-		return errors.New("local priv key empty")
+	now := time.Now()
+	msgID := newMessageID()
+	wire, err := s.sealDirect(peerID, peerPub, KindText, &MessageBody{ID: msgID, Text: content}, now)
+	if err != nil {
+		return err
 	}
 
-	// 支持两种参数：用户ID 或 会话ID
-	var peerID string
+	// 先放进发件箱并保存，再通过JetStream发布；断开 Hub 时留在发件箱里稍后发出
+	return s.queueOutgoing(msgID, directSubject(wire.CID), wire, now, content, false, "")
+}
+
+// resolvePeer 支持两种参数：用户ID 或 会话ID，返回对端用户ID和公钥
+func (s *Service) resolvePeer(peerIDOrCID string) (string, string, error) {
 	peerPub, err := s.getFriendKey(peerIDOrCID)
 	if err == nil {
 		// 直接是用户ID
-		peerID = peerIDOrCID
-	} else {
-		// 尝试解析会话ID，提取对端用户ID
-		// 会话ID是两个用户ID的组合，尝试两种可能：from + peer 或 peer + from
-		allFriends, err := s.storage.GetAllFriends()
-		if err != nil {
-			slog.Error("发送私聊失败：获取好友列表失败", "error", err)
-			return fmt.Errorf("get friends failed: %w", err)
-		}
-		found := false
-		for _, fid := range allFriends {
-			if deriveCID(from, fid) == peerIDOrCID || deriveCID(fid, from) == peerIDOrCID {
-				peerID = fid
-				peerPub, err = s.getFriendKey(fid)
-				if err != nil {
-					slog.Error("发送私聊失败：好友公钥不存在", "friend_id", fid, "error", err)
-					return fmt.Errorf("friend pub key not available: %w", err)
-				}
-				found = true
-				break
+		return peerIDOrCID, peerPub, nil
+	}
+	if s.storage == nil {
+		return "", "", fmt.Errorf("friend pub key not available: %w", err)
+	}
+
+	s.mu.RLock()
+	from := s.user.ID
+	s.mu.RUnlock()
+
+	// 尝试解析会话ID，提取对端用户ID
+	allFriends, err := s.storage.GetAllFriends()
+	if err != nil {
+		slog.Error("发送私聊失败：获取好友列表失败", "error", err)
+		return "", "", fmt.Errorf("get friends failed: %w", err)
+	}
+	for _, fid := range allFriends {
+		if deriveCID(from, fid) == peerIDOrCID {
+			peerPub, err = s.getFriendKey(fid)
+			if err != nil {
+				slog.Error("发送私聊失败：好友公钥不存在", "friend_id", fid, "error", err)
+				return "", "", fmt.Errorf("friend pub key not available: %w", err)
 			}
-		}
-		if !found {
-			slog.Error("发送私聊失败：无效的会话ID或好友ID", "input", peerIDOrCID)
-			return fmt.Errorf("invalid peer or conversation ID: %s", peerIDOrCID)
+			return fid, peerPub, nil
 		}
 	}
+	slog.Error("发送私聊失败：无效的会话ID或好友ID", "input", peerIDOrCID)
+	return "", "", fmt.Errorf("invalid peer or conversation ID: %s", peerIDOrCID)
+}
 
-	cid := deriveCID(from, peerID)
-	nonceB64, cipherB64, err := EncryptDirect(priv, peerPub, []byte(content))
-	if err != nil {
-		slog.Error("发送私聊失败：消息加密失败", "error", err)
-		return err
+// sealDirect 序列化并加密私聊消息体，生成待发布的载荷
+func (s *Service) sealDirect(peerID, peerPub string, kind MessageKind, body *MessageBody, now time.Time) (*EncWire, error) {
+	s.mu.RLock()
+	priv := s.userPrivB64
+	from := s.user.ID
+	nickname := s.user.Nickname
+	s.mu.RUnlock()
+
+	if priv == "" {
+		slog.Error("发送私聊失败：本地私钥为空")
+		return nil, errors.New("local priv key empty")
 	}
-	now := time.Now()
-	wire := EncWire{
-		CID:      cid,
+
+	wire := &EncWire{
+		V:        WireVersion,
+		Kind:     kind,
+		CID:      deriveCID(from, peerID),
 		Sender:   from,
 		TS:       now.Unix(),
-		Nonce:    nonceB64,
-		Cipher:   cipherB64,
-		Nickname: s.user.Nickname, // 带上发送者昵称
+		Nickname: nickname, // 带上发送者昵称
 	}
-	data, _ := json.Marshal(wire)
-	subj := fmt.Sprintf("dchat.dm.%s.msg", cid)
 
-	// 先使用JetStream发布，确保消息持久化并获取序列ID
-	seq, err := s.nats.PublishJetStream(subj, data)
+	// 优先使用双棘轮会话，对方不支持时退回静态 box
+	plain, err := encodeBody(body)
 	if err != nil {
-		slog.Error("发送私聊失败：NATS发布消息失败", "subject", subj, "error", err)
-		return err
+		return nil, err
 	}
-
-	// 自动保存自己发送的消息到本地存储
-	if s.storage != nil {
-		storedMsg := &storage.StoredMessage{
-			ID:             generateMessageID(),
-			ConversationID: cid,
-			SenderID:       from,
-			SenderNickname: s.user.Nickname,
-			Content:        content,
-			Timestamp:      now,
-			IsRead:         true, // 自己发送的消息默认已读
-			IsGroup:        false,
-			NatsSeq:        seq,
-		}
-		_ = s.storage.SaveMessage(storedMsg)
-
-		// 更新会话最后消息时间
-		conv, _ := s.storage.GetConversation(cid)
-		if conv == nil {
-			conv = &storage.StoredConversation{
-				ID:            cid,
-				Type:          "dm",
-				LastMessageAt: now,
-				CreatedAt:     now,
+	ratcheted, err := s.encryptRatchet(peerID, wire, plain)
+	if err != nil {
+		slog.Error("发送私聊失败：双棘轮加密失败", "peer", peerID, "error", err)
+		return nil, err
+	}
+	if ratcheted {
+		s.rememberRatchetEcho(wire.Nonce, plain)
+	} else {
+		// 静态 box 消息附带自己的预密钥，对方支持的话下一条消息就会建立会话
+		if adv := s.prekeyAdvert(); adv != nil {
+			withPrekey := *body
+			withPrekey.Prekey = adv
+			if plain, err = encodeBody(&withPrekey); err != nil {
+				return nil, err
 			}
-		} else {
-			conv.LastMessageAt = now
 		}
-		_ = s.storage.SaveConversation(conv)
+		wire.Nonce, wire.Cipher, err = EncryptDirect(priv, peerPub, plain)
+		if err != nil {
+			slog.Error("发送私聊失败：消息加密失败", "error", err)
+			return nil, err
+		}
 	}
-
-	return nil
+	if err := s.signWire(wire); err != nil {
+		slog.Error("发送私聊失败：消息签名失败", "error", err)
+		return nil, err
+	}
+	return wire, nil
 }
 
 // SendGroup 发送群聊
@@ -722,81 +772,223 @@ func (s *Service) SendGroup(gid, content string) error {
 		return errors.New("gid/content empty")
 	}
 
+	now := time.Now()
+	msgID := newMessageID()
+	wire, err := s.sealGroup(gid, KindText, &MessageBody{ID: msgID, Text: content}, now)
+	if err != nil {
+		return err
+	}
+
+	// 先放进发件箱并保存，再通过JetStream发布
+	return s.queueOutgoing(msgID, groupSubject(gid), wire, now, content, true, "")
+}
+
+// sendBody 向群聊或私聊（好友ID或会话ID）发送消息体，群密钥存在时按群聊处理；返回发布的载荷
+func (s *Service) sendBody(target string, kind MessageKind, body *MessageBody, now time.Time) (wire *EncWire, isGroup bool, seq uint64, err error) {
+	wire, isGroup, subj, err := s.sealBody(target, kind, body, now)
+	if err != nil {
+		return nil, isGroup, 0, err
+	}
+	seq, err = s.publishWire(subj, wire, body.ID)
+	return wire, isGroup, seq, err
+}
+
+// sealBody 为群聊或私聊（好友ID或会话ID）加密消息体，返回载荷和要发布到的主题
+func (s *Service) sealBody(target string, kind MessageKind, body *MessageBody, now time.Time) (wire *EncWire, isGroup bool, subj string, err error) {
+	if _, _, groupErr := s.currentGroupKey(target); groupErr == nil {
+		if wire, err = s.sealGroup(target, kind, body, now); err != nil {
+			return nil, true, "", err
+		}
+		return wire, true, groupSubject(target), nil
+	}
+	peerID, peerPub, err := s.resolvePeer(target)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if wire, err = s.sealDirect(peerID, peerPub, kind, body, now); err != nil {
+		return nil, false, "", err
+	}
+	return wire, false, directSubject(wire.CID), nil
+}
+
+// sealGroup 序列化并用群密钥加密消息体，生成待发布的载荷
+func (s *Service) sealGroup(gid string, kind MessageKind, body *MessageBody, now time.Time) (*EncWire, error) {
 	s.mu.RLock()
 	from := s.user.ID
+	nickname := s.user.Nickname
 	s.mu.RUnlock()
 
-	// 按需获取群组密钥
-	sym, err := s.getGroupKey(gid)
+	// 按需获取群组当前纪元的密钥
+	sym, epoch, err := s.currentGroupKey(gid)
 	if err != nil {
 		slog.Error("发送群聊失败：群组密钥不存在", "gid", gid, "error", err)
-		return fmt.Errorf("group key not available: %w", err)
+		return nil, fmt.Errorf("group key not available: %w", err)
 	}
 
-	nonceB64, cipherB64, err := EncryptGroup(sym, []byte(content))
+	plain, err := encodeBody(body)
+	if err != nil {
+		return nil, err
+	}
+	nonceB64, cipherB64, err := EncryptGroup(sym, plain)
 	if err != nil {
 		slog.Error("发送群聊失败：消息加密失败", "error", err)
-		return err
+		return nil, err
 	}
-	now := time.Now()
-	wire := EncWire{
+	wire := &EncWire{
+		V:        WireVersion,
+		Kind:     kind,
 		CID:      gid,
 		Sender:   from,
 		TS:       now.Unix(),
+		KeyID:    epoch,
 		Nonce:    nonceB64,
 		Cipher:   cipherB64,
-		Nickname: s.user.Nickname, // 带上发送者昵称
+		Nickname: nickname, // 带上发送者昵称
 	}
-	data, _ := json.Marshal(wire)
-	subj := fmt.Sprintf("dchat.grp.%s.msg", gid)
-  var storedMsg *storage.StoredMessage
-	// 自动保存自己发送的群聊消息到本地存储
-	if s.storage != nil {
-		storedMsg = &storage.StoredMessage{
-			ID:             generateMessageID(),
-			ConversationID: gid,
-			SenderID:       from,
-			SenderNickname: s.user.Nickname,
-			Content:        content,
-			Timestamp:      now,
-			IsRead:         true, // 自己发送的消息默认已读
-			IsGroup:        true,
-		}
-		_ = s.storage.SaveMessage(storedMsg)
-
-		// 更新群聊会话最后消息时间
-		conv, _ := s.storage.GetConversation(gid)
-		if conv == nil {
-			conv = &storage.StoredConversation{
-				ID:            gid,
-				Type:          "group",
-				LastMessageAt: now,
-				CreatedAt:     now,
-			}
-		} else {
-			conv.LastMessageAt = now
-		}
-		_ = s.storage.SaveConversation(conv)
+	if err := s.signWire(wire); err != nil {
+		slog.Error("发送群聊失败：消息签名失败", "error", err)
+		return nil, err
 	}
+	return wire, nil
+}
 
-	// 使用JetStream发布，确保消息持久化并获取序列ID
-	seq, err := s.nats.PublishJetStream(subj, data)
+// publishWire 序列化载荷并通过JetStream发布，返回序列ID。
+// msgID 是发送方生成的消息ID，作为 Nats-Msg-Id 让 Hub 丢弃超时重发造成的重复
+func (s *Service) publishWire(subj string, wire *EncWire, msgID string) (uint64, error) {
+	msg, err := wireMsg(subj, wire, msgID)
 	if err != nil {
-		slog.Error("发送群聊失败：NATS发布消息失败", "subject", subj, "error", err)
-		return err
+		return 0, err
+	}
+	seq, err := s.nats.PublishJetStreamMsg(msg)
+	if err != nil {
+		slog.Error("发送消息失败：NATS发布消息失败", "subject", subj, "kind", wire.Kind, "error", err)
+		return 0, err
 	}
+	return seq, nil
+}
+
+// publishWireAsync 异步发布载荷，不等 Hub 确认，确认或错误从返回的 PubAckFuture 取得
+func (s *Service) publishWireAsync(subj string, wire *EncWire, msgID string) (nats.PubAckFuture, error) {
+	msg, err := wireMsg(subj, wire, msgID)
+	if err != nil {
+		return nil, err
+	}
+	return s.nats.PublishJetStreamAsync(msg)
+}
+
+// wireMsg 序列化载荷，带上 Nats-Msg-Id 消息头
+func wireMsg(subj string, wire *EncWire, msgID string) (*nats.Msg, error) {
+	data, err := json.Marshal(wire)
+	if err != nil {
+		return nil, fmt.Errorf("marshal wire: %w", err)
+	}
+	msg := nats.NewMsg(subj)
+	msg.Data = data
+	msg.Header.Set(nats.MsgIdHdr, natsMsgID(wire, msgID))
+	return msg, nil
+}
+
+// natsMsgID 发布去重用的ID：有消息ID时就用它；编辑、回执、系统消息这类没有ID的按发送者和密文派生，同一份载荷重发时不变
+func natsMsgID(wire *EncWire, msgID string) string {
+	if msgID != "" {
+		return msgID
+	}
+	sum := sha256.Sum256([]byte(wire.Sender + "\n" + wire.Nonce + "\n" + wire.Cipher))
+	return hex.EncodeToString(sum[:16])
+}
 
-	// 保存自己发的消息时带上NATS序列ID
-	storedMsg.NatsSeq = seq
+// saveOutgoing 保存自己发送的消息并更新会话最后消息时间，state 为初始送达状态（已发布为 sent，进发件箱为 pending）
+func (s *Service) saveOutgoing(msgID string, wire *EncWire, sentAt time.Time, content string, isGroup bool, seq uint64, replyTo, state string) {
+	if s.storage == nil {
+		return
+	}
+	storedMsg := &storage.StoredMessage{
+		ID:             msgID,
+		ConversationID: wire.CID,
+		SenderID:       wire.Sender,
+		SenderNickname: wire.Nickname,
+		Content:        content,
+		Timestamp:      time.Unix(wire.TS, 0), // 和接收方保存的时间一致
+		IsRead:         true, // 自己发送的消息默认已读
+		IsGroup:        isGroup,
+		NatsSeq:        seq,
+		ReplyToID:      replyTo,
+	}
 	if err := s.storage.SaveMessage(storedMsg); err != nil {
 		slog.Error("保存自己发送的消息失败", "error", err)
 	}
+	if err := s.storage.SetDeliveryState(msgID, state, sentAt); err != nil {
+		slog.Error("保存送达状态失败", "error", err)
+	}
+	s.touchConversation(wire.CID, isGroup, sentAt)
+}
 
-	return nil
+// touchConversation 创建或更新会话的最后消息时间
+func (s *Service) touchConversation(cid string, isGroup bool, at time.Time) {
+	if s.storage == nil {
+		return
+	}
+	convType := "dm"
+	if isGroup {
+		convType = "group"
+	}
+	conv, _ := s.storage.GetConversation(cid)
+	if conv == nil {
+		conv = &storage.StoredConversation{
+			ID:            cid,
+			Type:          convType,
+			LastMessageAt: at,
+			CreatedAt:     time.Now(),
+		}
+	} else {
+		conv.LastMessageAt = at
+	}
+	// 会话列表按对端显示私聊，cid 是哈希，只能从好友列表反查一次
+	if !isGroup && conv.PeerID == "" {
+		conv.PeerID = s.directPeer(cid)
+	}
+	_ = s.storage.SaveConversation(conv)
+}
+
+// directPeer 从好友列表反查私聊 cid 对应的对端用户ID，找不到时返回空
+func (s *Service) directPeer(cid string) string {
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	friends, err := s.storage.GetAllFriends()
+	if err != nil {
+		return ""
+	}
+	for _, fid := range friends {
+		if deriveCID(self, fid) == cid {
+			return fid
+		}
+	}
+	return ""
+}
+
+// directSubject 私聊消息主题
+func directSubject(cid string) string {
+	return fmt.Sprintf("dchat.dm.%s.msg", cid)
+}
+
+// groupSubject 群聊消息主题
+func groupSubject(gid string) string {
+	return fmt.Sprintf("dchat.grp.%s.msg", gid)
+}
+
+// subjectCID 从 dchat.dm.<cid>.msg / dchat.grp.<gid>.msg 主题中取出会话ID
+func subjectCID(subject string) string {
+	parts := strings.Split(subject, ".")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[2]
 }
 
 // handleEncrypted 解密并派发
 func (s *Service) handleEncrypted(subject string, natsMsg *nats.Msg) {
+	receivedAt := time.Now()
 	// 1) 反序列化
 	var w EncWire
 	if err := json.Unmarshal(natsMsg.Data, &w); err != nil {
@@ -804,29 +996,47 @@ func (s *Service) handleEncrypted(subject string, natsMsg *nats.Msg) {
 		return
 	}
 
+	// 校验发送者签名，防止群成员冒充他人
+	verified, err := verifyWire(&w, subject)
+	if err != nil {
+		slog.Warn("消息签名校验失败", "sender", w.Sender, "cid", w.CID, "error", err)
+		s.dispatchError(err)
+		return
+	}
+
 	// 2) 读取基本状态
 	s.mu.RLock()
 	priv := s.userPrivB64
 	selfID := s.user.ID
 	s.mu.RUnlock()
 
-	// 3) 判定是否群聊
+	// 3) 判定是否群聊；已经离开的会话不再处理
 	isGroup := strings.HasPrefix(subject, "dchat.grp.")
+	if cid := subjectCID(subject); !s.joined(cid, isGroup) {
+		slog.Debug("忽略已离开会话的消息", "cid", cid, "is_group", isGroup)
+		return
+	}
 
 	// 4) 按需获取密钥并解密
-	var (
-		pt  []byte
-		err error
-	)
+	var pt []byte
 	if isGroup {
-		// 按需获取群组密钥
-		sym, keyErr := s.getGroupKey(w.CID)
-		if keyErr != nil {
-			slog.Debug("群聊消息处理失败：群组密钥不存在", "gid", w.CID, "error", keyErr)
-			s.dispatchError(fmt.Errorf("group key not available for %s: %w", w.CID, keyErr))
+		// 按载荷里的纪元获取群组密钥
+		pt, err = s.openGroup(&w, receivedAt)
+		if errors.Is(err, ErrRetiredGroupKey) {
+			slog.Warn("拒绝使用退役群密钥的消息", "gid", w.CID, "epoch", w.KeyID, "sender", w.Sender)
+			s.dispatchError(err)
+			return
+		}
+	} else if w.Enc == EncRatchet {
+		if w.Sender == selfID {
+			pt, err = s.ratchetEchoPlain(&w)
+		} else {
+			pt, err = s.decryptRatchet(&w)
+		}
+		if errors.Is(err, errRatchetReplay) {
+			slog.Debug("忽略已处理的双棘轮消息", "cid", w.CID, "sender", w.Sender)
 			return
 		}
-		pt, err = DecryptGroup(sym, w.Nonce, w.Cipher)
 	} else {
 		if priv == "" {
 			s.dispatchError(errors.New("local priv key missing"))
@@ -853,15 +1063,11 @@ func (s *Service) handleEncrypted(subject string, natsMsg *nats.Msg) {
 		return
 	}
 
-	// 5) 构造消息
-	msg := &DecryptedMessage{
-		CID:     w.CID,
-		Sender:  w.Sender,
-		TS:      time.Unix(w.TS, 0),
-		Plain:   string(pt),
-		IsGroup: isGroup,
-		RawWire: w,
-		Subject: subject,
+	kind, body, err := decodeBody(&w, pt)
+	if err != nil {
+		slog.Debug("消息体解析失败", "error", err, "version", w.V)
+		s.dispatchError(fmt.Errorf("decode: %w", err))
+		return
 	}
 
 	// 获取NATS序列ID用于存储去重
@@ -870,45 +1076,228 @@ func (s *Service) handleEncrypted(subject string, natsMsg *nats.Msg) {
 		natsSeq = meta.Sequence.Stream
 	}
 
-	// 6) 自动保存到本地存储（如果storage已初始化）
+	// 5) 按消息类型路由：存储、更新会话、通知UI
+	if err := s.routeInbound(&inboundMessage{
+		wire:     w,
+		kind:     kind,
+		body:     body,
+		isGroup:  isGroup,
+		verified: verified,
+		subject:  subject,
+		natsSeq:  natsSeq,
+		receivedAt: receivedAt,
+	}); err != nil {
+		s.dispatchError(err)
+	}
+}
+
+// inboundMessage 已解密的入站消息，实时订阅和离线同步共用
+type inboundMessage struct {
+	wire     EncWire
+	kind     MessageKind
+	body     *MessageBody
+	isGroup  bool
+	verified bool
+	subject  string
+	natsSeq  uint64
+	receivedAt time.Time // Hub 保存消息的时间（离线同步）或本地收到的时间，不是发送方填的 ts
+}
+
+// routeInbound 按消息类型分发已解密的载荷
+func (s *Service) routeInbound(in *inboundMessage) error {
+	// 好友告知的预密钥，只信任签名校验过的
+	if !in.isGroup && in.verified && in.body.Prekey != nil {
+		s.mu.RLock()
+		self := s.user.ID
+		s.mu.RUnlock()
+		if in.wire.Sender != self {
+			if err := s.rememberPeerPrekey(in.wire.Sender, in.body.Prekey, in.wire.TS); err != nil {
+				slog.Warn("保存好友预密钥失败", "peer", in.wire.Sender, "error", err)
+			}
+		}
+	}
+
+	// 管理员用新纪元发来的消息启用这个纪元
+	if in.isGroup && in.verified {
+		s.activateOnAdminUse(in)
+	}
+
+	switch in.kind {
+	case KindText:
+		return s.deliverMessage(in)
+	case KindFile:
+		if in.body.File == nil {
+			return errors.New("file message without attachment")
+		}
+		if err := in.body.File.validate(); err != nil {
+			slog.Warn("忽略无效的附件消息", "sender", in.wire.Sender, "cid", in.wire.CID, "error", err)
+			return nil
+		}
+		return s.deliverMessage(in)
+	case KindEdit, KindDelete:
+		return s.handleMessageUpdate(in)
+	case KindReaction:
+		return s.handleReaction(in)
+	case KindReceipt:
+		return s.handleReceipt(in)
+	case KindSystem:
+		return s.handleSystem(in)
+	default:
+		// 暂不支持的类型（可能来自更新版本的客户端），忽略即可
+		slog.Debug("忽略暂不支持的消息类型", "kind", in.kind, "cid", in.wire.CID)
+		return nil
+	}
+}
+
+// handleSystem 处理系统消息，不作为聊天消息保存
+func (s *Service) handleSystem(in *inboundMessage) error {
+	sys := in.body.System
+	if sys == nil {
+		return errors.New("system message without payload")
+	}
+
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	// 自己发出的系统消息会回显回来，本地已经处理过
+	if in.wire.Sender == self {
+		return nil
+	}
+
+	switch sys.Type {
+	case SystemGroupInvite:
+		// 邀请只接受好友通过私聊发来的
+		if in.isGroup || !in.verified || sys.GroupInvite == nil {
+			slog.Warn("忽略不可信的群邀请", "sender", in.wire.Sender, "cid", in.wire.CID)
+			return nil
+		}
+		return s.receiveGroupInvite(in, sys.GroupInvite)
+	case SystemGroupMeta:
+		// 群信息只在群主题上同步，由管理员签名
+		if !in.isGroup || !in.verified || sys.GroupMeta == nil || sys.GroupMeta.GID != in.wire.CID {
+			slog.Warn("忽略不可信的群信息", "sender", in.wire.Sender, "cid", in.wire.CID)
+			return nil
+		}
+		return s.applyGroupMeta(in.wire.Sender, sys.GroupMeta)
+	case SystemGroupKey:
+		// 群密钥只能通过私聊下发，群里发的密钥被移除的成员也能看到
+		if in.isGroup || !in.verified || sys.GroupKey == nil {
+			slog.Warn("忽略不可信的群密钥", "sender", in.wire.Sender, "cid", in.wire.CID)
+			return nil
+		}
+		return s.applyGroupKeyGrant(in, sys.GroupKey)
+	case SystemGroupKeyActive:
+		// 启用已经在 routeInbound 里按纪元处理
+		return nil
+	default:
+		slog.Debug("忽略暂不支持的系统消息", "type", sys.Type, "cid", in.wire.CID)
+		return nil
+	}
+}
+
+// deliverMessage 保存聊天消息、更新会话并通知UI
+func (s *Service) deliverMessage(in *inboundMessage) error {
+	w := in.wire
+	ts := time.Unix(w.TS, 0)
+	content := in.body.Text
+	if in.body.File != nil {
+		content = in.body.File.Name // 附件消息以文件名作为内容，便于列表显示和搜索
+	}
+
+	// 发送方生成的消息ID各端共用，编辑、回执等都据此引用；旧载荷没有ID时按载荷派生
+	msgID := in.body.ID
+	if msgID == "" {
+		msgID = legacyMessageID(&w)
+	} else if !validMessageID(msgID) {
+		slog.Warn("忽略消息ID无效的消息", "sender", w.Sender, "cid", w.CID)
+		return nil
+	}
+
+	replyTo := in.body.ReplyTo
+	if replyTo != "" && !validMessageID(replyTo) {
+		replyTo = ""
+	}
+
+	var attachment *storage.Attachment
+	// 自动保存到本地存储（如果storage已初始化）
 	if s.storage != nil {
+		existing, err := s.storage.GetMessage(msgID)
+		if err != nil {
+			return fmt.Errorf("load message: %w", err)
+		}
+		// 同一ID已被别人的消息占用，可能是伪造的重复ID
+		if existing != nil && (existing.SenderID != w.Sender || existing.ConversationID != w.CID) {
+			slog.Warn("忽略与已有消息ID冲突的消息", "msg_id", msgID, "sender", w.Sender, "cid", w.CID)
+			return nil
+		}
+		isNew := existing == nil
+		if !isNew {
+			// 重复收到已撤回的消息不再显示，已编辑的显示编辑后的内容
+			if existing.Deleted {
+				return nil
+			}
+			content = existing.Content
+		}
 		storedMsg := &storage.StoredMessage{
-			ID:             generateMessageID(),
+			ID:             msgID,
 			ConversationID: w.CID,
 			SenderID:       w.Sender,
-			SenderNickname: w.Nickname,
-			Content:        string(pt),
-			Timestamp:      time.Unix(w.TS, 0),
+			SenderNickname: w.Nickname, // 优先使用消息里的昵称
+			Content:        content,
+			Timestamp:      ts,
 			IsRead:         false,
-			IsGroup:        isGroup,
-			NatsSeq:        natsSeq,
+			IsGroup:        in.isGroup,
+			NatsSeq:        in.natsSeq,
+			ReplyToID:      replyTo,
+			Unverified:     !in.verified,
 		}
+		// 昵称空的话fallback到用户ID
 		if storedMsg.SenderNickname == "" {
 			storedMsg.SenderNickname = w.Sender
 		}
-		_ = s.storage.SaveMessage(storedMsg)
-
-		convType := "dm"
-		if isGroup {
-			convType = "group"
+		if err := s.storage.SaveMessage(storedMsg); err != nil {
+			slog.Error("保存消息失败", "error", err, "cid", w.CID)
+			return fmt.Errorf("save message: %w", err)
 		}
-		conv, _ := s.storage.GetConversation(w.CID)
-		if conv == nil {
-			conv = &storage.StoredConversation{
-				ID:            w.CID,
-				Type:          convType,
-				LastMessageAt: time.Unix(w.TS, 0),
-				CreatedAt:     time.Now(),
+		if in.body.File != nil {
+			attachment = attachmentRecord(msgID, w.CID, in.body.File, ts)
+			if err := s.storage.SaveAttachment(attachment); err != nil {
+				return fmt.Errorf("save attachment: %w", err)
 			}
-		} else {
-			conv.LastMessageAt = time.Unix(w.TS, 0)
 		}
-		_ = s.storage.SaveConversation(conv)
+		s.touchConversation(w.CID, in.isGroup, ts)
+		if isNew && in.body.ID != "" {
+			s.queueDeliveryReceipt(in, msgID)
+		}
 	}
 
-	// 7) 分发（实时订阅先到，标记已分发；离线同步后到会跳过）
-	s.dispatchDecrypted(msg)
-	s.markDispatched(subject, w.Nonce)
+	// 防重：实时订阅和离线同步可能先后收到同一条消息，只推送一次
+	if s.hasDispatched(msgID) {
+		return nil
+	}
+	// 免打扰的会话只保存不通知
+	if s.conversationMuted(w.CID, time.Now()) {
+		return nil
+	}
+	var preview *ReplyPreview
+	if replyTo != "" {
+		preview = s.replyPreview(w.CID, replyTo)
+	}
+	s.dispatchDecrypted(&DecryptedMessage{
+		CID:      w.CID,
+		Sender:   w.Sender,
+		TS:       ts,
+		Plain:    content,
+		Kind:     in.kind,
+		IsGroup:  in.isGroup,
+		Verified: in.verified,
+		RawWire:  w,
+		Subject:  in.subject,
+		ID:         msgID,
+		Attachment: attachment,
+		ReplyTo:    preview,
+	})
+	return nil
 }
 
 // dispatchDecrypted 分发解密成功事件
@@ -921,26 +1310,17 @@ func (s *Service) dispatchDecrypted(msg *DecryptedMessage) {
 	}
 }
 
-// hasDispatched 原子检查并标记，返回true表示已分发过
-func (s *Service) hasDispatched(subject, nonce string) bool {
-	key := subject + ":" + nonce
+// hasDispatched 按消息ID原子检查并标记，返回true表示已分发过
+func (s *Service) hasDispatched(msgID string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.dispatchedSeqs[key]; ok {
+	if _, ok := s.dispatchedSeqs[msgID]; ok {
 		return true
 	}
-	s.markDispatchedLocked(key)
+	s.markDispatchedLocked(msgID)
 	return false
 }
 
-// markDispatched 标记消息已分发（调用方需自行确保不重复分发）
-func (s *Service) markDispatched(subject, nonce string) {
-	key := subject + ":" + nonce
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.markDispatchedLocked(key)
-}
-
 func (s *Service) markDispatchedLocked(key string) {
 	if len(s.dispatchedSeqs) >= maxDispatchedCache {
 		s.dispatchedSeqs = make(map[string]struct{})
@@ -958,17 +1338,33 @@ func (s *Service) dispatchError(err error) {
 	}
 }
 
-// Close 关闭所有订阅
+// Close 退订所有会话、停止离线同步和后台协程，之后不再回调任何处理函数
 func (s *Service) Close() error {
 	s.cancel()
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	// stored subscriptions are nil placeholders (nats service doesn't expose *nats.Subscription)
-	s.directSubs = map[string]*nats.Subscription{}
-	s.groupSubs = map[string]*nats.Subscription{}
+	var subs []*nats.Subscription
+	for _, m := range []map[string][]*nats.Subscription{s.directSubs, s.groupSubs} {
+		for _, list := range m {
+			subs = append(subs, list...)
+		}
+	}
+	s.directSubs = map[string][]*nats.Subscription{}
+	s.groupSubs = map[string][]*nats.Subscription{}
 	s.handlers = nil
 	s.errHandlers = nil
-	return nil
+	s.eventHandlers = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for _, sub := range subs {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) && !errors.Is(err, nats.ErrBadSubscription) {
+			errs = append(errs, err)
+		}
+	}
+	if s.nats != nil {
+		s.nats.StopSync()
+	}
+	return errors.Join(errs...)
 }
 
 // --- 存储相关API ---
@@ -986,7 +1382,21 @@ func (s *Service) MarkAsRead(conversationID string, before time.Time) error {
 	if s.storage == nil {
 		return errors.New("storage not initialized")
 	}
-	return s.storage.MarkAsRead(conversationID, before)
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	unread, err := s.storage.GetUnreadMessageIDs(conversationID, before, self)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.MarkAsRead(conversationID, before); err != nil {
+		return err
+	}
+	// 已读回执发送失败不影响本地已读状态
+	if err := s.sendReceipt(conversationID, storage.DeliveryRead, unread); err != nil {
+		slog.Warn("发送已读回执失败", "cid", conversationID, "error", err)
+	}
+	return nil
 }
 
 // GetConversation 获取会话信息
@@ -997,6 +1407,14 @@ func (s *Service) GetConversation(conversationID string) (*storage.StoredConvers
 	return s.storage.GetConversation(conversationID)
 }
 
+// GetConversationSummaries 会话列表：显示名称、未读数、最后一条消息预览和置顶/免打扰状态
+func (s *Service) GetConversationSummaries() ([]*storage.ConversationSummary, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetConversationSummaries()
+}
+
 // SearchMessages 搜索消息
 func (s *Service) SearchMessages(query string, limit int) ([]*storage.StoredMessage, error) {
 	if s.storage == nil {
@@ -1005,6 +1423,14 @@ func (s *Service) SearchMessages(query string, limit int) ([]*storage.StoredMess
 	return s.storage.SearchMessages(query, limit)
 }
 
+// Search 全文搜索消息，支持会话、发送者和时间范围过滤，结果带高亮摘要
+func (s *Service) Search(opts storage.SearchOptions) ([]*storage.SearchResult, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.Search(opts)
+}
+
 // SaveMessage 手动保存消息（可选）
 func (s *Service) SaveMessage(msg *storage.StoredMessage) error {
 	if s.storage == nil {
@@ -1027,11 +1453,6 @@ func generateUserID() string {
 	return "user_" + randomID()
 }
 
-// generateMessageID 生成消息唯一ID
-func generateMessageID() string {
-	return "msg_" + randomID()
-}
-
 func randomID() string {
 	var b [8]byte
 	if _, err := rand.Read(b[:]); err != nil {
@@ -0,0 +1,116 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 签名校验失败的原因，配合 errors.Is 判断
+var (
+	ErrUnsignedMessage = errors.New("message is not signed")
+	ErrBadSignature    = errors.New("message signature invalid")
+	ErrSenderMismatch  = errors.New("sender does not match signing key")
+)
+
+// AuthError 发送者认证失败的消息，通过 OnError 回调通知
+type AuthError struct {
+	CID     string // 会话 cid 或 群 gid
+	Sender  string // 载荷声称的发送者
+	Signer  string // 载荷携带的签名公钥（U开头）
+	Subject string // 原始 NATS subject
+	Err     error  // ErrUnsignedMessage / ErrBadSignature / ErrSenderMismatch
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("reject message from %s in %s: %v", e.Sender, e.CID, e.Err)
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// signingPayload 构造签名原文：除 sig 以外的所有载荷字段按固定顺序拼接
+func (w *EncWire) signingPayload() []byte {
+	fields := []string{
+		"dchat-wire",
+		strconv.Itoa(w.V),
+		string(w.Kind),
+		w.CID,
+		w.Sender,
+		strconv.FormatInt(w.TS, 10),
+		strconv.FormatUint(uint64(w.KeyID), 10),
+		w.Nonce,
+		w.Cipher,
+		w.Nickname,
+		w.SignerKey,
+	}
+	// 双棘轮字段只在存在时参与签名，保持旧载荷的签名原文不变
+	if w.Enc != "" || w.Ratchet != nil {
+		fields = append(fields, w.Enc, w.Ratchet.String())
+	}
+	return []byte(strings.Join(fields, "\n"))
+}
+
+// signWire 用本地NSC用户私钥为载荷签名
+func (s *Service) signWire(w *EncWire) error {
+	s.mu.RLock()
+	km := s.nscKeyManager
+	s.mu.RUnlock()
+	if km == nil {
+		return errors.New("NSC signing key not loaded")
+	}
+
+	w.SignerKey = km.PublicKey()
+	sig, err := km.Sign(w.signingPayload())
+	if err != nil {
+		return fmt.Errorf("sign wire: %w", err)
+	}
+	w.Sig = B64(sig)
+	return nil
+}
+
+// SetUnsignedCutover 设置签名上线的时间。离线同步时 Hub 在这之前保存的未签名 v0 历史消息仍可读取，
+// 保存为未认证消息（StoredMessage.Unverified）；实时收到的未签名消息一律拒绝。
+// 没有设置时不放行任何未签名消息，App 从配置的 unsigned_cutover 读取
+func (s *Service) SetUnsignedCutover(t time.Time) {
+	s.mu.Lock()
+	s.unsignedCutover = t
+	s.mu.Unlock()
+}
+
+// acceptUnsigned 未签名的载荷是否是签名上线前保存在 Hub 上的 v0 历史消息
+func (s *Service) acceptUnsigned(w *EncWire, storedAt time.Time) bool {
+	s.mu.RLock()
+	cutover := s.unsignedCutover
+	s.mu.RUnlock()
+	return w.V == 0 && w.Sig == "" && w.SignerKey == "" && !storedAt.IsZero() && storedAt.Before(cutover)
+}
+
+// verifyWire 校验载荷签名，并确认 Sender 就是签名公钥派生出的用户ID。
+// 没有签名的载荷（包括 v0 旧载荷）返回 ErrUnsignedMessage，只有离线同步的历史消息可以经 acceptUnsigned 放行
+func verifyWire(w *EncWire, subject string) (verified bool, err error) {
+	reject := func(reason error) (bool, error) {
+		return false, &AuthError{CID: w.CID, Sender: w.Sender, Signer: w.SignerKey, Subject: subject, Err: reason}
+	}
+
+	if w.Sig == "" || w.SignerKey == "" {
+		return reject(ErrUnsignedMessage)
+	}
+	sig, err := B64Dec(w.Sig)
+	if err != nil {
+		return reject(ErrBadSignature)
+	}
+	if err := VerifyNSCSignature(w.SignerKey, w.signingPayload(), sig); err != nil {
+		return reject(ErrBadSignature)
+	}
+
+	chatPub, err := GetChatPubKeyFromNSCPub(w.SignerKey)
+	if err != nil {
+		return reject(ErrBadSignature)
+	}
+	if deriveUserIDFromPubKey(chatPub) != w.Sender {
+		return reject(ErrSenderMismatch)
+	}
+	return true, nil
+}
@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// drainTimeout 离开会话时等待订阅排空的最长时间
+const drainTimeout = 2 * time.Second
+
+// addSubs 登记会话的订阅并清除离开记录；并发的 Join 已经先登记过时退订多余的这份
+func (s *Service) addSubs(m map[string][]*nats.Subscription, cid string, subs []*nats.Subscription) {
+	s.mu.Lock()
+	_, exists := m[cid]
+	_, wasLeft := s.left[cid]
+	if !exists {
+		m[cid] = subs
+		delete(s.left, cid)
+	}
+	s.mu.Unlock()
+	if exists {
+		for _, sub := range subs {
+			_ = sub.Unsubscribe()
+		}
+		return
+	}
+	if wasLeft && s.storage != nil {
+		if err := s.storage.SetConversationLeft(cid, false); err != nil {
+			slog.Warn("清除会话离开记录失败", "cid", cid, "error", err)
+		}
+	}
+}
+
+// loadLeft 把持久化的离开记录读进内存，离线同步据此跳过离开的会话
+func (s *Service) loadLeft() error {
+	if s.storage == nil {
+		return nil
+	}
+	left, err := s.storage.GetLeftConversations()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cid := range left {
+		if _, ok := s.directSubs[cid]; ok {
+			continue
+		}
+		if _, ok := s.groupSubs[cid]; ok {
+			continue
+		}
+		s.left[cid] = struct{}{}
+	}
+	return nil
+}
+
+// trackSync 把会话的消息主题加入或移出离线同步的过滤主题。
+// 失败只记日志：实时订阅不受影响，下次加入或重启同步时会重新按登记的主题更新消费者
+func (s *Service) trackSync(subject string, add bool) {
+	if s.nats == nil {
+		return
+	}
+	var err error
+	if add {
+		err = s.nats.AddSyncSubject(subject)
+	} else {
+		err = s.nats.RemoveSyncSubject(subject)
+	}
+	if err != nil {
+		slog.Warn("更新离线同步主题失败", "subject", subject, "error", err)
+	}
+}
+
+// joined 会话是否处于订阅状态
+func (s *Service) joined(cid string, isGroup bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if isGroup {
+		_, ok := s.groupSubs[cid]
+		return ok
+	}
+	_, ok := s.directSubs[cid]
+	return ok
+}
+
+// hasLeft 会话是否已被离开
+func (s *Service) hasLeft(cid string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.left[cid]
+	return ok
+}
+
+// LeaveDirect 退订私聊会话：不再接收实时消息、正在输入和对方的在线状态，离线同步也不再拉取该会话。
+// 好友公钥和聊天记录保留，离开状态持久保存，重启后不会自动重新订阅；之后可以再次 JoinDirect
+func (s *Service) LeaveDirect(peerID string) error {
+	if peerID == "" {
+		return errors.New("peerID empty")
+	}
+	s.mu.RLock()
+	self := s.user.ID
+	s.mu.RUnlock()
+	return s.leave(deriveCID(self, peerID), false)
+}
+
+// LeaveGroup 退订群：不再接收群消息和正在输入，离线同步也不再拉取该群。
+// 群密钥和聊天记录保留，离开状态持久保存，重启后不会自动重新订阅；之后可以再次 JoinGroup
+func (s *Service) LeaveGroup(gid string) error {
+	if gid == "" {
+		return errors.New("gid empty")
+	}
+	return s.leave(gid, true)
+}
+
+// leave 移除会话登记并排空它的订阅，返回时不会再有该会话的消息回调。
+// 排空期间缓冲区里剩下的消息由 handleEncrypted 按登记丢弃，已经拉取的离线消息由 processOfflineMessage 丢弃
+func (s *Service) leave(cid string, isGroup bool) error {
+	s.mu.Lock()
+	m := s.directSubs
+	if isGroup {
+		m = s.groupSubs
+	}
+	subs := m[cid]
+	delete(m, cid)
+	s.left[cid] = struct{}{}
+	s.mu.Unlock()
+
+	var errs []error
+	if s.storage != nil {
+		if err := s.storage.SetConversationLeft(cid, true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if isGroup {
+		s.trackSync(groupSubject(cid), false)
+	} else {
+		s.trackSync(directSubject(cid), false)
+	}
+
+	// 排空前先监听关闭状态：订阅在缓冲区处理完、回调全部返回后才会关闭
+	var closed []<-chan nats.SubStatus
+	for _, sub := range subs {
+		ch := sub.StatusChanged(nats.SubscriptionClosed)
+		if err := sub.Drain(); err != nil {
+			if !errors.Is(err, nats.ErrConnectionClosed) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		closed = append(closed, ch)
+	}
+	timeout := time.NewTimer(drainTimeout)
+	defer timeout.Stop()
+	for _, ch := range closed {
+		select {
+		case <-ch:
+		case <-timeout.C:
+			slog.Warn("等待订阅排空超时", "cid", cid)
+			return errors.Join(errs...)
+		}
+	}
+	return errors.Join(errs...)
+}
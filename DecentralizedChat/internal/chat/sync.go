@@ -0,0 +1,254 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	natsservice "DecentralizedChat/internal/nats"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SyncProgress 离线同步追赶进度（群聊和私聊两个流合计），随 EventSyncProgress 推送。
+// 拉取到的消息后面还有积压时推送，追平时再推送一次 Finished=true
+type SyncProgress struct {
+	Done     uint64 `json:"done"`
+	Total    uint64 `json:"total"`
+	Finished bool   `json:"finished"`
+}
+
+// SyncGap 离线同步检测到的缺口，随 EventSyncGap 推送
+type SyncGap struct {
+	CID   string `json:"cid"`
+	From  uint64 `json:"from,omitempty"` // 已经过期、再也取不到的流序列号范围（含两端），其中可能有这个会话的消息
+	To    uint64 `json:"to,omitempty"`
+	Reset bool   `json:"reset"` // Hub 上的流被重建或换了 Hub，检查点作废，该会话从头重新同步
+}
+
+// loadSyncCheckpoints 把检查点读进内存，同步过程中每条消息都要查
+func (s *Service) loadSyncCheckpoints() error {
+	if s.storage == nil {
+		return nil
+	}
+	checkpoints, err := s.storage.GetSyncCheckpoints()
+	if err != nil {
+		return err
+	}
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	for _, cp := range checkpoints {
+		s.syncCheckpoints[cp.ConversationID] = cp.LastSeq
+	}
+	return nil
+}
+
+// syncCheckpoint 会话主题已处理到的流序列号
+func (s *Service) syncCheckpoint(subject string) uint64 {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	return s.syncCheckpoints[subjectCID(subject)]
+}
+
+const (
+	quarantineMaxAge  = 30 * 24 * time.Hour // 隔离的消息最多保留多久
+	quarantineMaxRows = 5000                // 隔离表最多保留的消息数，超出时删除最早隔离的
+)
+
+// errUndecryptable 离线消息解密失败
+var errUndecryptable = errors.New("decrypt offline message")
+
+// missingKeyError 解密所需的密钥还没到：新纪元的群密钥、群密钥或好友公钥，补上后可以重试
+type missingKeyError struct {
+	kind string // storage.QuarantineGroupKey / storage.QuarantineFriendKey
+	id   string // 群ID或好友ID
+	err  error
+}
+
+func (e *missingKeyError) Error() string {
+	return fmt.Sprintf("missing %s key for %s: %v", e.kind, e.id, e.err)
+}
+
+func (e *missingKeyError) Unwrap() error { return e.err }
+
+// handleSyncMessage 处理一条离线同步消息并推进会话的检查点。
+// 消费者按检查点回退重建后会重新投递一些已处理过的消息，不超过检查点的直接跳过（隔离中的除外）。
+// 解密失败的消息先隔离：缺少密钥的让消费者稍后重新投递，投递次数用完后留在隔离表里，
+// 等 AddFriendKey/AddGroupKey 或收到新的群密钥纪元时再重试；其余的解密失败不再重试
+func (s *Service) handleSyncMessage(msg *nats.Msg) error {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return s.processOfflineMessage(msg)
+	}
+	seq := meta.Sequence.Stream
+	if seq <= s.syncCheckpoint(msg.Subject) && (meta.NumDelivered == 1 || !s.isQuarantined(msg.Subject, seq)) {
+		return nil
+	}
+
+	err = s.processOfflinePayload(msg.Subject, msg.Data, seq, meta.Timestamp)
+	if errors.Is(err, errUndecryptable) {
+		if s.quarantine(msg.Subject, seq, meta.Timestamp, msg.Data, err) && meta.NumDelivered < natsservice.MaxSyncDeliveries {
+			// 还会重新投递，先不推进检查点
+			return fmt.Errorf("%w: %w", natsservice.ErrSyncRetry, err)
+		}
+	} else if meta.NumDelivered > 1 {
+		s.releaseQuarantine(msg.Subject, seq)
+	}
+	s.saveSyncCheckpoint(subjectCID(msg.Subject), meta.Stream, seq)
+	return err
+}
+
+// quarantine 把解密失败的离线消息放进隔离表（已经在的更新尝试次数和原因），返回是否因为缺少密钥
+func (s *Service) quarantine(subject string, seq uint64, storedAt time.Time, data []byte, cause error) bool {
+	var mk *missingKeyError
+	missing := errors.As(cause, &mk)
+	if s.storage == nil {
+		return missing
+	}
+	var w EncWire
+	_ = json.Unmarshal(data, &w)
+	q := &storage.QuarantinedMessage{
+		Subject:        subject,
+		NatsSeq:        seq,
+		StoredAt:       storedAt,
+		ConversationID: subjectCID(subject),
+		SenderID:       w.Sender,
+		Reason:         cause.Error(),
+		Payload:        data,
+	}
+	if missing {
+		q.KeyKind, q.KeyID = mk.kind, mk.id
+	}
+	if err := s.storage.QuarantineMessage(q); err != nil {
+		slog.Warn("隔离离线消息失败", "subject", subject, "seq", seq, "error", err)
+	}
+	if n, err := s.storage.PurgeQuarantine(time.Now().Add(-quarantineMaxAge), quarantineMaxRows); err != nil {
+		slog.Warn("清理隔离表失败", "error", err)
+	} else if n > 0 {
+		slog.Info("清理过期的隔离消息", "count", n)
+	}
+	return missing
+}
+
+// isQuarantined 消息是否在隔离表里
+func (s *Service) isQuarantined(subject string, seq uint64) bool {
+	if s.storage == nil {
+		return false
+	}
+	q, err := s.storage.GetQuarantinedMessage(subject, seq)
+	return err == nil && q != nil
+}
+
+// releaseQuarantine 消息已经处理，移出隔离表
+func (s *Service) releaseQuarantine(subject string, seq uint64) {
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.DeleteQuarantinedMessage(subject, seq); err != nil {
+		slog.Warn("移出隔离消息失败", "subject", subject, "seq", seq, "error", err)
+	}
+}
+
+// retryQuarantined 补上密钥后重试因为缺少它而隔离的消息；仍然失败（比如还差更新的纪元、签名无效）的更新原因后继续隔离，
+// 只有处理成功的才移出隔离表
+func (s *Service) retryQuarantined(kind, id string) {
+	if s.storage == nil {
+		return
+	}
+	msgs, err := s.storage.GetQuarantinedMessages(kind, id)
+	if err != nil {
+		slog.Warn("读取隔离消息失败", "key_kind", kind, "key_id", id, "error", err)
+		return
+	}
+	for _, q := range msgs {
+		// 旧记录没有保存时间，用第一次隔离的时间（只会更晚）
+		storedAt := q.StoredAt
+		if storedAt.IsZero() {
+			storedAt = q.CreatedAt
+		}
+		err := s.processOfflinePayload(q.Subject, q.Payload, q.NatsSeq, storedAt)
+		if err != nil {
+			// 失败的留在隔离表里，记下新的原因并累加重试次数
+			if !errors.Is(err, errUndecryptable) {
+				slog.Warn("重试隔离消息失败", "subject", q.Subject, "seq", q.NatsSeq, "error", err)
+			}
+			s.quarantine(q.Subject, q.NatsSeq, storedAt, q.Payload, err)
+			continue
+		}
+		slog.Info("隔离消息重试成功", "subject", q.Subject, "seq", q.NatsSeq)
+		s.releaseQuarantine(q.Subject, q.NatsSeq)
+	}
+}
+
+// GetQuarantinedMessages 离线同步中解密失败、仍在隔离的消息，按流序列号排列
+func (s *Service) GetQuarantinedMessages() ([]*storage.QuarantinedMessage, error) {
+	if s.storage == nil {
+		return nil, errors.New("storage not initialized")
+	}
+	return s.storage.GetQuarantinedMessages("", "")
+}
+
+// saveSyncCheckpoint 推进检查点，只前进不后退
+func (s *Service) saveSyncCheckpoint(cid, stream string, seq uint64) {
+	if cid == "" {
+		return
+	}
+	s.syncMu.Lock()
+	if seq <= s.syncCheckpoints[cid] {
+		s.syncMu.Unlock()
+		return
+	}
+	s.syncCheckpoints[cid] = seq
+	s.syncMu.Unlock()
+
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.SaveSyncCheckpoint(cid, stream, seq); err != nil {
+		slog.Warn("保存同步检查点失败", "cid", cid, "seq", seq, "error", err)
+	}
+}
+
+// handleSyncGap 转发缺口事件；流被重建时作废会话的检查点，新流上的序列号从头开始
+func (s *Service) handleSyncGap(gap natsservice.SyncGap) {
+	cid := subjectCID(gap.Subject)
+	if gap.Reset {
+		s.syncMu.Lock()
+		delete(s.syncCheckpoints, cid)
+		s.syncMu.Unlock()
+		if s.storage != nil {
+			if err := s.storage.DeleteSyncCheckpoint(cid); err != nil {
+				slog.Warn("删除同步检查点失败", "cid", cid, "error", err)
+			}
+		}
+	}
+	s.dispatchEvent(EventSyncGap, &SyncGap{CID: cid, From: gap.From, To: gap.To, Reset: gap.Reset})
+}
+
+// handleSyncProgress 合计两个流的进度后推送。实时到达、一批就拉完的消息不推送，
+// 只有出现积压（开始追赶）后才推送，追平时推送最后一次并清零
+func (s *Service) handleSyncProgress(p natsservice.SyncProgress) {
+	s.syncMu.Lock()
+	s.syncProgress[p.Kind] = p
+	sum := &SyncProgress{Finished: true}
+	for _, q := range s.syncProgress {
+		sum.Done += q.Done
+		sum.Total += q.Total
+		if q.Done < q.Total {
+			sum.Finished = false
+		}
+	}
+	emit := s.syncCatchingUp || !sum.Finished
+	s.syncCatchingUp = !sum.Finished
+	if sum.Finished {
+		clear(s.syncProgress)
+	}
+	s.syncMu.Unlock()
+
+	if emit {
+		s.dispatchEvent(EventSyncProgress, sum)
+	}
+}
@@ -20,6 +20,8 @@ type Config struct {
 	UI         UIConfig       `json:"ui"`
 	Keys       KeysConfig     `json:"keys"`
 	LogLevel   string         `json:"log_level"` // 日志级别: debug, info, warn, error
+	// UnsignedCutover 签名上线的时间，Hub 在这之前保存的未签名历史消息仍可读取；为空时首次启动记录当前时间
+	UnsignedCutover time.Time `json:"unsigned_cutover"`
 }
 
 type UserConfig struct {
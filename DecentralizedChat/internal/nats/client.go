@@ -19,11 +19,18 @@ type Service struct {
 	// ========== 离线消息同步相关字段 ==========
 	js              nats.JetStreamContext // JetStream上下文
 	syncCfg         *OfflineSyncConfig    // 同步配置
-	syncSubGroup    *nats.Subscription    // 群聊同步订阅
-	syncSubDirect   *nats.Subscription    // 私聊同步订阅
+	syncStreams     map[string]*syncStream // 按流名称登记的过滤主题和拉取订阅
 	syncCtx         context.Context       // 同步协程上下文
 	syncCancel      context.CancelFunc    // 同步取消函数
 	syncRunning     bool                  // 同步状态
+
+	kvBuckets  map[string]nats.KeyValue    // 已绑定的 KV 桶
+	objBuckets map[string]nats.ObjectStore // 已绑定的对象存储桶
+
+	reconnectHandlers []func() // 断线重连成功后的回调
+
+	pubAckTimeout      time.Duration // JetStream 发布等待确认的超时
+	pubAsyncMaxPending int           // 异步发布最多同时等待确认的条数，0 表示用 nats.go 的默认值
 }
 
 type ClientConfig struct {
@@ -37,11 +44,14 @@ type ClientConfig struct {
 	MaxReconnect   int                       // Max reconnect attempts (-1 infinite)
 	ReconnectWait  time.Duration             // Wait between reconnect attempts
 	InProcessServer nats.InProcessConnProvider // 同一进程内的 NATS server，走内存管道，不走 TCP
+	PublishAckTimeout      time.Duration // JetStream 发布（含异步）等待 Hub 确认的超时，默认 5s
+	PublishAsyncMaxPending int           // 异步发布最多同时等待确认的条数，超过后发布阻塞，默认 4000
 }
 
 // NewService creates a NATS client service with auth support
 func NewService(cfg ClientConfig) (*Service, error) {
 	var opts []nats.Option
+	var svc *Service // 重连回调里使用，连接建立后赋值
 
 	// Auth priority: creds -> token -> user/pass
 	if cfg.CredsFile != "" {
@@ -91,6 +101,9 @@ func NewService(cfg ClientConfig) (*Service, error) {
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
 			slog.Info("NATS reconnected", "url", nc.ConnectedUrl())
+			if svc != nil {
+				svc.notifyReconnect()
+			}
 		}),
 	)
 
@@ -102,16 +115,54 @@ func NewService(cfg ClientConfig) (*Service, error) {
 	// 初始化同步上下文
 	syncCtx, syncCancel := context.WithCancel(context.Background())
 
-	return &Service{
+	pubAckTimeout := cfg.PublishAckTimeout
+	if pubAckTimeout <= 0 {
+		pubAckTimeout = defaultPublishAckTimeout
+	}
+
+	svc = &Service{
 		conn: nc,
+		syncStreams: map[string]*syncStream{},
 		syncCtx: syncCtx,
 		syncCancel: syncCancel,
-	}, nil
+		pubAckTimeout: pubAckTimeout,
+		pubAsyncMaxPending: cfg.PublishAsyncMaxPending,
+	}
+	return svc, nil
+}
+
+// OnReconnect 注册断线重连成功后的回调（在 NATS 的回调协程里执行，不要阻塞）
+func (s *Service) OnReconnect(h func()) {
+	if h == nil {
+		return
+	}
+	s.mu.Lock()
+	s.reconnectHandlers = append(s.reconnectHandlers, h)
+	s.mu.Unlock()
 }
 
-func (s *Service) Subscribe(subject string, handler func(msg *nats.Msg)) error {
-	_, err := s.conn.Subscribe(subject, handler)
-	return err
+// notifyReconnect 通知重连回调
+func (s *Service) notifyReconnect() {
+	s.mu.RLock()
+	handlers := s.reconnectHandlers
+	s.mu.RUnlock()
+	for _, h := range handlers {
+		h()
+	}
+}
+
+// Subscribe 订阅主题，返回的订阅由调用方在不再需要时 Unsubscribe 或 Drain
+func (s *Service) Subscribe(subject string, handler func(msg *nats.Msg)) (*nats.Subscription, error) {
+	sub, err := s.conn.Subscribe(subject, handler)
+	if err != nil {
+		return nil, err
+	}
+	// 等服务端确认订阅，避免紧接着发布的消息丢失
+	if err := s.conn.Flush(); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+	return sub, nil
 }
 
 func (s *Service) Publish(subject string, data []byte) error {
@@ -145,33 +196,17 @@ func (s *Service) RequestJSON(subject string, data interface{}, timeout time.Dur
 	return msg, nil
 }
 
-// PublishJetStream 发布JetStream消息，返回序列ID
-func (s *Service) PublishJetStream(subject string, data []byte) (uint64, error) {
-	if s.js == nil {
-		var err error
-		s.js, err = s.conn.JetStream(nats.Domain("hub"))
-		if err != nil {
-			return 0, err
-		}
-	}
-	ack, err := s.js.Publish(subject, data)
-	if err != nil {
-		return 0, err
-	}
-	return ack.Sequence, nil
-}
-
 // SubscribeJSON subscribes and forwards raw JSON payload to handler
-func (s *Service) SubscribeJSON(subject string, handler func(data []byte) error) error {
-	_, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
+func (s *Service) SubscribeJSON(subject string, handler func(data []byte) error) (*nats.Subscription, error) {
+	sub, err := s.conn.Subscribe(subject, func(msg *nats.Msg) {
 		if err := handler(msg.Data); err != nil {
 			slog.Error("failed to process JSON message", "error", err, "subject", subject)
 		}
 	})
 	if err != nil {
-		return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
 	}
-	return nil
+	return sub, nil
 }
 
 func (s *Service) Close() error {
@@ -0,0 +1,120 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// hubDomain Hub 上的 JetStream domain，流和 KV 桶都在这里
+const hubDomain = "hub"
+
+// jetStream 返回 Hub domain 的 JetStream 上下文，第一次使用时创建
+func (s *Service) jetStream() (nats.JetStreamContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.js == nil {
+		opts := []nats.JSOpt{nats.Domain(hubDomain), nats.PublishAsyncTimeout(s.pubAckTimeout)}
+		if s.pubAsyncMaxPending > 0 {
+			opts = append(opts, nats.PublishAsyncMaxPending(s.pubAsyncMaxPending))
+		}
+		js, err := s.conn.JetStream(opts...)
+		if err != nil {
+			return nil, err
+		}
+		s.js = js
+	}
+	return s.js, nil
+}
+
+// KeyValue 绑定 Hub 上的 KV 桶，不存在时按默认配置创建（线上由运维预先创建多副本的桶）
+func (s *Service) KeyValue(bucket string) (nats.KeyValue, error) {
+	s.mu.RLock()
+	kv, ok := s.kvBuckets[bucket]
+	s.mu.RUnlock()
+	if ok {
+		return kv, nil
+	}
+
+	js, err := s.jetStream()
+	if err != nil {
+		return nil, fmt.Errorf("jetstream init failed: %w", err)
+	}
+	kv, err = js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			History: 1,
+			Storage: nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bind kv bucket %s: %w", bucket, err)
+	}
+
+	s.mu.Lock()
+	if s.kvBuckets == nil {
+		s.kvBuckets = make(map[string]nats.KeyValue)
+	}
+	s.kvBuckets[bucket] = kv
+	s.mu.Unlock()
+	return kv, nil
+}
+
+// KVPut 写入一个键，返回新的版本号
+func (s *Service) KVPut(bucket, key string, value []byte) (uint64, error) {
+	kv, err := s.KeyValue(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Put(key, value)
+}
+
+// KVGet 读取一个键的值和版本号，不存在时返回 nats.ErrKeyNotFound
+func (s *Service) KVGet(bucket, key string) ([]byte, uint64, error) {
+	kv, err := s.KeyValue(bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry, err := kv.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry.Value(), entry.Revision(), nil
+}
+
+// KVDelete 删除一个键；lastRevision 非0时只在版本号一致时删除，用于并发领取
+func (s *Service) KVDelete(bucket, key string, lastRevision uint64) error {
+	kv, err := s.KeyValue(bucket)
+	if err != nil {
+		return err
+	}
+	if lastRevision > 0 {
+		return kv.Delete(key, nats.LastRevision(lastRevision))
+	}
+	return kv.Delete(key)
+}
+
+// KVKeys 列出匹配 pattern（支持 * 和 > 通配符）的现存键
+func (s *Service) KVKeys(bucket, pattern string) ([]string, error) {
+	kv, err := s.KeyValue(bucket)
+	if err != nil {
+		return nil, err
+	}
+	w, err := kv.Watch(pattern, nats.IgnoreDeletes(), nats.MetaOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	var keys []string
+	for entry := range w.Updates() {
+		// nil 表示已经收到全部现存的键
+		if entry == nil {
+			break
+		}
+		keys = append(keys, entry.Key())
+	}
+	return keys, nil
+}
@@ -0,0 +1,60 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ObjectStore 绑定 Hub 上的对象存储桶，不存在时按默认配置创建（线上由运维预先创建多副本的桶）
+func (s *Service) ObjectStore(bucket string) (nats.ObjectStore, error) {
+	s.mu.RLock()
+	obs, ok := s.objBuckets[bucket]
+	s.mu.RUnlock()
+	if ok {
+		return obs, nil
+	}
+
+	js, err := s.jetStream()
+	if err != nil {
+		return nil, fmt.Errorf("jetstream init failed: %w", err)
+	}
+	obs, err = js.ObjectStore(bucket)
+	if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+		obs, err = js.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:  bucket,
+			Storage: nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bind object store %s: %w", bucket, err)
+	}
+
+	s.mu.Lock()
+	if s.objBuckets == nil {
+		s.objBuckets = make(map[string]nats.ObjectStore)
+	}
+	s.objBuckets[bucket] = obs
+	s.mu.Unlock()
+	return obs, nil
+}
+
+// PutObject 把 r 的内容按块上传为一个对象，返回对象信息
+func (s *Service) PutObject(bucket, name string, r io.Reader) (*nats.ObjectInfo, error) {
+	obs, err := s.ObjectStore(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return obs.Put(&nats.ObjectMeta{Name: name}, r)
+}
+
+// GetObject 打开一个对象用于读取，调用方负责 Close；读完时会校验摘要
+func (s *Service) GetObject(bucket, name string) (nats.ObjectResult, error) {
+	obs, err := s.ObjectStore(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return obs.Get(name)
+}
@@ -1,9 +1,13 @@
 package nats
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -11,108 +15,337 @@ import (
 
 // OfflineSyncConfig 同步配置
 type OfflineSyncConfig struct {
-	UserID         string                // 当前用户ID
-	MessageHandler func(*nats.Msg) error // 消息处理回调，支持获取NATS元数据
-	ErrorHandler   func(error)           // 错误处理回调
+	UserID          string                      // 当前用户ID
+	MessageHandler  func(*nats.Msg) error       // 消息处理回调，支持获取NATS元数据
+	ErrorHandler    func(error)                 // 错误处理回调
+	Checkpoint      func(subject string) uint64 // 会话主题已处理到的流序列号，没有记录返回 0
+	GapHandler      func(SyncGap)               // 检测到缺口时回调
+	ProgressHandler func(SyncProgress)          // 每拉取一批回调一次追赶进度
 }
 
+// SyncGap 离线同步检测到的缺口
+type SyncGap struct {
+	Subject string
+	From    uint64 // 取不到的流序列号范围（含两端），Reset 时为 0
+	To      uint64
+	Reset   bool // 检查点超过了流的最后序列号：流被重建或换了 Hub，检查点作废
+}
+
+// SyncProgress 一个流的追赶进度：本轮已处理 Done 条，共 Total 条，Done == Total 时追平
+type SyncProgress struct {
+	Kind  string // "group" / "direct"
+	Done  uint64
+	Total uint64
+}
+
+// ErrSyncRetry MessageHandler 返回包装了它的错误时消息不 ACK，按 syncRetryBackoff 延迟后重新投递，
+// 用于解密所需的密钥暂时还没到这类一会儿就能恢复的失败
+var ErrSyncRetry = errors.New("offline message retry later")
+
+// MaxSyncDeliveries 一条离线消息最多投递的次数，超过后不再重试（由 MessageHandler 自行隔离）
+const MaxSyncDeliveries = 5
+
+// syncRetryBackoff 第 n 次投递失败后等待 syncRetryBackoff[n-1] 再重新投递
+var syncRetryBackoff = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
 // InitOfflineMirror 初始化离线同步（直接跨domain消费Hub上的流，无需本地镜像）
 func (s *Service) InitOfflineMirror(cfg *OfflineSyncConfig) error {
 	if s.conn == nil || !s.conn.IsConnected() {
 		return fmt.Errorf("nats not connected")
 	}
 
-	// 初始化JetStream上下文，指定Hub的domain前缀
-	js, err := s.conn.JetStream(nats.Domain("hub"))
-	if err != nil {
+	// 初始化JetStream上下文，指定Hub的domain前缀（和发布共用）
+	if _, err := s.jetStream(); err != nil {
 		return fmt.Errorf("jetstream init failed: %w", err)
 	}
-	s.js = js
 	s.syncCfg = cfg
 
 	slog.Info("✅ 离线同步初始化成功，直接消费Hub domain流")
 	return nil
 }
 
-// StartSync 启动同步协程
-func (s *Service) StartSync() error {
-	if s.js == nil || s.syncCfg == nil {
-		return fmt.Errorf("mirror not initialized")
+// 离线同步消费的 Hub 流
+const (
+	groupStream  = "DChatGroups"
+	directStream = "DChatDirect"
+)
+
+// syncStream 一个流上的离线同步：已加入会话的消息主题作为持久消费者的过滤主题
+type syncStream struct {
+	kind     string              // "group" / "direct"，用于日志和错误
+	durable  string              // 消费者名前缀，后接用户ID
+	subjects map[string]struct{} // 过滤主题
+	sub      *nats.Subscription  // 拉取订阅，同步未启动或没有主题时为 nil
+	applyMu  sync.Mutex          // 串行更新 Hub 上的消费者，和 Hub 之间的请求不在 s.mu 里进行
+	// 正在用临时消费者补拉历史的主题，补完之前不加进持久消费者的过滤主题
+	backfilling map[string]struct{}
+}
+
+// syncStreamOf 按主题前缀选择所在的流
+func syncStreamOf(subject string) (string, error) {
+	switch {
+	case strings.HasPrefix(subject, "dchat.grp."):
+		return groupStream, nil
+	case strings.HasPrefix(subject, "dchat.dm."):
+		return directStream, nil
+	}
+	return "", fmt.Errorf("no sync stream for subject %s", subject)
+}
+
+// AddSyncSubject 把会话的消息主题加入离线同步，重复加入无影响。
+// 同步未启动时只做登记，StartSync 时按登记的主题创建消费者
+func (s *Service) AddSyncSubject(subject string) error {
+	stream, err := syncStreamOf(subject)
+	if err != nil {
+		return err
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	st := s.syncStreams[stream]
+	if st == nil {
+		st = &syncStream{kind: "direct", durable: "sync_consumer_dm", subjects: map[string]struct{}{}, backfilling: map[string]struct{}{}}
+		if stream == groupStream {
+			st.kind, st.durable = "group", "sync_consumer_grp"
+		}
+		s.syncStreams[stream] = st
+	}
+	if _, ok := st.subjects[subject]; ok {
+		s.mu.Unlock()
+		return nil
+	}
+	st.subjects[subject] = struct{}{}
+	running := s.syncRunning
+	s.mu.Unlock()
 
-	if s.syncRunning {
+	if !running {
+		return nil
+	}
+	return s.applySyncStream(stream, st)
+}
+
+// RemoveSyncSubject 把会话的消息主题移出离线同步，之后不再拉取该会话的消息
+func (s *Service) RemoveSyncSubject(subject string) error {
+	stream, err := syncStreamOf(subject)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	st := s.syncStreams[stream]
+	if st == nil {
+		s.mu.Unlock()
 		return nil
 	}
+	if _, ok := st.subjects[subject]; !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(st.subjects, subject)
+	running := s.syncRunning
+	s.mu.Unlock()
+
+	if !running {
+		return nil
+	}
+	return s.applySyncStream(stream, st)
+}
+
+// filter 排序后的过滤主题（不含正在补拉的），调用方持有 s.mu
+func (st *syncStream) filter() []string {
+	subjects := make([]string, 0, len(st.subjects))
+	for subj := range st.subjects {
+		if _, ok := st.backfilling[subj]; !ok {
+			subjects = append(subjects, subj)
+		}
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// applySyncStream 按登记的主题更新流上的持久消费者（不存在时创建），没有拉取协程时启动一个。
+// 主题为空时只停掉拉取订阅、保留 Hub 上的消费者：过滤主题为空等于消费整个流。
+// 调用方不持有 s.mu：只在锁里取主题快照和换订阅，和 Hub 之间的请求在锁外进行，检测到的缺口最后才回调
+func (s *Service) applySyncStream(stream string, st *syncStream) error {
+	gaps, err := s.updateSyncStream(stream, st)
+	for _, gap := range gaps {
+		s.reportGap(gap)
+	}
+	return err
+}
+
+// updateSyncStream applySyncStream 的主体，同一个流的更新由 applyMu 串行，返回需要回调的缺口
+func (s *Service) updateSyncStream(stream string, st *syncStream) ([]SyncGap, error) {
+	st.applyMu.Lock()
+	defer st.applyMu.Unlock()
+
+	s.mu.Lock()
+	if !s.syncRunning {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	ctx, sub, subjects := s.syncCtx, st.sub, st.filter()
+	if len(subjects) == 0 && sub != nil {
+		_ = sub.Unsubscribe()
+		st.sub = nil
+	}
+	s.mu.Unlock()
+	if len(subjects) == 0 {
+		return nil, nil
+	}
 
-	// ========== 订阅Hub上的群聊流 ==========
-	subGroup, err := s.js.PullSubscribe("dchat.grp.*.msg",
-		fmt.Sprintf("sync_consumer_grp_%s", s.syncCfg.UserID),
-		nats.DeliverAll(),
-		nats.AckExplicit(),
-		nats.BindStream("DChatGroups"),
-	)
+	durable := fmt.Sprintf("%s_%s", st.durable, s.syncCfg.UserID)
+	plan, err := s.ensureSyncConsumer(stream, durable, subjects)
+	gaps := plan.gaps
 	if err != nil {
-		return fmt.Errorf("create group subscription failed: %w", err)
+		return gaps, fmt.Errorf("update %s sync consumer failed: %w", st.kind, err)
 	}
-	s.syncSubGroup = subGroup
 
-	// ========== 订阅Hub上的私聊流 ==========
-	subDirect, err := s.js.PullSubscribe("dchat.dm.*.msg",
-		fmt.Sprintf("sync_consumer_dm_%s", s.syncCfg.UserID),
-		nats.DeliverAll(),
-		nats.AckExplicit(),
-		nats.BindStream("DChatDirect"),
-	)
+	s.mu.Lock()
+	if !s.syncRunning || s.syncCtx != ctx {
+		s.mu.Unlock()
+		return gaps, nil
+	}
+	for subj, from := range plan.backfill {
+		if _, ok := st.subjects[subj]; ok {
+			st.backfilling[subj] = struct{}{}
+			go s.backfillSync(ctx, stream, st, subj, from)
+		}
+	}
+	if len(plan.active) == 0 && st.sub != nil {
+		_ = st.sub.Unsubscribe()
+		st.sub = nil
+	}
+	s.mu.Unlock()
+	if len(plan.active) == 0 || (sub != nil && !plan.recreated) {
+		return gaps, nil
+	}
+
+	newSub, err := s.js.PullSubscribe("", durable, nats.Bind(stream, durable))
 	if err != nil {
-		return fmt.Errorf("create direct subscription failed: %w", err)
+		return gaps, fmt.Errorf("create %s subscription failed: %w", st.kind, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 请求 Hub 期间同步被停止（或停止后又重新启动）时丢掉这个订阅
+	if !s.syncRunning || s.syncCtx != ctx {
+		_ = newSub.Unsubscribe()
+		return gaps, nil
+	}
+	if st.sub != nil {
+		_ = st.sub.Unsubscribe()
+	}
+	st.sub = newSub
+	go s.syncLoop(ctx, stream, st, newSub)
+	return gaps, nil
+}
+
+// recoverSyncStream 拉取时发现 Hub 上的消费者没了，按检查点重建并换上新的拉取订阅
+func (s *Service) recoverSyncStream(stream string, st *syncStream, sub *nats.Subscription) error {
+	s.mu.RLock()
+	current := s.syncRunning && st.sub == sub
+	s.mu.RUnlock()
+	if !current {
+		return nil
 	}
-	s.syncSubDirect = subDirect
+	return s.applySyncStream(stream, st)
+}
 
+// StartSync 启动同步：每个流一个持久消费者，只过滤已加入会话的消息主题，不再拉取整个流
+func (s *Service) StartSync() error {
+	if s.js == nil || s.syncCfg == nil {
+		return fmt.Errorf("mirror not initialized")
+	}
+
+	s.mu.Lock()
+	if s.syncRunning {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.syncCtx.Err() != nil {
+		s.syncCtx, s.syncCancel = context.WithCancel(context.Background())
+	}
 	s.syncRunning = true
+	s.mu.Unlock()
 
-	// 启动两个后台协程分别同步群聊和私聊
-	go s.syncLoop("group", s.syncSubGroup)
-	go s.syncLoop("direct", s.syncSubDirect)
+	for _, stream := range []string{groupStream, directStream} {
+		s.mu.RLock()
+		st := s.syncStreams[stream]
+		s.mu.RUnlock()
+		if st == nil {
+			continue
+		}
+		if err := s.applySyncStream(stream, st); err != nil {
+			s.mu.Lock()
+			s.stopSyncLocked()
+			s.mu.Unlock()
+			return err
+		}
+	}
 
-	slog.Info("✅ 离线消息同步已启动（群聊+私聊）")
+	s.mu.RLock()
+	subjects := 0
+	for _, st := range s.syncStreams {
+		subjects += len(st.subjects)
+	}
+	s.mu.RUnlock()
+	slog.Info("✅ 离线消息同步已启动", "subjects", subjects)
 	return nil
 }
 
-// StopSync 停止同步
+// StopSync 停止同步，登记的主题保留，再次 StartSync 时继续使用
 func (s *Service) StopSync() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.syncSubGroup != nil {
-		_ = s.syncSubGroup.Unsubscribe()
-		s.syncSubGroup = nil
-	}
-	if s.syncSubDirect != nil {
-		_ = s.syncSubDirect.Unsubscribe()
-		s.syncSubDirect = nil
+	s.stopSyncLocked()
+	slog.Info("🛑 离线消息同步已停止")
+}
+
+// stopSyncLocked 退订全部拉取订阅并结束同步协程，调用方持有 s.mu
+func (s *Service) stopSyncLocked() {
+	for _, st := range s.syncStreams {
+		if st.sub != nil {
+			_ = st.sub.Unsubscribe()
+			st.sub = nil
+		}
+		// 补拉协程随 syncCtx 结束，下次启动时重新判断
+		clear(st.backfilling)
 	}
 	if s.syncCancel != nil {
 		s.syncCancel()
 	}
 	s.syncRunning = false
-	slog.Info("🛑 离线消息同步已停止")
 }
 
 // syncLoop 同步主循环，支持群聊和私聊两个流
-func (s *Service) syncLoop(streamType string, sub *nats.Subscription) {
+func (s *Service) syncLoop(ctx context.Context, stream string, st *syncStream, sub *nats.Subscription) {
+	streamType := st.kind
 	defer slog.Info("🛑 同步协程已退出", "type", streamType)
 
+	var done uint64 // 本轮追赶已处理的条数，追平后清零
+
 	for {
 		select {
-		case <-s.syncCtx.Done():
+		case <-ctx.Done():
 			return
 		default:
 			// 每次拉取10条消息
 			msgs, err := sub.Fetch(10, nats.MaxWait(5*time.Second))
 			if err != nil {
+				// 会话全部离开或停止同步时订阅已退订
+				if !sub.IsValid() {
+					return
+				}
+				if errors.Is(err, nats.ErrConsumerNotFound) || errors.Is(err, nats.ErrConsumerDeleted) || errors.Is(err, nats.ErrNoResponders) {
+					slog.Warn("Hub 上的同步消费者丢失，按检查点重建", "type", streamType, "error", err)
+					// 稍等再重建：删除消费者的请求可能还没处理完
+					time.Sleep(1 * time.Second)
+					if err := s.recoverSyncStream(stream, st, sub); err != nil {
+						slog.Error("重建同步消费者失败", "type", streamType, "error", err)
+					}
+					continue
+				}
 				if err == nats.ErrTimeout || strings.Contains(err.Error(), "context canceled") {
 					continue
 				}
@@ -128,17 +361,46 @@ func (s *Service) syncLoop(streamType string, sub *nats.Subscription) {
 				slog.Info("拉取到消息", "type", streamType, "count", len(msgs))
 			}
 
+			var pending uint64
 			for _, msg := range msgs {
-				// 调用回调处理
-				if s.syncCfg.MessageHandler != nil {
-					err := s.syncCfg.MessageHandler(msg)
-					if err != nil {
-						slog.Error("处理离线消息失败", "error", err, "subject", msg.Subject)
-					}
+				if meta := s.processSyncMsg(msg); meta != nil {
+					pending = meta.NumPending
 				}
-				// 无论处理结果都ACK，避免重复消费
-				_ = msg.Ack()
+				done++
+			}
+			if len(msgs) > 0 && s.syncCfg.ProgressHandler != nil {
+				s.syncCfg.ProgressHandler(SyncProgress{Kind: streamType, Done: done, Total: done + pending})
+			}
+			if pending == 0 {
+				done = 0
 			}
 		}
 	}
 }
+
+// processSyncMsg 交给 MessageHandler 处理一条离线消息并 ACK，需要重试时延迟重新投递。返回消息的元数据，取不到时为 nil
+func (s *Service) processSyncMsg(msg *nats.Msg) *nats.MsgMetadata {
+	meta, metaErr := msg.Metadata()
+	// 调用回调处理
+	var err error
+	if s.syncCfg.MessageHandler != nil {
+		err = s.syncCfg.MessageHandler(msg)
+	}
+	switch {
+	case errors.Is(err, ErrSyncRetry) && metaErr == nil && meta.NumDelivered < MaxSyncDeliveries:
+		// 稍后重新投递；最后一次投递的失败由 MessageHandler 自行隔离，照常 ACK
+		delay := syncRetryBackoff[min(int(meta.NumDelivered), len(syncRetryBackoff))-1]
+		slog.Warn("离线消息稍后重试", "subject", msg.Subject, "delivered", meta.NumDelivered, "delay", delay, "error", err)
+		_ = msg.NakWithDelay(delay)
+	default:
+		if err != nil {
+			slog.Error("处理离线消息失败", "error", err, "subject", msg.Subject)
+		}
+		// 其余的无论处理结果都ACK，避免重复消费
+		_ = msg.Ack()
+	}
+	if metaErr != nil {
+		return nil
+	}
+	return meta
+}
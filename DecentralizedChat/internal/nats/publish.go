@@ -0,0 +1,51 @@
+package nats
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultPublishAckTimeout 没有配置 PublishAckTimeout 时等待 Hub 确认的超时
+const defaultPublishAckTimeout = 5 * time.Second
+
+// PublishJetStream 发布JetStream消息，返回序列ID；opts 里的 nats.MsgId 指定去重用的消息ID
+func (s *Service) PublishJetStream(subject string, data []byte, opts ...nats.PubOpt) (uint64, error) {
+	return s.PublishJetStreamMsg(&nats.Msg{Subject: subject, Data: data}, opts...)
+}
+
+// PublishJetStreamMsg 发布带消息头的JetStream消息，等待 Hub 确认后返回序列ID。
+// 带 Nats-Msg-Id 时没收到确认重发 Hub 不会重复保存，消息ID由知道消息身份的调用方设置；
+// 确认超时默认为 PublishAckTimeout，opts 里的 nats.AckWait 可以覆盖
+func (s *Service) PublishJetStreamMsg(msg *nats.Msg, opts ...nats.PubOpt) (uint64, error) {
+	js, err := s.jetStream()
+	if err != nil {
+		return 0, err
+	}
+	opts = append([]nats.PubOpt{nats.AckWait(s.pubAckTimeout)}, opts...)
+	ack, err := js.PublishMsg(msg, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return ack.Sequence, nil
+}
+
+// PublishJetStreamAsync 异步发布JetStream消息，不等确认，从返回的 PubAckFuture 取得确认或错误；
+// 超过 PublishAckTimeout 没有确认时 Err() 返回超时。等待确认的消息达到 PublishAsyncMaxPending 时阻塞。
+// Nats-Msg-Id 同样由调用方设置
+func (s *Service) PublishJetStreamAsync(msg *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+	js, err := s.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	return js.PublishMsgAsync(msg, opts...)
+}
+
+// PublishAsyncComplete 之前的异步发布全部收到确认（或失败）时关闭
+func (s *Service) PublishAsyncComplete() (<-chan struct{}, error) {
+	js, err := s.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	return js.PublishAsyncComplete(), nil
+}
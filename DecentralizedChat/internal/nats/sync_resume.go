@@ -0,0 +1,276 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// syncPlan ensureSyncConsumer 的结果
+type syncPlan struct {
+	recreated bool              // 持久消费者是新建的，需要换上新的拉取订阅
+	active    []string          // 持久消费者过滤的主题（不含需要补拉的）
+	backfill  map[string]uint64 // 需要补拉的新主题 -> 补拉起点
+	gaps      []SyncGap         // 检测到的缺口，由调用方在不持锁时回调
+}
+
+// ensureSyncConsumer 让 Hub 上的持久消费者过滤当前登记的主题。消费者已存在时只更新过滤主题，位点保留，
+// 新加入的会话在消费者位点之前有没处理过的消息时先不加进过滤主题，由调用方用临时消费者补拉（见 backfillSync），
+// 避免回退持久消费者把其他会话的消息重新投递一遍。
+// 消费者不存在（首次同步、Hub 上的消费者丢失或换了 Hub）时新建，从检查点算出的最早序列号开始投递
+func (s *Service) ensureSyncConsumer(stream, durable string, subjects []string) (*syncPlan, error) {
+	ci, err := s.js.ConsumerInfo(stream, durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		ci, err = nil, nil
+	}
+	if err != nil {
+		return &syncPlan{}, err
+	}
+	start, plan, err := s.resumeSequence(stream, subjects, ci)
+	if err != nil {
+		return plan, err
+	}
+	for _, subj := range subjects {
+		if _, ok := plan.backfill[subj]; !ok {
+			plan.active = append(plan.active, subj)
+		}
+	}
+
+	if ci != nil {
+		// 过滤主题为空等于消费整个流，全部都要补拉时先不动消费者
+		if len(plan.active) == 0 {
+			return plan, nil
+		}
+		cfg := ci.Config
+		cfg.FilterSubject = ""
+		cfg.FilterSubjects = plan.active
+		_, err = s.js.UpdateConsumer(stream, &cfg)
+		return plan, err
+	}
+	cfg := &nats.ConsumerConfig{
+		Durable:        durable,
+		FilterSubjects: plan.active,
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+	}
+	if start > 1 {
+		cfg.DeliverPolicy, cfg.OptStartSeq = nats.DeliverByStartSequencePolicy, start
+	}
+	_, err = s.js.AddConsumer(stream, cfg)
+	plan.recreated = true
+	return plan, err
+}
+
+// resumeSequence 按检查点计算消费者需要从哪个序列号开始投递，顺带检测缺口：
+//   - 检查点超过流的最后序列号：流被重建或换了 Hub，检查点作废，该会话从头同步
+//   - 会话处理到的位置之后还有消息，但中间一段已经超过保留期被删除：这段消息再也取不到，报告缺口
+//
+// 消费者按序列号顺序投递，一直在过滤主题里的会话至少处理到了各会话检查点的最大值（流上的位置），
+// 不能只看这个会话自己的检查点，否则很久没有消息的会话每次都会误报缺口。
+// 消费者已存在时，它已经过滤的主题由它接着投递；新加入的主题在消费者位点之前有没处理过的消息时
+// 记进 plan.backfill 另行补拉，起点返回 0。消费者不存在时总是返回一个起点
+func (s *Service) resumeSequence(stream string, subjects []string, ci *nats.ConsumerInfo) (uint64, *syncPlan, error) {
+	plan := &syncPlan{backfill: map[string]uint64{}}
+	info, err := s.js.StreamInfo(stream)
+	if err != nil {
+		return 0, plan, err
+	}
+	first, last := info.State.FirstSeq, info.State.LastSeq
+
+	checkpoints := make(map[string]uint64, len(subjects))
+	var pos uint64
+	for _, subj := range subjects {
+		cp := s.checkpoint(subj)
+		if cp > last {
+			plan.gaps = append(plan.gaps, SyncGap{Subject: subj, Reset: true})
+			cp = 0
+		}
+		checkpoints[subj] = cp
+		pos = max(pos, cp)
+	}
+
+	var start uint64
+	for _, subj := range subjects {
+		cp := checkpoints[subj]
+		covered := ci != nil && consumerCovers(&ci.Config, subj)
+		if !covered && ci != nil && cp >= ci.Delivered.Stream {
+			continue // 更新过滤主题后消费者会从它的位点接着投递，覆盖检查点之后的消息
+		}
+		// 这个会话处理到了哪里：同步过的会话（新加入的除外）以流上的位置为准
+		done := cp
+		if cp > 0 && (covered || ci == nil) {
+			done = max(cp, pos)
+		}
+		if covered && done+1 >= first {
+			continue
+		}
+
+		lastOnSubj, err := s.lastSeqOn(stream, subj)
+		if err != nil {
+			return 0, plan, err
+		}
+		if lastOnSubj <= done {
+			continue
+		}
+		from := done + 1
+		if from < first {
+			if done > 0 {
+				plan.gaps = append(plan.gaps, SyncGap{Subject: subj, From: from, To: first - 1})
+			}
+			from = first
+		}
+		if covered || (ci != nil && from > ci.Delivered.Stream) {
+			continue
+		}
+		if ci != nil {
+			plan.backfill[subj] = from
+			continue
+		}
+		if start == 0 || from < start {
+			start = from
+		}
+	}
+	if ci == nil && start == 0 {
+		start = last + 1 // 各会话都没有新消息，只投递之后到达的
+	}
+	return start, plan, nil
+}
+
+// backfillSync 用临时消费者补拉新加入会话在持久消费者位点之前的消息，持久消费者的位点不动，其他会话不会重新投递。
+// 补完后再把主题加进持久消费者的过滤主题；这期间又有新消息落在位点之前时会再补一轮
+func (s *Service) backfillSync(ctx context.Context, stream string, st *syncStream, subject string, from uint64) {
+	slog.Info("补拉新加入会话的历史消息", "type", st.kind, "subject", subject, "from", from)
+	err := s.drainSubject(ctx, stream, subject, from)
+	if err != nil && ctx.Err() == nil {
+		slog.Error("补拉历史消息失败", "type", st.kind, "subject", subject, "error", err)
+		if s.syncCfg.ErrorHandler != nil {
+			s.syncCfg.ErrorHandler(fmt.Errorf("%s backfill failed: %w", st.kind, err))
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	s.mu.Lock()
+	current := s.syncRunning && s.syncCtx == ctx
+	if current {
+		delete(st.backfilling, subject)
+	}
+	s.mu.Unlock()
+	if !current {
+		return
+	}
+	if err := s.applySyncStream(stream, st); err != nil {
+		slog.Error("补拉后更新同步消费者失败", "type", st.kind, "error", err)
+		if s.syncCfg.ErrorHandler != nil {
+			s.syncCfg.ErrorHandler(err)
+		}
+	}
+}
+
+// drainSubject 从 from 开始投递主题上的消息，直到没有待投递和待确认的消息；会话离开或同步停止时提前返回。
+// 临时消费者在退订时删除，异常退出时由 Hub 在闲置一分钟后清理
+func (s *Service) drainSubject(ctx context.Context, stream, subject string, from uint64) error {
+	sub, err := s.js.PullSubscribe(subject, "", nats.BindStream(stream), nats.StartSequence(from),
+		nats.AckExplicit(), nats.InactiveThreshold(time.Minute))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for ctx.Err() == nil && s.syncingSubject(stream, subject) {
+		msgs, err := sub.Fetch(10, nats.MaxWait(2*time.Second))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return err
+		}
+		var pending uint64
+		for _, msg := range msgs {
+			if meta := s.processSyncMsg(msg); meta != nil {
+				pending = meta.NumPending
+			}
+		}
+		if pending > 0 {
+			continue
+		}
+		// 还有等待重新投递的消息时继续拉取
+		ci, err := sub.ConsumerInfo()
+		if err != nil {
+			return err
+		}
+		if ci.NumPending == 0 && ci.NumAckPending == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// syncingSubject 主题是否还登记在离线同步里
+func (s *Service) syncingSubject(stream, subject string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := s.syncStreams[stream]
+	if st == nil {
+		return false
+	}
+	_, ok := st.subjects[subject]
+	return ok
+}
+
+// lastSeqOn 主题上最后一条消息的流序列号，没有消息返回 0
+func (s *Service) lastSeqOn(stream, subject string) (uint64, error) {
+	msg, err := s.js.GetLastMsg(stream, subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return msg.Sequence, nil
+}
+
+// checkpoint 会话主题已处理到的流序列号
+func (s *Service) checkpoint(subject string) uint64 {
+	if s.syncCfg.Checkpoint == nil {
+		return 0
+	}
+	return s.syncCfg.Checkpoint(subject)
+}
+
+// reportGap 记录并回调缺口，调用方不持有 s.mu
+func (s *Service) reportGap(gap SyncGap) {
+	slog.Warn("离线同步检测到缺口", "subject", gap.Subject, "from", gap.From, "to", gap.To, "reset", gap.Reset)
+	if s.syncCfg.GapHandler != nil {
+		s.syncCfg.GapHandler(gap)
+	}
+}
+
+// consumerCovers 消费者的过滤主题是否包含 subject（旧版本的消费者过滤的是 dchat.dm.*.msg 这类通配主题）
+func consumerCovers(cfg *nats.ConsumerConfig, subject string) bool {
+	filters := cfg.FilterSubjects
+	if cfg.FilterSubject != "" {
+		filters = append(filters, cfg.FilterSubject)
+	}
+	for _, f := range filters {
+		if subjectMatches(f, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectMatches 按 NATS 通配规则匹配主题，* 匹配一段，> 匹配剩余所有段
+func subjectMatches(filter, subject string) bool {
+	ft, st := strings.Split(filter, "."), strings.Split(subject, ".")
+	for i, tok := range ft {
+		if tok == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (tok != "*" && tok != st[i]) {
+			return false
+		}
+	}
+	return len(ft) == len(st)
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// 加密数据库的全文检索：消息内容是密文，明文的 trigram 索引不能留在库里。
+// 改为把每个 trigram 用数据密钥派生的 HMAC 密钥算成盲索引词，按原文顺序写进 messages_blind（FTS5，ascii 分词）。
+// 查询词同样切成 trigram，用短语查询匹配连续的盲索引词，等同于明文的子串匹配，仍按 bm25 排序。
+// 索引里只有 HMAC，没有密钥看不出原文，但会暴露词频一类的统计信息
+
+// blindTokenLen 盲索引词取 HMAC 的前 8 字节
+const blindTokenLen = 8
+
+// deriveIndexKey 从数据密钥派生盲索引的 HMAC 密钥，轮换数据密钥时随之更换
+func deriveIndexKey(dek []byte) ([]byte, error) {
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dek, nil, []byte("dchat search index")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// blindTokens 按原文顺序把文本的每个 trigram（不区分大小写）算成盲索引词；不足三个字符时为空
+func blindTokens(key []byte, text string) []string {
+	runes := []rune(strings.ToLower(text))
+	if len(runes) < ftsMinTermLen {
+		return nil
+	}
+	tokens := make([]string, 0, len(runes)-ftsMinTermLen+1)
+	for i := 0; i+ftsMinTermLen <= len(runes); i++ {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(string(runes[i : i+ftsMinTermLen])))
+		tokens = append(tokens, hex.EncodeToString(mac.Sum(nil)[:blindTokenLen]))
+	}
+	return tokens
+}
+
+// blindPhrase 查询词对应的 FTS5 短语，词太短用不上索引时返回空
+func blindPhrase(key []byte, term string) string {
+	tokens := blindTokens(key, term)
+	if len(tokens) == 0 {
+		return ""
+	}
+	return `"` + strings.Join(tokens, " ") + `"`
+}
+
+// indexBlind 把一条消息写进盲索引；未加密时不写。内容太短没有盲索引词时也留一行，
+// 重建检查按行数比对。调用方持有锁，旧的索引行由 messages 上的触发器删除
+func (s *Storage) indexBlind(tx *sql.Tx, rowid int64, content string) error {
+	if s.indexKey == nil || content == "" {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO messages_blind (rowid, tokens) VALUES (?, ?)`,
+		rowid, strings.Join(blindTokens(s.indexKey, content), " "))
+	return err
+}
+
+// rebuildBlindIndex 用当前的数据密钥重建盲索引；调用方持有写锁。
+// 轮换密钥后索引词全部改变，VACUUM 也可能改变 messages 的 rowid，都需要重建
+func (s *Storage) rebuildBlindIndex() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM messages_blind`); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT rowid, content FROM messages WHERE content != ''`)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id      int64
+		content string
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.content); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range all {
+		plain, err := s.open(colMessageContent, r.content)
+		if err != nil {
+			return err
+		}
+		if err := s.indexBlind(tx, r.id, plain); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// blindIndexStale 盲索引的行数和有内容的消息数对不上（升级前加密的数据库、重建中途退出）
+func (s *Storage) blindIndexStale() (bool, error) {
+	var diff int
+	err := s.db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM messages WHERE content != '') - (SELECT COUNT(*) FROM messages_blind)
+	`).Scan(&diff)
+	return diff != 0, err
+}
+
+// searchBlind 用盲索引搜索加密数据库：三个字及以上的词走索引按相关度排序，
+// 短词在解密后匹配；只有短词时退回逐条解密
+func (s *Storage) searchBlind(opts SearchOptions, terms []string) ([]*StoredMessage, error) {
+	if s.indexKey == nil {
+		return nil, ErrLocked
+	}
+	var phrases, short []string
+	for _, t := range terms {
+		if p := blindPhrase(s.indexKey, t); p != "" {
+			phrases = append(phrases, p)
+		} else {
+			short = append(short, strings.ToLower(t))
+		}
+	}
+	if len(phrases) == 0 {
+		return s.searchDecrypted(opts, terms)
+	}
+
+	where, args := searchFilters(opts)
+	where = append([]string{"messages_blind MATCH ?"}, where...)
+	args = append([]any{strings.Join(phrases, " AND ")}, args...)
+	query := messageSelect + ` JOIN messages_blind b ON b.rowid = m.rowid WHERE ` + strings.Join(where, " AND ") +
+		` ORDER BY b.rank, m.timestamp DESC, m.id DESC`
+	if len(short) == 0 {
+		rows, err := s.db.Query(query+` LIMIT ? OFFSET ?`, append(args, opts.Limit, opts.Offset)...)
+		if err != nil {
+			return nil, err
+		}
+		return s.scanMessages(rows)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []*StoredMessage
+	skip := opts.Offset
+	for rows.Next() && len(messages) < opts.Limit {
+		msg, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !containsAll(strings.ToLower(msg.Content), short) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// previewMaxRunes 会话列表里最后一条消息预览的最大字符数
+const previewMaxRunes = 60
+
+// MuteForever 不设截止时间的免打扰
+var MuteForever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// ConversationSummary 会话列表的一行：会话本身、显示名称、未读数、最后一条消息和置顶/免打扰状态
+type ConversationSummary struct {
+	ID                 string     `json:"id"`
+	Type               string     `json:"type"`              // "dm" or "group"
+	DisplayName        string     `json:"display_name"`      // 群名称；私聊为对端最近使用的昵称；都没有时为对端ID或会话ID
+	PeerID             string     `json:"peer_id,omitempty"` // 私聊对端用户ID
+	UnreadCount        int        `json:"unread_count"`
+	LastMessageID      string     `json:"last_message_id,omitempty"`
+	LastMessagePreview string     `json:"last_message_preview"` // 截断后的内容，撤回的消息为空
+	LastMessageDeleted bool       `json:"last_message_deleted"`
+	LastSenderID       string     `json:"last_sender_id,omitempty"`
+	LastSenderNickname string     `json:"last_sender_nickname,omitempty"`
+	LastMessageAt      time.Time  `json:"last_message_at"`
+	Pinned             bool       `json:"pinned"`
+	Archived           bool       `json:"archived"`
+	MutedUntil         *time.Time `json:"muted_until,omitempty"`
+	Muted              bool       `json:"muted"` // 查询时免打扰是否仍然有效
+}
+
+// GetConversationSummaries 一次查询取出会话列表（含已归档的，由调用方按 Archived 分组）：置顶的在前，其余按最后消息时间倒序。
+// 未读数是 conversations 上增量维护的计数，最后一条消息按主键关联，不需要逐个会话统计
+func (s *Storage) GetConversationSummaries() ([]*ConversationSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(`
+		SELECT c.id, c.type, COALESCE(c.peer_id, ''),
+			COALESCE(g.name, (
+				SELECT p.sender_nickname FROM messages p
+				WHERE p.cid = c.id AND p.sender_id = c.peer_id AND COALESCE(p.sender_nickname, '') != ''
+				ORDER BY p.timestamp DESC LIMIT 1
+			), c.peer_id, c.id),
+			c.unread_count, COALESCE(m.id, ''), COALESCE(m.content, ''), COALESCE(m.deleted, 0),
+			COALESCE(m.sender_id, ''), COALESCE(m.sender_nickname, ''),
+			c.last_message_at, c.pinned, c.archived, c.muted_until
+		FROM conversations c
+		LEFT JOIN messages m ON m.id = c.last_message_id
+		LEFT JOIN group_info g ON g.group_id = c.id
+		ORDER BY c.pinned DESC, c.last_message_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var summaries []*ConversationSummary
+	for rows.Next() {
+		sum := &ConversationSummary{}
+		var lastAt, mutedUntil sql.NullTime
+		var content string
+		if err := rows.Scan(
+			&sum.ID, &sum.Type, &sum.PeerID, &sum.DisplayName,
+			&sum.UnreadCount, &sum.LastMessageID, &content, &sum.LastMessageDeleted,
+			&sum.LastSenderID, &sum.LastSenderNickname,
+			&lastAt, &sum.Pinned, &sum.Archived, &mutedUntil,
+		); err != nil {
+			return nil, err
+		}
+		if lastAt.Valid {
+			sum.LastMessageAt = lastAt.Time
+		}
+		if mutedUntil.Valid {
+			sum.MutedUntil = &mutedUntil.Time
+			sum.Muted = now.Before(mutedUntil.Time)
+		}
+		if content, err = s.open(colMessageContent, content); err != nil {
+			return nil, err
+		}
+		sum.LastMessagePreview = truncateRunes(content, previewMaxRunes)
+		summaries = append(summaries, sum)
+	}
+	return summaries, rows.Err()
+}
+
+// truncateRunes 按字符截断，超出时末尾加省略号
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
+
+// SetConversationPinned 置顶或取消置顶
+func (s *Storage) SetConversationPinned(cid string, pinned bool) error {
+	return s.updateConversation(cid, `pinned = ?`, pinned)
+}
+
+// SetConversationArchived 归档或取消归档，归档的会话照常接收消息
+func (s *Storage) SetConversationArchived(cid string, archived bool) error {
+	return s.updateConversation(cid, `archived = ?`, archived)
+}
+
+// SetConversationMuted 设置免打扰截止时间，nil 取消免打扰，MuteForever 一直免打扰
+func (s *Storage) SetConversationMuted(cid string, until *time.Time) error {
+	if until == nil {
+		return s.updateConversation(cid, `muted_until = NULL`)
+	}
+	return s.updateConversation(cid, `muted_until = ?`, *until)
+}
+
+// updateConversation 修改会话的管理字段，会话不存在时返回错误
+func (s *Storage) updateConversation(cid, set string, args ...any) error {
+	return withRetry(5, func() error {
+		res, err := s.db.Exec(`UPDATE conversations SET `+set+` WHERE id = ?`, append(args, cid)...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("conversation not found: %s", cid)
+		}
+		return nil
+	})
+}
+
+// ClearConversation 清空会话的聊天记录，保留会话本身和置顶、免打扰等设置；
+// 记下清空时间，之后离线同步重新送达的旧消息不再保存
+func (s *Storage) ClearConversation(cid string, at time.Time) error {
+	return withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := deleteConversationMessages(tx, cid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE conversations SET cleared_at = ? WHERE id = ?`, at, cid); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// DeleteConversation 删除会话及其全部消息；密钥由 DeleteFriendPubKey、DeleteGroupKeys 单独删除
+func (s *Storage) DeleteConversation(cid string) error {
+	return withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := deleteConversationMessages(tx, cid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM conversations WHERE id = ?`, cid); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// SetConversationLeft 记下会话已被主动离开，或在重新加入时清除
+func (s *Storage) SetConversationLeft(cid string, left bool) error {
+	return withRetry(5, func() error {
+		var err error
+		if left {
+			_, err = s.db.Exec(`INSERT OR IGNORE INTO left_conversations (cid, left_at) VALUES (?, ?)`, cid, time.Now())
+		} else {
+			_, err = s.db.Exec(`DELETE FROM left_conversations WHERE cid = ?`, cid)
+		}
+		return err
+	})
+}
+
+// GetLeftConversations 获取已离开的会话ID
+func (s *Storage) GetLeftConversations() (map[string]bool, error) {
+	rows, err := s.db.Query(`SELECT cid FROM left_conversations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	left := make(map[string]bool)
+	for rows.Next() {
+		var cid string
+		if err := rows.Scan(&cid); err != nil {
+			return nil, err
+		}
+		left[cid] = true
+	}
+	return left, rows.Err()
+}
+
+// deleteConversationMessages 删除会话的全部消息及其送达状态、回执、附件记录和表情回应
+func deleteConversationMessages(tx *sql.Tx, cid string) error {
+	for _, table := range []string{"message_delivery", "message_receipts", "attachments", "reactions"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE message_id IN (SELECT id FROM messages WHERE cid = ?)`, cid); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`DELETE FROM messages WHERE cid = ?`, cid)
+	return err
+}
+
+// DeleteFriendPubKey 删除好友公钥和与之建立的双棘轮会话
+func (s *Storage) DeleteFriendPubKey(userID string) error {
+	return withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, q := range []string{
+			`DELETE FROM friend_pub_keys WHERE user_id = ?`,
+			`DELETE FROM ratchet_sessions WHERE peer_id = ?`,
+			`DELETE FROM ratchet_peer_prekeys WHERE peer_id = ?`,
+		} {
+			if _, err := tx.Exec(q, userID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// DeleteGroupKeys 删除群的全部密钥纪元、群信息和成员名单
+func (s *Storage) DeleteGroupKeys(groupID string) error {
+	return withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, q := range []string{
+			`DELETE FROM group_sym_keys WHERE group_id = ?`,
+			`DELETE FROM group_key_epochs WHERE group_id = ?`,
+			`DELETE FROM group_info WHERE group_id = ?`,
+			`DELETE FROM group_members WHERE group_id = ?`,
+		} {
+			if _, err := tx.Exec(q, groupID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
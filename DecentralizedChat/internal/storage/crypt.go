@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 静态加密：敏感列用随机生成的数据密钥（AES-256-GCM）逐个加密，数据密钥本身用
+// NSC seed（HKDF）或用户口令（Argon2id）派生的密钥包装后存在 storage_keys 表。
+// seed 和数据库在同一台机器上，seed 派生的密钥只防数据库文件单独泄露；口令更安全，但每次启动都要解锁
+
+var (
+	// ErrLocked 数据库已加密但还没有解锁
+	ErrLocked = errors.New("storage is locked")
+	// ErrWrongKey 解锁口令或 seed 不正确
+	ErrWrongKey = errors.New("wrong storage key")
+)
+
+// 加密口令来源，storage_keys.kdf 列的取值
+const (
+	KeySeed       = "seed"
+	KeyPassphrase = "passphrase"
+)
+
+// Argon2id 参数，记录在 storage_keys 里，以后调整不影响已有数据库
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+)
+
+const (
+	keyLen        = 32
+	cipherVersion = 1
+)
+
+// Key 数据库加密口令，用 SeedKey 或 PassphraseKey 创建
+type Key struct {
+	kind   string
+	secret []byte
+}
+
+// SeedKey 用 NSC 用户 seed 派生数据库密钥，启动时可以自动解锁
+func SeedKey(seed string) Key {
+	return Key{kind: KeySeed, secret: []byte(seed)}
+}
+
+// PassphraseKey 用用户口令派生数据库密钥（Argon2id）
+func PassphraseKey(passphrase string) Key {
+	return Key{kind: KeyPassphrase, secret: []byte(passphrase)}
+}
+
+// encryptedColumns 需要加密的列；AAD 带上表名和列名，密文不能挪到别的列里使用
+var encryptedColumns = []struct{ table, column string }{
+	{"messages", "content"},
+	{"friend_pub_keys", "pub_key"},
+	{"group_sym_keys", "sym_key"},
+	{"group_key_epochs", "sym_key"},
+	{"group_invites", "sym_key"},
+	{"attachments", "file_key"},
+	{"ratchet_prekeys", "priv_key"},
+	{"ratchet_one_time_prekeys", "priv_key"},
+	{"ratchet_sessions", "state"},
+}
+
+// 各加密列的 AAD
+const (
+	colMessageContent = "messages.content"
+	colFriendPubKey   = "friend_pub_keys.pub_key"
+	colGroupSymKey    = "group_sym_keys.sym_key"
+	colGroupEpochKey  = "group_key_epochs.sym_key"
+	colInviteSymKey   = "group_invites.sym_key"
+	colFileKey        = "attachments.file_key"
+	colPrekeyPriv     = "ratchet_prekeys.priv_key"
+	colOneTimePriv    = "ratchet_one_time_prekeys.priv_key"
+	colSessionState   = "ratchet_sessions.state"
+)
+
+// keyRecord storage_keys 表的一行
+type keyRecord struct {
+	kind    string
+	salt    []byte
+	time    uint32
+	memory  uint32
+	threads uint8
+	wrapped string
+}
+
+// EncryptionKind 数据库加密口令来源：未加密时为空，否则为 KeySeed 或 KeyPassphrase
+func (s *Storage) EncryptionKind() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keyKind
+}
+
+// Locked 数据库已加密但还没有解锁，此时读写加密列都返回 ErrLocked
+func (s *Storage) Locked() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keyKind != "" && s.aead == nil
+}
+
+// Unlock 用口令解锁已加密的数据库
+func (s *Storage) Unlock(k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, err := loadKeyRecord(s.db)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return errors.New("storage is not encrypted")
+	}
+	if rec.kind != k.kind {
+		return fmt.Errorf("%w: database uses a %s key", ErrWrongKey, rec.kind)
+	}
+	aead, indexKey, err := rec.unwrap(k)
+	if err != nil {
+		return err
+	}
+	s.aead, s.indexKey = aead, indexKey
+	// 升级前加密的数据库还没有盲索引，轮换密钥中途退出时索引也可能不完整
+	stale, err := s.blindIndexStale()
+	if err != nil {
+		return err
+	}
+	if stale {
+		if err := s.rebuildBlindIndex(); err != nil {
+			return fmt.Errorf("rebuild search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// EnableEncryption 开启静态加密：生成数据密钥，把已有的敏感列全部加密
+func (s *Storage) EnableEncryption(k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyKind != "" {
+		return errors.New("storage is already encrypted")
+	}
+	return s.reencrypt(k)
+}
+
+// Rekey 更换口令并轮换数据密钥，所有加密列用新的数据密钥重新加密；必须先解锁
+func (s *Storage) Rekey(k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyKind == "" {
+		return errors.New("storage is not encrypted")
+	}
+	if s.aead == nil {
+		return ErrLocked
+	}
+	return s.reencrypt(k)
+}
+
+// reencrypt 生成新的数据密钥，在一个事务里重新加密全部敏感列并保存包装后的密钥；调用方持有写锁
+func (s *Storage) reencrypt(k Key) error {
+	if len(k.secret) == 0 {
+		return errors.New("empty storage key")
+	}
+	dek := make([]byte, keyLen)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	next, indexKey, err := dataKeys(dek)
+	if err != nil {
+		return err
+	}
+	rec, err := wrapKey(k, dek)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 先写入密钥记录：全文索引的触发器在加密后停用，重写 content 不会把密文写进索引
+	if _, err := tx.Exec(`
+		INSERT OR REPLACE INTO storage_keys (id, kdf, salt, argon_time, argon_memory, argon_threads, wrapped_key)
+		VALUES (1, ?, ?, ?, ?, ?, ?)
+	`, rec.kind, base64.StdEncoding.EncodeToString(rec.salt), rec.time, rec.memory, rec.threads, rec.wrapped); err != nil {
+		return fmt.Errorf("save storage key: %w", err)
+	}
+	for _, c := range encryptedColumns {
+		if err := s.reencryptColumn(tx, c.table, c.column, next); err != nil {
+			return fmt.Errorf("encrypt %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	// 明文索引不能留在数据库里；旧密钥的盲索引词也作废，VACUUM 之后重建
+	if _, err := tx.Exec(`INSERT INTO messages_fts(messages_fts) VALUES ('delete-all')`); err != nil {
+		return fmt.Errorf("clear search index: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM messages_blind`); err != nil {
+		return fmt.Errorf("clear search index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.aead, s.indexKey = next, indexKey
+	s.keyKind = k.kind
+
+	// 被改写的明文还留在空闲页和 WAL 里，重建数据库文件把它们清掉
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	if _, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if err := s.rebuildBlindIndex(); err != nil {
+		return fmt.Errorf("rebuild search index: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) reencryptColumn(tx *sql.Tx, table, column string, next cipher.AEAD) error {
+	aad := table + "." + column
+	rows, err := tx.Query(fmt.Sprintf(`SELECT rowid, %s FROM %s`, column, table))
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id    int64
+		value string
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.value); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range all {
+		plain, err := s.open(aad, r.value)
+		if err != nil {
+			return err
+		}
+		enc, err := sealWith(next, aad, plain)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE rowid = ?`, table, column), enc, r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal 加密一个列值；未开启加密时原样返回。调用方持有读锁
+func (s *Storage) seal(aad, plain string) (string, error) {
+	if s.keyKind == "" {
+		return plain, nil
+	}
+	if s.aead == nil {
+		return "", ErrLocked
+	}
+	return sealWith(s.aead, aad, plain)
+}
+
+// open 解密一个列值；未开启加密时原样返回。调用方持有读锁
+func (s *Storage) open(aad, value string) (string, error) {
+	if s.keyKind == "" {
+		return value, nil
+	}
+	if s.aead == nil {
+		return "", ErrLocked
+	}
+	return openWith(s.aead, aad, value)
+}
+
+// sealWith 加密结果为 base64(版本 || nonce || 密文)；空字符串（撤回的消息）不加密
+func sealWith(aead cipher.AEAD, aad, plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := append([]byte{cipherVersion}, nonce...)
+	out = aead.Seal(out, nonce, []byte(plain), []byte(aad))
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func openWith(aead cipher.AEAD, aad, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(value)
+	ns := aead.NonceSize()
+	if err != nil || len(raw) < 1+ns || raw[0] != cipherVersion {
+		return "", fmt.Errorf("decrypt %s: malformed value", aad)
+	}
+	plain, err := aead.Open(nil, raw[1:1+ns], raw[1+ns:], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s: %w", aad, err)
+	}
+	return string(plain), nil
+}
+
+// dataKeys 由数据密钥得到加密列用的 AEAD 和盲索引的 HMAC 密钥
+func dataKeys(dek []byte) (cipher.AEAD, []byte, error) {
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexKey, err := deriveIndexKey(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, indexKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKEK 从口令派生包装数据密钥用的密钥
+func (r *keyRecord) deriveKEK(k Key) ([]byte, error) {
+	switch r.kind {
+	case KeySeed:
+		kek := make([]byte, keyLen)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, k.secret, r.salt, []byte("dchat storage key")), kek); err != nil {
+			return nil, err
+		}
+		return kek, nil
+	case KeyPassphrase:
+		return argon2.IDKey(k.secret, r.salt, r.time, r.memory, r.threads, keyLen), nil
+	default:
+		return nil, fmt.Errorf("unknown storage key kind %q", r.kind)
+	}
+}
+
+// wrapKey 用口令派生的密钥包装数据密钥
+func wrapKey(k Key, dek []byte) (*keyRecord, error) {
+	rec := &keyRecord{kind: k.kind, salt: make([]byte, 16)}
+	if k.kind == KeyPassphrase {
+		rec.time, rec.memory, rec.threads = argonTime, argonMemory, argonThreads
+	}
+	if _, err := rand.Read(rec.salt); err != nil {
+		return nil, err
+	}
+	kek, err := rec.deriveKEK(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	rec.wrapped, err = sealWith(aead, "storage_keys.wrapped_key", string(dek))
+	return rec, err
+}
+
+// unwrap 解开数据密钥，返回加密列用的 AEAD 和盲索引密钥；口令错误时返回 ErrWrongKey
+func (r *keyRecord) unwrap(k Key) (cipher.AEAD, []byte, error) {
+	kek, err := r.deriveKEK(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	dek, err := openWith(aead, "storage_keys.wrapped_key", r.wrapped)
+	if err != nil || len(dek) != keyLen {
+		return nil, nil, ErrWrongKey
+	}
+	return dataKeys([]byte(dek))
+}
+
+// loadKeyRecord 读取密钥记录，未加密时返回 nil
+func loadKeyRecord(db *sql.DB) (*keyRecord, error) {
+	rec := &keyRecord{}
+	var salt string
+	var t, m, p sql.NullInt64
+	err := db.QueryRow(`
+		SELECT kdf, salt, argon_time, argon_memory, argon_threads, wrapped_key FROM storage_keys WHERE id = 1
+	`).Scan(&rec.kind, &salt, &t, &m, &p, &rec.wrapped)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load storage key: %w", err)
+	}
+	if rec.salt, err = base64.StdEncoding.DecodeString(salt); err != nil {
+		return nil, fmt.Errorf("load storage key: %w", err)
+	}
+	rec.time, rec.memory, rec.threads = uint32(t.Int64), uint32(m.Int64), uint8(p.Int64)
+	return rec, nil
+}
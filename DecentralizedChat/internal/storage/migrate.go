@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaTooNew 数据库由更新版本的程序创建，当前版本不认识它的表结构，拒绝打开
+var ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+
+// migration 一次表结构升级，在单个事务里执行并记录到 schema_version
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// column 迁移里新增的列
+type column struct{ name, def string }
+
+const versionTable = `
+CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+);
+`
+
+// LatestSchemaVersion 当前程序支持的最高表结构版本
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion 数据库当前的表结构版本
+func (s *Storage) SchemaVersion() (int, error) {
+	return schemaVersion(s.db)
+}
+
+func schemaVersion(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}) (int, error) {
+	var v int
+	err := q.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// migrate 把数据库升级到最新版本，每个迁移单独一个事务，失败时回滚且不记录版本
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(versionTable); err != nil {
+		return fmt.Errorf("create schema_version: %w", err)
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if latest := LatestSchemaVersion(); current > latest {
+		return fmt.Errorf("%w: database is v%d, supported up to v%d", ErrSchemaTooNew, current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migrate to v%d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 另一个进程可能刚刚升级过
+	v, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if v >= m.version {
+		return nil
+	}
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, CURRENT_TIMESTAMP)`,
+		m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execSQL 执行一段 SQL 语句
+func execSQL(stmts string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmts)
+		return err
+	}
+}
+
+// addColumns 给表补上缺少的列，已经存在的列跳过
+func addColumns(table string, cols ...column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range cols {
+			var n int
+			err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, c.name).Scan(&n)
+			if err != nil {
+				return fmt.Errorf("inspect %s.%s: %w", table, c.name, err)
+			}
+			if n > 0 {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c.name, c.def)); err != nil {
+				return fmt.Errorf("add column %s.%s: %w", table, c.name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// chain 依次执行多个迁移步骤
+func chain(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
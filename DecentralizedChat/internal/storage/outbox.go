@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OutboxEntry 发件箱里等待发布的消息，发布成功后移出
+type OutboxEntry struct {
+	MessageID      string    `json:"message_id"`
+	ConversationID string    `json:"cid"`
+	Subject        string    `json:"subject"`
+	Payload        []byte    `json:"-"`
+	State          string    `json:"state"` // DeliveryPending / DeliveryFailed
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+}
+
+// EnqueueOutbox 把消息放进发件箱
+func (s *Storage) EnqueueOutbox(e *OutboxEntry) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT INTO outbox (message_id, cid, subject, payload, state, attempts, last_error, created_at, next_attempt_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, e.MessageID, e.ConversationID, e.Subject, e.Payload, e.State, e.Attempts, e.LastError, e.CreatedAt, e.NextAttemptAt)
+		return err
+	})
+}
+
+// GetOutbox 按放入的先后取出发件箱里的全部消息
+func (s *Storage) GetOutbox() ([]*OutboxEntry, error) {
+	rows, err := s.db.Query(`SELECT ` + outboxColumns + ` FROM outbox ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*OutboxEntry
+	for rows.Next() {
+		e, err := scanOutbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// GetOutboxEntry 取出发件箱里的一条消息，不在发件箱里返回 nil
+func (s *Storage) GetOutboxEntry(messageID string) (*OutboxEntry, error) {
+	e, err := scanOutbox(s.db.QueryRow(`SELECT `+outboxColumns+` FROM outbox WHERE message_id = ?`, messageID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+// UpdateOutbox 更新发件箱消息的状态、尝试次数和下次尝试时间
+func (s *Storage) UpdateOutbox(e *OutboxEntry) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			UPDATE outbox SET state = ?, attempts = ?, last_error = ?, next_attempt_at = ? WHERE message_id = ?
+		`, e.State, e.Attempts, e.LastError, e.NextAttemptAt, e.MessageID)
+		return err
+	})
+}
+
+// SetOutboxPayload 替换发件箱消息的载荷（群密钥轮换后重新加密）
+func (s *Storage) SetOutboxPayload(messageID string, payload []byte) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`UPDATE outbox SET payload = ? WHERE message_id = ?`, payload, messageID)
+		return err
+	})
+}
+
+// DeleteOutbox 发布成功或取消后移出发件箱
+func (s *Storage) DeleteOutbox(messageID string) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`DELETE FROM outbox WHERE message_id = ?`, messageID)
+		return err
+	})
+}
+
+// SetMessageNatsSeq 发件箱里的消息发布后补上流序列号
+func (s *Storage) SetMessageNatsSeq(messageID string, seq uint64) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`UPDATE messages SET nats_seq = ? WHERE id = ?`, seq, messageID)
+		return err
+	})
+}
+
+// outboxColumns 与 scanOutbox 对应的查询列
+const outboxColumns = `message_id, cid, subject, payload, state, attempts, COALESCE(last_error, ''), created_at, next_attempt_at`
+
+// scanOutbox 扫描一行发件箱消息
+func scanOutbox(row interface{ Scan(dest ...any) error }) (*OutboxEntry, error) {
+	e := &OutboxEntry{}
+	if err := row.Scan(&e.MessageID, &e.ConversationID, &e.Subject, &e.Payload, &e.State, &e.Attempts, &e.LastError,
+		&e.CreatedAt, &e.NextAttemptAt); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
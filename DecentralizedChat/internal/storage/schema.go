@@ -1,7 +1,11 @@
 // Package storage 实现了本地消息存储模块，使用 SQLite 数据库存储聊天记录和会话信息
 package storage
 
-const schema = `
+// migrations 按版本号递增排列，已发布的迁移不能再修改，表结构变化一律追加新迁移。
+// 没有 schema_version 表的旧数据库从 v1 开始逐个执行，它们可能已经带有部分后续的表和列，
+// 所以每个迁移都要能在这样的库上重复执行（IF NOT EXISTS、addColumns）
+var migrations = []migration{
+	{1, "initial", execSQL(`
 CREATE TABLE IF NOT EXISTS conversations (
     id TEXT PRIMARY KEY,
     type TEXT NOT NULL,
@@ -18,13 +22,12 @@ CREATE TABLE IF NOT EXISTS messages (
     timestamp TIMESTAMP NOT NULL,
     is_read BOOLEAN DEFAULT 0,
     is_group BOOLEAN DEFAULT 0,
-    nats_seq INTEGER DEFAULT 0, -- NATS消息序列ID，用于去重
+    nats_seq INTEGER DEFAULT 0, -- NATS消息序列ID
     FOREIGN KEY (cid) REFERENCES conversations(id)
 );
 
 CREATE INDEX IF NOT EXISTS idx_messages_cid_time ON messages(cid, timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id);
--- 唯一约束，防止重复存储同一条消息（NATS序列ID+会话ID全局唯一）
 CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_unique ON messages(cid, nats_seq);
 
 -- 好友公钥存储表
@@ -34,10 +37,368 @@ CREATE TABLE IF NOT EXISTS friend_pub_keys (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- 群聊对称密钥存储表
+-- 群聊对称密钥存储表（当前纪元的密钥）
 CREATE TABLE IF NOT EXISTS group_sym_keys (
     group_id TEXT PRIMARY KEY,
     sym_key TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
-`
+`)},
+
+	{2, "group_key_epochs", execSQL(`
+-- 群密钥纪元表：每次轮换生成一个新纪元，旧纪元保留用于解密历史消息
+CREATE TABLE IF NOT EXISTS group_key_epochs (
+    group_id TEXT NOT NULL,
+    epoch INTEGER NOT NULL,
+    sym_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    retired_at TIMESTAMP, -- 被新纪元取代的时间，晚于该时间用旧纪元加密的消息会被拒绝
+    PRIMARY KEY (group_id, epoch)
+);
+
+-- 旧版本每个群只有一个密钥，作为纪元0迁移过来
+INSERT OR IGNORE INTO group_key_epochs (group_id, epoch, sym_key, created_at)
+SELECT group_id, 0, sym_key, created_at FROM group_sym_keys
+WHERE NOT EXISTS (SELECT 1 FROM group_key_epochs e WHERE e.group_id = group_sym_keys.group_id);
+`)},
+
+	{3, "group_invites", execSQL(`
+-- 通过私聊收到的群邀请
+CREATE TABLE IF NOT EXISTS group_invites (
+    group_id TEXT PRIMARY KEY,
+    group_name TEXT,
+    sym_key TEXT NOT NULL,
+    key_epoch INTEGER DEFAULT 0,
+    inviter_id TEXT NOT NULL,
+    inviter_nickname TEXT,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending / accepted / declined
+    meta TEXT, -- 邀请时的群信息快照（JSON）
+    received_at TIMESTAMP NOT NULL
+);
+`)},
+
+	{4, "group_roster", execSQL(`
+-- 群信息，通过群内的 group_meta 系统消息同步
+CREATE TABLE IF NOT EXISTS group_info (
+    group_id TEXT PRIMARY KEY,
+    name TEXT,
+    description TEXT,
+    creator_id TEXT,
+    version INTEGER DEFAULT 0, -- 每次修改递增，只接受更高版本
+    updated_by TEXT,
+    updated_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 群成员名单
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'member', -- owner / admin / member
+    PRIMARY KEY (group_id, user_id)
+);
+`)},
+
+	{5, "ratchet", execSQL(`
+-- 自己的签名预密钥（X25519），对方用它发起双棘轮会话
+CREATE TABLE IF NOT EXISTS ratchet_prekeys (
+    prekey_id INTEGER PRIMARY KEY,
+    priv_key TEXT NOT NULL,
+    pub_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 自己的一次性预密钥，公钥发布在 DChatPrekeys KV 桶，被用于建立会话后删除
+CREATE TABLE IF NOT EXISTS ratchet_one_time_prekeys (
+    prekey_id INTEGER PRIMARY KEY,
+    priv_key TEXT NOT NULL,
+    pub_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 好友通过私聊告知的预密钥，存在时发起双棘轮会话
+CREATE TABLE IF NOT EXISTS ratchet_peer_prekeys (
+    peer_id TEXT PRIMARY KEY,
+    prekey_id INTEGER NOT NULL,
+    pub_key TEXT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 双棘轮会话状态（JSON），每个好友可能同时存在多个会话
+CREATE TABLE IF NOT EXISTS ratchet_sessions (
+    peer_id TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    state TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (peer_id, session_id)
+);
+`)},
+
+	{6, "attachments", execSQL(`
+-- 文件/图片附件：密文在 Hub 的对象存储里，这里保存对象名和解密密钥
+CREATE TABLE IF NOT EXISTS attachments (
+    message_id TEXT PRIMARY KEY,
+    cid TEXT NOT NULL,
+    bucket TEXT NOT NULL,
+    object_name TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    mime_type TEXT,
+    size INTEGER NOT NULL,
+    file_key TEXT NOT NULL,
+    chunk_size INTEGER NOT NULL,
+    local_path TEXT, -- 下载（或发送）后的本地路径
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_cid ON attachments(cid);
+`)},
+
+	{7, "receipts", execSQL(`
+-- 自己发出的消息的送达状态（按全部接收者汇总）
+CREATE TABLE IF NOT EXISTS message_delivery (
+    message_id TEXT PRIMARY KEY,
+    state TEXT NOT NULL DEFAULT 'sent', -- sent / delivered / read
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 每个接收者对自己发出的消息的回执
+CREATE TABLE IF NOT EXISTS message_receipts (
+    message_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    state TEXT NOT NULL, -- delivered / read
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id)
+);
+`)},
+
+	{8, "message_edits", addColumns("messages",
+		column{"edited_at", "TIMESTAMP"},       // 最后一次编辑的时间
+		column{"deleted", "BOOLEAN DEFAULT 0"}, // 发送方撤回后只保留墓碑，内容清空
+	)},
+
+	// 消息按发送方生成的ID去重；(cid, nats_seq) 唯一索引会把实时收到的 nats_seq=0 消息当成重复
+	{9, "sender_message_ids", execSQL(`
+DROP INDEX IF EXISTS idx_messages_unique;
+`)},
+
+	{10, "reply_threads", chain(
+		addColumns("messages", column{"reply_to_id", "TEXT"}), // 回复的消息ID，多层回复沿着它找到话题的根消息
+		execSQL(`CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to_id);`),
+	)},
+
+	{11, "reactions", execSQL(`
+-- 表情回应，每人对每条消息的每个表情一行；取消时保留 removed=1，
+-- op_id 是回应操作的 ULID，只接受更新的操作，离线同步重复或乱序到达时不会回退
+CREATE TABLE IF NOT EXISTS reactions (
+    message_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    removed BOOLEAN NOT NULL DEFAULT 0,
+    op_id TEXT NOT NULL,
+    added_op TEXT NOT NULL DEFAULT '', -- 使回应生效的那次操作，用于按回应先后排列
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+`)},
+
+	// 消息全文索引：外部内容表，正文只存在 messages 里，由触发器保持同步。
+	// trigram 分词按三个字符切分，中文等不以空格分词的文字也能做子串匹配。
+	// 索引按 messages 的 rowid 关联，VACUUM 可能改变 rowid，之后需要 rebuild
+	{12, "message_search", execSQL(`
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+    content,
+    content = 'messages',
+    content_rowid = 'rowid',
+    tokenize = 'trigram'
+);
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+    INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+    INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+    INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+    INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+
+-- 把已有消息全部索引进去
+INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');
+`)},
+
+	// 静态加密的密钥记录。加密后 messages.content 是密文，全文索引的触发器停用，搜索改为解密后匹配
+	{13, "encryption", execSQL(`
+CREATE TABLE IF NOT EXISTS storage_keys (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    kdf TEXT NOT NULL, -- seed：NSC seed 经 HKDF 派生；passphrase：用户口令经 Argon2id 派生
+    salt TEXT NOT NULL,
+    argon_time INTEGER,
+    argon_memory INTEGER,
+    argon_threads INTEGER,
+    wrapped_key TEXT NOT NULL, -- 用派生密钥加密的数据密钥
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TRIGGER IF EXISTS messages_fts_insert;
+DROP TRIGGER IF EXISTS messages_fts_delete;
+DROP TRIGGER IF EXISTS messages_fts_update;
+
+CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages
+WHEN NOT EXISTS (SELECT 1 FROM storage_keys) BEGIN
+    INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+
+CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages
+WHEN NOT EXISTS (SELECT 1 FROM storage_keys) BEGIN
+    INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+
+CREATE TRIGGER messages_fts_update AFTER UPDATE OF content ON messages
+WHEN NOT EXISTS (SELECT 1 FROM storage_keys) BEGIN
+    INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+    INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+`)},
+
+	// 会话列表摘要：未读数和最后一条消息由 messages 上的触发器随写入增量维护，
+	// SaveMessage、MarkAsRead、撤回和删除消息时自动更新，列表查询不再逐个会话统计
+	{14, "conversation_summaries", chain(
+		addColumns("conversations",
+			column{"unread_count", "INTEGER NOT NULL DEFAULT 0"}, // 未读且未撤回的消息数
+			column{"last_message_id", "TEXT"},
+			column{"peer_id", "TEXT"}, // 私聊对端用户ID，群聊为空
+			column{"pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+			column{"muted_until", "TIMESTAMP"}, // 免打扰截止时间，空为未开启
+		),
+		execSQL(`
+CREATE INDEX IF NOT EXISTS idx_conversations_list ON conversations(pinned DESC, last_message_at DESC);
+
+-- 消息先于会话写入时补建会话，保证计数有地方记
+CREATE TRIGGER IF NOT EXISTS messages_summary_insert AFTER INSERT ON messages BEGIN
+    INSERT OR IGNORE INTO conversations (id, type, last_message_at, created_at)
+    VALUES (new.cid, CASE WHEN new.is_group THEN 'group' ELSE 'dm' END, new.timestamp, new.timestamp);
+    UPDATE conversations SET
+        unread_count = unread_count + (new.is_read = 0 AND COALESCE(new.deleted, 0) = 0),
+        last_message_id = CASE
+            WHEN new.timestamp >= COALESCE((SELECT timestamp FROM messages WHERE id = conversations.last_message_id), '')
+            THEN new.id ELSE last_message_id END
+    WHERE id = new.cid;
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_summary_update AFTER UPDATE OF is_read, deleted ON messages
+WHEN (old.is_read = 0 AND COALESCE(old.deleted, 0) = 0) != (new.is_read = 0 AND COALESCE(new.deleted, 0) = 0) BEGIN
+    UPDATE conversations SET unread_count = MAX(unread_count + CASE
+        WHEN new.is_read = 0 AND COALESCE(new.deleted, 0) = 0 THEN 1 ELSE -1 END, 0)
+    WHERE id = new.cid;
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_summary_delete AFTER DELETE ON messages BEGIN
+    UPDATE conversations SET
+        unread_count = MAX(unread_count - (old.is_read = 0 AND COALESCE(old.deleted, 0) = 0), 0),
+        last_message_id = CASE WHEN last_message_id = old.id THEN (
+            SELECT id FROM messages WHERE cid = old.cid ORDER BY timestamp DESC, id DESC LIMIT 1
+        ) ELSE last_message_id END
+    WHERE id = old.cid;
+END;
+
+-- 用已有消息回填
+INSERT OR IGNORE INTO conversations (id, type, last_message_at, created_at)
+SELECT cid, CASE WHEN MAX(is_group) THEN 'group' ELSE 'dm' END, MAX(timestamp), MIN(timestamp)
+FROM messages GROUP BY cid;
+
+UPDATE conversations SET
+    unread_count = (
+        SELECT COUNT(*) FROM messages m
+        WHERE m.cid = conversations.id AND m.is_read = 0 AND COALESCE(m.deleted, 0) = 0
+    ),
+    last_message_id = (
+        SELECT id FROM messages m WHERE m.cid = conversations.id ORDER BY m.timestamp DESC, m.id DESC LIMIT 1
+    );
+`),
+	)},
+
+	{15, "conversation_management", addColumns("conversations",
+		column{"archived", "BOOLEAN NOT NULL DEFAULT 0"},
+		column{"cleared_at", "TIMESTAMP"}, // 清空聊天记录的时间，不再保存早于它的消息（离线同步可能重新送达）
+	)},
+
+	// 离线同步检查点：每个会话已处理到的 Hub 流序列号，Hub 上的消费者丢失或换 Hub 时从这里续传
+	{16, "sync_checkpoints", execSQL(`
+CREATE TABLE IF NOT EXISTS sync_checkpoints (
+    cid TEXT PRIMARY KEY,
+    stream TEXT NOT NULL,
+    last_seq INTEGER NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+`)},
+
+	// 离线同步解密不了的消息：缺少密钥的在补上密钥后自动重试，密钥齐全仍解不开的留作排查
+	{17, "sync_quarantine", execSQL(`
+CREATE TABLE IF NOT EXISTS sync_quarantine (
+    subject TEXT NOT NULL,
+    nats_seq INTEGER NOT NULL,
+    cid TEXT NOT NULL,
+    sender_id TEXT,
+    key_kind TEXT NOT NULL DEFAULT '', -- group / friend：缺少的密钥；为空表示密钥齐全仍无法解密
+    key_id TEXT NOT NULL DEFAULT '',   -- 群ID或好友ID
+    reason TEXT,
+    payload BLOB NOT NULL, -- 原始的加密载荷
+    attempts INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (subject, nats_seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_quarantine_key ON sync_quarantine(key_kind, key_id);
+`)},
+
+	// 发件箱：消息先落盘再发布，断开 Hub 期间排队，恢复后按顺序发出
+	{18, "outbox", execSQL(`
+CREATE TABLE IF NOT EXISTS outbox (
+    message_id TEXT PRIMARY KEY,
+    cid TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    payload BLOB NOT NULL, -- 已加密签名的载荷，重试时原样发布
+    state TEXT NOT NULL,   -- pending / failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+`)},
+
+	// 未签名的 v0 历史消息标记为未认证；隔离的消息记下 Hub 保存它的时间，重试时按这个时间判断
+	{19, "unverified_messages", chain(
+		addColumns("messages", column{"unverified", "BOOLEAN NOT NULL DEFAULT 0"}),
+		addColumns("sync_quarantine", column{"stored_at", "TIMESTAMP"}),
+	)},
+
+	// 主动离开的会话：重启后不再自动订阅，直到再次加入
+	{20, "left_conversations", execSQL(`
+CREATE TABLE IF NOT EXISTS left_conversations (
+    cid TEXT PRIMARY KEY,
+    left_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+`)},
+
+	// 加密数据库的全文索引：存的是 trigram 的 HMAC（盲索引词），按 messages 的 rowid 关联。
+	// 写入由 Storage 计算后插入，删除和改写内容时触发器删掉旧的一行；已加密的数据库解锁时补建
+	{21, "blind_search", execSQL(`
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_blind USING fts5(
+    tokens,
+    tokenize = 'ascii'
+);
+
+CREATE TRIGGER IF NOT EXISTS messages_blind_delete AFTER DELETE ON messages BEGIN
+    DELETE FROM messages_blind WHERE rowid = old.rowid;
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_blind_update AFTER UPDATE OF content ON messages BEGIN
+    DELETE FROM messages_blind WHERE rowid = old.rowid;
+END;
+`)},
+}
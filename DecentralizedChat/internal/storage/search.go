@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"html"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 全文检索用 FTS5 的 trigram 分词：按三个字符切分，中文不需要分词也能做任意子串匹配。
+// 少于三个字符的词（中文常见的两字词）trigram 索引用不上，退回 LIKE
+const (
+	ftsMinTermLen   = 3
+	defaultSearchN  = 50
+	snippetContext  = 20 // 摘要里命中词前后各保留的字符数
+	snippetMaxRunes = 80
+)
+
+// SearchOptions 消息搜索条件，Query 按空白拆成多个词，全部命中才返回
+type SearchOptions struct {
+	Query          string     `json:"query"`
+	ConversationID string     `json:"conversation_id,omitempty"`
+	SenderID       string     `json:"sender_id,omitempty"`
+	Since          *time.Time `json:"since,omitempty"` // 含
+	Until          *time.Time `json:"until,omitempty"` // 不含
+	Limit          int        `json:"limit,omitempty"` // 默认 50
+	Offset         int        `json:"offset,omitempty"`
+}
+
+// SearchResult 一条搜索结果
+type SearchResult struct {
+	*StoredMessage
+	Snippet string `json:"snippet"` // 命中位置附近的摘要，已做 HTML 转义，命中词用 <mark></mark> 包裹
+}
+
+// Search 全文搜索消息：按相关度排序（只有短词时按时间倒序），支持会话、发送者和时间范围过滤。
+// 开启静态加密后明文索引停用，改用盲索引（见 blind_index.go），排序规则不变
+func (s *Storage) Search(opts SearchOptions) ([]*SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := strings.Fields(opts.Query)
+	if opts.Limit <= 0 {
+		opts.Limit = defaultSearchN
+	}
+	opts.Offset = max(opts.Offset, 0)
+
+	var messages []*StoredMessage
+	var err error
+	if s.keyKind != "" {
+		messages, err = s.searchBlind(opts, terms)
+	} else {
+		messages, err = s.searchIndexed(opts, terms)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fillReactions(messages); err != nil {
+		return nil, err
+	}
+	results := make([]*SearchResult, len(messages))
+	for i, m := range messages {
+		results[i] = &SearchResult{StoredMessage: m, Snippet: highlightSnippet(m.Content, terms)}
+	}
+	return results, nil
+}
+
+// searchFilters 关键词以外的过滤条件
+func searchFilters(opts SearchOptions) ([]string, []any) {
+	where := []string{"m.deleted = 0"}
+	var args []any
+	if opts.ConversationID != "" {
+		where = append(where, "m.cid = ?")
+		args = append(args, opts.ConversationID)
+	}
+	if opts.SenderID != "" {
+		where = append(where, "m.sender_id = ?")
+		args = append(args, opts.SenderID)
+	}
+	if opts.Since != nil {
+		where = append(where, "m.timestamp >= ?")
+		args = append(args, *opts.Since)
+	}
+	if opts.Until != nil {
+		where = append(where, "m.timestamp < ?")
+		args = append(args, *opts.Until)
+	}
+	return where, args
+}
+
+// searchIndexed 用全文索引搜索明文数据库
+func (s *Storage) searchIndexed(opts SearchOptions, terms []string) ([]*StoredMessage, error) {
+	var match []string
+	var where []string
+	var args []any
+	for _, t := range terms {
+		if utf8.RuneCountInString(t) >= ftsMinTermLen {
+			match = append(match, `"`+strings.ReplaceAll(t, `"`, `""`)+`"`)
+		} else {
+			where = append(where, `m.content LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(t)+"%")
+		}
+	}
+	fw, fa := searchFilters(opts)
+	where, args = append(where, fw...), append(args, fa...)
+
+	query := messageSelect
+	order := "m.timestamp DESC, m.id DESC"
+	if len(match) > 0 {
+		query += ` JOIN messages_fts f ON f.rowid = m.rowid`
+		where = append([]string{"messages_fts MATCH ?"}, where...)
+		args = append([]any{strings.Join(match, " AND ")}, args...)
+		order = "f.rank, " + order
+	}
+	query += " WHERE " + strings.Join(where, " AND ") + " ORDER BY " + order + " LIMIT ? OFFSET ?"
+	args = append(args, opts.Limit, opts.Offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanMessages(rows)
+}
+
+// searchDecrypted 按时间倒序逐条解密，保留包含全部关键词的消息；加密数据库只有短词时使用
+func (s *Storage) searchDecrypted(opts SearchOptions, terms []string) ([]*StoredMessage, error) {
+	where, args := searchFilters(opts)
+	rows, err := s.db.Query(messageSelect+" WHERE "+strings.Join(where, " AND ")+
+		" ORDER BY m.timestamp DESC, m.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lowered := make([]string, len(terms))
+	for i, t := range terms {
+		lowered[i] = strings.ToLower(t)
+	}
+	var messages []*StoredMessage
+	skip := opts.Offset
+	for rows.Next() && len(messages) < opts.Limit {
+		msg, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !containsAll(strings.ToLower(msg.Content), lowered) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func containsAll(text string, terms []string) bool {
+	for _, t := range terms {
+		if !strings.Contains(text, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeLike 转义 LIKE 通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// highlightSnippet 截取第一个命中词附近的文字，命中词用 <mark> 包裹，其余部分 HTML 转义
+func highlightSnippet(content string, terms []string) string {
+	text := []rune(content)
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// 标记每个字符是否落在某个命中词里（大小写不敏感）
+	hit := make([]bool, len(text))
+	first := -1
+	for _, t := range terms {
+		needle := []rune(strings.ToLower(t))
+		if len(needle) == 0 {
+			continue
+		}
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) != string(needle) {
+				continue
+			}
+			for j := i; j < i+len(needle); j++ {
+				hit[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start, end := 0, len(text)
+	if len(text) > snippetMaxRunes {
+		start = max(first-snippetContext, 0)
+		end = min(start+snippetMaxRunes, len(text))
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && hit[j] == hit[i] {
+			j++
+		}
+		seg := html.EscapeString(string(text[i:j]))
+		if hit[i] {
+			b.WriteString("<mark>" + seg + "</mark>")
+		} else {
+			b.WriteString(seg)
+		}
+		i = j
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
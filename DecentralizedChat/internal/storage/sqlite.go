@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -12,6 +14,12 @@ import (
 // Storage SQLite 本地存储
 type Storage struct {
 	db *sql.DB
+
+	// mu 保护静态加密的状态；读写加密列的方法持有读锁，更换密钥时持有写锁
+	mu      sync.RWMutex
+	keyKind  string      // 加密口令来源，未加密时为空
+	aead     cipher.AEAD // 数据密钥，未解锁时为 nil
+	indexKey []byte      // 盲索引的 HMAC 密钥，由数据密钥派生，未解锁时为 nil
 }
 
 // withRetry 为数据库写操作提供重试机制，解决SQLITE_BUSY锁冲突问题
@@ -59,13 +67,23 @@ func NewSQLiteStorage(path string) (*Storage, error) {
 		return nil, fmt.Errorf("set sqlite optimization pragmas: %w", err)
 	}
 
-	// 执行 schema 初始化
-	_, err = db.Exec(schema)
-	if err != nil {
+	// 升级表结构到当前版本
+	if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &Storage{db: db}, nil
+	// 已加密的数据库需要 Unlock 之后才能读写加密列
+	rec, err := loadKeyRecord(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &Storage{db: db}
+	if rec != nil {
+		s.keyKind = rec.kind
+	}
+	return s, nil
 }
 
 // Close 关闭数据库连接
@@ -73,171 +91,627 @@ func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
-// SaveMessage 保存消息，自动去重（基于NATS序列ID）
+// SaveMessage 保存消息，按消息ID去重，已存在时忽略；会话的未读数和最后一条消息由触发器同步更新。
+// 会话清空记录之前的消息不再保存
 func (s *Storage) SaveMessage(msg *StoredMessage) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	content, err := s.seal(colMessageContent, msg.Content)
+	if err != nil {
+		return err
+	}
 	return withRetry(5, func() error {
-		_, err := s.db.Exec(`
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(`
 			INSERT OR IGNORE INTO messages
-			(id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group, nats_seq)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			(id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group, nats_seq, reply_to_id, unverified)
+			SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?
+			WHERE NOT EXISTS (SELECT 1 FROM conversations WHERE id = ? AND cleared_at >= ?)
 		`, msg.ID, msg.ConversationID, msg.SenderID, msg.SenderNickname,
-			msg.Content, msg.Timestamp, msg.IsRead, msg.IsGroup, msg.NatsSeq)
-		return err
+			content, msg.Timestamp, msg.IsRead, msg.IsGroup, msg.NatsSeq, msg.ReplyToID, msg.Unverified,
+			msg.ConversationID, msg.Timestamp)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		rowid, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err := s.indexBlind(tx, rowid, msg.Content); err != nil {
+			return err
+		}
+		return tx.Commit()
 	})
 }
 
+// messageSelect 查询消息的公共列，附带自己发出的消息的送达状态
+const messageSelect = `
+	SELECT m.id, m.cid, m.sender_id, m.sender_nickname, m.content, m.timestamp, m.is_read, m.is_group,
+		COALESCE(d.state, ''), m.edited_at, COALESCE(m.deleted, 0), COALESCE(m.reply_to_id, ''), m.unverified
+	FROM messages m
+	LEFT JOIN message_delivery d ON d.message_id = m.id
+`
+
+// scanMessages 读取 messageSelect 查询的结果并解密内容；调用方持有读锁
+func (s *Storage) scanMessages(rows *sql.Rows) ([]*StoredMessage, error) {
+	defer rows.Close()
+	var messages []*StoredMessage
+	for rows.Next() {
+		msg, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// scanMessage 读取当前行
+func (s *Storage) scanMessage(rows *sql.Rows) (*StoredMessage, error) {
+	msg := &StoredMessage{}
+	var editedAt sql.NullTime
+	err := rows.Scan(
+		&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.SenderNickname,
+		&msg.Content, &msg.Timestamp, &msg.IsRead, &msg.IsGroup, &msg.DeliveryState,
+		&editedAt, &msg.Deleted, &msg.ReplyToID, &msg.Unverified,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if msg.Content, err = s.open(colMessageContent, msg.Content); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 // GetMessages 获取会话历史消息，cid为空时返回所有消息
 func (s *Storage) GetMessages(cid string, limit int, before *time.Time) ([]*StoredMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var rows *sql.Rows
 	var err error
 
 	if cid == "" {
 		// 空cid返回所有消息
 		if before != nil {
-			rows, err = s.db.Query(`
-				SELECT id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group
-				FROM messages
-				WHERE timestamp < ?
-				ORDER BY timestamp DESC
+			rows, err = s.db.Query(messageSelect+`
+				WHERE m.timestamp < ?
+				ORDER BY m.timestamp DESC, m.id DESC
 				LIMIT ?
 			`, *before, limit)
 		} else {
-			rows, err = s.db.Query(`
-				SELECT id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group
-				FROM messages
-				ORDER BY timestamp DESC
+			rows, err = s.db.Query(messageSelect+`
+				ORDER BY m.timestamp DESC, m.id DESC
 				LIMIT ?
 			`, limit)
 		}
 	} else {
 		// 返回指定会话的消息
 		if before != nil {
-			rows, err = s.db.Query(`
-				SELECT id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group
-				FROM messages
-				WHERE cid = ? AND timestamp < ?
-				ORDER BY timestamp DESC
+			rows, err = s.db.Query(messageSelect+`
+				WHERE m.cid = ? AND m.timestamp < ?
+				ORDER BY m.timestamp DESC, m.id DESC
 				LIMIT ?
 			`, cid, *before, limit)
 		} else {
-			rows, err = s.db.Query(`
-				SELECT id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group
-				FROM messages
-				WHERE cid = ?
-				ORDER BY timestamp DESC
+			rows, err = s.db.Query(messageSelect+`
+				WHERE m.cid = ?
+				ORDER BY m.timestamp DESC, m.id DESC
 				LIMIT ?
 			`, cid, limit)
 		}
 	}
 
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// 反转顺序，得到 旧→新 的排序，这样渲染时最旧的消息在最上面，最新的在最下面
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	if err := s.fillReactions(messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// fillReactions 给消息附上汇总后的表情回应
+func (s *Storage) fillReactions(messages []*StoredMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byID := make(map[string]*StoredMessage, len(messages))
+	args := make([]any, 0, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+		args = append(args, m.ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	rows, err := s.db.Query(`
+		SELECT message_id, emoji, user_id FROM reactions
+		WHERE removed = 0 AND message_id IN (`+placeholders+`)
+		ORDER BY added_op
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msgID, emoji, userID string
+		if err := rows.Scan(&msgID, &emoji, &userID); err != nil {
+			return err
+		}
+		m := byID[msgID]
+		if m.Reactions == nil {
+			m.Reactions = make(map[string][]string)
+		}
+		m.Reactions[emoji] = append(m.Reactions[emoji], userID)
+	}
+	return rows.Err()
+}
+
+// SaveReaction 保存回应操作，只有比已保存的操作更新时才生效；返回可见状态（是否回应）是否改变
+func (s *Storage) SaveReaction(r *Reaction) (bool, error) {
+	var changed bool
+	err := withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var removed bool
+		var opID string
+		err = tx.QueryRow(`
+			SELECT removed, op_id FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?
+		`, r.MessageID, r.UserID, r.Emoji).Scan(&removed, &opID)
+		switch {
+		case err == sql.ErrNoRows:
+			// 没有记录时取消等同于未回应，仍然记下操作，防止更早的回应晚到后生效
+			changed = !r.Removed
+		case err != nil:
+			return err
+		case r.OpID <= opID:
+			changed = false
+			return nil
+		default:
+			changed = removed != r.Removed
+		}
+		// 重复回应只推进 op_id，保留原来的排列位置
+		_, err = tx.Exec(`
+			INSERT INTO reactions (message_id, user_id, emoji, removed, op_id, added_op, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(message_id, user_id, emoji) DO UPDATE SET
+				removed = excluded.removed, op_id = excluded.op_id,
+				added_op = CASE WHEN reactions.removed = 0 AND excluded.removed = 0 THEN reactions.added_op ELSE excluded.added_op END,
+				updated_at = excluded.updated_at
+		`, r.MessageID, r.UserID, r.Emoji, r.Removed, r.OpID, r.OpID, r.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return changed, err
+}
+
+// GetReactions 获取一条消息当前的表情回应，按回应先后排列
+func (s *Storage) GetReactions(messageID string) ([]*Reaction, error) {
+	rows, err := s.db.Query(`
+		SELECT message_id, user_id, emoji, removed, op_id, updated_at FROM reactions
+		WHERE message_id = ? AND removed = 0
+		ORDER BY added_op
+	`, messageID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	var list []*Reaction
+	for rows.Next() {
+		r := &Reaction{}
+		if err := rows.Scan(&r.MessageID, &r.UserID, &r.Emoji, &r.Removed, &r.OpID, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
 
-	var messages []*StoredMessage
+// GetMessage 按ID获取一条消息，不存在时返回 nil
+func (s *Storage) GetMessage(id string) (*StoredMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(messageSelect+` WHERE m.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.scanMessages(rows)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	if err := s.fillReactions(messages); err != nil {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+// threadIDs 递归查出以 root 为根的话题里的全部消息ID（含根消息和多层回复）
+const threadIDs = `
+	WITH RECURSIVE thread(id) AS (
+		SELECT ?
+		UNION
+		SELECT m.id FROM messages m JOIN thread t ON m.reply_to_id = t.id
+	)
+`
+
+// GetThread 获取话题：根消息和它的全部回复，按时间正序
+func (s *Storage) GetThread(rootID string) ([]*StoredMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(threadIDs+messageSelect+`
+		WHERE m.id IN (SELECT id FROM thread)
+		ORDER BY m.timestamp, m.id
+	`, rootID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fillReactions(messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// GetThreadUnreadIDs 获取话题里别人发来的未读回复ID
+func (s *Storage) GetThreadUnreadIDs(rootID, selfID string) ([]string, error) {
+	rows, err := s.db.Query(threadIDs+`
+		SELECT id FROM messages
+		WHERE id IN (SELECT id FROM thread) AND id != ? AND is_read = 0 AND sender_id != ?
+		ORDER BY timestamp
+	`, rootID, rootID, selfID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
 	for rows.Next() {
-		msg := &StoredMessage{}
-		err := rows.Scan(
-			&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.SenderNickname,
-			&msg.Content, &msg.Timestamp, &msg.IsRead, &msg.IsGroup,
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetThreadUnreadCounts 统计会话里每个话题（按根消息ID）别人发来的未读回复数，没有未读的话题不返回
+func (s *Storage) GetThreadUnreadCounts(cid, selfID string) (map[string]int, error) {
+	// 根消息：没有回复对象，或回复的消息本地不存在
+	rows, err := s.db.Query(`
+		WITH RECURSIVE tree(id, root) AS (
+			SELECT id, id FROM messages
+			WHERE cid = ? AND (reply_to_id IS NULL OR reply_to_id NOT IN (SELECT id FROM messages))
+			UNION
+			SELECT m.id, t.root FROM messages m JOIN tree t ON m.reply_to_id = t.id
 		)
-		if err != nil {
+		SELECT t.root, COUNT(*) FROM tree t JOIN messages m ON m.id = t.id
+		WHERE t.id != t.root AND m.is_read = 0 AND m.sender_id != ?
+		GROUP BY t.root
+	`, cid, selfID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var root string
+		var n int
+		if err := rows.Scan(&root, &n); err != nil {
 			return nil, err
 		}
-		messages = append(messages, msg)
+		counts[root] = n
 	}
+	return counts, rows.Err()
+}
 
-	// 反转顺序，得到 旧→新 的排序，这样渲染时最旧的消息在最上面，最新的在最下面
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+// MarkMessagesRead 把指定消息标记为已读
+func (s *Storage) MarkMessagesRead(ids []string) error {
+	if len(ids) == 0 {
+		return nil
 	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`UPDATE messages SET is_read = 1 WHERE id IN (`+placeholders+`)`, args...)
+		return err
+	})
+}
 
-	return messages, rows.Err()
+// EditMessage 改写消息内容，已撤回的消息不修改，返回是否改动
+func (s *Storage) EditMessage(id, content string, at time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enc, err := s.seal(colMessageContent, content)
+	if err != nil {
+		return false, err
+	}
+	var n int64
+	err = withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(`
+			UPDATE messages SET content = ?, edited_at = ?
+			WHERE id = ? AND deleted = 0
+		`, enc, at, id)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		var rowid int64
+		if err := tx.QueryRow(`SELECT rowid FROM messages WHERE id = ?`, id).Scan(&rowid); err != nil {
+			return err
+		}
+		if err := s.indexBlind(tx, rowid, content); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return n > 0, err
+}
+
+// TombstoneMessage 把消息改成墓碑：清空内容和附件记录，只保留占位，返回是否改动
+func (s *Storage) TombstoneMessage(id string, at time.Time) (bool, error) {
+	var n int64
+	err := withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(`
+			UPDATE messages SET content = '', deleted = 1, edited_at = ?
+			WHERE id = ? AND deleted = 0
+		`, at, id)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		for _, q := range []string{
+			`DELETE FROM attachments WHERE message_id = ?`,
+			`DELETE FROM reactions WHERE message_id = ?`,
+		} {
+			if _, err := tx.Exec(q, id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	return n > 0, err
 }
 
-// MarkAsRead 标记会话消息已读
+// DeleteMessage 从本地彻底删除一条消息及其送达状态、回执和附件记录
+func (s *Storage) DeleteMessage(id string) error {
+	return withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, q := range []string{
+			`DELETE FROM messages WHERE id = ?`,
+			`DELETE FROM message_delivery WHERE message_id = ?`,
+			`DELETE FROM message_receipts WHERE message_id = ?`,
+			`DELETE FROM attachments WHERE message_id = ?`,
+			`DELETE FROM reactions WHERE message_id = ?`,
+		} {
+			if _, err := tx.Exec(q, id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// GetUnreadMessageIDs 获取会话里 before 之前别人发来的未读消息ID
+func (s *Storage) GetUnreadMessageIDs(cid string, before time.Time, selfID string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT id FROM messages
+		WHERE cid = ? AND timestamp <= ? AND is_read = 0 AND sender_id != ?
+		ORDER BY timestamp
+	`, cid, before, selfID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SetDeliveryState 更新自己发出的消息的送达状态
+func (s *Storage) SetDeliveryState(messageID, state string, at time.Time) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT INTO message_delivery (message_id, state, updated_at)
+			VALUES (?, ?, ?)
+			ON CONFLICT(message_id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at
+		`, messageID, state, at)
+		return err
+	})
+}
+
+// SaveMessageReceipt 保存接收者的回执，状态只升不降（delivered -> read），返回是否有变化
+func (s *Storage) SaveMessageReceipt(r *MessageReceipt) (bool, error) {
+	var changed bool
+	err := withRetry(5, func() error {
+		res, err := s.db.Exec(`
+			INSERT INTO message_receipts (message_id, user_id, state, updated_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(message_id, user_id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at
+			WHERE excluded.state = 'read' AND message_receipts.state != 'read'
+		`, r.MessageID, r.UserID, r.State, r.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		changed = n > 0
+		return err
+	})
+	return changed, err
+}
+
+// GetMessageReceipts 获取消息的全部回执
+func (s *Storage) GetMessageReceipts(messageID string) ([]*MessageReceipt, error) {
+	rows, err := s.db.Query(`
+		SELECT message_id, user_id, state, updated_at
+		FROM message_receipts
+		WHERE message_id = ?
+		ORDER BY updated_at
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var receipts []*MessageReceipt
+	for rows.Next() {
+		r := &MessageReceipt{}
+		if err := rows.Scan(&r.MessageID, &r.UserID, &r.State, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+// MarkAsRead 标记会话消息已读，会话未读数由触发器按实际变化的行扣减
 func (s *Storage) MarkAsRead(cid string, before time.Time) error {
 	return withRetry(5, func() error {
 		_, err := s.db.Exec(`
 			UPDATE messages
 			SET is_read = 1
-			WHERE cid = ? AND timestamp <= ?
+			WHERE cid = ? AND timestamp <= ? AND is_read = 0
 		`, cid, before)
 		return err
 	})
 }
 
-// SaveConversation 保存会话
+// SaveConversation 保存会话，已存在时只更新最后消息时间和空缺的对端ID，不影响未读数等摘要字段
 func (s *Storage) SaveConversation(conv *StoredConversation) error {
 	return withRetry(5, func() error {
 		_, err := s.db.Exec(`
-			INSERT OR REPLACE INTO conversations
-			(id, type, last_message_at, created_at)
-			VALUES (?, ?, ?, ?)
-		`, conv.ID, conv.Type, conv.LastMessageAt, conv.CreatedAt)
+			INSERT INTO conversations
+			(id, type, last_message_at, created_at, peer_id)
+			VALUES (?, ?, ?, ?, NULLIF(?, ''))
+			ON CONFLICT(id) DO UPDATE SET
+				last_message_at = excluded.last_message_at,
+				peer_id = COALESCE(conversations.peer_id, excluded.peer_id)
+		`, conv.ID, conv.Type, conv.LastMessageAt, conv.CreatedAt, conv.PeerID)
 		return err
 	})
 }
 
 // GetConversation 获取会话
 func (s *Storage) GetConversation(id string) (*StoredConversation, error) {
-	conv := &StoredConversation{}
-	err := s.db.QueryRow(`
-		SELECT id, type, last_message_at, created_at
-		FROM conversations
-		WHERE id = ?
-	`, id).Scan(&conv.ID, &conv.Type, &conv.LastMessageAt, &conv.CreatedAt)
+	row := s.db.QueryRow(`
+		SELECT `+conversationColumns+`
+		FROM conversations c
+		LEFT JOIN group_info g ON g.group_id = c.id
+		WHERE c.id = ?
+	`, id)
+	conv, err := scanConversation(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	return conv, err
 }
 
-// SearchMessages 搜索消息
+// conversationColumns 查询会话的公共列，配合 scanConversation 使用
+const conversationColumns = `c.id, c.type, COALESCE(g.name, ''), COALESCE(c.peer_id, ''), c.last_message_at, c.created_at,
+	c.pinned, c.archived, c.muted_until`
+
+// scanConversation 读取 conversationColumns 查询的一行
+func scanConversation(row interface{ Scan(dest ...any) error }) (*StoredConversation, error) {
+	conv := &StoredConversation{}
+	var mutedUntil sql.NullTime
+	if err := row.Scan(&conv.ID, &conv.Type, &conv.Title, &conv.PeerID, &conv.LastMessageAt, &conv.CreatedAt,
+		&conv.Pinned, &conv.Archived, &mutedUntil); err != nil {
+		return nil, err
+	}
+	if mutedUntil.Valid {
+		conv.MutedUntil = &mutedUntil.Time
+	}
+	return conv, nil
+}
+
+// SearchMessages 搜索消息，按相关度排序；需要过滤条件和摘要时用 Search
 func (s *Storage) SearchMessages(query string, limit int) ([]*StoredMessage, error) {
-	rows, err := s.db.Query(`
-		SELECT id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group
-		FROM messages
-		WHERE content LIKE ?
-		ORDER BY timestamp DESC
-		LIMIT ?
-	`, "%"+query+"%", limit)
+	results, err := s.Search(SearchOptions{Query: query, Limit: limit})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var messages []*StoredMessage
-	for rows.Next() {
-		msg := &StoredMessage{}
-		err := rows.Scan(
-			&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.SenderNickname,
-			&msg.Content, &msg.Timestamp, &msg.IsRead, &msg.IsGroup,
-		)
-		if err != nil {
-			return nil, err
-		}
-		messages = append(messages, msg)
+	messages := make([]*StoredMessage, len(results))
+	for i, r := range results {
+		messages[i] = r.StoredMessage
 	}
-
-	return messages, rows.Err()
+	return messages, nil
 }
 
 // SaveFriendPubKey 保存好友公钥
 func (s *Storage) SaveFriendPubKey(userID, pubKey string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enc, err := s.seal(colFriendPubKey, pubKey)
+	if err != nil {
+		return err
+	}
 	return withRetry(5, func() error {
 		_, err := s.db.Exec(`
 			INSERT OR REPLACE INTO friend_pub_keys
 			(user_id, pub_key)
 			VALUES (?, ?)
-		`, userID, pubKey)
+		`, userID, enc)
 		return err
 	})
 }
 
 // GetFriendPubKey 获取好友公钥
 func (s *Storage) GetFriendPubKey(userID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var pubKey string
 	err := s.db.QueryRow(`
 		SELECT pub_key FROM friend_pub_keys WHERE user_id = ?
@@ -245,23 +719,34 @@ func (s *Storage) GetFriendPubKey(userID string) (string, error) {
 	if err == sql.ErrNoRows {
 		return "", fmt.Errorf("friend pub key not found: %s", userID)
 	}
-	return pubKey, err
+	if err != nil {
+		return "", err
+	}
+	return s.open(colFriendPubKey, pubKey)
 }
 
 // SaveGroupSymKey 保存群聊对称密钥
 func (s *Storage) SaveGroupSymKey(groupID, symKey string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enc, err := s.seal(colGroupSymKey, symKey)
+	if err != nil {
+		return err
+	}
 	return withRetry(5, func() error {
 		_, err := s.db.Exec(`
 			INSERT OR REPLACE INTO group_sym_keys
 			(group_id, sym_key)
 			VALUES (?, ?)
-		`, groupID, symKey)
+		`, groupID, enc)
 		return err
 	})
 }
 
 // GetGroupSymKey 获取群聊对称密钥
 func (s *Storage) GetGroupSymKey(groupID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var symKey string
 	err := s.db.QueryRow(`
 		SELECT sym_key FROM group_sym_keys WHERE group_id = ?
@@ -269,7 +754,507 @@ func (s *Storage) GetGroupSymKey(groupID string) (string, error) {
 	if err == sql.ErrNoRows {
 		return "", fmt.Errorf("group sym key not found: %s", groupID)
 	}
-	return symKey, err
+	if err != nil {
+		return "", err
+	}
+	return s.open(colGroupSymKey, symKey)
+}
+
+// SaveGroupKeyEpoch 保存群密钥纪元，同一纪元已存在时保持不变
+func (s *Storage) SaveGroupKeyEpoch(e *GroupKeyEpoch) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	symKey, err := s.seal(colGroupEpochKey, e.SymKey)
+	if err != nil {
+		return err
+	}
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR IGNORE INTO group_key_epochs
+			(group_id, epoch, sym_key, created_at, retired_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, e.GroupID, e.Epoch, symKey, e.CreatedAt, e.RetiredAt)
+		return err
+	})
+}
+
+// RetireGroupKeyEpochs 把早于 epoch 且仍在使用的纪元标记为在 at 时刻退役
+func (s *Storage) RetireGroupKeyEpochs(groupID string, epoch uint32, at time.Time) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			UPDATE group_key_epochs
+			SET retired_at = ?
+			WHERE group_id = ? AND epoch < ? AND retired_at IS NULL
+		`, at, groupID, epoch)
+		return err
+	})
+}
+
+// GetGroupKeyEpochs 获取群的所有密钥纪元，按纪元升序
+func (s *Storage) GetGroupKeyEpochs(groupID string) ([]*GroupKeyEpoch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(`
+		SELECT group_id, epoch, sym_key, created_at, retired_at
+		FROM group_key_epochs
+		WHERE group_id = ?
+		ORDER BY epoch ASC
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var epochs []*GroupKeyEpoch
+	for rows.Next() {
+		e := &GroupKeyEpoch{}
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&e.GroupID, &e.Epoch, &e.SymKey, &e.CreatedAt, &retiredAt); err != nil {
+			return nil, err
+		}
+		if retiredAt.Valid {
+			e.RetiredAt = &retiredAt.Time
+		}
+		if e.SymKey, err = s.open(colGroupEpochKey, e.SymKey); err != nil {
+			return nil, err
+		}
+		epochs = append(epochs, e)
+	}
+	return epochs, rows.Err()
+}
+
+// SaveGroupInfo 保存群信息
+func (s *Storage) SaveGroupInfo(info *GroupInfo) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR REPLACE INTO group_info
+			(group_id, name, description, creator_id, version, updated_by, updated_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, info.GroupID, info.Name, info.Description, info.CreatorID, info.Version,
+			info.UpdatedBy, info.UpdatedAt, info.CreatedAt)
+		return err
+	})
+}
+
+// GetGroupInfo 获取群信息，不存在时返回 nil
+func (s *Storage) GetGroupInfo(groupID string) (*GroupInfo, error) {
+	info := &GroupInfo{}
+	var (
+		description, creatorID, updatedBy sql.NullString
+		updatedAt                         sql.NullTime
+	)
+	err := s.db.QueryRow(`
+		SELECT group_id, name, description, creator_id, version, updated_by, updated_at, created_at
+		FROM group_info
+		WHERE group_id = ?
+	`, groupID).Scan(&info.GroupID, &info.Name, &description, &creatorID, &info.Version,
+		&updatedBy, &updatedAt, &info.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Description = description.String
+	info.CreatorID = creatorID.String
+	info.UpdatedBy = updatedBy.String
+	info.UpdatedAt = updatedAt.Time
+	return info, nil
+}
+
+// SaveGroupMembers 用新的名单整体替换群成员
+func (s *Storage) SaveGroupMembers(groupID string, members []*GroupMember) error {
+	return withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`DELETE FROM group_members WHERE group_id = ?`, groupID); err != nil {
+			return err
+		}
+		for _, m := range members {
+			if _, err := tx.Exec(`
+				INSERT OR REPLACE INTO group_members (group_id, user_id, role)
+				VALUES (?, ?, ?)
+			`, groupID, m.UserID, m.Role); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// GetGroupMembers 获取群成员名单，群主和管理员排在前面
+func (s *Storage) GetGroupMembers(groupID string) ([]*GroupMember, error) {
+	rows, err := s.db.Query(`
+		SELECT group_id, user_id, role
+		FROM group_members
+		WHERE group_id = ?
+		ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, user_id
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*GroupMember
+	for rows.Next() {
+		m := &GroupMember{}
+		if err := rows.Scan(&m.GroupID, &m.UserID, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SaveGroupInvite 保存群邀请，同一个群的新邀请覆盖旧邀请
+func (s *Storage) SaveGroupInvite(inv *GroupInvite) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	symKey, err := s.seal(colInviteSymKey, inv.SymKey)
+	if err != nil {
+		return err
+	}
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR REPLACE INTO group_invites
+			(group_id, group_name, sym_key, key_epoch, inviter_id, inviter_nickname, status, meta, received_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, inv.GroupID, inv.GroupName, symKey, inv.KeyEpoch, inv.InviterID,
+			inv.InviterNickname, inv.Status, inv.Meta, inv.ReceivedAt)
+		return err
+	})
+}
+
+// GetGroupInvite 获取群邀请，不存在时返回 nil
+func (s *Storage) GetGroupInvite(groupID string) (*GroupInvite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	inv := &GroupInvite{}
+	var meta sql.NullString
+	err := s.db.QueryRow(`
+		SELECT group_id, group_name, sym_key, key_epoch, inviter_id, inviter_nickname, status, meta, received_at
+		FROM group_invites
+		WHERE group_id = ?
+	`, groupID).Scan(&inv.GroupID, &inv.GroupName, &inv.SymKey, &inv.KeyEpoch, &inv.InviterID,
+		&inv.InviterNickname, &inv.Status, &meta, &inv.ReceivedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv.Meta = meta.String
+	if inv.SymKey, err = s.open(colInviteSymKey, inv.SymKey); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// GetPendingGroupInvites 获取待处理的群邀请，按收到时间倒序
+func (s *Storage) GetPendingGroupInvites() ([]*GroupInvite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(`
+		SELECT group_id, group_name, sym_key, key_epoch, inviter_id, inviter_nickname, status, received_at
+		FROM group_invites
+		WHERE status = ?
+		ORDER BY received_at DESC
+	`, InvitePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []*GroupInvite
+	for rows.Next() {
+		inv := &GroupInvite{}
+		if err := rows.Scan(&inv.GroupID, &inv.GroupName, &inv.SymKey, &inv.KeyEpoch, &inv.InviterID,
+			&inv.InviterNickname, &inv.Status, &inv.ReceivedAt); err != nil {
+			return nil, err
+		}
+		if inv.SymKey, err = s.open(colInviteSymKey, inv.SymKey); err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// UpdateGroupInviteStatus 更新群邀请状态
+func (s *Storage) UpdateGroupInviteStatus(groupID, status string) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			UPDATE group_invites SET status = ? WHERE group_id = ?
+		`, status, groupID)
+		return err
+	})
+}
+
+// SaveAttachment 保存消息附件，同一条消息重复保存时忽略
+func (s *Storage) SaveAttachment(a *Attachment) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fileKey, err := s.seal(colFileKey, a.FileKey)
+	if err != nil {
+		return err
+	}
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR IGNORE INTO attachments
+			(message_id, cid, bucket, object_name, file_name, mime_type, size, file_key, chunk_size, local_path, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, a.MessageID, a.ConversationID, a.Bucket, a.ObjectName, a.FileName, a.MimeType,
+			a.Size, fileKey, a.ChunkSize, a.LocalPath, a.CreatedAt)
+		return err
+	})
+}
+
+// GetAttachment 获取消息的附件，没有附件时返回 nil
+func (s *Storage) GetAttachment(messageID string) (*Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a := &Attachment{}
+	var mimeType, localPath sql.NullString
+	err := s.db.QueryRow(`
+		SELECT message_id, cid, bucket, object_name, file_name, mime_type, size, file_key, chunk_size, local_path, created_at
+		FROM attachments
+		WHERE message_id = ?
+	`, messageID).Scan(&a.MessageID, &a.ConversationID, &a.Bucket, &a.ObjectName, &a.FileName, &mimeType,
+		&a.Size, &a.FileKey, &a.ChunkSize, &localPath, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.MimeType = mimeType.String
+	a.LocalPath = localPath.String
+	if a.FileKey, err = s.open(colFileKey, a.FileKey); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetAttachmentLocalPath 记录附件下载后的本地路径
+func (s *Storage) SetAttachmentLocalPath(messageID, path string) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`UPDATE attachments SET local_path = ? WHERE message_id = ?`, path, messageID)
+		return err
+	})
+}
+
+// SaveRatchetPrekey 保存自己的预密钥
+func (s *Storage) SaveRatchetPrekey(pk *RatchetPrekey) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	privKey, err := s.seal(colPrekeyPriv, pk.PrivKey)
+	if err != nil {
+		return err
+	}
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR REPLACE INTO ratchet_prekeys
+			(prekey_id, priv_key, pub_key, created_at)
+			VALUES (?, ?, ?, ?)
+		`, pk.ID, privKey, pk.PubKey, pk.CreatedAt)
+		return err
+	})
+}
+
+// GetRatchetPrekey 按ID获取自己的预密钥，不存在时返回 nil
+func (s *Storage) GetRatchetPrekey(id uint32) (*RatchetPrekey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pk := &RatchetPrekey{}
+	err := s.db.QueryRow(`
+		SELECT prekey_id, priv_key, pub_key, created_at
+		FROM ratchet_prekeys
+		WHERE prekey_id = ?
+	`, id).Scan(&pk.ID, &pk.PrivKey, &pk.PubKey, &pk.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pk.PrivKey, err = s.open(colPrekeyPriv, pk.PrivKey); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// GetLatestRatchetPrekey 获取最新的预密钥，不存在时返回 nil
+func (s *Storage) GetLatestRatchetPrekey() (*RatchetPrekey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pk := &RatchetPrekey{}
+	err := s.db.QueryRow(`
+		SELECT prekey_id, priv_key, pub_key, created_at
+		FROM ratchet_prekeys
+		ORDER BY prekey_id DESC
+		LIMIT 1
+	`).Scan(&pk.ID, &pk.PrivKey, &pk.PubKey, &pk.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pk.PrivKey, err = s.open(colPrekeyPriv, pk.PrivKey); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// DeleteRatchetPrekeysBefore 删除编号小于 id 的签名预密钥（已经被替换、不再需要的）
+func (s *Storage) DeleteRatchetPrekeysBefore(id uint32) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`DELETE FROM ratchet_prekeys WHERE prekey_id < ?`, id)
+		return err
+	})
+}
+
+// SaveOneTimePrekey 保存自己的一次性预密钥
+func (s *Storage) SaveOneTimePrekey(pk *RatchetPrekey) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	privKey, err := s.seal(colOneTimePriv, pk.PrivKey)
+	if err != nil {
+		return err
+	}
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR REPLACE INTO ratchet_one_time_prekeys
+			(prekey_id, priv_key, pub_key, created_at)
+			VALUES (?, ?, ?, ?)
+		`, pk.ID, privKey, pk.PubKey, pk.CreatedAt)
+		return err
+	})
+}
+
+// GetOneTimePrekey 按ID获取一次性预密钥，不存在（已用过）时返回 nil
+func (s *Storage) GetOneTimePrekey(id uint32) (*RatchetPrekey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pk := &RatchetPrekey{}
+	err := s.db.QueryRow(`
+		SELECT prekey_id, priv_key, pub_key, created_at
+		FROM ratchet_one_time_prekeys
+		WHERE prekey_id = ?
+	`, id).Scan(&pk.ID, &pk.PrivKey, &pk.PubKey, &pk.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pk.PrivKey, err = s.open(colOneTimePriv, pk.PrivKey); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// DeleteOneTimePrekey 删除用过的一次性预密钥
+func (s *Storage) DeleteOneTimePrekey(id uint32) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`DELETE FROM ratchet_one_time_prekeys WHERE prekey_id = ?`, id)
+		return err
+	})
+}
+
+// GetMaxOneTimePrekeyID 获取已分配的最大一次性预密钥ID，没有时为0
+func (s *Storage) GetMaxOneTimePrekeyID() (uint32, error) {
+	var id sql.NullInt64
+	err := s.db.QueryRow(`SELECT MAX(prekey_id) FROM ratchet_one_time_prekeys`).Scan(&id)
+	return uint32(id.Int64), err
+}
+
+// SavePeerPrekey 保存好友的预密钥
+func (s *Storage) SavePeerPrekey(pk *PeerPrekey) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT OR REPLACE INTO ratchet_peer_prekeys
+			(peer_id, prekey_id, pub_key, updated_at)
+			VALUES (?, ?, ?, ?)
+		`, pk.PeerID, pk.PrekeyID, pk.PubKey, pk.UpdatedAt)
+		return err
+	})
+}
+
+// GetPeerPrekey 获取好友的预密钥，不存在时返回 nil
+func (s *Storage) GetPeerPrekey(peerID string) (*PeerPrekey, error) {
+	pk := &PeerPrekey{}
+	err := s.db.QueryRow(`
+		SELECT peer_id, prekey_id, pub_key, updated_at
+		FROM ratchet_peer_prekeys
+		WHERE peer_id = ?
+	`, peerID).Scan(&pk.PeerID, &pk.PrekeyID, &pk.PubKey, &pk.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pk, err
+}
+
+// SaveRatchetSession 保存双棘轮会话状态
+func (s *Storage) SaveRatchetSession(sess *RatchetSession) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, err := s.seal(colSessionState, sess.State)
+	if err != nil {
+		return err
+	}
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT INTO ratchet_sessions
+			(peer_id, session_id, state, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(peer_id, session_id) DO UPDATE SET
+				state = excluded.state,
+				updated_at = excluded.updated_at
+		`, sess.PeerID, sess.SessionID, state, sess.CreatedAt, sess.UpdatedAt)
+		return err
+	})
+}
+
+// GetRatchetSessions 获取和好友的所有双棘轮会话
+func (s *Storage) GetRatchetSessions(peerID string) ([]*RatchetSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(`
+		SELECT peer_id, session_id, state, created_at, updated_at
+		FROM ratchet_sessions
+		WHERE peer_id = ?
+		ORDER BY session_id
+	`, peerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*RatchetSession
+	for rows.Next() {
+		sess := &RatchetSession{}
+		if err := rows.Scan(&sess.PeerID, &sess.SessionID, &sess.State, &sess.CreatedAt, &sess.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if sess.State, err = s.open(colSessionState, sess.State); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteRatchetSessions 删除和好友的所有双棘轮会话
+func (s *Storage) DeleteRatchetSessions(peerID string) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`DELETE FROM ratchet_sessions WHERE peer_id = ?`, peerID)
+		return err
+	})
 }
 
 // GetAllFriends 获取所有好友ID列表
@@ -313,9 +1298,10 @@ func (s *Storage) GetAllGroups() ([]string, error) {
 // GetAllConversations 获取所有会话列表，按最后消息时间倒序排列
 func (s *Storage) GetAllConversations() ([]*StoredConversation, error) {
 	rows, err := s.db.Query(`
-		SELECT id, type, last_message_at, created_at
-		FROM conversations
-		ORDER BY last_message_at DESC
+		SELECT `+conversationColumns+`
+		FROM conversations c
+		LEFT JOIN group_info g ON g.group_id = c.id
+		ORDER BY c.last_message_at DESC
 	`)
 	if err != nil {
 		return nil, err
@@ -324,8 +1310,8 @@ func (s *Storage) GetAllConversations() ([]*StoredConversation, error) {
 
 	var convs []*StoredConversation
 	for rows.Next() {
-		conv := &StoredConversation{}
-		if err := rows.Scan(&conv.ID, &conv.Type, &conv.LastMessageAt, &conv.CreatedAt); err != nil {
+		conv, err := scanConversation(rows)
+		if err != nil {
 			return nil, err
 		}
 		convs = append(convs, conv)
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// 隔离消息缺少的密钥类型
+const (
+	QuarantineGroupKey  = "group"
+	QuarantineFriendKey = "friend"
+)
+
+// SyncCheckpoint 会话的离线同步检查点
+type SyncCheckpoint struct {
+	ConversationID string    `json:"cid"`
+	Stream         string    `json:"stream"`   // DChatGroups / DChatDirect
+	LastSeq        uint64    `json:"last_seq"` // 已处理的最大流序列号
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// SaveSyncCheckpoint 记录会话已处理到的流序列号，只前进不后退（乱序重投不会把检查点拉回去）
+func (s *Storage) SaveSyncCheckpoint(cid, stream string, seq uint64) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`
+			INSERT INTO sync_checkpoints (cid, stream, last_seq, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(cid) DO UPDATE SET
+				stream = excluded.stream,
+				last_seq = MAX(sync_checkpoints.last_seq, excluded.last_seq),
+				updated_at = excluded.updated_at
+		`, cid, stream, seq, time.Now())
+		return err
+	})
+}
+
+// GetSyncCheckpoints 取出全部检查点
+func (s *Storage) GetSyncCheckpoints() ([]*SyncCheckpoint, error) {
+	rows, err := s.db.Query(`SELECT cid, stream, last_seq, updated_at FROM sync_checkpoints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []*SyncCheckpoint
+	for rows.Next() {
+		cp := &SyncCheckpoint{}
+		if err := rows.Scan(&cp.ConversationID, &cp.Stream, &cp.LastSeq, &cp.UpdatedAt); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	return checkpoints, rows.Err()
+}
+
+// DeleteSyncCheckpoint 删除会话的检查点，Hub 上的流被重建（序列号重新开始）时使用
+func (s *Storage) DeleteSyncCheckpoint(cid string) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`DELETE FROM sync_checkpoints WHERE cid = ?`, cid)
+		return err
+	})
+}
+
+// QuarantinedMessage 离线同步解密不了的消息，保留原始载荷以便之后重试
+type QuarantinedMessage struct {
+	Subject        string    `json:"subject"`
+	NatsSeq        uint64    `json:"nats_seq"`
+	ConversationID string    `json:"cid"`
+	SenderID       string    `json:"sender_id"`
+	KeyKind        string    `json:"key_kind"` // QuarantineGroupKey / QuarantineFriendKey，为空表示不是缺少密钥
+	KeyID          string    `json:"key_id"`
+	Reason         string    `json:"reason"`
+	Payload        []byte    `json:"-"`
+	StoredAt       time.Time `json:"stored_at"` // Hub 保存这条消息的时间（流元数据），旧记录为空
+	Attempts       int       `json:"attempts"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastAttemptAt  time.Time `json:"last_attempt_at"`
+}
+
+// QuarantineMessage 隔离一条消息；已经隔离过时累加尝试次数并更新原因和缺少的密钥
+func (s *Storage) QuarantineMessage(q *QuarantinedMessage) error {
+	return withRetry(5, func() error {
+		now := time.Now()
+		_, err := s.db.Exec(`
+			INSERT INTO sync_quarantine (subject, nats_seq, cid, sender_id, key_kind, key_id, reason, payload, stored_at, created_at, last_attempt_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(subject, nats_seq) DO UPDATE SET
+				key_kind = excluded.key_kind,
+				key_id = excluded.key_id,
+				reason = excluded.reason,
+				attempts = sync_quarantine.attempts + 1,
+				last_attempt_at = excluded.last_attempt_at
+		`, q.Subject, q.NatsSeq, q.ConversationID, q.SenderID, q.KeyKind, q.KeyID, q.Reason, q.Payload, sql.NullTime{Time: q.StoredAt, Valid: !q.StoredAt.IsZero()}, now, now)
+		return err
+	})
+}
+
+// GetQuarantinedMessages 按缺少的密钥取出隔离的消息，keyKind 为空时取出全部；按序列号排列
+func (s *Storage) GetQuarantinedMessages(keyKind, keyID string) ([]*QuarantinedMessage, error) {
+	query := `SELECT ` + quarantineColumns + ` FROM sync_quarantine`
+	var args []any
+	if keyKind != "" {
+		query += ` WHERE key_kind = ? AND key_id = ?`
+		args = append(args, keyKind, keyID)
+	}
+	rows, err := s.db.Query(query+` ORDER BY nats_seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []*QuarantinedMessage
+	for rows.Next() {
+		q, err := scanQuarantined(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, q)
+	}
+	return msgs, rows.Err()
+}
+
+// GetQuarantinedMessage 取出一条隔离的消息，不在隔离表里返回 nil
+func (s *Storage) GetQuarantinedMessage(subject string, natsSeq uint64) (*QuarantinedMessage, error) {
+	q, err := scanQuarantined(s.db.QueryRow(`SELECT `+quarantineColumns+` FROM sync_quarantine
+		WHERE subject = ? AND nats_seq = ?`, subject, natsSeq))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return q, err
+}
+
+// DeleteQuarantinedMessage 重试成功（或不再需要）后移出隔离
+func (s *Storage) DeleteQuarantinedMessage(subject string, natsSeq uint64) error {
+	return withRetry(5, func() error {
+		_, err := s.db.Exec(`DELETE FROM sync_quarantine WHERE subject = ? AND nats_seq = ?`, subject, natsSeq)
+		return err
+	})
+}
+
+// PurgeQuarantine 清理隔离表：删除 before 之前隔离的消息，剩下的超过 keep 条时删除最早隔离的，返回删除的条数
+func (s *Storage) PurgeQuarantine(before time.Time, keep int) (int64, error) {
+	var purged int64
+	err := withRetry(5, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		expired, err := tx.Exec(`DELETE FROM sync_quarantine WHERE created_at < ?`, before)
+		if err != nil {
+			return err
+		}
+		overflow, err := tx.Exec(`
+			DELETE FROM sync_quarantine WHERE rowid IN (
+				SELECT rowid FROM sync_quarantine ORDER BY created_at DESC, nats_seq DESC LIMIT -1 OFFSET ?
+			)
+		`, keep)
+		if err != nil {
+			return err
+		}
+		n1, _ := expired.RowsAffected()
+		n2, _ := overflow.RowsAffected()
+		purged = n1 + n2
+		return tx.Commit()
+	})
+	return purged, err
+}
+
+// quarantineColumns 与 scanQuarantined 对应的查询列
+const quarantineColumns = `subject, nats_seq, cid, COALESCE(sender_id, ''), key_kind, key_id, COALESCE(reason, ''),
+	payload, stored_at, attempts, created_at, last_attempt_at`
+
+// scanQuarantined 扫描一行隔离消息
+func scanQuarantined(row interface{ Scan(dest ...any) error }) (*QuarantinedMessage, error) {
+	q := &QuarantinedMessage{}
+	var storedAt sql.NullTime
+	if err := row.Scan(&q.Subject, &q.NatsSeq, &q.ConversationID, &q.SenderID, &q.KeyKind, &q.KeyID, &q.Reason,
+		&q.Payload, &storedAt, &q.Attempts, &q.CreatedAt, &q.LastAttemptAt); err != nil {
+		return nil, err
+	}
+	q.StoredAt = storedAt.Time
+	return q, nil
+}
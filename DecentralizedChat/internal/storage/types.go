@@ -12,13 +12,146 @@ type StoredMessage struct {
 	Timestamp      time.Time `json:"timestamp"`
 	IsRead         bool      `json:"is_read"`
 	IsGroup        bool      `json:"is_group"`
-	NatsSeq        uint64    `json:"nats_seq"` // NATS消息序列ID，用于去重
+	NatsSeq        uint64    `json:"nats_seq"` // NATS消息序列ID，实时订阅收到的为0
+	DeliveryState  string    `json:"delivery_state,omitempty"` // 自己发出的消息的送达状态，其他人的消息为空
+	EditedAt       *time.Time `json:"edited_at,omitempty"`     // 编辑或撤回的时间，未改动过为 nil
+	Deleted        bool       `json:"deleted,omitempty"`       // 已被发送方撤回，Content 为空
+	ReplyToID      string     `json:"reply_to_id,omitempty"`   // 回复的消息ID
+	Unverified     bool       `json:"unverified,omitempty"`    // v0 旧载荷没有签名，SenderID 只是载荷声称的发送者
+	Reactions      map[string][]string `json:"reactions,omitempty"` // 表情 -> 回应的用户ID，按回应先后排列
+}
+
+// Reaction 一个用户对一条消息的一个表情回应
+type Reaction struct {
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	Removed   bool      `json:"removed"`
+	OpID      string    `json:"op_id"` // 回应操作的ID（ULID），只接受比已保存的更新的操作
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 送达状态，按 sent < delivered < read 递进；pending / failed 表示消息还在发件箱里，没有发布到 Hub
+const (
+	DeliveryPending   = "pending"
+	DeliveryFailed    = "failed"
+	DeliverySent      = "sent"
+	DeliveryDelivered = "delivered"
+	DeliveryRead      = "read"
+)
+
+// MessageReceipt 一个接收者对消息的回执
+type MessageReceipt struct {
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	State     string    `json:"state"` // DeliveryDelivered / DeliveryRead
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // StoredConversation 存储的会话
 type StoredConversation struct {
 	ID             string    `json:"id"`
 	Type           string    `json:"type"` // "dm" or "group"
+	Title          string    `json:"title"` // 群名称，私聊为空
+	PeerID         string    `json:"peer_id,omitempty"` // 私聊对端用户ID
 	LastMessageAt  time.Time `json:"last_message_at"`
 	CreatedAt      time.Time `json:"created_at"`
+	Pinned         bool       `json:"pinned"`
+	Archived       bool       `json:"archived"`
+	MutedUntil     *time.Time `json:"muted_until,omitempty"` // 免打扰截止时间，MuteForever 表示一直免打扰
+}
+
+// GroupKeyEpoch 群密钥的一个纪元
+type GroupKeyEpoch struct {
+	GroupID   string     `json:"group_id"`
+	Epoch     uint32     `json:"epoch"`
+	SymKey    string     `json:"sym_key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"` // nil 表示仍在使用
+}
+
+// GroupInfo 群信息
+type GroupInfo struct {
+	GroupID     string    `json:"group_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatorID   string    `json:"creator_id"`
+	Version     uint64    `json:"version"`
+	UpdatedBy   string    `json:"updated_by"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// 群成员角色
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// GroupMember 群成员
+type GroupMember struct {
+	GroupID string `json:"group_id"`
+	UserID  string `json:"user_id"`
+	Role    string `json:"role"` // RoleOwner / RoleAdmin / RoleMember
+}
+
+// 群邀请状态
+const (
+	InvitePending  = "pending"
+	InviteAccepted = "accepted"
+	InviteDeclined = "declined"
+)
+
+// GroupInvite 收到的群邀请
+type GroupInvite struct {
+	GroupID         string    `json:"group_id"`
+	GroupName       string    `json:"group_name"`
+	SymKey          string    `json:"-"` // 群密钥不下发给前端
+	KeyEpoch        uint32    `json:"key_epoch"`
+	InviterID       string    `json:"inviter_id"`
+	InviterNickname string    `json:"inviter_nickname"`
+	Status          string    `json:"status"` // InvitePending / InviteAccepted / InviteDeclined
+	Meta            string    `json:"-"` // 邀请时的群信息快照（JSON）
+	ReceivedAt      time.Time `json:"received_at"`
+}
+
+// Attachment 消息附件，FileKey 是解密对象用的随机密钥
+type Attachment struct {
+	MessageID      string    `json:"message_id"`
+	ConversationID string    `json:"conversation_id"`
+	Bucket         string    `json:"bucket"`
+	ObjectName     string    `json:"object_name"`
+	FileName       string    `json:"file_name"`
+	MimeType       string    `json:"mime_type"`
+	Size           int64     `json:"size"` // 明文字节数
+	FileKey        string    `json:"-"`
+	ChunkSize      int       `json:"chunk_size"`
+	LocalPath      string    `json:"local_path"` // 未下载时为空
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// RatchetPrekey 自己的预密钥
+type RatchetPrekey struct {
+	ID        uint32    `json:"id"`
+	PrivKey   string    `json:"-"`
+	PubKey    string    `json:"pub_key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PeerPrekey 好友的预密钥
+type PeerPrekey struct {
+	PeerID    string    `json:"peer_id"`
+	PrekeyID  uint32    `json:"prekey_id"`
+	PubKey    string    `json:"pub_key"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RatchetSession 双棘轮会话，State 是序列化后的会话状态
+type RatchetSession struct {
+	PeerID    string    `json:"peer_id"`
+	SessionID string    `json:"session_id"`
+	State     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
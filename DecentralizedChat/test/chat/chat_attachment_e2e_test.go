@@ -0,0 +1,139 @@
+// E2E 集成测试：加密附件（对象存储）
+package e2e_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	gnats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试私聊和群聊发送文件：对象存储里只有密文，接收方下载解密后内容一致，并收到进度事件
+func TestChat_Attachment_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 加密附件 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	received := make(chan *chat.DecryptedMessage, 8)
+	chatBob.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == aliceID {
+			received <- msg
+		}
+	})
+	progress := make(chan *chat.FileProgress, 256)
+	chatBob.OnEvent(func(name string, payload any) {
+		if name == chat.EventFileProgress {
+			progress <- payload.(*chat.FileProgress)
+		}
+	})
+	expectFile := func() *chat.DecryptedMessage {
+		t.Helper()
+		select {
+		case msg := <-received:
+			require.Equal(t, chat.KindFile, msg.Kind)
+			require.NotNil(t, msg.Attachment)
+			require.NotEmpty(t, msg.ID)
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("❌ 等待附件消息超时")
+			return nil
+		}
+	}
+
+	dir := t.TempDir()
+	data := make([]byte, 200<<10+123) // 跨多个加密分块
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "report.pdf")
+	require.NoError(t, os.WriteFile(src, data, 0o600))
+
+	// 1. 私聊发送文件
+	t.Log("Step 1: Alice 私聊发送文件...")
+	require.NoError(t, chatAlice.SendFile(bobID, src))
+	msg := expectFile()
+	assert.Equal(t, "report.pdf", msg.Plain)
+	assert.Equal(t, "report.pdf", msg.Attachment.FileName)
+	assert.Equal(t, "application/pdf", msg.Attachment.MimeType)
+	assert.Equal(t, int64(len(data)), msg.Attachment.Size)
+	assert.Empty(t, msg.Attachment.LocalPath)
+
+	// 对象存储里是密文
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream(gnats.Domain("hub"))
+	require.NoError(t, err)
+	obs, err := js.ObjectStore("DChatFiles")
+	require.NoError(t, err)
+	stored, err := obs.GetBytes(msg.Attachment.ObjectName)
+	require.NoError(t, err)
+	assert.Greater(t, len(stored), len(data), "密文包含每块的认证标签")
+	assert.False(t, bytes.Contains(stored, data[:64]), "对象存储里不应出现明文")
+	t.Log("✅ 附件以密文上传")
+
+	// 2. Bob 下载到目录，按原文件名保存
+	t.Log("Step 2: Bob 下载附件...")
+	for len(progress) > 0 {
+		<-progress
+	}
+	downloads := t.TempDir()
+	require.NoError(t, chatBob.DownloadAttachment(msg.ID, downloads))
+	got, err := os.ReadFile(filepath.Join(downloads, "report.pdf"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	var last *chat.FileProgress
+	for len(progress) > 0 {
+		p := <-progress
+		assert.Equal(t, chat.TransferDownload, p.Direction)
+		assert.Equal(t, msg.ID, p.MessageID)
+		last = p
+	}
+	require.NotNil(t, last, "应收到下载进度事件")
+	assert.Equal(t, int64(len(data)), last.Done)
+	assert.Equal(t, last.Total, last.Done)
+	t.Log("✅ 下载解密后内容一致")
+
+	// 3. 群聊发送图片
+	t.Log("Step 3: Alice 在群里发送图片...")
+	gid, groupKey, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	chatBob.AddGroupKey(gid, groupKey)
+	require.NoError(t, chatBob.JoinGroup(gid))
+
+	img := filepath.Join(dir, "cat.png")
+	require.NoError(t, os.WriteFile(img, []byte("\x89PNG\r\n\x1a\n一只猫"), 0o600))
+	require.NoError(t, chatAlice.SendFile(gid, img))
+	msg = expectFile()
+	assert.True(t, msg.IsGroup)
+	assert.Equal(t, gid, msg.CID)
+	assert.Equal(t, "image/png", msg.Attachment.MimeType)
+
+	dest := filepath.Join(t.TempDir(), "saved.png")
+	require.NoError(t, chatBob.DownloadAttachment(msg.ID, dest))
+	got, err = os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n一只猫", string(got))
+	t.Log("✅ 群聊图片收发正常")
+
+	// 4. 没有附件的消息不能下载
+	assert.Error(t, chatBob.DownloadAttachment("no-such-message", dest))
+}
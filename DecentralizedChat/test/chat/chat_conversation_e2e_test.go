@@ -0,0 +1,184 @@
+// E2E 集成测试：会话列表与会话管理
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试会话列表摘要、置顶、免打扰、清空记录和删除会话（退群、删除密钥）
+func TestChat_ConversationManagement_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 会话管理 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	_, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	chatBob.SetUser("Bob")
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	aliceInbox := make(chan *chat.DecryptedMessage, 16)
+	chatAlice.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == bobID {
+			aliceInbox <- msg
+		}
+	})
+	expectMsg := func(text string) {
+		t.Helper()
+		select {
+		case msg := <-aliceInbox:
+			require.Equal(t, text, msg.Plain)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待消息 %q 超时", text)
+		}
+	}
+	expectSilence := func() {
+		t.Helper()
+		select {
+		case msg := <-aliceInbox:
+			t.Fatalf("❌ 不应收到消息通知: %q", msg.Plain)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	summary := func(cid string) *storage.ConversationSummary {
+		t.Helper()
+		list, err := chatAlice.GetConversationSummaries()
+		require.NoError(t, err)
+		for _, sum := range list {
+			if sum.ID == cid {
+				return sum
+			}
+		}
+		return nil
+	}
+	cid := chatAlice.GetConversationID(bobID)
+	// 消息时间精确到秒，需要区分先后时等到下一秒
+	nextSecond := func() { time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second))) }
+	countMessages := func(cid string) int {
+		msgs, err := chatAlice.GetMessages(cid, 100, nil)
+		require.NoError(t, err)
+		return len(msgs)
+	}
+
+	// 1. 会话列表摘要：显示对端昵称和未读数
+	t.Log("Step 1: 会话列表摘要...")
+	aliceID := chatAlice.GetUser().ID
+	require.NoError(t, chatBob.SendDirect(aliceID, "在吗"))
+	expectMsg("在吗")
+	require.NoError(t, chatBob.SendDirect(aliceID, "晚上一起吃饭"))
+	expectMsg("晚上一起吃饭")
+	dm := summary(cid)
+	require.NotNil(t, dm)
+	assert.Equal(t, bobID, dm.PeerID)
+	assert.Equal(t, "Bob", dm.DisplayName)
+	assert.Equal(t, 2, dm.UnreadCount)
+	assert.Equal(t, "晚上一起吃饭", dm.LastMessagePreview)
+	assert.Equal(t, "Bob", dm.LastSenderNickname)
+
+	require.NoError(t, chatAlice.MarkAsRead(cid, time.Now()))
+	assert.Equal(t, 0, summary(cid).UnreadCount)
+	t.Log("✅ 摘要和未读数正确")
+
+	// 2. 免打扰：照常保存和计入未读，但不回调
+	t.Log("Step 2: 免打扰...")
+	require.NoError(t, chatAlice.MuteConversation(cid, time.Time{}))
+	dm = summary(cid)
+	assert.True(t, dm.Muted)
+	require.NoError(t, chatBob.SendDirect(aliceID, "免打扰期间的消息"))
+	expectSilence()
+	require.Eventually(t, func() bool { return countMessages(cid) == 3 }, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 1, summary(cid).UnreadCount)
+
+	require.NoError(t, chatAlice.UnmuteConversation(cid))
+	require.NoError(t, chatBob.SendDirect(aliceID, "取消免打扰"))
+	expectMsg("取消免打扰")
+
+	// 到期的免打扰自动失效
+	require.NoError(t, chatAlice.MuteConversation(cid, time.Now().Add(-time.Minute)))
+	assert.False(t, summary(cid).Muted)
+	require.NoError(t, chatBob.SendDirect(aliceID, "免打扰已到期"))
+	expectMsg("免打扰已到期")
+	t.Log("✅ 免打扰只抑制通知")
+
+	// 3. 置顶和归档
+	t.Log("Step 3: 置顶和归档...")
+	gid, groupKey, err := chatBob.CreateGroup()
+	require.NoError(t, err)
+	chatAlice.AddGroupKey(gid, groupKey)
+	require.NoError(t, chatAlice.JoinGroup(gid))
+	nextSecond()
+	require.NoError(t, chatBob.SendGroup(gid, "群里第一条"))
+	expectMsg("群里第一条")
+
+	list, err := chatAlice.GetConversationSummaries()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, gid, list[0].ID, "群聊的消息更新")
+	require.NoError(t, chatAlice.PinConversation(cid, true))
+	require.NoError(t, chatAlice.ArchiveConversation(gid, true))
+	list, err = chatAlice.GetConversationSummaries()
+	require.NoError(t, err)
+	assert.Equal(t, cid, list[0].ID, "置顶的会话排在最前")
+	assert.True(t, list[0].Pinned)
+	assert.True(t, list[1].Archived)
+	assert.Error(t, chatAlice.PinConversation("no-such-conversation", true))
+	t.Log("✅ 置顶和归档正常")
+
+	// 4. 清空聊天记录，会话和设置保留
+	t.Log("Step 4: 清空记录...")
+	require.NoError(t, chatAlice.ClearConversation(cid))
+	assert.Equal(t, 0, countMessages(cid))
+	dm = summary(cid)
+	require.NotNil(t, dm)
+	assert.True(t, dm.Pinned)
+	assert.Equal(t, 0, dm.UnreadCount)
+	assert.Empty(t, dm.LastMessageID)
+
+	// 清空之后发来的消息正常保存
+	nextSecond()
+	require.NoError(t, chatBob.SendDirect(aliceID, "清空之后"))
+	expectMsg("清空之后")
+	assert.Equal(t, 1, countMessages(cid))
+	t.Log("✅ 清空记录正常")
+
+	// 5. 删除群会话即退群，不再收到该群的消息
+	t.Log("Step 5: 删除群会话...")
+	require.NoError(t, chatAlice.DeleteConversation(gid, false))
+	assert.Nil(t, summary(gid))
+	require.NoError(t, chatBob.SendGroup(gid, "退群之后的消息"))
+	expectSilence()
+	assert.Nil(t, summary(gid), "退群后不应重新建出会话")
+
+	// 保留了密钥，可以重新加入
+	require.NoError(t, chatAlice.JoinGroup(gid))
+	require.NoError(t, chatBob.SendGroup(gid, "欢迎回来"))
+	expectMsg("欢迎回来")
+	assert.Equal(t, 1, countMessages(gid))
+
+	// 删除时一并删除群密钥
+	require.NoError(t, chatAlice.DeleteConversation(gid, true))
+	assert.Error(t, chatAlice.JoinGroup(gid), "群密钥已删除")
+	t.Log("✅ 退群正常")
+
+	// 6. 删除私聊会话并删除好友公钥
+	t.Log("Step 6: 删除私聊会话...")
+	require.NoError(t, chatAlice.DeleteConversation(cid, true))
+	assert.Nil(t, summary(cid))
+	assert.Equal(t, 0, countMessages(cid))
+	assert.Error(t, chatAlice.SendDirect(bobID, "好友公钥已删除"))
+	require.NoError(t, chatBob.SendDirect(aliceID, "还在吗"))
+	expectSilence()
+	t.Log("✅ 删除私聊会话正常")
+}
@@ -0,0 +1,136 @@
+// E2E 集成测试：消息编辑与撤回
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试私聊编辑、群聊撤回：接收方改写本地记录并收到 message:updated，非发送方不能编辑/撤回
+func TestChat_EditDelete_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 消息编辑与撤回 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	received := make(chan *chat.DecryptedMessage, 8)
+	chatBob.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == aliceID {
+			received <- msg
+		}
+	})
+	updates := make(chan *chat.MessageUpdate, 8)
+	chatBob.OnEvent(func(name string, payload any) {
+		if name == chat.EventMessageUpdated {
+			updates <- payload.(*chat.MessageUpdate)
+		}
+	})
+	expectMsg := func(text string) *chat.DecryptedMessage {
+		t.Helper()
+		select {
+		case msg := <-received:
+			require.Equal(t, text, msg.Plain)
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待消息 %q 超时", text)
+			return nil
+		}
+	}
+	expectUpdate := func(msgID string, kind chat.MessageKind) *chat.MessageUpdate {
+		t.Helper()
+		select {
+		case u := <-updates:
+			assert.Equal(t, msgID, u.MessageID)
+			assert.Equal(t, kind, u.Kind)
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待 %s 事件超时", kind)
+			return nil
+		}
+	}
+	stored := func(svc *chat.Service, cid, msgID string) *storage.StoredMessage {
+		t.Helper()
+		msgs, err := svc.GetMessages(cid, 50, nil)
+		require.NoError(t, err)
+		for _, m := range msgs {
+			if m.ID == msgID {
+				return m
+			}
+		}
+		return nil
+	}
+
+	// 1. 私聊编辑
+	t.Log("Step 1: 私聊编辑...")
+	cid := chatAlice.GetConversationID(bobID)
+	require.NoError(t, chatAlice.SendDirect(bobID, "明天十点开会"))
+	msg := expectMsg("明天十点开会")
+
+	require.NoError(t, chatAlice.EditMessage(msg.ID, "明天十一点开会"))
+	u := expectUpdate(msg.ID, chat.KindEdit)
+	assert.Equal(t, "明天十一点开会", u.Text)
+	assert.Equal(t, cid, u.CID)
+
+	for _, svc := range []*chat.Service{chatAlice, chatBob} {
+		m := stored(svc, cid, msg.ID)
+		require.NotNil(t, m)
+		assert.Equal(t, "明天十一点开会", m.Content)
+		assert.NotNil(t, m.EditedAt)
+	}
+	t.Log("✅ 双方记录都已改写")
+
+	// 2. 只有发送方可以编辑/撤回
+	t.Log("Step 2: 非发送方编辑...")
+	assert.ErrorIs(t, chatBob.EditMessage(msg.ID, "篡改"), chat.ErrNotMessageSender)
+	assert.ErrorIs(t, chatBob.DeleteMessage(msg.ID, true), chat.ErrNotMessageSender)
+	assert.ErrorIs(t, chatAlice.EditMessage("no-such-message", "x"), chat.ErrMessageNotFound)
+	t.Log("✅ 非发送方被拒绝")
+
+	// 3. 群聊撤回
+	t.Log("Step 3: 群聊撤回...")
+	gid, groupKey, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	chatBob.AddGroupKey(gid, groupKey)
+	require.NoError(t, chatBob.JoinGroup(gid))
+	require.NoError(t, chatAlice.SendGroup(gid, "发错群了"))
+	msg = expectMsg("发错群了")
+
+	require.NoError(t, chatAlice.DeleteMessage(msg.ID, true))
+	u = expectUpdate(msg.ID, chat.KindDelete)
+	assert.True(t, u.Deleted)
+	for _, svc := range []*chat.Service{chatAlice, chatBob} {
+		m := stored(svc, gid, msg.ID)
+		require.NotNil(t, m, "撤回后保留墓碑")
+		assert.True(t, m.Deleted)
+		assert.Empty(t, m.Content)
+	}
+	assert.Error(t, chatAlice.EditMessage(msg.ID, "还能改吗"), "墓碑不能再编辑")
+	t.Log("✅ 群聊撤回后只剩墓碑")
+
+	// 4. 只删除本地记录，不通知对方
+	t.Log("Step 4: 本地删除...")
+	require.NoError(t, chatBob.DeleteMessage(msg.ID, false))
+	assert.Nil(t, stored(chatBob, gid, msg.ID))
+	assert.NotNil(t, stored(chatAlice, gid, msg.ID))
+	select {
+	case u := <-updates:
+		t.Fatalf("❌ 本地删除不应产生更新事件: %+v", u)
+	case <-time.After(300 * time.Millisecond):
+	}
+	t.Log("✅ 本地删除正常")
+}
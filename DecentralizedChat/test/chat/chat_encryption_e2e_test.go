@@ -2,8 +2,6 @@
 package e2e_test
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"testing"
 	"time"
@@ -13,24 +11,66 @@ import (
 	"DecentralizedChat/internal/storage"
 
 	"github.com/nats-io/nats-server/v2/server"
+	gnats "github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
+	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/crypto/curve25519"
 )
 
 const testHost = "127.0.0.1"
 
-// 生成X25519密钥对
-func generateX25519KeyPair(t *testing.T) (privB64, pubB64 string) {
+// 生成NSC用户身份并加载到chat服务，返回派生的用户ID和NSC公钥
+func loadNSCIdentity(t *testing.T, svc *chat.Service) (uid, nscPub string) {
 	t.Helper()
-	privKey := make([]byte, 32)
-	_, err := rand.Read(privKey)
+	userKey, err := nkeys.CreateUser()
 	require.NoError(t, err)
+	seed, err := userKey.Seed()
+	require.NoError(t, err)
+	nscPub, err = userKey.PublicKey()
+	require.NoError(t, err)
+
+	require.NoError(t, svc.LoadNSCKeys(string(seed)))
+	return svc.GetUser().ID, nscPub
+}
 
-	pubKey, err := curve25519.X25519(privKey, curve25519.Basepoint)
+// waitSent 等待发送方的发件箱清空：发送调用只把消息放进发件箱，由后台循环发布到 Hub
+func waitSent(t *testing.T, svc *chat.Service) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		entries, err := svc.GetOutbox()
+		return err == nil && len(entries) == 0
+	}, 5*time.Second, 10*time.Millisecond, "发件箱里的消息应已发出")
+}
+
+// newTestChat 创建连接到 url 的 chat 服务和它的本地存储，测试结束时停止离线同步并关闭连接和存储
+func newTestChat(t *testing.T, url, name string) (*chat.Service, *storage.Storage) {
+	t.Helper()
+	st, err := storage.NewSQLiteStorage(t.TempDir() + "/" + name + ".db")
 	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	n, err := nats.NewService(nats.ClientConfig{URL: url, Name: name})
+	require.NoError(t, err)
+	t.Cleanup(func() { n.StopSync(); n.Close() })
+	return chat.NewService(n, st), st
+}
 
-	return base64.StdEncoding.EncodeToString(privKey), base64.StdEncoding.EncodeToString(pubKey)
+// joinByInvite admin 邀请 member 入群，member 收到邀请后接受；双方需要已经互为好友
+func joinByInvite(t *testing.T, admin, member *chat.Service, gid string) {
+	t.Helper()
+	require.NoError(t, admin.InviteToGroup(gid, member.GetUser().ID))
+	require.Eventually(t, func() bool {
+		invites, err := member.ListPendingInvites()
+		if err != nil {
+			return false
+		}
+		for _, inv := range invites {
+			if inv.GroupID == gid {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond, "等待群邀请")
+	require.NoError(t, member.AcceptInvite(gid))
 }
 
 // 启动测试 NATS 服务器
@@ -42,6 +82,7 @@ func startTestNATSServer(t *testing.T) (*server.Server, string) {
 		Port:     -1,
 		HTTPPort: -1,
 		JetStream: true,
+		JetStreamDomain: "hub", // 和线上Hub一致，chat服务按hub domain发布
 		StoreDir:  t.TempDir(),
 		NoLog:    true,
 		NoSigs:   true,
@@ -57,9 +98,36 @@ func startTestNATSServer(t *testing.T) (*server.Server, string) {
 	}
 
 	url := fmt.Sprintf("nats://%s:%d", testHost, opts.Port)
+	createChatStreams(t, url)
 	return s, url
 }
 
+// 创建和线上一致的 DChatGroups / DChatDirect 流
+func createChatStreams(t *testing.T, url string) {
+	t.Helper()
+
+	nc, err := gnats.Connect(url)
+	require.NoError(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	for name, subject := range map[string]string{
+		"DChatGroups": "dchat.grp.*.msg",
+		"DChatDirect": "dchat.dm.*.msg",
+	} {
+		_, err = js.AddStream(&gnats.StreamConfig{
+			Name:     name,
+			Subjects: []string{subject},
+			Storage:    gnats.FileStorage,
+			MaxAge:     30 * 24 * time.Hour,
+			Duplicates: 24 * time.Hour,
+		})
+		require.NoError(t, err, "创建流 %s 失败", name)
+	}
+}
+
 // 测试私聊端到端加密解密
 func TestChat_DirectMessage_Encryption_E2E(t *testing.T) {
 	t.Log("=== E2E 测试: 私聊消息加密解密 ===")
@@ -98,22 +166,15 @@ func TestChat_DirectMessage_Encryption_E2E(t *testing.T) {
 	chatA := chat.NewService(natsA, storageA)
 	chatB := chat.NewService(natsB, storageB)
 
-	// 设置用户ID
-	aliceID := "alice_123"
-	bobID := "bob_456"
-	chatA.SetUserID(aliceID)
-	chatB.SetUserID(bobID)
+	// 4. 加载NSC身份（聊天密钥、签名密钥和用户ID都从NSC seed派生）
+	aliceID, aliceNscPub := loadNSCIdentity(t, chatA)
+	bobID, bobNscPub := loadNSCIdentity(t, chatB)
 
-	// 4. 生成测试密钥对（真实有效的X25519密钥对）
-	alicePriv, alicePub := generateX25519KeyPair(t)
-	chatA.SetKeyPair(alicePriv, alicePub)
-
-	bobPriv, bobPub := generateX25519KeyPair(t)
-	chatB.SetKeyPair(bobPriv, bobPub)
-
-	// 互相添加好友公钥
-	chatA.AddFriendKey(bobID, bobPub)
-	chatB.AddFriendKey(aliceID, alicePub)
+	// 互相通过NSC公钥添加好友
+	_, err = chatA.AddFriendNSCKey(bobNscPub)
+	require.NoError(t, err)
+	_, err = chatB.AddFriendNSCKey(aliceNscPub)
+	require.NoError(t, err)
 	t.Log("✅ Chat 服务创建完成，密钥已交换")
 
 	// 5. Bob 订阅私聊
@@ -194,10 +255,10 @@ func TestChat_GroupMessage_Encryption_E2E(t *testing.T) {
 	chatBob := chat.NewService(natsBob, storageBob)
 	chatCharlie := chat.NewService(natsCharlie, storageCharlie)
 
-	// 设置用户ID
-	chatAlice.SetUserID("alice")
-	chatBob.SetUserID("bob")
-	chatCharlie.SetUserID("charlie")
+	// 加载NSC身份，群消息用NSC用户私钥签名
+	aliceID, _ := loadNSCIdentity(t, chatAlice)
+	loadNSCIdentity(t, chatBob)
+	loadNSCIdentity(t, chatCharlie)
 
 	// 4. 群对称密钥（模拟群创建时生成和分发，32字节base64编码）
 	groupID := "group_test_001"
@@ -244,7 +305,7 @@ func TestChat_GroupMessage_Encryption_E2E(t *testing.T) {
 	select {
 	case msg := <-receivedBob:
 		assert.Equal(t, testGroupMsg, msg.Plain, "Bob收到的群消息内容不匹配")
-		assert.Equal(t, "alice", msg.Sender, "发送者ID不匹配")
+		assert.Equal(t, aliceID, msg.Sender, "发送者ID不匹配")
 		assert.True(t, msg.IsGroup, "群聊消息应该标记为群聊")
 		t.Log("✅ Bob 成功收到并解密群消息")
 	case <-time.After(5 * time.Second):
@@ -255,7 +316,7 @@ func TestChat_GroupMessage_Encryption_E2E(t *testing.T) {
 	select {
 	case msg := <-receivedCharlie:
 		assert.Equal(t, testGroupMsg, msg.Plain, "Charlie收到的群消息内容不匹配")
-		assert.Equal(t, "alice", msg.Sender, "发送者ID不匹配")
+		assert.Equal(t, aliceID, msg.Sender, "发送者ID不匹配")
 		assert.True(t, msg.IsGroup, "群聊消息应该标记为群聊")
 		t.Log("✅ Charlie 成功收到并解密群消息")
 	case <-time.After(5 * time.Second):
@@ -0,0 +1,154 @@
+// E2E 集成测试：带版本和类型的消息信封
+package e2e_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/nats"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试 v1 载荷按类型路由；未签名的 v0 旧载荷实时收到时拒绝，只有签名上线前保存在 Hub 上的
+// 历史消息在离线同步时按纯文本解析，保存为未认证消息
+func TestChat_VersionedEnvelope_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 消息信封版本与类型 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	natsAlice, err := nats.NewService(nats.ClientConfig{URL: natsURL, Name: "alice"})
+	require.NoError(t, err)
+	defer natsAlice.Close()
+
+	natsBob, err := nats.NewService(nats.ClientConfig{URL: natsURL, Name: "bob"})
+	require.NoError(t, err)
+	defer natsBob.Close()
+
+	storageAlice, err := storage.NewSQLiteStorage(t.TempDir() + "/alice.db")
+	require.NoError(t, err)
+	defer storageAlice.Close()
+
+	storageBob, err := storage.NewSQLiteStorage(t.TempDir() + "/bob.db")
+	require.NoError(t, err)
+	defer storageBob.Close()
+
+	chatAlice := chat.NewService(natsAlice, storageAlice)
+	chatBob := chat.NewService(natsBob, storageBob)
+	aliceID, _ := loadNSCIdentity(t, chatAlice)
+	loadNSCIdentity(t, chatBob)
+
+	groupID := "group_envelope_001"
+	groupKey, err := chat.GenerateGroupKey()
+	require.NoError(t, err)
+	chatAlice.AddGroupKey(groupID, groupKey)
+	chatBob.AddGroupKey(groupID, groupKey)
+	require.NoError(t, chatBob.JoinGroup(groupID))
+
+	received := make(chan *chat.DecryptedMessage, 4)
+	chatBob.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		received <- msg
+	})
+	rejected := make(chan error, 4)
+	chatBob.OnError(func(err error) {
+		rejected <- err
+	})
+
+	publishRaw := func(w chat.EncWire) {
+		data, err := json.Marshal(w)
+		require.NoError(t, err)
+		_, err = natsAlice.PublishJetStream("dchat.grp."+groupID+".msg", data)
+		require.NoError(t, err)
+	}
+
+	// 1. 旧版 v0 载荷：没有 v/kind/签名，密文就是纯文本；实时收到时拒绝
+	t.Log("Step 1: 发布 v0 旧载荷...")
+	nonce, cipher, err := chat.EncryptGroup(groupKey, []byte("旧版本的消息"))
+	require.NoError(t, err)
+	publishRaw(chat.EncWire{CID: groupID, Sender: aliceID, TS: time.Now().Unix(), Nonce: nonce, Cipher: cipher})
+
+	select {
+	case err := <-rejected:
+		var authErr *chat.AuthError
+		require.ErrorAs(t, err, &authErr)
+		assert.ErrorIs(t, err, chat.ErrUnsignedMessage)
+		assert.Equal(t, aliceID, authErr.Sender)
+		t.Log("✅ 实时收到的 v0 载荷被拒绝")
+	case msg := <-received:
+		t.Fatalf("❌ 未签名的 v0 载荷不应送达: %q", msg.Plain)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待拒绝 v0 消息超时")
+	}
+
+	// 2. 正常发送的文本消息是 v1 结构化载荷
+	t.Log("Step 2: 通过 SendGroup 发送 v1 文本消息...")
+	require.NoError(t, chatAlice.SendGroup(groupID, "新版本的消息"))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "新版本的消息", msg.Plain)
+		assert.Equal(t, chat.KindText, msg.Kind)
+		assert.Equal(t, chat.WireVersion, msg.RawWire.V)
+		assert.Equal(t, chat.KindText, msg.RawWire.Kind)
+		assert.True(t, msg.Verified)
+		t.Log("✅ v1 载荷按类型路由")
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待 v1 消息超时")
+	}
+
+	stored, err := storageBob.GetMessages(groupID, 10, nil)
+	require.NoError(t, err)
+	require.Len(t, stored, 1, "只保存签名的消息")
+	assert.Equal(t, "新版本的消息", stored[0].Content)
+	assert.False(t, stored[0].Unverified)
+
+	// 3. 签名上线前保存在 Hub 上的 v0 历史消息：离线同步时按纯文本解析，标记为未认证
+	t.Log("Step 3: 离线同步签名上线前的 v0 历史消息...")
+	syncHistory := func(name string, cutover time.Time) *storage.Storage {
+		t.Helper()
+		svc, st := newTestChat(t, natsURL, name)
+		loadNSCIdentity(t, svc)
+		svc.SetUnsignedCutover(cutover)
+		svc.AddGroupKey(groupID, groupKey)
+		require.NoError(t, svc.JoinGroup(groupID))
+		require.NoError(t, svc.InitOfflineSync())
+		require.Eventually(t, func() bool {
+			msgs, err := st.GetMessages(groupID, 10, nil)
+			return err == nil && len(msgs) > 0
+		}, 10*time.Second, 50*time.Millisecond, "等待离线同步")
+		return st
+	}
+
+	carol := syncHistory("carol", time.Now().Add(time.Hour))
+	require.Eventually(t, func() bool {
+		msgs, err := carol.GetMessages(groupID, 10, nil)
+		return err == nil && len(msgs) == 2
+	}, 10*time.Second, 50*time.Millisecond, "两条消息都应同步")
+	msgs, err := carol.GetMessages(groupID, 10, nil)
+	require.NoError(t, err)
+	for _, m := range msgs {
+		if m.Content == "旧版本的消息" {
+			assert.True(t, m.Unverified, "v0 载荷没有签名")
+			assert.Equal(t, aliceID, m.SenderID)
+		} else {
+			assert.Equal(t, "新版本的消息", m.Content)
+			assert.False(t, m.Unverified)
+		}
+	}
+	t.Log("✅ v0 历史消息以纯文本保存，标记为未认证")
+
+	// 4. 签名上线后保存的未签名载荷，离线同步时同样拒绝
+	t.Log("Step 4: 离线同步签名上线后的 v0 载荷...")
+	dave := syncHistory("dave", time.Now().Add(-time.Hour))
+	time.Sleep(500 * time.Millisecond)
+	msgs, err = dave.GetMessages(groupID, 10, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1, "只同步签名的消息")
+	assert.Equal(t, "新版本的消息", msgs[0].Content)
+	t.Log("✅ 签名上线后的未签名载荷被拒绝")
+}
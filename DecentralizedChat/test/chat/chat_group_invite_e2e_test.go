@@ -0,0 +1,112 @@
+// E2E 集成测试：通过私聊发送群邀请
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试邀请好友入群：收到待处理邀请，接受后自动保存密钥并订阅群消息
+func TestChat_GroupInvite_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 群邀请 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, storageBob := newTestChat(t, natsURL, "bob")
+	chatCarol, _ := newTestChat(t, natsURL, "carol")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	carolID, carolNSC := loadNSCIdentity(t, chatCarol)
+	chatAlice.SetUser("Alice")
+
+	for _, nsc := range []string{bobNSC, carolNSC} {
+		_, err := chatAlice.AddFriendNSCKey(nsc)
+		require.NoError(t, err)
+	}
+	_, err := chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+	_, err = chatCarol.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	invites := make(chan *storage.GroupInvite, 2)
+	chatBob.OnEvent(func(name string, payload any) {
+		if name == chat.EventGroupInvite {
+			invites <- payload.(*storage.GroupInvite)
+		}
+	})
+
+	// 1. Alice 建群并邀请 Bob
+	t.Log("Step 1: Alice 创建群并邀请 Bob...")
+	gid, _, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	require.NoError(t, chatAlice.UpdateGroupInfo(gid, "周末爬山", ""))
+	require.NoError(t, chatAlice.InviteToGroup(gid, bobID))
+
+	select {
+	case inv := <-invites:
+		assert.Equal(t, gid, inv.GroupID)
+		assert.Equal(t, "周末爬山", inv.GroupName)
+		assert.Equal(t, aliceID, inv.InviterID)
+		assert.Equal(t, "Alice", inv.InviterNickname)
+		assert.Equal(t, storage.InvitePending, inv.Status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待群邀请超时")
+	}
+
+	pending, err := chatBob.ListPendingInvites()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	t.Log("✅ Bob 收到待处理的群邀请")
+
+	// 2. Bob 接受邀请后能收到群消息
+	t.Log("Step 2: Bob 接受邀请...")
+	require.NoError(t, chatBob.AcceptInvite(gid))
+
+	pending, err = chatBob.ListPendingInvites()
+	require.NoError(t, err)
+	assert.Empty(t, pending, "接受后不再是待处理邀请")
+	info, err := storageBob.GetGroupInfo(gid)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	assert.Equal(t, "周末爬山", info.Name)
+
+	received := make(chan *chat.DecryptedMessage, 4)
+	chatBob.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.CID == gid {
+			received <- msg
+		}
+	})
+	require.NoError(t, chatAlice.SendGroup(gid, "欢迎 Bob"))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "欢迎 Bob", msg.Plain)
+		assert.Equal(t, aliceID, msg.Sender)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 接受邀请后未收到群消息")
+	}
+	assert.Error(t, chatBob.AcceptInvite(gid), "邀请不能重复接受")
+	t.Log("✅ 接受邀请后自动加入群聊")
+
+	// 3. Carol 拒绝邀请
+	t.Log("Step 3: Carol 拒绝邀请...")
+	require.NoError(t, chatAlice.InviteToGroup(gid, carolID))
+	require.Eventually(t, func() bool {
+		pending, err := chatCarol.ListPendingInvites()
+		return err == nil && len(pending) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, chatCarol.DeclineInvite(gid))
+
+	pending, err = chatCarol.ListPendingInvites()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Error(t, chatCarol.JoinGroup(gid), "拒绝邀请后没有群密钥")
+	t.Log("✅ 拒绝邀请不会保存群密钥")
+}
@@ -0,0 +1,156 @@
+// E2E 集成测试：群信息与成员名单同步
+package e2e_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试管理员修改群信息后成员同步更新，非管理员不能修改，移除成员后名单随之更新
+func TestChat_GroupMeta_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 群信息与成员名单 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, storageBob := newTestChat(t, natsURL, "bob")
+	chatCarol, _ := newTestChat(t, natsURL, "carol")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	carolID, carolNSC := loadNSCIdentity(t, chatCarol)
+
+	for _, nsc := range []string{bobNSC, carolNSC} {
+		_, err := chatAlice.AddFriendNSCKey(nsc)
+		require.NoError(t, err)
+	}
+	for _, svc := range []*chat.Service{chatBob, chatCarol} {
+		_, err := svc.AddFriendNSCKey(aliceNSC)
+		require.NoError(t, err)
+	}
+
+	updates := make(chan *chat.GroupMeta, 8)
+	chatBob.OnEvent(func(name string, payload any) {
+		if name == chat.EventGroupUpdated {
+			updates <- payload.(*chat.GroupMeta)
+		}
+	})
+	bobErrs := make(chan error, 8)
+	chatBob.OnError(func(err error) { bobErrs <- err })
+
+	join := func(svc *chat.Service, gid string) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			pending, err := svc.ListPendingInvites()
+			return err == nil && len(pending) == 1
+		}, 5*time.Second, 50*time.Millisecond)
+		require.NoError(t, svc.AcceptInvite(gid))
+	}
+	memberIDs := func(svc *chat.Service, gid string) map[string]string {
+		t.Helper()
+		members, err := svc.ListGroupMembers(gid)
+		require.NoError(t, err)
+		roles := make(map[string]string, len(members))
+		for _, m := range members {
+			roles[m.UserID] = m.Role
+		}
+		return roles
+	}
+
+	// 1. Alice 建群并邀请 Bob 和 Carol，接受邀请后拿到完整名单
+	t.Log("Step 1: 建群并邀请成员...")
+	gid, _, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	require.NoError(t, chatAlice.UpdateGroupInfo(gid, "读书会", "每周日晚上"))
+	require.NoError(t, chatAlice.InviteToGroup(gid, bobID))
+	join(chatBob, gid)
+	require.NoError(t, chatAlice.InviteToGroup(gid, carolID))
+	join(chatCarol, gid)
+
+	info, err := chatBob.GetGroupInfo(gid)
+	require.NoError(t, err)
+	assert.Equal(t, "读书会", info.Name)
+	assert.Equal(t, "每周日晚上", info.Description)
+	assert.Equal(t, aliceID, info.CreatorID)
+
+	// Bob 接受邀请时名单里还没有 Carol，之后通过群主题同步
+	require.Eventually(t, func() bool {
+		return len(memberIDs(chatBob, gid)) == 3
+	}, 5*time.Second, 50*time.Millisecond, "Bob 应同步到 Carol 入群")
+	assert.Equal(t, map[string]string{
+		aliceID: storage.RoleOwner,
+		bobID:   storage.RoleMember,
+		carolID: storage.RoleMember,
+	}, memberIDs(chatBob, gid))
+	t.Log("✅ 成员名单已同步")
+
+	// 2. 管理员改名，成员收到 group:updated
+	t.Log("Step 2: Alice 修改群信息...")
+	for len(updates) > 0 {
+		<-updates
+	}
+	require.NoError(t, chatAlice.UpdateGroupInfo(gid, "读书会（第二季）", "每周日晚上"))
+	select {
+	case meta := <-updates:
+		assert.Equal(t, gid, meta.GID)
+		assert.Equal(t, "读书会（第二季）", meta.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待群信息更新超时")
+	}
+	info, err = chatBob.GetGroupInfo(gid)
+	require.NoError(t, err)
+	assert.Equal(t, "读书会（第二季）", info.Name)
+
+	require.NoError(t, chatAlice.SendGroup(gid, "新一季开始了"))
+	require.Eventually(t, func() bool {
+		conv, err := storageBob.GetConversation(gid)
+		return err == nil && conv != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	conv, err := storageBob.GetConversation(gid)
+	require.NoError(t, err)
+	assert.Equal(t, "读书会（第二季）", conv.Title, "群会话标题来自群名称")
+	t.Log("✅ 群信息修改已同步")
+
+	// 3. 非管理员不能修改群信息
+	t.Log("Step 3: Bob 尝试修改群信息...")
+	err = chatBob.UpdateGroupInfo(gid, "Bob 的群", "")
+	assert.True(t, errors.Is(err, chat.ErrNotGroupAdmin), "非管理员不能修改: %v", err)
+	assert.Error(t, chatBob.InviteToGroup(gid, aliceID))
+
+	// 4. 提升 Bob 为管理员后可以修改
+	t.Log("Step 4: Alice 设置 Bob 为管理员...")
+	require.NoError(t, chatAlice.SetGroupAdmin(gid, bobID, true))
+	require.Eventually(t, func() bool {
+		return memberIDs(chatBob, gid)[bobID] == storage.RoleAdmin
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, chatBob.UpdateGroupInfo(gid, "读书会", "Bob 改的简介"))
+	require.Eventually(t, func() bool {
+		info, err := chatAlice.GetGroupInfo(gid)
+		return err == nil && info.Description == "Bob 改的简介"
+	}, 5*time.Second, 50*time.Millisecond, "Alice 应接受管理员 Bob 的修改")
+	t.Log("✅ 管理员权限生效")
+
+	// 5. 移除 Carol：名单更新，密钥轮换
+	t.Log("Step 5: Alice 移除 Carol...")
+	require.NoError(t, chatAlice.RemoveGroupMember(gid, carolID))
+	require.Eventually(t, func() bool {
+		_, ok := memberIDs(chatBob, gid)[carolID]
+		return !ok
+	}, 5*time.Second, 50*time.Millisecond, "Bob 的名单应移除 Carol")
+	assert.NotContains(t, memberIDs(chatAlice, gid), carolID)
+	assert.Error(t, chatAlice.RemoveGroupMember(gid, aliceID), "不能移除群主")
+
+	select {
+	case err := <-bobErrs:
+		t.Fatalf("❌ Bob 意外错误: %v", err)
+	default:
+	}
+	t.Log("✅ 移除成员后名单已更新")
+}
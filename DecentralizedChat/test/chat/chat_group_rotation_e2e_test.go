@@ -0,0 +1,370 @@
+// E2E 集成测试：群密钥纪元轮换与成员移除
+package e2e_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/nats"
+	"DecentralizedChat/internal/storage"
+
+	gnats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotationMember 轮换测试里的一个群成员
+type rotationMember struct {
+	svc      *chat.Service
+	store    *storage.Storage
+	id       string
+	nscPub   string
+	received chan *chat.DecryptedMessage
+	errs     chan error
+}
+
+func newRotationMember(t *testing.T, natsURL, name string) *rotationMember {
+	st, err := storage.NewSQLiteStorage(t.TempDir() + "/" + name + ".db")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	n, err := nats.NewService(nats.ClientConfig{URL: natsURL, Name: name})
+	require.NoError(t, err)
+	t.Cleanup(func() { n.Close() })
+
+	m := &rotationMember{
+		svc:      chat.NewService(n, st),
+		store:    st,
+		received: make(chan *chat.DecryptedMessage, 16),
+		errs:     make(chan error, 8),
+	}
+	m.id, m.nscPub = loadNSCIdentity(t, m.svc)
+	m.svc.OnDecrypted(func(msg *chat.DecryptedMessage) { m.received <- msg })
+	m.svc.OnError(func(err error) { m.errs <- err })
+	return m
+}
+
+// newRotationGroup Alice 建群并邀请其他成员，和每个成员互为好友，密钥通过私聊下发
+func newRotationGroup(t *testing.T, alice *rotationMember, others ...*rotationMember) (gid, groupKey string) {
+	for _, m := range others {
+		_, err := alice.svc.AddFriendNSCKey(m.nscPub)
+		require.NoError(t, err)
+		_, err = m.svc.AddFriendNSCKey(alice.nscPub)
+		require.NoError(t, err)
+	}
+	gid, groupKey, err := alice.svc.CreateGroup()
+	require.NoError(t, err)
+	for _, m := range others {
+		joinByInvite(t, alice.svc, m.svc, gid)
+	}
+	return gid, groupKey
+}
+
+// expectGroupMessage 等待成员收到别人在群里发的指定消息
+func expectGroupMessage(t *testing.T, m *rotationMember, gid, text string) *chat.DecryptedMessage {
+	t.Helper()
+	for {
+		select {
+		case msg := <-m.received:
+			if msg.CID != gid || msg.Sender == m.id {
+				continue
+			}
+			assert.Equal(t, text, msg.Plain)
+			return msg
+		case err := <-m.errs:
+			t.Fatalf("❌ 意外错误: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待消息 %q 超时", text)
+		}
+	}
+}
+
+// 测试轮换群密钥后被移除的成员无法继续发言，历史纪元仍然保留
+func TestChat_GroupKeyRotation_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 群密钥轮换 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	type member = rotationMember
+	alice := newRotationMember(t, natsURL, "alice")
+	bob := newRotationMember(t, natsURL, "bob")
+	charlie := newRotationMember(t, natsURL, "charlie")
+	gid, groupKey := newRotationGroup(t, alice, bob, charlie)
+
+	expectMessage := func(m *member, text string) *chat.DecryptedMessage {
+		t.Helper()
+		return expectGroupMessage(t, m, gid, text)
+	}
+
+	// 1. 轮换前所有成员都能收到纪元0的消息
+	t.Log("Step 1: 轮换前发送消息...")
+	require.NoError(t, alice.svc.SendGroup(gid, "轮换前的消息"))
+	msg := expectMessage(bob, "轮换前的消息")
+	assert.Equal(t, uint32(0), msg.RawWire.KeyID)
+	expectMessage(charlie, "轮换前的消息")
+	t.Log("✅ 纪元0消息正常")
+
+	// 2. 移除 Charlie：只把新密钥发给 Bob
+	t.Log("Step 2: 轮换群密钥并移除 Charlie...")
+	epoch, err := alice.svc.RotateGroupKey(gid, []string{bob.id})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), epoch)
+
+	// 密钥全部送达后 Alice 在群里发启用消息，Bob 收到后才退役旧纪元
+	require.Eventually(t, func() bool {
+		epochs, err := bob.store.GetGroupKeyEpochs(gid)
+		return err == nil && len(epochs) == 2 && epochs[0].RetiredAt != nil
+	}, 5*time.Second, 50*time.Millisecond, "Bob 应通过私聊收到新纪元密钥并启用")
+
+	epochs, err := bob.store.GetGroupKeyEpochs(gid)
+	require.NoError(t, err)
+	assert.Equal(t, groupKey, epochs[0].SymKey, "旧纪元密钥需要保留以解密历史消息")
+	assert.Nil(t, epochs[1].RetiredAt)
+
+	charlieEpochs, err := charlie.store.GetGroupKeyEpochs(gid)
+	require.NoError(t, err)
+	assert.Len(t, charlieEpochs, 1, "被移除的成员不应拿到新密钥")
+	t.Log("✅ 新纪元密钥只下发给剩余成员")
+
+	// 3. 剩余成员用新纪元通信
+	t.Log("Step 3: Bob 用新纪元发送消息...")
+	require.NoError(t, bob.svc.SendGroup(gid, "轮换后的消息"))
+	msg = expectMessage(alice, "轮换后的消息")
+	assert.Equal(t, uint32(1), msg.RawWire.KeyID)
+	t.Log("✅ 新纪元消息正常")
+
+	select {
+	case err := <-charlie.errs:
+		t.Logf("Charlie 无法解密新纪元消息: %v", err)
+	case msg := <-charlie.received:
+		t.Fatalf("❌ 被移除的成员不应解密新消息: %q", msg.Plain)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ Charlie 应收到解密失败错误")
+	}
+
+	// 4. Charlie 继续用退役的纪元0发言，其他成员拒绝
+	t.Log("Step 4: 被移除的 Charlie 用旧纪元发送消息...")
+	time.Sleep(1100 * time.Millisecond) // 退役时间精确到秒，确保收到的时间晚于它
+	require.NoError(t, charlie.svc.SendGroup(gid, "我还在群里吗"))
+	for _, m := range []*member{alice, bob} {
+	wait:
+		for {
+			select {
+			case err := <-m.errs:
+				assert.True(t, errors.Is(err, chat.ErrRetiredGroupKey), "应拒绝退役纪元的消息: %v", err)
+				break wait
+			case msg := <-m.received:
+				if msg.Sender == m.id {
+					continue // 自己消息的回显
+				}
+				t.Fatalf("❌ 退役纪元的消息不应被接受: %q", msg.Plain)
+			case <-time.After(5 * time.Second):
+				t.Fatal("❌ 等待拒绝事件超时")
+			}
+		}
+	}
+	// 同一条旧纪元消息可能被重复拒绝（慢速环境下实时订阅会收到重发），清掉多余的拒绝事件以免影响后面的步骤
+	time.Sleep(300 * time.Millisecond)
+	for _, m := range []*member{alice, bob} {
+		for len(m.errs) > 0 {
+			assert.ErrorIs(t, <-m.errs, chat.ErrRetiredGroupKey)
+		}
+	}
+	t.Log("✅ 退役纪元的新消息被拒绝")
+
+	// 5. 密钥没有送达时不切换纪元，重试沿用同一纪元和密钥
+	t.Log("Step 5: 轮换时密钥发送失败...")
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	info, err := js.StreamInfo("DChatDirect")
+	require.NoError(t, err)
+	cfg := info.Config
+	cfg.MaxMsgSize = 64
+	_, err = js.UpdateStream(&cfg)
+	require.NoError(t, err)
+
+	_, err = alice.svc.RotateGroupKey(gid, []string{bob.id})
+	require.Error(t, err, "密钥没有送达时应返回错误")
+	aliceEpochs, err := alice.store.GetGroupKeyEpochs(gid)
+	require.NoError(t, err)
+	assert.Len(t, aliceEpochs, 2, "没有送达时不切换到新纪元")
+
+	cfg.MaxMsgSize = -1
+	_, err = js.UpdateStream(&cfg)
+	require.NoError(t, err)
+	epoch, err = alice.svc.RotateGroupKey(gid, []string{bob.id})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), epoch, "重试沿用上次的纪元")
+	require.Eventually(t, func() bool {
+		epochs, err := bob.store.GetGroupKeyEpochs(gid)
+		return err == nil && len(epochs) == 3
+	}, 5*time.Second, 50*time.Millisecond, "Bob 应收到重试的密钥")
+	require.NoError(t, alice.svc.SendGroup(gid, "重试之后"))
+	expectMessage(bob, "重试之后")
+	t.Log("✅ 全部送达后才切换纪元")
+
+	// 6. 发件箱里排队的群消息在轮换后按新纪元重新加密
+	t.Log("Step 6: 排队期间轮换群密钥...")
+	ginfo, err := js.StreamInfo("DChatGroups")
+	require.NoError(t, err)
+	gcfg := ginfo.Config
+	gcfg.MaxMsgSize = 64
+	_, err = js.UpdateStream(&gcfg)
+	require.NoError(t, err)
+	require.NoError(t, alice.svc.SendGroup(gid, "排队中的消息"))
+	var queued *storage.OutboxEntry
+	require.Eventually(t, func() bool {
+		entries, err := alice.svc.GetOutbox()
+		if err != nil || len(entries) != 1 || entries[0].State != storage.DeliveryFailed {
+			return false
+		}
+		queued = entries[0]
+		return true
+	}, 5*time.Second, 50*time.Millisecond, "发不出去的群消息应留在发件箱里")
+
+	gcfg.MaxMsgSize = -1
+	_, err = js.UpdateStream(&gcfg)
+	require.NoError(t, err)
+	epoch, err = alice.svc.RotateGroupKey(gid, []string{bob.id})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		epochs, err := bob.store.GetGroupKeyEpochs(gid)
+		return err == nil && len(epochs) == 4 && epochs[2].RetiredAt != nil
+	}, 5*time.Second, 50*time.Millisecond, "Bob 应启用新纪元")
+	time.Sleep(1100 * time.Millisecond) // 退役时间精确到秒，用旧纪元发出会被拒绝
+	require.NoError(t, alice.svc.RetrySend(queued.MessageID))
+	require.Eventually(t, func() bool {
+		entries, err := alice.svc.GetOutbox()
+		return err == nil && len(entries) == 0
+	}, 5*time.Second, 50*time.Millisecond, "重试后应发出")
+	// Hub 拒收时实时订阅已经收到过一次，这里按 Nats-Msg-Id 找到流里保存的那条
+	ginfo, err = js.StreamInfo("DChatGroups")
+	require.NoError(t, err)
+	var stored *gnats.RawStreamMsg
+	for seq := ginfo.State.LastSeq; seq >= ginfo.State.FirstSeq && stored == nil; seq-- {
+		if m, err := js.GetMsg("DChatGroups", seq); err == nil && m.Header.Get(gnats.MsgIdHdr) == queued.MessageID {
+			stored = m
+		}
+	}
+	require.NotNil(t, stored, "流里应有重试发出的消息")
+	var w chat.EncWire
+	require.NoError(t, json.Unmarshal(stored.Data, &w))
+	assert.Equal(t, epoch, w.KeyID, "按当前纪元重新加密")
+	t.Log("✅ 排队的群消息按新纪元发出")
+
+	// 7. 线下分享密钥加入的群认不出管理员，不接受任何人的轮换
+	t.Log("Step 7: 没有群信息的群收到密钥轮换...")
+	legacy, legacyKey, err := alice.svc.CreateGroup()
+	require.NoError(t, err)
+	bob.svc.AddGroupKey(legacy, legacyKey)
+	require.NoError(t, bob.svc.JoinGroup(legacy))
+	_, err = alice.svc.RotateGroupKey(legacy, []string{bob.id})
+	require.NoError(t, err)
+	select {
+	case err := <-bob.errs:
+		assert.ErrorIs(t, err, chat.ErrNotGroupAdmin)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ Bob 应拒绝认不出管理员的密钥轮换")
+	}
+	legacyEpochs, err := bob.store.GetGroupKeyEpochs(legacy)
+	require.NoError(t, err)
+	assert.Len(t, legacyEpochs, 1, "不接受轮换")
+	t.Log("✅ 认不出管理员时拒绝轮换")
+}
+
+// 测试轮换只送达部分成员时群不分裂：已收到新密钥的成员继续用旧纪元，管理员启用后才切换
+func TestChat_GroupKeyRotation_PartialFailure_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 群密钥部分送达 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	alice := newRotationMember(t, natsURL, "alice")
+	bob := newRotationMember(t, natsURL, "bob")
+	charlie := newRotationMember(t, natsURL, "charlie")
+	gid, _ := newRotationGroup(t, alice, bob, charlie)
+
+	// 1. 让 Alice 给 Charlie 的私聊主题写满：按主题限制条数、满了拒绝新消息，发给 Bob 的不受影响
+	t.Log("Step 1: 限制 Charlie 的私聊主题...")
+	require.NoError(t, alice.svc.SendDirect(charlie.id, "占一个位置"))
+	waitSent(t, alice.svc)
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	info, err := js.StreamInfo("DChatDirect", &gnats.StreamInfoRequest{SubjectsFilter: ">"})
+	require.NoError(t, err)
+	var bobCount, charlieCount uint64
+	for subj, n := range info.State.Subjects {
+		switch subj {
+		case "dchat.dm." + alice.svc.GetConversationID(bob.id) + ".msg":
+			bobCount = n
+		case "dchat.dm." + alice.svc.GetConversationID(charlie.id) + ".msg":
+			charlieCount = n
+		}
+	}
+	require.Greater(t, charlieCount, bobCount)
+	original := info.Config
+	limited := original
+	limited.Discard = gnats.DiscardNew
+	limited.DiscardNewPerSubject = true
+	limited.MaxMsgsPerSubject = int64(charlieCount)
+	_, err = js.UpdateStream(&limited)
+	require.NoError(t, err)
+
+	// 2. 轮换失败，Bob 收到了新密钥但不启用。Charlie 暂时退订私聊，Hub 拒收的密钥也不会实时送到他那里
+	t.Log("Step 2: 轮换只送达 Bob...")
+	require.NoError(t, charlie.svc.LeaveDirect(alice.id))
+	_, err = alice.svc.RotateGroupKey(gid, []string{bob.id, charlie.id})
+	require.Error(t, err, "Charlie 没收到密钥时应返回错误")
+	require.Eventually(t, func() bool {
+		epochs, err := bob.store.GetGroupKeyEpochs(gid)
+		return err == nil && len(epochs) == 2
+	}, 5*time.Second, 50*time.Millisecond, "Bob 应收到新纪元密钥")
+	time.Sleep(1100 * time.Millisecond) // 退役时间精确到秒，错误地退役时旧纪元的消息会被拒绝
+	epochs, err := bob.store.GetGroupKeyEpochs(gid)
+	require.NoError(t, err)
+	assert.Nil(t, epochs[0].RetiredAt, "管理员没有启用之前不退役旧纪元")
+	charlieEpochs, err := charlie.store.GetGroupKeyEpochs(gid)
+	require.NoError(t, err)
+	assert.Len(t, charlieEpochs, 1)
+	t.Log("✅ 收到授权时不退役旧纪元")
+
+	// 3. 三个人仍然在纪元0上互通
+	t.Log("Step 3: 部分送达后继续聊天...")
+	require.NoError(t, bob.svc.SendGroup(gid, "Bob 在旧纪元"))
+	msg := expectGroupMessage(t, charlie, gid, "Bob 在旧纪元")
+	assert.Equal(t, uint32(0), msg.RawWire.KeyID, "Bob 还没启用新纪元")
+	expectGroupMessage(t, alice, gid, "Bob 在旧纪元")
+	require.NoError(t, charlie.svc.SendGroup(gid, "Charlie 在旧纪元"))
+	expectGroupMessage(t, alice, gid, "Charlie 在旧纪元")
+	expectGroupMessage(t, bob, gid, "Charlie 在旧纪元")
+	t.Log("✅ 群没有分裂")
+
+	// 4. 恢复后重试，全部送达，Alice 的启用消息让所有成员切换
+	t.Log("Step 4: 重试轮换...")
+	_, err = js.UpdateStream(&original)
+	require.NoError(t, err)
+	require.NoError(t, charlie.svc.JoinDirect(alice.id))
+	epoch, err := alice.svc.RotateGroupKey(gid, []string{bob.id, charlie.id})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), epoch, "重试沿用上次的纪元")
+	for _, m := range []*rotationMember{bob, charlie} {
+		require.Eventually(t, func() bool {
+			epochs, err := m.store.GetGroupKeyEpochs(gid)
+			return err == nil && len(epochs) == 2 && epochs[0].RetiredAt != nil
+		}, 5*time.Second, 50*time.Millisecond, "成员应在启用消息到达后退役旧纪元")
+	}
+	require.NoError(t, charlie.svc.SendGroup(gid, "Charlie 在新纪元"))
+	msg = expectGroupMessage(t, bob, gid, "Charlie 在新纪元")
+	assert.Equal(t, uint32(1), msg.RawWire.KeyID)
+	expectGroupMessage(t, alice, gid, "Charlie 在新纪元")
+	t.Log("✅ 管理员启用后全体切换")
+}
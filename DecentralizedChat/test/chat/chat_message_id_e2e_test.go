@@ -0,0 +1,84 @@
+// E2E 集成测试：发送方生成的全局消息ID
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试消息ID由发送方生成（ULID）并在各端一致；实时收到的多条消息（没有序列ID）都能保存
+func TestChat_MessageID_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 全局消息ID ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	received := make(chan *chat.DecryptedMessage, 16)
+	chatBob.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == aliceID {
+			received <- msg
+		}
+	})
+
+	// 1. 连续发送多条私聊
+	t.Log("Step 1: 连续发送...")
+	texts := []string{"第一条", "第二条", "第三条"}
+	for _, text := range texts {
+		require.NoError(t, chatAlice.SendDirect(bobID, text))
+	}
+	var ids []string
+	for range texts {
+		select {
+		case msg := <-received:
+			ids = append(ids, msg.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("❌ 等待消息超时")
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("❌ 同一条消息不应重复推送: %q", msg.Plain)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// 2. 双方保存的消息ID一致，都是按时间递增的 ULID
+	t.Log("Step 2: 比较双方的消息ID...")
+	cid := chatAlice.GetConversationID(bobID)
+	idsOf := func(svc *chat.Service) []string {
+		t.Helper()
+		msgs, err := svc.GetMessages(cid, 50, nil)
+		require.NoError(t, err)
+		var out []string
+		for _, m := range msgs {
+			if m.SenderID == aliceID {
+				out = append(out, m.ID)
+			}
+		}
+		return out
+	}
+	sent := idsOf(chatAlice)
+	require.Len(t, sent, len(texts))
+	assert.ElementsMatch(t, sent, ids, "推送的ID就是发送方的ID")
+	assert.ElementsMatch(t, sent, idsOf(chatBob), "接收方保存了全部消息，ID与发送方一致")
+	for i, id := range sent {
+		assert.Len(t, id, 26)
+		if i > 0 {
+			assert.Less(t, sent[i-1], id, "ULID 按发送顺序递增")
+		}
+	}
+	t.Log("✅ 消息ID各端一致")
+}
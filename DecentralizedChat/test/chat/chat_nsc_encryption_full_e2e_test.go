@@ -11,6 +11,7 @@ import (
 	"DecentralizedChat/internal/storage"
 
 	"github.com/nats-io/nats-server/v2/server"
+	gnats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -25,7 +26,9 @@ func startTestNATSServer(t *testing.T) (*server.Server, string) {
 		Host:     testHost,
 		Port:     -1,
 		HTTPPort: -1,
-		JetStream: false, // 不需要JetStream，纯pub/sub即可
+		JetStream: true, // 消息通过JetStream发布，需要和线上一致的hub domain及流
+		JetStreamDomain: "hub",
+		StoreDir:  t.TempDir(),
 		NoLog:    true,
 		NoSigs:   true,
 	}
@@ -40,6 +43,14 @@ func startTestNATSServer(t *testing.T) (*server.Server, string) {
 	}
 
 	url := fmt.Sprintf("nats://%s:%d", testHost, opts.Port)
+
+	nc, err := gnats.Connect(url)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	_, err = js.AddStream(&gnats.StreamConfig{Name: "DChatDirect", Subjects: []string{"dchat.dm.*.msg"}})
+	require.NoError(t, err)
 	return s, url
 }
 
@@ -59,12 +70,10 @@ func TestChat_Full_NSC_Encryption_E2E(t *testing.T) {
 	aliceKey, _ := nkeys.CreateUser()
 	aliceSeed, _ := aliceKey.Seed()
 	aliceNscPub, _ := aliceKey.PublicKey() // Alice的公开身份ID
-	aliceUID := "alice_001"
 
 	bobKey, _ := nkeys.CreateUser()
 	bobSeed, _ := bobKey.Seed()
 	bobNscPub, _ := bobKey.PublicKey() // Bob的公开身份ID
-	bobUID := "bob_001"
 	t.Log("✅ 生成Alice和Bob的NSC身份密钥对成功")
 	t.Logf("   Alice NSC公钥: %s", aliceNscPub)
 	t.Logf("   Bob NSC公钥: %s", bobNscPub)
@@ -77,15 +86,15 @@ func TestChat_Full_NSC_Encryption_E2E(t *testing.T) {
 		Name: "alice-client",
 	})
 	require.NoError(t, err)
-	defer natsAlice.Close()
 	storageAlice, err := storage.NewSQLiteStorage(t.TempDir() + "/alice.db")
 	require.NoError(t, err)
 	defer storageAlice.Close()
+	defer natsAlice.Close() // 先断开连接再关闭存储，避免回显消息写入已关闭的数据库
 	chatAlice := chat.NewService(natsAlice, storageAlice)
-	chatAlice.SetUserID(aliceUID)
-	// 加载Alice的NSC密钥，自动派生聊天密钥对
+	// 加载Alice的NSC密钥，自动派生聊天密钥对和用户ID（消息签名要求用户ID与NSC公钥一致）
 	err = chatAlice.LoadNSCKeys(string(aliceSeed))
 	require.NoError(t, err)
+	aliceUID := chatAlice.GetUser().ID
 	t.Log("✅ Alice Chat服务初始化完成，NSC密钥已加载")
 
 	// Bob端初始化
@@ -94,15 +103,15 @@ func TestChat_Full_NSC_Encryption_E2E(t *testing.T) {
 		Name: "bob-client",
 	})
 	require.NoError(t, err)
-	defer natsBob.Close()
 	storageBob, err := storage.NewSQLiteStorage(t.TempDir() + "/bob.db")
 	require.NoError(t, err)
 	defer storageBob.Close()
+	defer natsBob.Close() // 先断开连接再关闭存储，避免回显消息写入已关闭的数据库
 	chatBob := chat.NewService(natsBob, storageBob)
-	chatBob.SetUserID(bobUID)
-	// 加载Bob的NSC密钥，自动派生聊天密钥对
+	// 加载Bob的NSC密钥，自动派生聊天密钥对和用户ID
 	err = chatBob.LoadNSCKeys(string(bobSeed))
 	require.NoError(t, err)
+	bobUID := chatBob.GetUser().ID
 	t.Log("✅ Bob Chat服务初始化完成，NSC密钥已加载")
 
 	// =================== Step 3: 添加好友（仅使用NSC公钥，不需要交换聊天公钥） ===================
@@ -164,6 +173,10 @@ func TestChat_Full_NSC_Encryption_E2E(t *testing.T) {
 	require.NoError(t, err)
 	aliceReceived := make(chan *chat.DecryptedMessage, 1)
 	chatAlice.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		// 添加好友时已自动订阅会话，会收到自己上一条消息的回显
+		if msg.Sender == aliceUID {
+			return
+		}
 		t.Logf("📥 Alice收到回复: 发送者=%s, 内容=%q", msg.Sender, msg.Plain)
 		aliceReceived <- msg
 	})
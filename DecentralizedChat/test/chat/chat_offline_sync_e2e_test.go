@@ -0,0 +1,505 @@
+// E2E 集成测试：离线同步只消费自己会话的主题
+package e2e_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/nats"
+	"DecentralizedChat/internal/storage"
+
+	gnats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试离线同步的持久消费者按已加入的会话过滤主题，其他人的会话不会投递过来；加入和离开会话时随之更新
+func TestChat_OfflineSyncFilter_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 按会话过滤的离线同步 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	// 服务器最后关闭：先停掉离线同步，避免同步协程在断开的连接上反复重试
+	t.Cleanup(natssrv.Shutdown)
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	chatCarol, _ := newTestChat(t, natsURL, "carol")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	carolID, carolNSC := loadNSCIdentity(t, chatCarol)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	for _, nsc := range []string{aliceNSC, carolNSC} {
+		_, err := chatBob.AddFriendNSCKey(nsc)
+		require.NoError(t, err)
+	}
+	_, err = chatCarol.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	dmConsumer := "sync_consumer_dm_" + aliceID
+	grpConsumer := "sync_consumer_grp_" + aliceID
+	consumerInfo := func(stream, name string) *gnats.ConsumerInfo {
+		t.Helper()
+		ci, err := js.ConsumerInfo(stream, name)
+		require.NoError(t, err)
+		return ci
+	}
+	expectFilter := func(stream, name string, subjects ...string) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			ci, err := js.ConsumerInfo(stream, name)
+			return err == nil && assert.ObjectsAreEqual(subjects, ci.Config.FilterSubjects)
+		}, 5*time.Second, 50*time.Millisecond, "%s 的过滤主题应为 %v", name, subjects)
+	}
+	// 流里这些主题上保存的消息数（私聊里还有回执等控制消息，按流统计而不是按发送次数）
+	storedOn := func(stream string, subjects ...string) uint64 {
+		t.Helper()
+		var n uint64
+		for _, subj := range subjects {
+			si, err := js.StreamInfo(stream, &gnats.StreamInfoRequest{SubjectsFilter: subj})
+			require.NoError(t, err)
+			n += si.State.Subjects[subj]
+		}
+		return n
+	}
+	// 等待消费者投递并确认完过滤范围内的消息：累计投递数正好等于这些主题上的消息数
+	expectSynced := func(stream, name string, subjects ...string) uint64 {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			ci := consumerInfo(stream, name)
+			return ci.NumPending == 0 && ci.NumAckPending == 0 && ci.Delivered.Consumer == storedOn(stream, subjects...)
+		}, 10*time.Second, 50*time.Millisecond, "%s 应只消费 %v 上的消息", name, subjects)
+		return consumerInfo(stream, name).Delivered.Consumer
+	}
+	cidAB := chatAlice.GetConversationID(bobID)
+	cidAC := chatAlice.GetConversationID(carolID)
+
+	dmAB := "dchat.dm." + cidAB + ".msg"
+	dmAC := "dchat.dm." + cidAC + ".msg"
+	dmBC := "dchat.dm." + chatBob.GetConversationID(carolID) + ".msg"
+
+	// 1. 启动同步前别人的会话里已经有消息
+	t.Log("Step 1: 只为已加入的私聊创建消费者...")
+	for _, text := range []string{"bob→carol 1", "bob→carol 2", "bob→carol 3"} {
+		require.NoError(t, chatBob.SendDirect(carolID, text))
+	}
+	require.NoError(t, chatBob.SendDirect(aliceID, "bob→alice"))
+	require.NoError(t, chatAlice.InitOfflineSync())
+
+	expectFilter("DChatDirect", dmConsumer, dmAB)
+	expectSynced("DChatDirect", dmConsumer, dmAB)
+	require.GreaterOrEqual(t, storedOn("DChatDirect", dmBC), uint64(3))
+	_, err = js.ConsumerInfo("DChatGroups", grpConsumer)
+	assert.ErrorIs(t, err, gnats.ErrConsumerNotFound, "没有加入任何群时不创建群聊消费者")
+
+	require.NoError(t, chatBob.SendDirect(carolID, "bob→carol 4"))
+	time.Sleep(300 * time.Millisecond)
+	expectSynced("DChatDirect", dmConsumer, dmAB)
+	t.Log("✅ 消费者只过滤自己的会话")
+
+	// 2. 加入会话时追加过滤主题
+	t.Log("Step 2: 加群、加好友...")
+	gid, _, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	grp := "dchat.grp." + gid + ".msg"
+	expectFilter("DChatGroups", grpConsumer, grp)
+	require.NoError(t, chatAlice.SendGroup(gid, "群里第一条"))
+	expectSynced("DChatGroups", grpConsumer, grp)
+
+	_, err = chatAlice.AddFriendNSCKey(carolNSC)
+	require.NoError(t, err)
+	want := []string{dmAB, dmAC}
+	if want[1] < want[0] {
+		want[0], want[1] = want[1], want[0]
+	}
+	expectFilter("DChatDirect", dmConsumer, want...)
+	t.Log("✅ 加入会话后过滤主题随之增加")
+
+	// 3. 离开会话时移除过滤主题
+	t.Log("Step 3: 离开私聊...")
+	require.NoError(t, chatAlice.LeaveDirect(bobID))
+	expectFilter("DChatDirect", dmConsumer, dmAC)
+	delivered := expectSynced("DChatDirect", dmConsumer, dmAB, dmAC)
+	before := storedOn("DChatDirect", dmAB)
+	require.NoError(t, chatBob.SendDirect(aliceID, "离开之后"))
+	require.Eventually(t, func() bool { return storedOn("DChatDirect", dmAB) > before }, 5*time.Second, 50*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	ci := consumerInfo("DChatDirect", dmConsumer)
+	assert.Equal(t, delivered, ci.Delivered.Consumer, "离开的私聊不再投递")
+	assert.Zero(t, ci.NumPending)
+	t.Log("✅ 离开会话后不再拉取")
+
+	// 4. 最后一个群也离开后停止拉取，重新加入后恢复
+	t.Log("Step 4: 离开再回到群...")
+	require.NoError(t, chatAlice.LeaveGroup(gid))
+	require.NoError(t, chatAlice.JoinGroup(gid))
+	require.NoError(t, chatAlice.SendGroup(gid, "回到群里"))
+	waitSent(t, chatAlice)
+	require.EqualValues(t, 2, storedOn("DChatGroups", grp))
+	expectSynced("DChatGroups", grpConsumer, grp)
+	t.Log("✅ 重新加入后同步恢复")
+
+	// 5. 回到私聊时补拉离开期间的消息，持久消费者的位点已经越过它们，但不重建
+	t.Log("Step 5: 回到私聊补拉历史...")
+	require.NoError(t, chatAlice.SendDirect(carolID, "alice→carol"))
+	waitSent(t, chatAlice)
+	lastAC, err := js.GetLastMsg("DChatDirect", dmAC)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		ci := consumerInfo("DChatDirect", dmConsumer)
+		return ci.Delivered.Stream >= lastAC.Sequence && ci.NumAckPending == 0
+	}, 5*time.Second, 50*time.Millisecond, "持久消费者应越过离开期间的消息")
+	rejoinFrom := consumerInfo("DChatDirect", dmConsumer)
+
+	require.NoError(t, chatAlice.JoinDirect(bobID))
+	require.Eventually(t, func() bool {
+		msgs, err := chatAlice.GetMessages(cidAB, 100, nil)
+		if err != nil {
+			return false
+		}
+		for _, m := range msgs {
+			if m.Content == "离开之后" {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond, "应补拉离开期间的消息")
+	expectFilter("DChatDirect", dmConsumer, want...)
+	rejoined := consumerInfo("DChatDirect", dmConsumer)
+	assert.Equal(t, rejoinFrom.Created, rejoined.Created, "持久消费者不重建")
+	assert.GreaterOrEqual(t, rejoined.Delivered.Consumer, rejoinFrom.Delivered.Consumer, "其他会话的消息不重新投递")
+	require.Eventually(t, func() bool {
+		n := 0
+		for range js.ConsumerNames("DChatDirect") {
+			n++
+		}
+		return n == 1
+	}, 5*time.Second, 50*time.Millisecond, "补拉用的临时消费者应被删除")
+	t.Log("✅ 用临时消费者补拉，持久消费者保持不变")
+}
+
+// 测试离线同步检查点：Hub 上的消费者丢失后从检查点续传并推送追赶进度，消息过期和流重建时报告缺口
+func TestChat_OfflineSyncCheckpoints_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 离线同步检查点 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	t.Cleanup(natssrv.Shutdown)
+
+	bobStore, err := storage.NewSQLiteStorage(t.TempDir() + "/bob.db")
+	require.NoError(t, err)
+	t.Cleanup(func() { bobStore.Close() })
+	bobNats, err := nats.NewService(nats.ClientConfig{URL: natsURL, Name: "bob"})
+	require.NoError(t, err)
+	t.Cleanup(func() { bobNats.Close() })
+	chatBob := chat.NewService(bobNats, bobStore)
+	loadNSCIdentity(t, chatBob)
+	gid, groupKey, err := chatBob.CreateGroup()
+	require.NoError(t, err)
+	grp := "dchat.grp." + gid + ".msg"
+
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	consumer := func() string {
+		t.Helper()
+		names := js.ConsumerNames("DChatGroups")
+		var found []string
+		for name := range names {
+			found = append(found, name)
+		}
+		require.Len(t, found, 1)
+		return found[0]
+	}
+	lastSeq := func() uint64 {
+		t.Helper()
+		msg, err := js.GetLastMsg("DChatGroups", grp)
+		require.NoError(t, err)
+		return msg.Sequence
+	}
+
+	// Alice 每次"启动"都用同一个数据库和身份，退出后不再有实时订阅
+	aliceKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	aliceSeed, err := aliceKey.Seed()
+	require.NoError(t, err)
+	aliceDB := t.TempDir() + "/alice.db"
+	var (
+		aliceStore *storage.Storage
+		aliceNats  *nats.Service
+		chatAlice  *chat.Service
+	)
+	progress := make(chan chat.SyncProgress, 64)
+	gaps := make(chan chat.SyncGap, 8)
+	startAlice := func() {
+		t.Helper()
+		aliceStore, err = storage.NewSQLiteStorage(aliceDB)
+		require.NoError(t, err)
+		aliceNats, err = nats.NewService(nats.ClientConfig{URL: natsURL, Name: "alice"})
+		require.NoError(t, err)
+		chatAlice = chat.NewService(aliceNats, aliceStore)
+		require.NoError(t, chatAlice.LoadNSCKeys(string(aliceSeed)))
+		chatAlice.OnEvent(func(name string, payload any) {
+			switch name {
+			case chat.EventSyncProgress:
+				progress <- *payload.(*chat.SyncProgress)
+			case chat.EventSyncGap:
+				gaps <- *payload.(*chat.SyncGap)
+			}
+		})
+		chatAlice.AddGroupKey(gid, groupKey)
+		require.NoError(t, chatAlice.JoinGroup(gid))
+		require.NoError(t, chatAlice.InitOfflineSync())
+	}
+	var stoppedAt uint64 // 退出时保存的检查点
+	stopAlice := func() {
+		t.Helper()
+		require.NoError(t, chatAlice.Close())
+		require.NoError(t, aliceNats.Close())
+		cps, err := aliceStore.GetSyncCheckpoints()
+		require.NoError(t, err)
+		require.Len(t, cps, 1)
+		stoppedAt = cps[0].LastSeq
+		require.NoError(t, aliceStore.Close())
+	}
+	t.Cleanup(func() {
+		if aliceNats.IsConnected() {
+			stopAlice()
+		}
+	})
+	bobSends := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			require.NoError(t, chatBob.SendGroup(gid, fmt.Sprintf("消息 %d", i)))
+		}
+		waitSent(t, chatBob)
+	}
+	expectMessages := func(n int) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			msgs, err := chatAlice.GetMessages(gid, 100, nil)
+			return err == nil && len(msgs) == n
+		}, 10*time.Second, 50*time.Millisecond, "Alice 应有 %d 条群消息", n)
+	}
+	savedCheckpoint := func() uint64 {
+		t.Helper()
+		cps, err := aliceStore.GetSyncCheckpoints()
+		require.NoError(t, err)
+		require.Len(t, cps, 1)
+		require.Equal(t, gid, cps[0].ConversationID)
+		return cps[0].LastSeq
+	}
+	// 检查点追上会话最后一条消息（Alice 的回执也发在群主题上，按流里实际的最后序列号比较）
+	expectCaughtUp := func() {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return savedCheckpoint() == lastSeq()
+		}, 10*time.Second, 50*time.Millisecond, "检查点应追上流的最后序列号")
+	}
+	expectGap := func(want chat.SyncGap) {
+		t.Helper()
+		select {
+		case gap := <-gaps:
+			assert.Equal(t, want, gap)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待缺口事件 %+v 超时", want)
+		}
+	}
+
+	// 1. 同步过的消息记下检查点
+	t.Log("Step 1: 记录检查点...")
+	startAlice()
+	bobSends(3)
+	expectMessages(3)
+	expectCaughtUp()
+	t.Log("✅ 检查点等于会话最后一条消息的序列号")
+
+	// 2. 运行中 Hub 上的消费者被删除，拉取协程按检查点重建
+	t.Log("Step 2: 运行中消费者丢失...")
+	require.NoError(t, js.DeleteConsumer("DChatGroups", consumer()))
+	bobSends(2)
+	expectMessages(5)
+	expectCaughtUp()
+	t.Log("✅ 重建消费者后继续同步")
+
+	// 3. 离线期间 Hub 上的消费者丢失，从检查点续传
+	t.Log("Step 3: 消费者丢失后续传...")
+	stopAlice()
+	checkpoint := stoppedAt
+	require.NoError(t, js.DeleteConsumer("DChatGroups", consumer()))
+	bobSends(25)
+	for len(progress) > 0 {
+		<-progress
+	}
+	startAlice()
+	expectMessages(30)
+	expectCaughtUp()
+
+	ci, err := js.ConsumerInfo("DChatGroups", consumer())
+	require.NoError(t, err)
+	assert.Equal(t, gnats.DeliverByStartSequencePolicy, ci.Config.DeliverPolicy)
+	assert.Equal(t, checkpoint+1, ci.Config.OptStartSeq, "从检查点之后开始投递")
+
+	var seen []chat.SyncProgress
+	require.Eventually(t, func() bool {
+		for len(progress) > 0 {
+			seen = append(seen, <-progress)
+		}
+		return len(seen) > 0 && seen[len(seen)-1].Finished
+	}, 5*time.Second, 50*time.Millisecond, "应推送追平的进度")
+	// Alice 的回执也发在群主题上，追赶期间到达的会计入总数，不按条数精确比较
+	require.Greater(t, len(seen), 1)
+	assert.Less(t, seen[0].Done, seen[0].Total, "第一批之后还有积压")
+	final := seen[len(seen)-1]
+	assert.True(t, final.Finished)
+	assert.Equal(t, final.Total, final.Done)
+	assert.GreaterOrEqual(t, final.Total, uint64(25))
+	t.Log("✅ 只补拉检查点之后的消息，推送追赶进度")
+
+	// 4. 检查点之后的消息已经过期
+	t.Log("Step 4: 消息过期...")
+	stopAlice()
+	checkpoint = stoppedAt
+	bobSends(3)
+	keep := lastSeq()
+	require.NoError(t, js.PurgeStream("DChatGroups", &gnats.StreamPurgeRequest{Sequence: keep}))
+	startAlice()
+	expectGap(chat.SyncGap{CID: gid, From: checkpoint + 1, To: keep - 1})
+	expectMessages(31)
+	expectCaughtUp()
+	t.Log("✅ 报告取不到的序列号范围")
+
+	// 5. 流被重建（或换了 Hub），序列号从头开始
+	t.Log("Step 5: 流重建...")
+	stopAlice()
+	checkpoint = stoppedAt
+	require.NoError(t, js.DeleteStream("DChatGroups"))
+	_, err = js.AddStream(&gnats.StreamConfig{Name: "DChatGroups", Subjects: []string{"dchat.grp.*.msg"}})
+	require.NoError(t, err)
+	bobSends(2)
+	startAlice()
+	expectGap(chat.SyncGap{CID: gid, Reset: true})
+	expectMessages(33)
+	expectCaughtUp()
+	assert.Less(t, savedCheckpoint(), checkpoint, "检查点按新流的序列号重新记录")
+	t.Log("✅ 检查点作废后从新流的开头同步")
+}
+
+// 测试离线消息先于解密它的群密钥到达：先隔离并延迟重新投递，收到新纪元的群密钥后自动解密，重新投递时正常 ACK
+func TestChat_OfflineSyncQuarantine_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 缺少密钥的离线消息重试 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	t.Cleanup(natssrv.Shutdown)
+
+	chatAlice, aliceStore := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	gid, _, err := chatBob.CreateGroup()
+	require.NoError(t, err)
+	joinByInvite(t, chatBob, chatAlice, gid)
+	require.NoError(t, chatAlice.InitOfflineSync())
+
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	grpConsumer := "sync_consumer_grp_" + aliceID
+	texts := func() []string {
+		msgs, err := chatAlice.GetMessages(gid, 100, nil)
+		require.NoError(t, err)
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Content)
+		}
+		return out
+	}
+
+	// 1. Alice 离开私聊，收不到 Bob 下发的新纪元群密钥，之后的群消息解不开
+	t.Log("Step 1: 新纪元的群消息先于群密钥到达...")
+	require.NoError(t, chatAlice.LeaveDirect(bobID))
+	_, err = chatBob.RotateGroupKey(gid, []string{aliceID})
+	require.NoError(t, err)
+	require.NoError(t, chatBob.SendGroup(gid, "新纪元"))
+	waitSent(t, chatBob)
+	last, err := js.GetLastMsg("DChatGroups", "dchat.grp."+gid+".msg")
+	require.NoError(t, err)
+
+	// 轮换后 Bob 发的启用消息同样用新纪元加密，也会被隔离
+	var q *storage.QuarantinedMessage
+	require.Eventually(t, func() bool {
+		quarantined, err := chatAlice.GetQuarantinedMessages()
+		if err != nil || len(quarantined) != 2 {
+			return false
+		}
+		for _, m := range quarantined {
+			if m.NatsSeq == last.Sequence {
+				q = m
+			}
+		}
+		return q != nil
+	}, 5*time.Second, 50*time.Millisecond, "解不开的消息应被隔离")
+	assert.Equal(t, last.Sequence, q.NatsSeq)
+	assert.Equal(t, gid, q.ConversationID)
+	assert.Equal(t, bobID, q.SenderID)
+	assert.Equal(t, storage.QuarantineGroupKey, q.KeyKind)
+	assert.Equal(t, gid, q.KeyID)
+	ci, err := js.ConsumerInfo("DChatGroups", grpConsumer)
+	require.NoError(t, err)
+	assert.Less(t, ci.AckFloor.Stream, last.Sequence, "缺少密钥的消息不应 ACK，等待重新投递")
+	assert.NotContains(t, texts(), "新纪元")
+	// 同样等这把密钥、但补上密钥后仍然处理不了的消息
+	broken := &storage.QuarantinedMessage{
+		Subject: "dchat.grp." + gid + ".msg", NatsSeq: last.Sequence + 1000, ConversationID: gid,
+		KeyKind: storage.QuarantineGroupKey, KeyID: gid, Reason: "forged", Payload: []byte("not json"),
+	}
+	require.NoError(t, aliceStore.QuarantineMessage(broken))
+	t.Log("✅ 消息已隔离，等待重新投递")
+
+	// 2. 回到私聊，同步到新纪元的群密钥后自动重试隔离的消息
+	t.Log("Step 2: 收到群密钥后重试...")
+	require.NoError(t, chatAlice.JoinDirect(bobID))
+	require.Eventually(t, func() bool {
+		msgs, err := chatAlice.GetQuarantinedMessages()
+		return err == nil && len(msgs) == 1 && msgs[0].NatsSeq == broken.NatsSeq
+	}, 5*time.Second, 50*time.Millisecond, "收到群密钥后应移出隔离")
+	assert.Contains(t, texts(), "新纪元")
+	kept, err := aliceStore.GetQuarantinedMessage(broken.Subject, broken.NatsSeq)
+	require.NoError(t, err)
+	require.NotNil(t, kept, "重试失败的消息应留在隔离表里")
+	assert.Equal(t, 2, kept.Attempts)
+	assert.Contains(t, kept.Reason, "unmarshal")
+	t.Log("✅ 隔离的消息已解密保存，重试失败的继续隔离")
+
+	// 3. 重新投递时消息已处理过，正常 ACK 且不重复保存
+	t.Log("Step 3: 等待重新投递...")
+	require.Eventually(t, func() bool {
+		ci, err := js.ConsumerInfo("DChatGroups", grpConsumer)
+		return err == nil && ci.AckFloor.Stream >= last.Sequence
+	}, 15*time.Second, 200*time.Millisecond, "重新投递后应 ACK")
+	count := 0
+	for _, text := range texts() {
+		if text == "新纪元" {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count, "重新投递不应重复保存")
+	t.Log("✅ 重新投递后已 ACK")
+}
@@ -0,0 +1,237 @@
+// E2E 集成测试：发件箱
+package e2e_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/nats"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/nats-io/nats-server/v2/server"
+	gnats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试断开 Hub 时消息留在发件箱里（pending），恢复连接后按顺序带着 Nats-Msg-Id 发出；
+// 以及取消、发布失败（failed）、手动重试和 Hub 不确认时发送不阻塞
+func TestChat_Outbox_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 发件箱 ===")
+
+	// 同一个端口和存储目录重启服务器，模拟断开 Hub 后恢复
+	storeDir := t.TempDir()
+	startServer := func(port int) *server.Server {
+		t.Helper()
+		srv, err := server.NewServer(&server.Options{
+			Host:            testHost,
+			Port:            port,
+			HTTPPort:        -1,
+			JetStream:       true,
+			JetStreamDomain: "hub",
+			StoreDir:        storeDir,
+			NoLog:           true,
+			NoSigs:          true,
+		})
+		require.NoError(t, err)
+		srv.Start()
+		require.True(t, srv.ReadyForConnections(10*time.Second), "NATS 服务器未在超时时间内就绪")
+		return srv
+	}
+	natssrv := startServer(-1)
+	port := natssrv.Addr().(*net.TCPAddr).Port
+	natsURL := fmt.Sprintf("nats://%s:%d", testHost, port)
+	createChatStreams(t, natsURL)
+	t.Cleanup(func() { natssrv.Shutdown() })
+
+	st, err := storage.NewSQLiteStorage(t.TempDir() + "/alice.db")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	aliceNats, err := nats.NewService(nats.ClientConfig{URL: natsURL, Name: "alice", ReconnectWait: 100 * time.Millisecond})
+	require.NoError(t, err)
+	t.Cleanup(func() { aliceNats.Close() })
+	chatAlice := chat.NewService(aliceNats, st)
+	t.Cleanup(func() { chatAlice.Close() })
+	loadNSCIdentity(t, chatAlice)
+	bobStore, err := storage.NewSQLiteStorage(t.TempDir() + "/bob.db")
+	require.NoError(t, err)
+	t.Cleanup(func() { bobStore.Close() })
+	chatBob := chat.NewService(nil, bobStore)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err = chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	cid := chatAlice.GetConversationID(bobID)
+
+	states := make(chan chat.SendStateUpdate, 64)
+	chatAlice.OnEvent(func(name string, payload any) {
+		if name == chat.EventSendState {
+			states <- *payload.(*chat.SendStateUpdate)
+		}
+	})
+	expectState := func(msgID, state string) chat.SendStateUpdate {
+		t.Helper()
+		for {
+			select {
+			case u := <-states:
+				if u.MessageID == msgID && u.State == state {
+					return u
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("❌ 等待消息 %s 变为 %s 超时", msgID, state)
+			}
+		}
+	}
+	// 按内容找自己发出的消息
+	message := func(content string) *storage.StoredMessage {
+		t.Helper()
+		msgs, err := chatAlice.GetMessages(cid, 100, nil)
+		require.NoError(t, err)
+		for _, m := range msgs {
+			if m.Content == content {
+				return m
+			}
+		}
+		return nil
+	}
+	outbox := func() []*storage.OutboxEntry {
+		t.Helper()
+		entries, err := chatAlice.GetOutbox()
+		require.NoError(t, err)
+		return entries
+	}
+
+	nc, err := gnats.Connect(natsURL, gnats.MaxReconnects(-1), gnats.ReconnectWait(100*time.Millisecond))
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	subject := "dchat.dm." + cid + ".msg"
+	lastSeq := func() uint64 {
+		t.Helper()
+		info, err := js.StreamInfo("DChatDirect")
+		require.NoError(t, err)
+		return info.State.LastSeq
+	}
+	// 流里 from 之后这个会话上的消息ID（Nats-Msg-Id），按序列号排列
+	storedIDs := func(from uint64) []string {
+		t.Helper()
+		var ids []string
+		for seq := from; seq <= lastSeq(); seq++ {
+			msg, err := js.GetMsg("DChatDirect", seq)
+			require.NoError(t, err)
+			if msg.Subject == subject {
+				ids = append(ids, msg.Header.Get(gnats.MsgIdHdr))
+			}
+		}
+		return ids
+	}
+
+	// 1. 在线时立即发出
+	t.Log("Step 1: 在线发送...")
+	start := lastSeq() + 1
+	require.NoError(t, chatAlice.SendDirect(bobID, "在线"))
+	online := message("在线")
+	require.NotNil(t, online)
+	expectState(online.ID, storage.DeliveryPending)
+	sent := expectState(online.ID, storage.DeliverySent)
+	assert.Equal(t, 1, sent.Attempts)
+	online = message("在线")
+	assert.Equal(t, storage.DeliverySent, online.DeliveryState)
+	assert.Empty(t, outbox())
+	assert.Equal(t, []string{online.ID}, storedIDs(start), "发布时带上 Nats-Msg-Id")
+	t.Log("✅ 在线时消息直接发出")
+
+	// 2. 断开后消息排队，UI 里立即可见
+	t.Log("Step 2: 断开 Hub 后发送...")
+	natssrv.Shutdown()
+	require.Eventually(t, func() bool { return !aliceNats.IsConnected() }, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, chatAlice.SendDirect(bobID, "离线一"), "断开时发送不报错")
+	require.NoError(t, chatAlice.SendDirect(bobID, "离线二"))
+	first, second := message("离线一"), message("离线二")
+	require.NotNil(t, first)
+	require.NotNil(t, second)
+	assert.Equal(t, storage.DeliveryPending, first.DeliveryState)
+	assert.Equal(t, storage.DeliveryPending, second.DeliveryState)
+	queued := outbox()
+	require.Len(t, queued, 2)
+	assert.Equal(t, first.ID, queued[0].MessageID)
+	assert.Equal(t, second.ID, queued[1].MessageID)
+	t.Log("✅ 消息进入发件箱")
+
+	// 3. 恢复后按顺序发出
+	t.Log("Step 3: 恢复连接...")
+	natssrv = startServer(port)
+	expectState(first.ID, storage.DeliverySent)
+	expectState(second.ID, storage.DeliverySent)
+	assert.Empty(t, outbox())
+	assert.Equal(t, storage.DeliverySent, message("离线一").DeliveryState)
+	assert.Equal(t, []string{online.ID, first.ID, second.ID}, storedIDs(start), "恢复后按发送顺序发出")
+	t.Log("✅ 恢复后发件箱清空")
+
+	// 4. 取消还没发出的消息
+	t.Log("Step 4: 取消...")
+	natssrv.Shutdown()
+	require.Eventually(t, func() bool { return !aliceNats.IsConnected() }, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, chatAlice.SendDirect(bobID, "不发了"))
+	cancelled := message("不发了")
+	require.NotNil(t, cancelled)
+	require.NoError(t, chatAlice.CancelSend(cancelled.ID))
+	expectState(cancelled.ID, chat.SendCancelled)
+	assert.Nil(t, message("不发了"), "取消后从本地删除")
+	assert.Empty(t, outbox())
+	require.Error(t, chatAlice.CancelSend(online.ID), "已经发出的消息不能取消")
+
+	natssrv = startServer(port)
+	require.Eventually(t, func() bool { return aliceNats.IsConnected() }, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, chatAlice.SendDirect(bobID, "取消之后"))
+	after := message("取消之后")
+	expectState(after.ID, storage.DeliverySent)
+	assert.Equal(t, []string{online.ID, first.ID, second.ID, after.ID}, storedIDs(start), "取消的消息不会发出")
+	t.Log("✅ 取消的消息没有发出")
+
+	// 5. Hub 拒收的消息标记为 failed，手动重试
+	t.Log("Step 5: 发送失败后重试...")
+	info, err := js.StreamInfo("DChatDirect")
+	require.NoError(t, err)
+	cfg := info.Config
+	cfg.MaxMsgSize = 64
+	_, err = js.UpdateStream(&cfg)
+	require.NoError(t, err)
+	require.NoError(t, chatAlice.SendDirect(bobID, "太大了"))
+	big := message("太大了")
+	failed := expectState(big.ID, storage.DeliveryFailed)
+	assert.NotEmpty(t, failed.Error)
+	assert.Equal(t, storage.DeliveryFailed, message("太大了").DeliveryState)
+	queued = outbox()
+	require.Len(t, queued, 1)
+	assert.Equal(t, storage.DeliveryFailed, queued[0].State)
+	assert.True(t, strings.Contains(queued[0].LastError, "maximum"), "记录失败原因: %s", queued[0].LastError)
+
+	cfg.MaxMsgSize = -1
+	_, err = js.UpdateStream(&cfg)
+	require.NoError(t, err)
+	require.NoError(t, chatAlice.RetrySend(big.ID))
+	expectState(big.ID, storage.DeliverySent)
+	assert.Equal(t, storage.DeliverySent, message("太大了").DeliveryState)
+	assert.Empty(t, outbox())
+	require.Error(t, chatAlice.RetrySend(big.ID), "不在发件箱里的消息不能重试")
+	t.Log("✅ 手动重试后发出")
+
+	// 6. 连着 Hub 但迟迟收不到确认时，发送调用不等待发布
+	t.Log("Step 6: Hub 不确认...")
+	require.NoError(t, js.DeleteStream("DChatDirect"))
+	// 订阅者让发布有人接收但不回确认，发件箱循环会一直等到确认超时
+	_, err = nc.Subscribe(subject, func(*gnats.Msg) {})
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+	begin := time.Now()
+	require.NoError(t, chatAlice.SendDirect(bobID, "等确认"))
+	require.NoError(t, chatAlice.SendDirect(bobID, "再等确认"))
+	assert.Less(t, time.Since(begin), time.Second, "发送不应等待 Hub 确认")
+	assert.Len(t, outbox(), 2)
+	t.Log("✅ 发送立即返回，消息留在发件箱里")
+}
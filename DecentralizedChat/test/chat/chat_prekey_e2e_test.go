@@ -0,0 +1,121 @@
+// E2E 集成测试：KV 预密钥目录
+package e2e_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	gnats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试发布预密钥包、领取一次性预密钥、拒绝被篡改的预密钥包，以及好友离线时第一条私聊就使用双棘轮
+func TestChat_PrekeyDirectory_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: KV 预密钥目录 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, storageAlice := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream(gnats.Domain("hub"))
+	require.NoError(t, err)
+	oneTimeKeys := func() int {
+		t.Helper()
+		kv, err := js.KeyValue("DChatPrekeys")
+		require.NoError(t, err)
+		keys, err := kv.ListKeys()
+		require.NoError(t, err)
+		n := 0
+		for range keys.Keys() {
+			n++
+		}
+		return n - 1 // 去掉 <uid>.bundle
+	}
+
+	// 1. Alice 发布预密钥包和 20 把一次性预密钥
+	t.Log("Step 1: Alice 发布预密钥...")
+	require.NoError(t, chatAlice.PublishPrekeys())
+	assert.Equal(t, 20, oneTimeKeys())
+
+	// 2. 每次获取领取一把不同的一次性预密钥，重新发布时补足
+	t.Log("Step 2: Bob 获取预密钥包...")
+	b1, err := chatBob.FetchPrekeyBundle(aliceID)
+	require.NoError(t, err)
+	require.NotNil(t, b1.OneTimePrekey)
+	b2, err := chatBob.FetchPrekeyBundle(aliceID)
+	require.NoError(t, err)
+	require.NotNil(t, b2.OneTimePrekey)
+	assert.NotEqual(t, b1.OneTimePrekey.ID, b2.OneTimePrekey.ID, "一次性预密钥不能被领取两次")
+	assert.Equal(t, b1.SignedPrekey, b2.SignedPrekey)
+	assert.Equal(t, 18, oneTimeKeys())
+
+	require.NoError(t, chatAlice.PublishPrekeys())
+	assert.Equal(t, 20, oneTimeKeys())
+	t.Log("✅ 一次性预密钥领取后删除并可补足")
+
+	// 3. 被篡改的预密钥包会被拒绝
+	t.Log("Step 3: 篡改预密钥包...")
+	kv, err := js.KeyValue("DChatPrekeys")
+	require.NoError(t, err)
+	entry, err := kv.Get(aliceID + ".bundle")
+	require.NoError(t, err)
+	var forged chat.PrekeyBundle
+	require.NoError(t, json.Unmarshal(entry.Value(), &forged))
+	forged.SignedPrekey.Pub = b1.OneTimePrekey.Pub
+	data, err := json.Marshal(&forged)
+	require.NoError(t, err)
+	_, err = kv.Put(aliceID+".bundle", data)
+	require.NoError(t, err)
+
+	_, err = chatBob.FetchPrekeyBundle(aliceID)
+	assert.True(t, errors.Is(err, chat.ErrBadSignature), "篡改的预密钥应被拒绝: %v", err)
+	_, err = chatAlice.FetchPrekeyBundle(bobID)
+	assert.True(t, errors.Is(err, chat.ErrNoPrekeyBundle), "未发布预密钥包: %v", err)
+
+	require.NoError(t, chatAlice.PublishPrekeys())
+	t.Log("✅ 篡改的预密钥包被拒绝")
+
+	// 4. Bob 没收到过 Alice 的消息，第一条私聊就通过 KV 建立双棘轮会话
+	t.Log("Step 4: Bob 发出第一条私聊...")
+	received := make(chan *chat.DecryptedMessage, 8)
+	chatAlice.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == bobID {
+			received <- msg
+		}
+	})
+	require.NoError(t, chatBob.SendDirect(aliceID, "第一条就前向保密"))
+
+	var msg *chat.DecryptedMessage
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待消息超时")
+	}
+	assert.Equal(t, "第一条就前向保密", msg.Plain)
+	assert.Equal(t, chat.EncRatchet, msg.RawWire.Enc)
+	require.NotNil(t, msg.RawWire.Ratchet)
+	require.NotNil(t, msg.RawWire.Ratchet.Init)
+	otk := msg.RawWire.Ratchet.Init.OneTimeID
+	assert.NotZero(t, otk, "握手应使用一次性预密钥")
+
+	used, err := storageAlice.GetOneTimePrekey(otk)
+	require.NoError(t, err)
+	assert.Nil(t, used, "建立会话后一次性预密钥私钥应删除")
+	t.Log("✅ 第一条私聊即使用双棘轮")
+}
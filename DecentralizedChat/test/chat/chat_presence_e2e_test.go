@@ -0,0 +1,133 @@
+// E2E 集成测试：在线状态与正在输入
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试在线状态心跳与超时、私聊和群聊的正在输入提示，且这些信号不会落库
+func TestChat_PresenceTyping_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 在线状态与正在输入 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatAlice.SetPresenceInterval(200 * time.Millisecond)
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	chatBob.SetPresenceInterval(200 * time.Millisecond)
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	watch := func(svc *chat.Service) (chan *chat.Presence, chan *chat.TypingUpdate) {
+		presence := make(chan *chat.Presence, 32)
+		typing := make(chan *chat.TypingUpdate, 32)
+		svc.OnEvent(func(name string, payload any) {
+			switch name {
+			case chat.EventPresence:
+				presence <- payload.(*chat.Presence)
+			case chat.EventTyping:
+				typing <- payload.(*chat.TypingUpdate)
+			}
+		})
+		return presence, typing
+	}
+	alicePresence, aliceTyping := watch(chatAlice)
+	bobPresence, _ := watch(chatBob)
+
+	expectPresence := func(ch chan *chat.Presence, uid, status string) {
+		t.Helper()
+		for {
+			select {
+			case p := <-ch:
+				if p.UID == uid && p.Status == status {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("❌ 等待 %s 的 %s 状态超时", uid, status)
+			}
+		}
+	}
+	expectTyping := func(cid string, active bool) *chat.TypingUpdate {
+		t.Helper()
+		select {
+		case u := <-aliceTyping:
+			assert.Equal(t, bobID, u.UserID)
+			assert.Equal(t, cid, u.CID)
+			assert.Equal(t, active, u.Active)
+			return u
+		case <-time.After(10 * time.Second): // 超时结束要等满 6 秒有效期
+			t.Fatalf("❌ 等待正在输入事件超时 (active=%v)", active)
+			return nil
+		}
+	}
+
+	// 1. 双方上线，互相收到在线状态
+	t.Log("Step 1: 上线...")
+	require.NoError(t, chatAlice.SetPresence(chat.PresenceOnline))
+	require.NoError(t, chatBob.SetPresence(chat.PresenceOnline))
+	expectPresence(bobPresence, aliceID, chat.PresenceOnline)
+	expectPresence(alicePresence, bobID, chat.PresenceOnline)
+	assert.Equal(t, chat.PresenceOnline, chatBob.GetPresence(aliceID).Status)
+	assert.Error(t, chatAlice.SetPresence("busy"))
+
+	require.NoError(t, chatAlice.SetPresence(chat.PresenceAway))
+	expectPresence(bobPresence, aliceID, chat.PresenceAway)
+
+	// 心跳持续刷新，超过一个 TTL 仍保持 away
+	time.Sleep(time.Second)
+	assert.Equal(t, chat.PresenceAway, chatBob.GetPresence(aliceID).Status)
+	require.NoError(t, chatAlice.SetPresence(chat.PresenceOnline))
+	expectPresence(bobPresence, aliceID, chat.PresenceOnline)
+	t.Log("✅ 在线状态同步正常")
+
+	// 2. 私聊正在输入
+	t.Log("Step 2: 私聊正在输入...")
+	cid := chatBob.GetConversationID(aliceID)
+	require.NoError(t, chatBob.SendTyping(aliceID, true))
+	expectTyping(cid, true)
+	require.NoError(t, chatBob.SendTyping(cid, false))
+	u := expectTyping(cid, false)
+	assert.False(t, u.IsGroup)
+	t.Log("✅ 私聊正在输入正常")
+
+	// 3. 群聊正在输入
+	t.Log("Step 3: 群聊正在输入...")
+	gid, groupKey, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	chatBob.AddGroupKey(gid, groupKey)
+	require.NoError(t, chatBob.JoinGroup(gid))
+	require.NoError(t, chatBob.SendTyping(gid, true))
+	u = expectTyping(gid, true)
+	assert.True(t, u.IsGroup)
+
+	// 不再重发时超时自动结束
+	expectTyping(gid, false)
+	t.Log("✅ 群聊正在输入正常")
+
+	// 4. 信号不落库
+	for _, c := range []string{cid, gid} {
+		msgs, err := chatAlice.GetMessages(c, 50, nil)
+		require.NoError(t, err)
+		assert.Empty(t, msgs, "正在输入不应保存为消息")
+	}
+
+	// 5. Alice 掉线（不发 offline），心跳超时后 Bob 看到离线
+	t.Log("Step 5: 心跳超时...")
+	require.NoError(t, chatAlice.Close())
+	expectPresence(bobPresence, aliceID, chat.PresenceOffline)
+	p := chatBob.GetPresence(aliceID)
+	assert.Equal(t, chat.PresenceOffline, p.Status)
+	assert.False(t, p.LastSeen.IsZero())
+	t.Log("✅ 心跳超时判定离线")
+}
@@ -0,0 +1,166 @@
+// E2E 集成测试：私聊双棘轮会话（前向保密）
+package e2e_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/nats"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试私聊自动协商双棘轮会话：第一条消息用静态 box 告知预密钥，之后双方都用会话加密，重启后会话继续可用
+func TestChat_DirectRatchet_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 私聊双棘轮会话 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	type peer struct {
+		svc      *chat.Service
+		nc       *nats.Service
+		store    *storage.Storage
+		id       string
+		nscPub   string
+		seed     string
+		received chan *chat.DecryptedMessage
+	}
+	connect := func(p *peer, name string) {
+		n, err := nats.NewService(nats.ClientConfig{URL: natsURL, Name: name})
+		require.NoError(t, err)
+		t.Cleanup(func() { n.Close() })
+		p.nc = n
+		p.svc = chat.NewService(n, p.store)
+		require.NoError(t, p.svc.LoadNSCKeys(p.seed))
+		p.id = p.svc.GetUser().ID
+		p.received = make(chan *chat.DecryptedMessage, 16)
+		p.svc.OnDecrypted(func(msg *chat.DecryptedMessage) { p.received <- msg })
+		p.svc.OnError(func(err error) { t.Logf("%s 错误: %v", name, err) })
+	}
+	newPeer := func(name string) *peer {
+		st, err := storage.NewSQLiteStorage(t.TempDir() + "/" + name + ".db")
+		require.NoError(t, err)
+		t.Cleanup(func() { st.Close() })
+		userKey, err := nkeys.CreateUser()
+		require.NoError(t, err)
+		seed, err := userKey.Seed()
+		require.NoError(t, err)
+		nscPub, err := userKey.PublicKey()
+		require.NoError(t, err)
+
+		p := &peer{store: st, seed: string(seed), nscPub: nscPub}
+		connect(p, name)
+		return p
+	}
+	// expect 等待对方发来的消息（跳过自己的回显），返回原始载荷
+	expect := func(p *peer, from, text string) *chat.DecryptedMessage {
+		t.Helper()
+		for {
+			select {
+			case msg := <-p.received:
+				if msg.Sender != from {
+					continue
+				}
+				require.Equal(t, text, msg.Plain)
+				return msg
+			case <-time.After(5 * time.Second):
+				t.Fatalf("❌ 等待消息 %q 超时", text)
+			}
+		}
+	}
+
+	alice := newPeer("alice")
+	bob := newPeer("bob")
+	_, err := alice.svc.AddFriendNSCKey(bob.nscPub)
+	require.NoError(t, err)
+	_, err = bob.svc.AddFriendNSCKey(alice.nscPub)
+	require.NoError(t, err)
+
+	// 1. 第一条消息还没有会话，用静态 box 并附带预密钥
+	t.Log("Step 1: Alice 发出第一条消息...")
+	require.NoError(t, alice.svc.SendDirect(bob.id, "你好 Bob"))
+	msg := expect(bob, alice.id, "你好 Bob")
+	assert.Empty(t, msg.RawWire.Enc, "第一条消息使用静态 box")
+	t.Log("✅ 静态 box 消息正常")
+
+	// 2. Bob 已知 Alice 的预密钥，回复时发起双棘轮会话
+	t.Log("Step 2: Bob 回复并发起会话...")
+	require.NoError(t, bob.svc.SendDirect(alice.id, "你好 Alice"))
+	msg = expect(alice, bob.id, "你好 Alice")
+	assert.Equal(t, chat.EncRatchet, msg.RawWire.Enc)
+	require.NotNil(t, msg.RawWire.Ratchet)
+	assert.NotNil(t, msg.RawWire.Ratchet.Init, "发起方的第一条消息带握手参数")
+	sid := msg.RawWire.Ratchet.SID
+
+	// Alice 收到自己消息的回显时也能看到明文
+	require.NoError(t, alice.svc.SendDirect(bob.id, "收到"))
+	msg = expect(bob, alice.id, "收到")
+	assert.Equal(t, chat.EncRatchet, msg.RawWire.Enc)
+	assert.Equal(t, sid, msg.RawWire.Ratchet.SID)
+	assert.Nil(t, msg.RawWire.Ratchet.Init, "接收方不需要握手参数")
+	expect(alice, alice.id, "收到")
+	t.Log("✅ 双棘轮会话已建立")
+
+	// 3. 多轮往返，每次换方向都会推进 DH 棘轮
+	t.Log("Step 3: 多轮收发...")
+	dhKeys := make(map[string]bool)
+	for i := range 3 {
+		for j := range 2 {
+			text := fmt.Sprintf("Bob 第%d轮第%d条", i, j)
+			require.NoError(t, bob.svc.SendDirect(alice.id, text))
+			msg = expect(alice, bob.id, text)
+			assert.Nil(t, msg.RawWire.Ratchet.Init, "收到回复后不再带握手参数")
+			dhKeys[msg.RawWire.Ratchet.DH] = true
+		}
+		text := fmt.Sprintf("Alice 第%d轮", i)
+		require.NoError(t, alice.svc.SendDirect(bob.id, text))
+		msg = expect(bob, alice.id, text)
+		dhKeys[msg.RawWire.Ratchet.DH] = true
+	}
+	assert.GreaterOrEqual(t, len(dhKeys), 6, "每轮都应使用新的棘轮公钥")
+
+	sessions, err := bob.store.GetRatchetSessions(alice.id)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, sid, sessions[0].SessionID)
+	t.Log("✅ 棘轮随对话推进")
+
+	// 4. Bob 重启后从 SQLite 恢复会话
+	t.Log("Step 4: Bob 重启...")
+	require.NoError(t, bob.svc.Close())
+	bob.nc.Close()
+	connect(bob, "bob-restarted")
+	require.NoError(t, bob.svc.JoinDirect(alice.id))
+	require.NoError(t, alice.svc.SendDirect(bob.id, "重启后还能收到吗"))
+	msg = expect(bob, alice.id, "重启后还能收到吗")
+	assert.Equal(t, chat.EncRatchet, msg.RawWire.Enc)
+	require.NoError(t, bob.svc.SendDirect(alice.id, "能"))
+	msg = expect(alice, bob.id, "能")
+	assert.Equal(t, sid, msg.RawWire.Ratchet.SID)
+	t.Log("✅ 会话状态持久化")
+
+	// 5. 关闭前向保密的好友始终使用静态 box
+	t.Log("Step 5: 不支持双棘轮的好友...")
+	carol := newPeer("carol")
+	carol.svc.SetForwardSecrecy(false)
+	_, err = alice.svc.AddFriendNSCKey(carol.nscPub)
+	require.NoError(t, err)
+	_, err = carol.svc.AddFriendNSCKey(alice.nscPub)
+	require.NoError(t, err)
+
+	require.NoError(t, alice.svc.SendDirect(carol.id, "Carol 你好"))
+	expect(carol, alice.id, "Carol 你好")
+	require.NoError(t, carol.svc.SendDirect(alice.id, "你好"))
+	msg = expect(alice, carol.id, "你好")
+	assert.Empty(t, msg.RawWire.Enc, "对方没有告知预密钥，不建立会话")
+	require.NoError(t, alice.svc.SendDirect(carol.id, "好的"))
+	msg = expect(carol, alice.id, "好的")
+	assert.Empty(t, msg.RawWire.Enc)
+	t.Log("✅ 不支持的好友回退到静态 box")
+}
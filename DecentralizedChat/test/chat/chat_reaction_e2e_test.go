@@ -0,0 +1,148 @@
+// E2E 集成测试：表情回应
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试表情回应的添加、取消和汇总；实时订阅和离线同步都送达时不重复计数
+func TestChat_Reactions_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 表情回应 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	// 服务器最后关闭：先停掉离线同步，避免同步协程在断开的连接上反复重试
+	t.Cleanup(natssrv.Shutdown)
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	chatCarol, _ := newTestChat(t, natsURL, "carol")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	carolID, carolNSC := loadNSCIdentity(t, chatCarol)
+	for _, nsc := range []string{bobNSC, carolNSC} {
+		_, err := chatAlice.AddFriendNSCKey(nsc)
+		require.NoError(t, err)
+	}
+	for _, svc := range []*chat.Service{chatBob, chatCarol} {
+		_, err := svc.AddFriendNSCKey(aliceNSC)
+		require.NoError(t, err)
+	}
+	// Alice 同时开着实时订阅和离线同步，同一条回应会收到两次
+	require.NoError(t, chatAlice.InitOfflineSync())
+
+	updates := make(chan *chat.ReactionUpdate, 32)
+	chatAlice.OnEvent(func(name string, payload any) {
+		if name == chat.EventReaction {
+			if u := payload.(*chat.ReactionUpdate); u.UserID != aliceID {
+				updates <- u
+			}
+		}
+	})
+	expectUpdate := func(from, emoji string, active bool) {
+		t.Helper()
+		select {
+		case u := <-updates:
+			assert.Equal(t, from, u.UserID)
+			assert.Equal(t, emoji, u.Emoji)
+			assert.Equal(t, active, u.Active)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待 %s 的 %s 回应超时", from, emoji)
+		}
+	}
+	expectNoUpdate := func() {
+		t.Helper()
+		select {
+		case u := <-updates:
+			t.Fatalf("❌ 不应收到重复的回应事件: %+v", u)
+		case <-time.After(800 * time.Millisecond):
+		}
+	}
+	reactionsOf := func(svc *chat.Service, gid, msgID string) map[string][]string {
+		t.Helper()
+		msgs, err := svc.GetMessages(gid, 50, nil)
+		require.NoError(t, err)
+		for _, m := range msgs {
+			if m.ID == msgID {
+				return m.Reactions
+			}
+		}
+		t.Fatalf("❌ 找不到消息 %s", msgID)
+		return nil
+	}
+
+	gid, _, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	for _, m := range []struct {
+		svc *chat.Service
+		id  string
+	}{{chatBob, bobID}, {chatCarol, carolID}} {
+		require.NoError(t, chatAlice.InviteToGroup(gid, m.id))
+		require.Eventually(t, func() bool {
+			pending, err := m.svc.ListPendingInvites()
+			return err == nil && len(pending) == 1
+		}, 5*time.Second, 50*time.Millisecond)
+		require.NoError(t, m.svc.AcceptInvite(gid))
+	}
+
+	received := make(chan *chat.DecryptedMessage, 8)
+	chatCarol.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == aliceID {
+			received <- msg
+		}
+	})
+	require.NoError(t, chatAlice.SendGroup(gid, "新版本发布了"))
+	var msg *chat.DecryptedMessage
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待群消息超时")
+	}
+	require.Eventually(t, func() bool {
+		m, err := chatBob.GetMessages(gid, 50, nil)
+		return err == nil && len(m) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// 1. 两个成员回应
+	t.Log("Step 1: 添加回应...")
+	require.NoError(t, chatBob.React(msg.ID, "👍"))
+	expectUpdate(bobID, "👍", true)
+	require.NoError(t, chatCarol.React(msg.ID, "👍"))
+	expectUpdate(carolID, "👍", true)
+	require.NoError(t, chatCarol.React(msg.ID, "🎉"))
+	expectUpdate(carolID, "🎉", true)
+	expectNoUpdate()
+
+	want := map[string][]string{"👍": {bobID, carolID}, "🎉": {carolID}}
+	assert.Equal(t, want, reactionsOf(chatAlice, gid, msg.ID))
+	assert.Equal(t, want, reactionsOf(chatBob, gid, msg.ID), "各端汇总一致")
+	t.Log("✅ 回应按表情汇总")
+
+	// 2. 重复回应不重复计数
+	t.Log("Step 2: 重复回应...")
+	require.NoError(t, chatBob.React(msg.ID, "👍"))
+	expectNoUpdate()
+	assert.Equal(t, want, reactionsOf(chatAlice, gid, msg.ID))
+	t.Log("✅ 重复回应幂等")
+
+	// 3. 取消回应
+	t.Log("Step 3: 取消回应...")
+	require.NoError(t, chatCarol.Unreact(msg.ID, "🎉"))
+	expectUpdate(carolID, "🎉", false)
+	expectNoUpdate()
+	assert.Equal(t, map[string][]string{"👍": {bobID, carolID}}, reactionsOf(chatAlice, gid, msg.ID))
+
+	list, err := chatAlice.GetReactions(msg.ID)
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+	t.Log("✅ 取消回应正常")
+
+	// 4. 无效参数
+	assert.Error(t, chatBob.React(msg.ID, ""))
+	assert.ErrorIs(t, chatBob.React("no-such-message", "👍"), chat.ErrMessageNotFound)
+}
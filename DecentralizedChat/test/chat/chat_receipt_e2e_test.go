@@ -0,0 +1,163 @@
+// E2E 集成测试：送达与已读回执
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+	"DecentralizedChat/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试私聊和群聊的送达/已读回执：发送方的送达状态随回执推进，并推送 message:receipt 事件
+func TestChat_Receipts_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 送达与已读回执 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	chatCarol, _ := newTestChat(t, natsURL, "carol")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	carolID, carolNSC := loadNSCIdentity(t, chatCarol)
+	for _, nsc := range []string{bobNSC, carolNSC} {
+		_, err := chatAlice.AddFriendNSCKey(nsc)
+		require.NoError(t, err)
+	}
+	for _, svc := range []*chat.Service{chatBob, chatCarol} {
+		_, err := svc.AddFriendNSCKey(aliceNSC)
+		require.NoError(t, err)
+	}
+
+	receipts := make(chan *chat.ReceiptUpdate, 16)
+	chatAlice.OnEvent(func(name string, payload any) {
+		if name == chat.EventMessageReceipt {
+			receipts <- payload.(*chat.ReceiptUpdate)
+		}
+	})
+	inbox := func(svc *chat.Service) chan *chat.DecryptedMessage {
+		ch := make(chan *chat.DecryptedMessage, 16)
+		svc.OnDecrypted(func(msg *chat.DecryptedMessage) {
+			if msg.Sender == aliceID {
+				ch <- msg
+			}
+		})
+		return ch
+	}
+	bobInbox, carolInbox := inbox(chatBob), inbox(chatCarol)
+	expectMsg := func(ch chan *chat.DecryptedMessage, text string) *chat.DecryptedMessage {
+		t.Helper()
+		for {
+			select {
+			case msg := <-ch:
+				if msg.Plain == text {
+					return msg
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("❌ 等待消息 %q 超时", text)
+				return nil
+			}
+		}
+	}
+	expectReceipt := func(from, state, delivery string) *chat.ReceiptUpdate {
+		t.Helper()
+		select {
+		case r := <-receipts:
+			assert.Equal(t, from, r.UserID)
+			assert.Equal(t, state, r.State)
+			assert.Equal(t, delivery, r.Delivery)
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待 %s 的 %s 回执超时", from, state)
+			return nil
+		}
+	}
+	deliveryState := func(cid, msgID string) string {
+		t.Helper()
+		msgs, err := chatAlice.GetMessages(cid, 50, nil)
+		require.NoError(t, err)
+		for _, m := range msgs {
+			if m.ID == msgID {
+				return m.DeliveryState
+			}
+		}
+		t.Fatalf("❌ 找不到消息 %s", msgID)
+		return ""
+	}
+
+	// 1. 私聊：发送后为 sent，对方收到后 delivered，已读后 read
+	t.Log("Step 1: 私聊回执...")
+	cid := chatAlice.GetConversationID(bobID)
+	require.NoError(t, chatAlice.SendDirect(bobID, "在吗"))
+	msg := expectMsg(bobInbox, "在吗")
+	require.NotEmpty(t, msg.ID)
+
+	r := expectReceipt(bobID, storage.DeliveryDelivered, storage.DeliveryDelivered)
+	assert.Equal(t, msg.ID, r.MessageID, "双方使用同一个消息ID")
+	assert.Equal(t, cid, r.CID)
+	assert.Equal(t, storage.DeliveryDelivered, deliveryState(cid, msg.ID))
+
+	require.NoError(t, chatBob.MarkAsRead(cid, time.Now()))
+	expectReceipt(bobID, storage.DeliveryRead, storage.DeliveryRead)
+	assert.Equal(t, storage.DeliveryRead, deliveryState(cid, msg.ID))
+
+	// 重复标记已读不会再发回执
+	require.NoError(t, chatBob.MarkAsRead(cid, time.Now()))
+	select {
+	case r := <-receipts:
+		t.Fatalf("❌ 不应收到重复回执: %+v", r)
+	case <-time.After(500 * time.Millisecond):
+	}
+	t.Log("✅ 私聊回执正常")
+
+	// 2. 群聊：所有成员都已读后才算 read
+	t.Log("Step 2: 群聊回执...")
+	gid, _, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	for _, m := range []struct {
+		svc *chat.Service
+		id  string
+	}{{chatBob, bobID}, {chatCarol, carolID}} {
+		require.NoError(t, chatAlice.InviteToGroup(gid, m.id))
+		require.Eventually(t, func() bool {
+			pending, err := m.svc.ListPendingInvites()
+			return err == nil && len(pending) == 1
+		}, 5*time.Second, 50*time.Millisecond)
+		require.NoError(t, m.svc.AcceptInvite(gid))
+	}
+
+	require.NoError(t, chatAlice.SendGroup(gid, "今晚聚餐"))
+	msg = expectMsg(bobInbox, "今晚聚餐")
+	expectMsg(carolInbox, "今晚聚餐")
+
+	// 两个成员的送达回执，第二个到达时汇总为 delivered
+	delivered := map[string]string{}
+	for range 2 {
+		select {
+		case r := <-receipts:
+			assert.Equal(t, msg.ID, r.MessageID)
+			assert.Equal(t, storage.DeliveryDelivered, r.State)
+			delivered[r.UserID] = r.Delivery
+		case <-time.After(5 * time.Second):
+			t.Fatal("❌ 等待群聊送达回执超时")
+		}
+	}
+	assert.Len(t, delivered, 2)
+	assert.Equal(t, storage.DeliveryDelivered, deliveryState(gid, msg.ID))
+
+	require.NoError(t, chatBob.MarkAsRead(gid, time.Now()))
+	expectReceipt(bobID, storage.DeliveryRead, storage.DeliveryDelivered)
+	require.NoError(t, chatCarol.MarkAsRead(gid, time.Now()))
+	expectReceipt(carolID, storage.DeliveryRead, storage.DeliveryRead)
+	assert.Equal(t, storage.DeliveryRead, deliveryState(gid, msg.ID))
+
+	list, err := chatAlice.GetMessageReceipts(msg.ID)
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+	t.Log("✅ 群聊回执汇总正常")
+}
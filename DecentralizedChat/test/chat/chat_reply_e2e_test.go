@@ -0,0 +1,132 @@
+// E2E 集成测试：回复与话题
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试私聊回复带父消息预览、群聊多层回复组成话题，以及话题级未读数
+func TestChat_ReplyThread_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 回复与话题 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	inbox := func(svc *chat.Service, from string) chan *chat.DecryptedMessage {
+		ch := make(chan *chat.DecryptedMessage, 16)
+		svc.OnDecrypted(func(msg *chat.DecryptedMessage) {
+			if msg.Sender == from {
+				ch <- msg
+			}
+		})
+		return ch
+	}
+	aliceInbox, bobInbox := inbox(chatAlice, bobID), inbox(chatBob, aliceID)
+	expectMsg := func(ch chan *chat.DecryptedMessage, text string) *chat.DecryptedMessage {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			require.Equal(t, text, msg.Plain)
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待消息 %q 超时", text)
+			return nil
+		}
+	}
+
+	// 1. 私聊回复，接收方看到父消息预览
+	t.Log("Step 1: 私聊回复...")
+	require.NoError(t, chatAlice.SendDirect(bobID, "周末去爬山吗？山顶风景很好，记得带水和外套"))
+	parent := expectMsg(bobInbox, "周末去爬山吗？山顶风景很好，记得带水和外套")
+	assert.Nil(t, parent.ReplyTo)
+
+	require.NoError(t, chatBob.SendReply(parent.ID, "好啊"))
+	reply := expectMsg(aliceInbox, "好啊")
+	require.NotNil(t, reply.ReplyTo)
+	assert.Equal(t, parent.ID, reply.ReplyTo.ID)
+	assert.Equal(t, aliceID, reply.ReplyTo.SenderID)
+	assert.Equal(t, "周末去爬山吗？山顶风景很好，记得带水和外套", reply.ReplyTo.Snippet)
+	assert.False(t, reply.ReplyTo.Missing)
+
+	cid := chatAlice.GetConversationID(bobID)
+	for _, svc := range []*chat.Service{chatAlice, chatBob} {
+		thread, err := svc.GetThread(parent.ID)
+		require.NoError(t, err)
+		require.Len(t, thread, 2)
+		assert.Equal(t, parent.ID, thread[0].ID)
+		assert.Equal(t, parent.ID, thread[1].ReplyToID)
+		assert.Equal(t, cid, thread[1].ConversationID)
+	}
+	assert.ErrorIs(t, chatBob.SendReply("no-such-message", "?"), chat.ErrMessageNotFound)
+	t.Log("✅ 私聊回复带父消息预览")
+
+	// 2. 群聊多层回复
+	t.Log("Step 2: 群聊话题...")
+	gid, groupKey, err := chatAlice.CreateGroup()
+	require.NoError(t, err)
+	chatBob.AddGroupKey(gid, groupKey)
+	require.NoError(t, chatBob.JoinGroup(gid))
+
+	require.NoError(t, chatBob.SendGroup(gid, "发布会定在几号？"))
+	root := expectMsg(aliceInbox, "发布会定在几号？")
+	require.NoError(t, chatBob.SendGroup(gid, "另一个话题"))
+	other := expectMsg(aliceInbox, "另一个话题")
+
+	require.NoError(t, chatAlice.SendReply(root.ID, "下周三"))
+	first := expectMsg(bobInbox, "下周三")
+	require.NotNil(t, first.ReplyTo)
+	assert.True(t, first.IsGroup)
+
+	// Bob 回复 Alice 的回复，仍属于同一个话题
+	require.NoError(t, chatBob.SendReply(first.ID, "收到"))
+	expectMsg(aliceInbox, "收到")
+	require.NoError(t, chatBob.SendReply(root.ID, "地点呢？"))
+	expectMsg(aliceInbox, "地点呢？")
+	require.NoError(t, chatBob.SendReply(other.ID, "另一个话题的回复"))
+	expectMsg(aliceInbox, "另一个话题的回复")
+
+	thread, err := chatAlice.GetThread(root.ID)
+	require.NoError(t, err)
+	var texts []string
+	for _, m := range thread {
+		texts = append(texts, m.Content)
+	}
+	assert.Equal(t, []string{"发布会定在几号？", "下周三", "收到", "地点呢？"}, texts)
+	t.Log("✅ 多层回复归入同一话题")
+
+	// 3. 话题级未读数：只统计别人发来的回复
+	t.Log("Step 3: 话题未读数...")
+	counts, err := chatAlice.GetThreadUnreadCounts(gid)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{root.ID: 2, other.ID: 1}, counts)
+
+	require.NoError(t, chatAlice.MarkThreadAsRead(root.ID))
+	counts, err = chatAlice.GetThreadUnreadCounts(gid)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{other.ID: 1}, counts, "只清除该话题的未读")
+
+	// 话题外的根消息仍未读
+	msgs, err := chatAlice.GetMessages(gid, 50, nil)
+	require.NoError(t, err)
+	for _, m := range msgs {
+		if m.ID == root.ID {
+			assert.False(t, m.IsRead, "标记话题已读不影响根消息")
+		}
+	}
+	t.Log("✅ 话题未读数正常")
+}
@@ -0,0 +1,126 @@
+// E2E 集成测试：消息发送者签名认证
+package e2e_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	gnats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试群成员无法冒充其他成员发送消息
+func TestChat_SenderSignature_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 消息发送者签名认证 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, _ := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	chatMallory, _ := newTestChat(t, natsURL, "mallory")
+	aliceID, _ := loadNSCIdentity(t, chatAlice)
+	loadNSCIdentity(t, chatBob)
+	loadNSCIdentity(t, chatMallory)
+
+	groupID := "group_signature_001"
+	groupKey, err := chat.GenerateGroupKey()
+	require.NoError(t, err)
+	for _, svc := range []*chat.Service{chatAlice, chatBob, chatMallory} {
+		svc.AddGroupKey(groupID, groupKey)
+	}
+	require.NoError(t, chatBob.JoinGroup(groupID))
+
+	received := make(chan *chat.DecryptedMessage, 4)
+	chatBob.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		received <- msg
+	})
+	rejected := make(chan error, 4)
+	chatBob.OnError(func(err error) {
+		rejected <- err
+	})
+
+	expectRejected := func(reason error) {
+		t.Helper()
+		select {
+		case err := <-rejected:
+			var authErr *chat.AuthError
+			require.True(t, errors.As(err, &authErr), "应返回 AuthError, 实际: %v", err)
+			assert.True(t, errors.Is(err, reason), "拒绝原因不匹配: %v", err)
+			assert.Equal(t, aliceID, authErr.Sender)
+		case msg := <-received:
+			t.Fatalf("❌ 伪造的消息不应被推送: %q", msg.Plain)
+		case <-time.After(5 * time.Second):
+			t.Fatal("❌ 等待拒绝事件超时")
+		}
+	}
+
+	// 1. Mallory 用自己的密钥签名，却声称自己是 Alice
+	t.Log("Step 1: Mallory 冒充 Alice 发送群消息...")
+	chatMallory.SetUserID(aliceID)
+	require.NoError(t, chatMallory.SendGroup(groupID, "我是 Alice（其实不是）"))
+	expectRejected(chat.ErrSenderMismatch)
+	t.Log("✅ 发送者与签名公钥不匹配的消息被拒绝")
+
+	// 2. 截获 Alice 的真实载荷并篡改密文，签名校验失败
+	t.Log("Step 2: 篡改 Alice 的载荷...")
+	nc, err := gnats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+	captured := make(chan []byte, 1)
+	sub, err := nc.Subscribe("dchat.grp."+groupID+".msg", func(m *gnats.Msg) {
+		var w chat.EncWire
+		if json.Unmarshal(m.Data, &w) == nil && w.Sender == aliceID && w.SignerKey != "" {
+			select {
+			case captured <- m.Data:
+			default:
+			}
+		}
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, nc.Flush())
+
+	require.NoError(t, chatAlice.SendGroup(groupID, "真正的 Alice"))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "真正的 Alice", msg.Plain)
+		assert.Equal(t, aliceID, msg.Sender)
+		assert.True(t, msg.Verified)
+		t.Log("✅ Alice 的签名消息校验通过")
+	case err := <-rejected:
+		t.Fatalf("❌ 合法消息被拒绝: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 等待 Alice 消息超时")
+	}
+
+	var wire chat.EncWire
+	select {
+	case data := <-captured:
+		require.NoError(t, json.Unmarshal(data, &wire))
+	case <-time.After(5 * time.Second):
+		t.Fatal("❌ 未截获 Alice 的载荷")
+	}
+	nonce, cipher, err := chat.EncryptGroup(groupKey, []byte(`{"text":"被篡改的内容"}`))
+	require.NoError(t, err)
+	wire.Nonce, wire.Cipher = nonce, cipher
+	data, err := json.Marshal(wire)
+	require.NoError(t, err)
+	require.NoError(t, nc.Publish("dchat.grp."+groupID+".msg", data))
+	expectRejected(chat.ErrBadSignature)
+	t.Log("✅ 签名与内容不匹配的消息被拒绝")
+
+	// 3. 去掉签名的 v1 载荷
+	t.Log("Step 3: 发送没有签名的 v1 载荷...")
+	wire.SignerKey, wire.Sig = "", ""
+	data, err = json.Marshal(wire)
+	require.NoError(t, err)
+	require.NoError(t, nc.Publish("dchat.grp."+groupID+".msg", data))
+	expectRejected(chat.ErrUnsignedMessage)
+	t.Log("✅ 没有签名的 v1 载荷被拒绝")
+}
@@ -0,0 +1,141 @@
+// E2E 集成测试：订阅生命周期
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/chat"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 测试离开私聊/群聊后服务端不再有订阅、也不再投递消息，重新加入后恢复，Close 退订全部会话
+func TestChat_SubscriptionLifecycle_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 订阅生命周期 ===")
+
+	natssrv, natsURL := startTestNATSServer(t)
+	defer natssrv.Shutdown()
+
+	chatAlice, aliceStore := newTestChat(t, natsURL, "alice")
+	chatBob, _ := newTestChat(t, natsURL, "bob")
+	aliceID, aliceNSC := loadNSCIdentity(t, chatAlice)
+	bobID, bobNSC := loadNSCIdentity(t, chatBob)
+	_, err := chatAlice.AddFriendNSCKey(bobNSC)
+	require.NoError(t, err)
+	_, err = chatBob.AddFriendNSCKey(aliceNSC)
+	require.NoError(t, err)
+
+	aliceInbox := make(chan *chat.DecryptedMessage, 16)
+	chatAlice.OnDecrypted(func(msg *chat.DecryptedMessage) {
+		if msg.Sender == bobID {
+			aliceInbox <- msg
+		}
+	})
+	expectMsg := func(text string) {
+		t.Helper()
+		select {
+		case msg := <-aliceInbox:
+			require.Equal(t, text, msg.Plain)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("❌ 等待消息 %q 超时", text)
+		}
+	}
+	expectSilence := func() {
+		t.Helper()
+		select {
+		case msg := <-aliceInbox:
+			t.Fatalf("❌ 离开后不应收到消息: %q", msg.Plain)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	// 服务端上某个主题的订阅数（Alice 和 Bob 各自订阅同一个会话主题）
+	subsOn := func(subject string) int {
+		sz, err := natssrv.Subsz(&server.SubszOptions{Subscriptions: true, Test: subject})
+		require.NoError(t, err)
+		return len(sz.Subs)
+	}
+	// 和 joined 时相比，subjects 上的订阅数应该少 drop 个（JetStream 流也算一个订阅，只比较差值）
+	var joinedSubs map[string]int
+	snapshot := func(subjects ...string) {
+		joinedSubs = map[string]int{}
+		for _, subj := range subjects {
+			joinedSubs[subj] = subsOn(subj)
+		}
+	}
+	expectSubs := func(drop int) {
+		t.Helper()
+		for subj, n := range joinedSubs {
+			require.Eventually(t, func() bool { return subsOn(subj) == n-drop }, 2*time.Second, 20*time.Millisecond,
+				"主题 %s 的订阅数应为 %d，实际 %d", subj, n-drop, subsOn(subj))
+		}
+	}
+	cid := chatAlice.GetConversationID(bobID)
+	countMessages := func(cid string) int {
+		msgs, err := chatAlice.GetMessages(cid, 100, nil)
+		require.NoError(t, err)
+		return len(msgs)
+	}
+
+	// 1. 离开私聊：消息、正在输入、在线状态三个订阅都退订
+	t.Log("Step 1: 离开私聊...")
+	require.NoError(t, chatBob.SendDirect(aliceID, "离开之前"))
+	expectMsg("离开之前")
+	dmSubjects := []string{"dchat.dm." + cid + ".msg", "dchat.dm." + cid + ".typing", "dchat.presence." + bobID}
+	snapshot(dmSubjects...)
+
+	require.NoError(t, chatAlice.LeaveDirect(bobID))
+	expectSubs(1)
+	require.NoError(t, chatBob.SendDirect(aliceID, "离开之后"))
+	expectSilence()
+	assert.Equal(t, 1, countMessages(cid), "离开后的消息不应保存")
+	require.NoError(t, chatAlice.LeaveDirect(bobID), "重复离开不报错")
+	left, err := aliceStore.GetLeftConversations()
+	require.NoError(t, err)
+	assert.True(t, left[cid], "离开状态应持久保存，重启后不再自动加入")
+
+	require.NoError(t, chatAlice.JoinDirect(bobID))
+	expectSubs(0)
+	left, err = aliceStore.GetLeftConversations()
+	require.NoError(t, err)
+	assert.False(t, left[cid], "重新加入后应清除离开状态")
+	require.NoError(t, chatBob.SendDirect(aliceID, "重新加入"))
+	expectMsg("重新加入")
+	t.Log("✅ 离开私聊后不再投递")
+
+	// 2. 离开群聊
+	t.Log("Step 2: 离开群聊...")
+	gid, groupKey, err := chatBob.CreateGroup()
+	require.NoError(t, err)
+	chatAlice.AddGroupKey(gid, groupKey)
+	require.NoError(t, chatAlice.JoinGroup(gid))
+	require.NoError(t, chatAlice.JoinGroup(gid), "重复加入不重复订阅")
+	require.NoError(t, chatBob.SendGroup(gid, "群消息"))
+	expectMsg("群消息")
+	groupSubjects := []string{"dchat.grp." + gid + ".msg", "dchat.grp." + gid + ".typing"}
+	snapshot(groupSubjects...)
+
+	require.NoError(t, chatAlice.LeaveGroup(gid))
+	expectSubs(1)
+	require.NoError(t, chatBob.SendGroup(gid, "离开群之后"))
+	expectSilence()
+	assert.Equal(t, 1, countMessages(gid))
+
+	require.NoError(t, chatAlice.JoinGroup(gid))
+	require.NoError(t, chatBob.SendGroup(gid, "回到群里"))
+	expectMsg("回到群里")
+	t.Log("✅ 离开群聊后不再投递")
+
+	// 3. Close 退订全部会话
+	t.Log("Step 3: Close...")
+	snapshot(append(dmSubjects, groupSubjects...)...)
+	require.NoError(t, chatAlice.Close())
+	expectSubs(1)
+	require.NoError(t, chatBob.SendDirect(aliceID, "关闭之后"))
+	require.NoError(t, chatBob.SendGroup(gid, "关闭之后"))
+	expectSilence()
+	assert.Equal(t, 2, countMessages(cid), "关闭后的私聊消息不应保存")
+	t.Log("✅ Close 退订全部订阅")
+}
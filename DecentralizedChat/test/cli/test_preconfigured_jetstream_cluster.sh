@@ -178,6 +178,7 @@ if ! nats stream create "DChatGroups" \
     --retention limits \
     --max-msgs-per-subject 1000 \
     --max-age 30d \
+    --dupe-window 24h \
     --replicas 3 \
     --discard old \
     --defaults >/dev/null 2>&1; then
@@ -195,6 +196,7 @@ if ! nats stream create "DChatDirect" \
     --retention limits \
     --max-msgs-per-subject 1000 \
     --max-age 30d \
+    --dupe-window 24h \
     --replicas 3 \
     --discard old \
     --defaults >/dev/null 2>&1; then
@@ -96,7 +96,7 @@ func TestLeafNode_P2P_Through_Public_Hub_E2E(t *testing.T) {
 
 	// 节点A订阅主题
 	received := make(chan string, 1)
-	err = clientA.Subscribe(testSubject, func(msg *nats.Msg) {
+	_, err = clientA.Subscribe(testSubject, func(msg *nats.Msg) {
 		t.Logf("📥 收到消息: %q", string(msg.Data))
 		received <- string(msg.Data)
 	})
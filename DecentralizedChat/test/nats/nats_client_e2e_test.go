@@ -71,7 +71,7 @@ func TestNATSClient_ConnectPublishSubscribe_E2E(t *testing.T) {
 	received := make(chan string, 1)
 	subject := "dchat.test.e2e"
 
-	err = svc.Subscribe(subject, func(msg *gnats.Msg) {
+	_, err = svc.Subscribe(subject, func(msg *gnats.Msg) {
 		t.Logf("收到消息: %q", string(msg.Data))
 		received <- string(msg.Data)
 	})
@@ -141,7 +141,7 @@ func TestNATSClient_PublishJSON_E2E(t *testing.T) {
 	received := make(chan TestMessage, 1)
 	subject := "dchat.test.json"
 
-	err = svc.Subscribe(subject, func(msg *gnats.Msg) {
+	_, err = svc.Subscribe(subject, func(msg *gnats.Msg) {
 		var tm TestMessage
 		if err := json.Unmarshal(msg.Data, &tm); err == nil {
 			received <- tm
@@ -0,0 +1,171 @@
+// E2E 集成测试：JetStream 发布去重、异步发布和确认超时
+package e2e_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"DecentralizedChat/internal/nats"
+
+	gnats "github.com/nats-io/nats.go"
+)
+
+func TestNATSClient_PublishJetStream_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: JetStream 发布 ===")
+	t.Log("")
+
+	opts := defaultOptions()
+	opts.JetStream = true
+	opts.JetStreamDomain = "hub"
+	opts.StoreDir = t.TempDir()
+	s, err := startServer(opts)
+	if err != nil || s == nil {
+		t.Fatalf("startServer failed: %v", err)
+	}
+	defer s.Shutdown()
+	url := fmt.Sprintf("nats://%s:%d", testHost, opts.Port)
+
+	nc, err := gnats.Connect(url)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("JetStream failed: %v", err)
+	}
+	if _, err := js.AddStream(&gnats.StreamConfig{Name: "PubTest", Subjects: []string{"pub.test.>"}, Duplicates: time.Minute}); err != nil {
+		t.Fatalf("AddStream failed: %v", err)
+	}
+
+	svc, err := nats.NewService(nats.ClientConfig{URL: url, Name: "e2e-publish", PublishAckTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	defer svc.Close()
+
+	// 1. 同一个 Nats-Msg-Id 重发只存一份
+	t.Log("Step 1: 带 Nats-Msg-Id 重复发布...")
+	msg := gnats.NewMsg("pub.test.dedup")
+	msg.Data = []byte("hello")
+	msg.Header.Set(gnats.MsgIdHdr, "msg-1")
+	seq1, err := svc.PublishJetStreamMsg(msg)
+	if err != nil {
+		t.Fatalf("PublishJetStreamMsg failed: %v", err)
+	}
+	seq2, err := svc.PublishJetStream("pub.test.dedup", []byte("hello"), gnats.MsgId("msg-1"))
+	if err != nil {
+		t.Fatalf("PublishJetStream failed: %v", err)
+	}
+	if seq1 != seq2 {
+		t.Fatalf("重复发布应返回同一个序列号: %d != %d", seq1, seq2)
+	}
+	info, err := js.StreamInfo("PubTest")
+	if err != nil {
+		t.Fatalf("StreamInfo failed: %v", err)
+	}
+	if info.State.Msgs != 1 {
+		t.Fatalf("重复发布后流里应只有 1 条消息，实际 %d", info.State.Msgs)
+	}
+	stored, err := js.GetMsg("PubTest", seq1)
+	if err != nil {
+		t.Fatalf("GetMsg failed: %v", err)
+	}
+	if got := stored.Header.Get(gnats.MsgIdHdr); got != "msg-1" {
+		t.Fatalf("消息头未保存: %q", got)
+	}
+	t.Log("✅ Hub 按 Nats-Msg-Id 丢弃了重复消息")
+
+	// 没有指定消息ID时不去重，内容相同的两次发布都保存
+	seq3, err := svc.PublishJetStream("pub.test.noid", []byte("hello"))
+	if err != nil {
+		t.Fatalf("PublishJetStream failed: %v", err)
+	}
+	seq4, err := svc.PublishJetStreamMsg(&gnats.Msg{Subject: "pub.test.noid", Data: []byte("hello")})
+	if err != nil {
+		t.Fatalf("PublishJetStreamMsg failed: %v", err)
+	}
+	if seq3 == seq4 {
+		t.Fatalf("没有消息ID的两次发布不应去重: %d", seq3)
+	}
+	if stored, err = js.GetMsg("PubTest", seq3); err != nil || stored.Header.Get(gnats.MsgIdHdr) != "" {
+		t.Fatalf("不应自动补上 Nats-Msg-Id: %v", err)
+	}
+	t.Log("✅ 没有消息ID时内容相同的消息都保存")
+
+	// 2. 异步发布，从 PubAckFuture 取得确认
+	t.Log("Step 2: 异步发布...")
+	var futures []gnats.PubAckFuture
+	for i := 0; i < 10; i++ {
+		m := gnats.NewMsg("pub.test.async")
+		m.Data = []byte(fmt.Sprintf("async-%d", i))
+		m.Header.Set(gnats.MsgIdHdr, fmt.Sprintf("async-%d", i))
+		f, err := svc.PublishJetStreamAsync(m)
+		if err != nil {
+			t.Fatalf("PublishJetStreamAsync failed: %v", err)
+		}
+		futures = append(futures, f)
+	}
+	done, err := svc.PublishAsyncComplete()
+	if err != nil {
+		t.Fatalf("PublishAsyncComplete failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待异步发布确认超时")
+	}
+	var last uint64
+	for i, f := range futures {
+		select {
+		case ack := <-f.Ok():
+			if ack.Sequence <= last {
+				t.Fatalf("第 %d 条确认的序列号没有递增: %d", i, ack.Sequence)
+			}
+			last = ack.Sequence
+		case err := <-f.Err():
+			t.Fatalf("第 %d 条异步发布失败: %v", i, err)
+		}
+	}
+	t.Logf("✅ 10 条异步发布全部确认，最后序列号 %d", last)
+
+	// 3. 没有流接收时按配置的超时返回
+	t.Log("Step 3: 确认超时...")
+	if err := js.DeleteStream("PubTest"); err != nil {
+		t.Fatalf("DeleteStream failed: %v", err)
+	}
+	// 订阅者让请求有人响应但不回确认，才会等到超时而不是 no responders
+	if _, err := nc.Subscribe("pub.test.>", func(*gnats.Msg) {}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	nc.Flush()
+	start := time.Now()
+	_, err = svc.PublishJetStream("pub.test.timeout", []byte("lost"))
+	if !errors.Is(err, gnats.ErrTimeout) {
+		t.Fatalf("应返回确认超时，实际: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("确认超时未按配置生效: %v", elapsed)
+	}
+	t.Log("✅ 按 PublishAckTimeout 返回超时")
+
+	m := gnats.NewMsg("pub.test.timeout")
+	m.Data = []byte("lost")
+	f, err := svc.PublishJetStreamAsync(m)
+	if err != nil {
+		t.Fatalf("PublishJetStreamAsync failed: %v", err)
+	}
+	select {
+	case <-f.Ok():
+		t.Fatal("没有流接收时不应收到确认")
+	case err := <-f.Err():
+		if !errors.Is(err, gnats.ErrAsyncPublishTimeout) {
+			t.Fatalf("异步发布应返回超时，实际: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("异步发布没有按 PublishAckTimeout 超时")
+	}
+	t.Log("✅ 异步发布按 PublishAckTimeout 超时")
+}
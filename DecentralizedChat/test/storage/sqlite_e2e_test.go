@@ -63,15 +63,15 @@ func TestSQLite_E2E(t *testing.T) {
 	// 3. 测试消息去重
 	t.Log("\nStep 3: 测试消息去重功能...")
 	duplicateMsg := &storage.StoredMessage{
-		ID:             "msg_test_003", // 不同的ID
+		ID:             "msg_test_001", // 和msg1相同的消息ID，应该被去重
 		ConversationID: "cid_test_001",
 		SenderID:       "user_alice",
 		SenderNickname: "Alice",
-		Content:        "Hello Bob!", // 和msg1内容相同
-		Timestamp:      testMsg1.Timestamp, // 和msg1时间戳相同
+		Content:        "Hello Bob!",
+		Timestamp:      testMsg1.Timestamp,
 		IsRead:         false,
 		IsGroup:        false,
-		NatsSeq:        1001, // 和msg1相同的NATS序列ID，应该被去重
+		NatsSeq:        0, // 实时订阅收到的同一条消息没有序列ID
 	}
 
 	err = store.SaveMessage(duplicateMsg)
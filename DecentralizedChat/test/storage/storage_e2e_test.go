@@ -2,12 +2,17 @@
 package storage_test
 
 import (
+	"database/sql"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"DecentralizedChat/internal/storage"
+
+	_ "modernc.org/sqlite"
 )
 
 func TestStorage_E2E(t *testing.T) {
@@ -393,3 +398,1313 @@ func TestSQLiteStorage_FilePersistence_E2E(t *testing.T) {
 
 	t.Log("✅ 文件持久化测试通过")
 }
+
+// 测试群密钥纪元：旧版单密钥迁移为纪元0，轮换后旧纪元保留并标记退役
+func TestSQLiteStorage_GroupKeyEpochs_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 群密钥纪元 ===")
+	t.Log("")
+
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "chat_group_keys_test.db")
+
+	// 模拟旧版本数据库：只有 group_sym_keys 表
+	legacy, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("打开旧数据库失败: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE group_sym_keys (
+			group_id TEXT PRIMARY KEY,
+			sym_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO group_sym_keys (group_id, sym_key) VALUES ('grp_legacy', 'legacy_key');
+	`)
+	if err != nil {
+		t.Fatalf("写入旧数据失败: %v", err)
+	}
+	legacy.Close()
+
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	epochs, err := s.GetGroupKeyEpochs("grp_legacy")
+	if err != nil {
+		t.Fatalf("查询群密钥纪元失败: %v", err)
+	}
+	if len(epochs) != 1 || epochs[0].Epoch != 0 || epochs[0].SymKey != "legacy_key" {
+		t.Fatalf("旧群密钥应迁移为纪元0: %+v", epochs)
+	}
+	t.Log("✅ 旧群密钥迁移为纪元0")
+
+	// 轮换到纪元1
+	rotatedAt := time.Now().Truncate(time.Second)
+	if err := s.SaveGroupKeyEpoch(&storage.GroupKeyEpoch{GroupID: "grp_legacy", Epoch: 1, SymKey: "new_key", CreatedAt: rotatedAt}); err != nil {
+		t.Fatalf("保存新纪元失败: %v", err)
+	}
+	if err := s.RetireGroupKeyEpochs("grp_legacy", 1, rotatedAt); err != nil {
+		t.Fatalf("退役旧纪元失败: %v", err)
+	}
+	// 同一纪元重复保存不覆盖原密钥
+	if err := s.SaveGroupKeyEpoch(&storage.GroupKeyEpoch{GroupID: "grp_legacy", Epoch: 1, SymKey: "other_key", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("重复保存纪元失败: %v", err)
+	}
+
+	epochs, err = s.GetGroupKeyEpochs("grp_legacy")
+	if err != nil {
+		t.Fatalf("查询群密钥纪元失败: %v", err)
+	}
+	if len(epochs) != 2 {
+		t.Fatalf("应该有2个纪元，实际有%d个", len(epochs))
+	}
+	if epochs[0].RetiredAt == nil || !epochs[0].RetiredAt.Equal(rotatedAt) {
+		t.Errorf("纪元0应在轮换时间退役: %v", epochs[0].RetiredAt)
+	}
+	if epochs[1].RetiredAt != nil || epochs[1].SymKey != "new_key" {
+		t.Errorf("纪元1应为当前纪元且密钥不变: %+v", epochs[1])
+	}
+
+	t.Log("✅ 群密钥纪元测试通过")
+}
+
+func TestSQLiteStorage_EditTombstone_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 消息编辑与墓碑 ===")
+	t.Log("")
+
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "chat_edit_test.db")
+
+	// 模拟旧版本数据库：messages 表没有 edited_at/deleted 列
+	legacy, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("打开旧数据库失败: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE messages (
+			id TEXT PRIMARY KEY,
+			cid TEXT NOT NULL,
+			sender_id TEXT NOT NULL,
+			sender_nickname TEXT,
+			content TEXT NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			is_read BOOLEAN DEFAULT 0,
+			is_group BOOLEAN DEFAULT 0,
+			nats_seq INTEGER DEFAULT 0
+		);
+		INSERT INTO messages (id, cid, sender_id, sender_nickname, content, timestamp, nats_seq)
+		VALUES ('msg_old', 'cid_1', 'alice', 'Alice', '旧消息', '2024-01-01 00:00:00', 1);
+	`)
+	if err != nil {
+		t.Fatalf("写入旧数据失败: %v", err)
+	}
+	legacy.Close()
+
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	msg, err := s.GetMessage("msg_old")
+	if err != nil || msg == nil {
+		t.Fatalf("读取旧消息失败: %v", err)
+	}
+	if msg.EditedAt != nil || msg.Deleted {
+		t.Fatalf("旧消息不应有编辑/撤回标记: %+v", msg)
+	}
+	t.Log("✅ 旧数据库补上新增列")
+
+	// 编辑
+	editedAt := time.Now().Truncate(time.Second)
+	changed, err := s.EditMessage("msg_old", "改过的消息", editedAt)
+	if err != nil || !changed {
+		t.Fatalf("编辑消息失败: changed=%v err=%v", changed, err)
+	}
+	msg, _ = s.GetMessage("msg_old")
+	if msg.Content != "改过的消息" || msg.EditedAt == nil || !msg.EditedAt.Equal(editedAt) {
+		t.Fatalf("编辑结果不正确: %+v", msg)
+	}
+
+	// 撤回后内容和附件记录清空，不能再编辑，也搜不到
+	if err := s.SaveAttachment(&storage.Attachment{
+		MessageID: "msg_old", ConversationID: "cid_1", Bucket: "DChatFiles", ObjectName: "obj",
+		FileName: "a.txt", Size: 1, FileKey: "k", ChunkSize: 1, CreatedAt: time.Now(),
+	}); err != nil {
+		t.Fatalf("保存附件失败: %v", err)
+	}
+	changed, err = s.TombstoneMessage("msg_old", time.Now())
+	if err != nil || !changed {
+		t.Fatalf("撤回消息失败: changed=%v err=%v", changed, err)
+	}
+	msg, _ = s.GetMessage("msg_old")
+	if !msg.Deleted || msg.Content != "" {
+		t.Fatalf("撤回后应为墓碑: %+v", msg)
+	}
+	if a, _ := s.GetAttachment("msg_old"); a != nil {
+		t.Fatal("撤回后附件记录应被删除")
+	}
+	if changed, _ := s.EditMessage("msg_old", "再改", time.Now()); changed {
+		t.Fatal("墓碑不能再编辑")
+	}
+	if changed, _ := s.TombstoneMessage("msg_old", time.Now()); changed {
+		t.Fatal("重复撤回不应再改动")
+	}
+	if found, _ := s.SearchMessages("", 10); len(found) != 0 {
+		t.Fatalf("搜索不应返回墓碑: %d", len(found))
+	}
+	t.Log("✅ 编辑与墓碑正常")
+
+	// 本地删除
+	if err := s.DeleteMessage("msg_old"); err != nil {
+		t.Fatalf("删除消息失败: %v", err)
+	}
+	if msg, _ := s.GetMessage("msg_old"); msg != nil {
+		t.Fatal("删除后不应再查到消息")
+	}
+	t.Log("✅ 本地删除正常")
+}
+
+func TestSQLiteStorage_FullTextSearch_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 全文搜索 ===")
+	t.Log("")
+
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "chat_search_test.db")
+
+	// 模拟旧版本数据库：已有消息但没有全文索引
+	legacy, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("打开旧数据库失败: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE messages (
+			id TEXT PRIMARY KEY,
+			cid TEXT NOT NULL,
+			sender_id TEXT NOT NULL,
+			sender_nickname TEXT,
+			content TEXT NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			is_read BOOLEAN DEFAULT 0,
+			is_group BOOLEAN DEFAULT 0,
+			nats_seq INTEGER DEFAULT 0
+		);
+		INSERT INTO messages (id, cid, sender_id, sender_nickname, content, timestamp, nats_seq)
+		VALUES ('msg_old', 'cid_1', 'alice', 'Alice', '旧版本里的会议纪要', '2024-01-01 00:00:00', 1);
+	`)
+	if err != nil {
+		t.Fatalf("写入旧数据失败: %v", err)
+	}
+	legacy.Close()
+
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	found, err := s.Search(storage.SearchOptions{Query: "会议纪要"})
+	if err != nil || len(found) != 1 || found[0].ID != "msg_old" {
+		t.Fatalf("旧消息应被补建索引: %v %d", err, len(found))
+	}
+	t.Log("✅ 旧数据库补建全文索引")
+
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local)
+	for i, m := range []struct{ id, cid, sender, content string }{
+		{"m1", "cid_1", "alice", "明天下午三点开会，讨论发布计划"},
+		{"m2", "cid_1", "bob", "发布计划已经发到群里了，会议室在三楼"},
+		{"m3", "cid_2", "bob", "周末一起去爬山吗"},
+		{"m4", "cid_2", "carol", "Release notes <draft> are READY"},
+		{"m5", "cid_1", "carol", "发布计划发布计划，重要的事情说两遍"},
+	} {
+		err := s.SaveMessage(&storage.StoredMessage{
+			ID: m.id, ConversationID: m.cid, SenderID: m.sender, SenderNickname: m.sender,
+			Content: m.content, Timestamp: base.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+
+	ids := func(results []*storage.SearchResult) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+	search := func(opts storage.SearchOptions) []string {
+		t.Helper()
+		results, err := s.Search(opts)
+		if err != nil {
+			t.Fatalf("搜索 %+v 失败: %v", opts, err)
+		}
+		return ids(results)
+	}
+	sameSet := func(got []string, want ...string) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		seen := map[string]bool{}
+		for _, id := range got {
+			seen[id] = true
+		}
+		for _, id := range want {
+			if !seen[id] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// 中文：三字及以上走全文索引，两字词退回子串匹配
+	if got := search(storage.SearchOptions{Query: "发布计划"}); !sameSet(got, "m1", "m2", "m5") || got[0] != "m5" {
+		t.Fatalf("中文长词搜索结果不正确（命中次数多的应排在前面）: %v", got)
+	}
+	if got := search(storage.SearchOptions{Query: "爬山"}); !sameSet(got, "m3") {
+		t.Fatalf("中文两字词搜索结果不正确: %v", got)
+	}
+	if got := search(storage.SearchOptions{Query: "发布计划 会议"}); !sameSet(got, "m2") {
+		t.Fatalf("多个词应同时命中: %v", got)
+	}
+	if got := search(storage.SearchOptions{Query: "release ready"}); !sameSet(got, "m4") {
+		t.Fatalf("英文搜索应不区分大小写: %v", got)
+	}
+	if got := search(storage.SearchOptions{Query: `100% "引号`}); len(got) != 0 {
+		t.Fatalf("特殊字符不应报错也不应误匹配: %v", got)
+	}
+	t.Log("✅ 中英文搜索与排序正常")
+
+	// 过滤条件
+	if got := search(storage.SearchOptions{Query: "发布计划", ConversationID: "cid_1", SenderID: "bob"}); !sameSet(got, "m2") {
+		t.Fatalf("会话和发送者过滤不正确: %v", got)
+	}
+	since, until := base.Add(time.Hour), base.Add(4*time.Hour)
+	if got := search(storage.SearchOptions{Query: "发布计划", Since: &since, Until: &until}); !sameSet(got, "m2") {
+		t.Fatalf("时间范围过滤不正确: %v", got)
+	}
+	if got := search(storage.SearchOptions{SenderID: "carol"}); len(got) != 2 || got[0] != "m5" {
+		t.Fatalf("没有关键词时应按时间倒序列出: %v", got)
+	}
+	if got := search(storage.SearchOptions{Query: "发布计划", Limit: 1, Offset: 1}); len(got) != 1 {
+		t.Fatalf("分页不正确: %v", got)
+	}
+	t.Log("✅ 过滤条件正常")
+
+	// 高亮摘要
+	results, _ := s.Search(storage.SearchOptions{Query: "ready draft"})
+	if len(results) != 1 || results[0].Snippet != "Release notes &lt;<mark>draft</mark>&gt; are <mark>READY</mark>" {
+		t.Fatalf("摘要高亮不正确: %+v", results)
+	}
+	long := "开头" + strings.Repeat("无关的内容", 30) + "关键字在这里" + strings.Repeat("后面的内容", 30)
+	if err := s.SaveMessage(&storage.StoredMessage{
+		ID: "m6", ConversationID: "cid_1", SenderID: "alice", Content: long, Timestamp: base,
+	}); err != nil {
+		t.Fatalf("保存消息失败: %v", err)
+	}
+	results, _ = s.Search(storage.SearchOptions{Query: "关键字"})
+	if len(results) != 1 || !strings.HasPrefix(results[0].Snippet, "…") || !strings.HasSuffix(results[0].Snippet, "…") ||
+		!strings.Contains(results[0].Snippet, "<mark>关键字</mark>在这里") {
+		t.Fatalf("长消息摘要应截取命中位置附近: %+v", results)
+	}
+	t.Log("✅ 高亮摘要正常")
+
+	// 编辑、撤回、删除后索引同步
+	if _, err := s.EditMessage("m3", "周末改成去看电影", time.Now()); err != nil {
+		t.Fatalf("编辑消息失败: %v", err)
+	}
+	if got := search(storage.SearchOptions{Query: "看电影"}); !sameSet(got, "m3") {
+		t.Fatalf("编辑后应能搜到新内容: %v", got)
+	}
+	if got := search(storage.SearchOptions{Query: "爬山"}); len(got) != 0 {
+		t.Fatalf("编辑后不应再搜到旧内容: %v", got)
+	}
+	if _, err := s.TombstoneMessage("m1", time.Now()); err != nil {
+		t.Fatalf("撤回消息失败: %v", err)
+	}
+	if err := s.DeleteMessage("m2"); err != nil {
+		t.Fatalf("删除消息失败: %v", err)
+	}
+	if got := search(storage.SearchOptions{Query: "发布计划"}); !sameSet(got, "m5") {
+		t.Fatalf("撤回和删除的消息不应被搜到: %v", got)
+	}
+	t.Log("✅ 索引随消息变化同步")
+}
+
+// openFixture 用 testdata 里的 SQL 生成一个旧版本数据库文件
+func openFixture(t *testing.T, name string) string {
+	t.Helper()
+	script, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("读取数据库样本 %s 失败: %v", name, err)
+	}
+	dbPath := filepath.Join(t.TempDir(), strings.TrimSuffix(name, ".sql")+".db")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("创建数据库样本失败: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(script)); err != nil {
+		t.Fatalf("写入数据库样本 %s 失败: %v", name, err)
+	}
+	return dbPath
+}
+
+// 测试加密数据库的搜索：盲索引按相关度排序，写入、编辑、撤回后索引同步，更换口令和重新打开后仍可搜索，文件里没有明文
+func TestSQLiteStorage_EncryptedSearch_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 加密数据库的全文搜索 ===")
+	t.Log("")
+
+	dbPath := filepath.Join(t.TempDir(), "chat_encrypted_search_test.db")
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local)
+	save := func(s *storage.Storage, i int, id, cid, sender, content string) {
+		t.Helper()
+		if err := s.SaveMessage(&storage.StoredMessage{
+			ID: id, ConversationID: cid, SenderID: sender, Content: content, Timestamp: base.Add(time.Duration(i) * time.Hour),
+		}); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	save(s, 0, "m1", "cid_1", "alice", "明天下午三点开会，讨论发布计划")
+	save(s, 1, "m2", "cid_1", "bob", "发布计划已经发到群里了，会议室在三楼")
+	search := func(s *storage.Storage, query string) []string {
+		t.Helper()
+		results, err := s.Search(storage.SearchOptions{Query: query})
+		if err != nil {
+			t.Fatalf("搜索 %q 失败: %v", query, err)
+		}
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	// 命中次数最多的 m5 排第一，其余两条都命中一次
+	expectRanked := func(s *storage.Storage) {
+		t.Helper()
+		got := search(s, "发布计划")
+		if len(got) != 3 || got[0] != "m5" {
+			t.Fatalf("加密后应按相关度排序: %v", got)
+		}
+		if got := search(s, "发布计划 会议"); len(got) != 1 || got[0] != "m2" {
+			t.Fatalf("长词和短词应同时命中: %v", got)
+		}
+		if got := search(s, "RELEASE"); len(got) != 1 || got[0] != "m4" {
+			t.Fatalf("加密后搜索应不区分大小写: %v", got)
+		}
+		if got := search(s, "计划发到"); len(got) != 0 {
+			t.Fatalf("不连续的文字不应命中: %v", got)
+		}
+	}
+
+	// ===== Step 1: 开启加密后补建盲索引，新消息随写入索引 =====
+	t.Log("Step 1: 开启加密...")
+	if err := s.EnableEncryption(storage.SeedKey("SUBLINDINDEXSEED")); err != nil {
+		t.Fatalf("开启加密失败: %v", err)
+	}
+	save(s, 2, "m3", "cid_2", "bob", "周末一起去爬山吗")
+	save(s, 3, "m4", "cid_2", "carol", "Release notes are ready")
+	save(s, 4, "m5", "cid_1", "carol", "发布计划发布计划，重要的事情说两遍")
+	expectRanked(s)
+	if got := search(s, "爬山"); len(got) != 1 || got[0] != "m3" {
+		t.Fatalf("只有短词时应解密匹配: %v", got)
+	}
+	t.Log("✅ 加密后按相关度排序")
+
+	// ===== Step 2: 编辑和撤回 =====
+	t.Log("Step 2: 编辑和撤回...")
+	if _, err := s.EditMessage("m3", "周末一起去看电影吗", time.Now()); err != nil {
+		t.Fatalf("编辑失败: %v", err)
+	}
+	if got := search(s, "去爬山"); len(got) != 0 {
+		t.Fatalf("编辑后旧内容不应再被搜到: %v", got)
+	}
+	if got := search(s, "看电影"); len(got) != 1 || got[0] != "m3" {
+		t.Fatalf("编辑后的内容应能搜到: %v", got)
+	}
+	if _, err := s.TombstoneMessage("m3", time.Now()); err != nil {
+		t.Fatalf("撤回失败: %v", err)
+	}
+	if got := search(s, "看电影"); len(got) != 0 {
+		t.Fatalf("撤回后不应再被搜到: %v", got)
+	}
+	t.Log("✅ 索引随编辑和撤回更新")
+
+	// ===== Step 3: 更换口令后重新打开 =====
+	t.Log("Step 3: 更换口令并重新打开...")
+	if err := s.Rekey(storage.PassphraseKey("blind index passphrase")); err != nil {
+		t.Fatalf("更换口令失败: %v", err)
+	}
+	expectRanked(s)
+	s.Close()
+
+	raw, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("读取数据库文件失败: %v", err)
+	}
+	for _, plain := range []string{"发布计划", "布计划", "Release", "elease"} {
+		if strings.Contains(string(raw), plain) {
+			t.Fatalf("数据库文件里不应有明文: %s", plain)
+		}
+	}
+
+	// 模拟升级前加密的数据库：盲索引是空的，解锁时补建
+	db, _ := sql.Open("sqlite", dbPath)
+	if _, err := db.Exec(`DELETE FROM messages_blind`); err != nil {
+		t.Fatalf("清空盲索引失败: %v", err)
+	}
+	db.Close()
+	s, err = storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Search(storage.SearchOptions{Query: "发布计划"}); !errors.Is(err, storage.ErrLocked) {
+		t.Fatalf("锁定时搜索应返回 ErrLocked: %v", err)
+	}
+	if err := s.Unlock(storage.PassphraseKey("blind index passphrase")); err != nil {
+		t.Fatalf("解锁失败: %v", err)
+	}
+	expectRanked(s)
+	t.Log("✅ 更换口令、重新打开后排序不变，文件里没有明文")
+}
+
+// 测试表结构迁移：新库、未记录版本的旧库和中间版本的库都升级到最新版本，更新版本的库拒绝打开
+func TestSQLiteStorage_SchemaMigrations_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 表结构迁移 ===")
+	t.Log("")
+
+	latest := storage.LatestSchemaVersion()
+	expectLatest := func(s *storage.Storage) {
+		t.Helper()
+		v, err := s.SchemaVersion()
+		if err != nil || v != latest {
+			t.Fatalf("表结构版本应为 v%d，实际 v%d: %v", latest, v, err)
+		}
+	}
+
+	// ===== Step 1: 新数据库 =====
+	t.Log("Step 1: 新数据库...")
+	dbPath := filepath.Join(t.TempDir(), "chat_fresh.db")
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	expectLatest(s)
+	s.Close()
+
+	// 重复打开不会重复执行迁移
+	s, err = storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	expectLatest(s)
+	s.Close()
+	db, _ := sql.Open("sqlite", dbPath)
+	var applied int
+	db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&applied)
+	db.Close()
+	if applied != latest {
+		t.Fatalf("每个迁移只应记录一次: %d 条记录", applied)
+	}
+	t.Log("✅ 新数据库直接升级到最新版本")
+
+	// ===== Step 2: 引入迁移之前的数据库 =====
+	t.Log("Step 2: 未记录版本的旧数据库...")
+	s, err = storage.NewSQLiteStorage(openFixture(t, "v0_unversioned.sql"))
+	if err != nil {
+		t.Fatalf("升级旧数据库失败: %v", err)
+	}
+	expectLatest(s)
+
+	msgs, err := s.GetMessages("cid_dm", 10, nil)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("旧消息应保留: %d %v", len(msgs), err)
+	}
+	if msgs[0].ID != "msg_legacy_1" || !msgs[0].IsRead || msgs[0].Deleted || msgs[0].EditedAt != nil {
+		t.Fatalf("旧消息字段不正确: %+v", msgs[0])
+	}
+	if key, _ := s.GetFriendPubKey("bob"); key != "bob_pub_key" {
+		t.Fatalf("好友公钥应保留: %q", key)
+	}
+	epochs, err := s.GetGroupKeyEpochs("grp_legacy")
+	if err != nil || len(epochs) != 1 || epochs[0].SymKey != "legacy_group_key" {
+		t.Fatalf("旧群密钥应迁移为纪元0: %+v %v", epochs, err)
+	}
+	if found, _ := s.Search(storage.SearchOptions{Query: "升级之前"}); len(found) != 3 {
+		t.Fatalf("旧消息应建立全文索引: %d", len(found))
+	}
+	summaries, err := s.GetConversationSummaries()
+	if err != nil || len(summaries) != 2 {
+		t.Fatalf("旧会话应出现在会话列表: %d %v", len(summaries), err)
+	}
+	for _, sum := range summaries {
+		if sum.UnreadCount != 1 {
+			t.Fatalf("未读数应按已有消息回填: %+v", sum)
+		}
+		if sum.ID == "cid_dm" && sum.LastMessageID != "msg_legacy_2" {
+			t.Fatalf("最后一条消息应按已有消息回填: %+v", sum)
+		}
+	}
+
+	// (cid, nats_seq) 唯一索引已删除，实时收到的 nats_seq=0 消息不再互相覆盖；新增的列可以使用
+	for _, m := range []*storage.StoredMessage{
+		{ID: "msg_live_1", ConversationID: "cid_dm", SenderID: "bob", Content: "实时消息一", Timestamp: time.Now()},
+		{ID: "msg_live_2", ConversationID: "cid_dm", SenderID: "bob", Content: "实时消息二", Timestamp: time.Now(), ReplyToID: "msg_legacy_1"},
+	} {
+		if err := s.SaveMessage(m); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	if msgs, _ := s.GetMessages("cid_dm", 10, nil); len(msgs) != 4 {
+		t.Fatalf("nats_seq=0 的消息应都能保存: %d", len(msgs))
+	}
+	if thread, _ := s.GetThread("msg_legacy_1"); len(thread) != 2 {
+		t.Fatalf("升级后应支持回复: %d", len(thread))
+	}
+	if _, err := s.SaveReaction(&storage.Reaction{
+		MessageID: "msg_legacy_1", UserID: "bob", Emoji: "👍", OpID: "01JKV8A0000000000000000009", UpdatedAt: time.Now(),
+	}); err != nil {
+		t.Fatalf("升级后应支持表情回应: %v", err)
+	}
+	s.Close()
+	t.Log("✅ 旧数据库升级到最新版本，数据保留")
+
+	// ===== Step 3: 中间版本的数据库 =====
+	t.Log("Step 3: v8 数据库...")
+	s, err = storage.NewSQLiteStorage(openFixture(t, "v8_message_edits.sql"))
+	if err != nil {
+		t.Fatalf("升级 v8 数据库失败: %v", err)
+	}
+	expectLatest(s)
+
+	edited, err := s.GetMessage("01JKV8A0000000000000000001")
+	if err != nil || edited == nil || edited.EditedAt == nil || edited.DeliveryState != storage.DeliveryRead {
+		t.Fatalf("编辑时间和送达状态应保留: %+v %v", edited, err)
+	}
+	if tomb, _ := s.GetMessage("01JKV8A0000000000000000002"); tomb == nil || !tomb.Deleted {
+		t.Fatalf("墓碑应保留: %+v", tomb)
+	}
+	if found, _ := s.Search(storage.SearchOptions{Query: "编辑过"}); len(found) != 1 {
+		t.Fatalf("v8 消息应建立全文索引: %d", len(found))
+	}
+	if epochs, _ := s.GetGroupKeyEpochs("grp_v8"); len(epochs) != 1 {
+		t.Fatalf("已有的群密钥纪元不应重复迁移: %+v", epochs)
+	}
+	s.Close()
+	t.Log("✅ v8 数据库只执行后续迁移")
+
+	// ===== Step 4: 更新版本的数据库 =====
+	t.Log("Step 4: 更新版本的数据库...")
+	futurePath := openFixture(t, "v99_future.sql")
+	if _, err := storage.NewSQLiteStorage(futurePath); !errors.Is(err, storage.ErrSchemaTooNew) {
+		t.Fatalf("应拒绝打开更新版本的数据库: %v", err)
+	}
+	db, _ = sql.Open("sqlite", futurePath)
+	defer db.Close()
+	var tables int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'`).Scan(&tables)
+	if tables != 1 {
+		t.Fatalf("拒绝打开时不应改动数据库: %d 张表", tables)
+	}
+	t.Log("✅ 拒绝打开更新版本的数据库")
+}
+
+// 测试静态加密：开启加密后敏感列和索引里不留明文，重新打开需要解锁，更换口令后旧口令失效
+func TestSQLiteStorage_Encryption_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 静态加密 ===")
+	t.Log("")
+
+	dbPath := filepath.Join(t.TempDir(), "chat_encrypted.db")
+	const seed = "SUAMLK2ZNL35WSMW37E7UD4VZ7ELPKW7DHC3BWBSD2GCZ7IUQQXZIORRBU"
+	const secretText = "银行卡密码藏在书架第三层"
+
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+	}
+	must(s.SaveMessage(&storage.StoredMessage{ID: "m1", ConversationID: "cid_1", SenderID: "alice", Content: secretText, Timestamp: now}))
+	must(s.SaveFriendPubKey("bob", "bob_friend_pub_key_b64"))
+	must(s.SaveGroupSymKey("grp_1", "group_sym_key_b64"))
+	must(s.SaveGroupKeyEpoch(&storage.GroupKeyEpoch{GroupID: "grp_1", Epoch: 0, SymKey: "group_sym_key_b64", CreatedAt: now}))
+	must(s.SaveGroupInvite(&storage.GroupInvite{GroupID: "grp_2", SymKey: "invite_sym_key_b64", InviterID: "bob", Status: storage.InvitePending, ReceivedAt: now}))
+	must(s.SaveAttachment(&storage.Attachment{MessageID: "m1", ConversationID: "cid_1", Bucket: "DChatFiles", ObjectName: "obj", FileName: "a.txt", Size: 1, FileKey: "attachment_file_key_b64", ChunkSize: 1, CreatedAt: now}))
+	must(s.SaveRatchetPrekey(&storage.RatchetPrekey{ID: 1, PrivKey: "prekey_priv_b64", PubKey: "prekey_pub", CreatedAt: now}))
+	must(s.SaveOneTimePrekey(&storage.RatchetPrekey{ID: 7, PrivKey: "otk_priv_b64", PubKey: "otk_pub", CreatedAt: now}))
+	must(s.SaveRatchetSession(&storage.RatchetSession{PeerID: "bob", SessionID: "s1", State: `{"root":"ratchet_state"}`, CreatedAt: now, UpdatedAt: now}))
+	if s.EncryptionKind() != "" || s.Locked() {
+		t.Fatal("新数据库默认不加密")
+	}
+
+	// ===== Step 1: 开启加密 =====
+	t.Log("Step 1: 用 seed 开启加密...")
+	if err := s.EnableEncryption(storage.SeedKey(seed)); err != nil {
+		t.Fatalf("开启加密失败: %v", err)
+	}
+	if err := s.EnableEncryption(storage.SeedKey(seed)); err == nil {
+		t.Fatal("重复开启加密应报错")
+	}
+	must(s.SaveMessage(&storage.StoredMessage{ID: "m2", ConversationID: "cid_1", SenderID: "bob", Content: "加密之后发的消息", Timestamp: now.Add(time.Second)}))
+
+	checkPlain := func(s *storage.Storage) {
+		t.Helper()
+		if msg, err := s.GetMessage("m1"); err != nil || msg.Content != secretText {
+			t.Fatalf("读取消息应透明解密: %+v %v", msg, err)
+		}
+		if key, err := s.GetFriendPubKey("bob"); err != nil || key != "bob_friend_pub_key_b64" {
+			t.Fatalf("好友公钥不正确: %q %v", key, err)
+		}
+		if key, err := s.GetGroupSymKey("grp_1"); err != nil || key != "group_sym_key_b64" {
+			t.Fatalf("群密钥不正确: %q %v", key, err)
+		}
+		if epochs, err := s.GetGroupKeyEpochs("grp_1"); err != nil || len(epochs) != 1 || epochs[0].SymKey != "group_sym_key_b64" {
+			t.Fatalf("群密钥纪元不正确: %+v %v", epochs, err)
+		}
+		if inv, err := s.GetGroupInvite("grp_2"); err != nil || inv.SymKey != "invite_sym_key_b64" {
+			t.Fatalf("邀请里的群密钥不正确: %+v %v", inv, err)
+		}
+		if a, err := s.GetAttachment("m1"); err != nil || a.FileKey != "attachment_file_key_b64" {
+			t.Fatalf("附件密钥不正确: %+v %v", a, err)
+		}
+		if pk, err := s.GetLatestRatchetPrekey(); err != nil || pk.PrivKey != "prekey_priv_b64" {
+			t.Fatalf("预密钥不正确: %+v %v", pk, err)
+		}
+		if pk, err := s.GetOneTimePrekey(7); err != nil || pk.PrivKey != "otk_priv_b64" {
+			t.Fatalf("一次性预密钥不正确: %+v %v", pk, err)
+		}
+		if sessions, err := s.GetRatchetSessions("bob"); err != nil || len(sessions) != 1 || sessions[0].State != `{"root":"ratchet_state"}` {
+			t.Fatalf("会话状态不正确: %+v %v", sessions, err)
+		}
+		// 加密后搜索改为解密匹配，短词长词都能搜到，过滤条件照常生效
+		if found, err := s.Search(storage.SearchOptions{Query: "书架第三层"}); err != nil || len(found) != 1 || found[0].Snippet == "" {
+			t.Fatalf("加密后应能搜索: %+v %v", found, err)
+		}
+		if found, _ := s.Search(storage.SearchOptions{Query: "消息", SenderID: "bob"}); len(found) != 1 || found[0].ID != "m2" {
+			t.Fatalf("加密后过滤条件不正确: %+v", found)
+		}
+	}
+	checkPlain(s)
+	s.Close()
+
+	raw, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("读取数据库文件失败: %v", err)
+	}
+	for _, secret := range []string{secretText, "加密之后发的消息", "group_sym_key_b64", "invite_sym_key_b64",
+		"attachment_file_key_b64", "prekey_priv_b64", "otk_priv_b64", "ratchet_state", "bob_friend_pub_key_b64"} {
+		if strings.Contains(string(raw), secret) {
+			t.Fatalf("数据库文件里不应有明文: %s", secret)
+		}
+	}
+	t.Log("✅ 数据库文件里没有明文")
+
+	// ===== Step 2: 重新打开需要解锁 =====
+	t.Log("Step 2: 重新打开并解锁...")
+	s, err = storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	if s.EncryptionKind() != storage.KeySeed || !s.Locked() {
+		t.Fatalf("重新打开后应处于锁定状态: %s %v", s.EncryptionKind(), s.Locked())
+	}
+	if _, err := s.GetMessage("m1"); !errors.Is(err, storage.ErrLocked) {
+		t.Fatalf("锁定时读取应返回 ErrLocked: %v", err)
+	}
+	if err := s.SaveGroupSymKey("grp_3", "k"); !errors.Is(err, storage.ErrLocked) {
+		t.Fatalf("锁定时写入应返回 ErrLocked: %v", err)
+	}
+	if err := s.Rekey(storage.PassphraseKey("x")); !errors.Is(err, storage.ErrLocked) {
+		t.Fatalf("锁定时不能更换口令: %v", err)
+	}
+	if err := s.Unlock(storage.SeedKey("SUWRONGSEED")); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("错误的 seed 应返回 ErrWrongKey: %v", err)
+	}
+	if err := s.Unlock(storage.PassphraseKey(seed)); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("口令类型不符应返回 ErrWrongKey: %v", err)
+	}
+	if err := s.Unlock(storage.SeedKey(seed)); err != nil {
+		t.Fatalf("解锁失败: %v", err)
+	}
+	checkPlain(s)
+	t.Log("✅ 解锁后透明读写")
+
+	// ===== Step 3: 更换为口令 =====
+	t.Log("Step 3: 更换为口令...")
+	if err := s.Rekey(storage.PassphraseKey("correct horse battery staple")); err != nil {
+		t.Fatalf("更换口令失败: %v", err)
+	}
+	checkPlain(s)
+	s.Close()
+
+	s, err = storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	defer s.Close()
+	if s.EncryptionKind() != storage.KeyPassphrase {
+		t.Fatalf("口令来源应为 passphrase: %s", s.EncryptionKind())
+	}
+	if err := s.Unlock(storage.SeedKey(seed)); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("更换口令后 seed 不能再解锁: %v", err)
+	}
+	if err := s.Unlock(storage.PassphraseKey("wrong horse")); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("错误的口令应返回 ErrWrongKey: %v", err)
+	}
+	if err := s.Unlock(storage.PassphraseKey("correct horse battery staple")); err != nil {
+		t.Fatalf("口令解锁失败: %v", err)
+	}
+	checkPlain(s)
+	t.Log("✅ 更换口令后数据完整，旧口令失效")
+
+	// ===== Step 4: 轮换后删除被替换的签名预密钥 =====
+	t.Log("Step 4: 删除被替换的签名预密钥...")
+	if err := s.SaveRatchetPrekey(&storage.RatchetPrekey{ID: 2, PrivKey: "prekey2_priv_b64", PubKey: "prekey2_pub", CreatedAt: now}); err != nil {
+		t.Fatalf("保存预密钥失败: %v", err)
+	}
+	if err := s.DeleteRatchetPrekeysBefore(2); err != nil {
+		t.Fatalf("删除旧预密钥失败: %v", err)
+	}
+	if pk, err := s.GetRatchetPrekey(1); err != nil || pk != nil {
+		t.Fatalf("被替换的预密钥应已删除: %+v %v", pk, err)
+	}
+	if pk, err := s.GetLatestRatchetPrekey(); err != nil || pk.ID != 2 || pk.PrivKey != "prekey2_priv_b64" {
+		t.Fatalf("当前预密钥应保留: %+v %v", pk, err)
+	}
+	t.Log("✅ 旧签名预密钥已删除，当前的保留")
+}
+
+func TestSQLiteStorage_ConversationSummaries_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 会话列表摘要与未读计数 ===")
+	t.Log("")
+
+	tmpDir := t.TempDir()
+	s, err := storage.NewSQLiteStorage(filepath.Join(tmpDir, "chat_summary_test.db"))
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	save := func(m *storage.StoredMessage) {
+		t.Helper()
+		if err := s.SaveMessage(m); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	find := func(id string) *storage.ConversationSummary {
+		t.Helper()
+		list, err := s.GetConversationSummaries()
+		if err != nil {
+			t.Fatalf("获取会话列表失败: %v", err)
+		}
+		for _, sum := range list {
+			if sum.ID == id {
+				return sum
+			}
+		}
+		t.Fatalf("会话列表里没有 %s", id)
+		return nil
+	}
+
+	// ===== Step 1: 消息先于会话写入，未读数随保存累加 =====
+	t.Log("Step 1: 保存私聊和群聊消息...")
+	save(&storage.StoredMessage{ID: "dm_1", ConversationID: "cid_dm", SenderID: "bob", SenderNickname: "Bobby", Content: "在吗", Timestamp: at(1)})
+	save(&storage.StoredMessage{ID: "dm_2", ConversationID: "cid_dm", SenderID: "bob", SenderNickname: "Bob", Content: "晚上一起吃饭", Timestamp: at(2)})
+	save(&storage.StoredMessage{ID: "dm_3", ConversationID: "cid_dm", SenderID: "me", SenderNickname: "Me", Content: "好的", Timestamp: at(3), IsRead: true})
+	// 重复保存不重复计数
+	save(&storage.StoredMessage{ID: "dm_2", ConversationID: "cid_dm", SenderID: "bob", SenderNickname: "Bob", Content: "晚上一起吃饭", Timestamp: at(2)})
+	// 对端ID由聊天服务补上，已有的未读数不能被覆盖
+	if err := s.SaveConversation(&storage.StoredConversation{
+		ID: "cid_dm", Type: "dm", PeerID: "bob", LastMessageAt: at(3), CreatedAt: at(1),
+	}); err != nil {
+		t.Fatalf("保存会话失败: %v", err)
+	}
+
+	if err := s.SaveGroupInfo(&storage.GroupInfo{GroupID: "grp_1", Name: "周末爬山", CreatorID: "carol", UpdatedAt: at(0), CreatedAt: at(0)}); err != nil {
+		t.Fatalf("保存群信息失败: %v", err)
+	}
+	long := strings.Repeat("山", 100)
+	save(&storage.StoredMessage{ID: "grp_1_a", ConversationID: "grp_1", SenderID: "carol", SenderNickname: "Carol", Content: "集合时间？", Timestamp: at(4), IsGroup: true})
+	save(&storage.StoredMessage{ID: "grp_1_b", ConversationID: "grp_1", SenderID: "dave", SenderNickname: "Dave", Content: long, Timestamp: at(5), IsGroup: true})
+	if err := s.SaveConversation(&storage.StoredConversation{ID: "grp_1", Type: "group", LastMessageAt: at(5), CreatedAt: at(4)}); err != nil {
+		t.Fatalf("保存会话失败: %v", err)
+	}
+
+	list, err := s.GetConversationSummaries()
+	if err != nil || len(list) != 2 {
+		t.Fatalf("会话列表数量不正确: %d %v", len(list), err)
+	}
+	if list[0].ID != "grp_1" || list[1].ID != "cid_dm" {
+		t.Fatalf("会话应按最后消息时间倒序: %s, %s", list[0].ID, list[1].ID)
+	}
+	dm := list[1]
+	if dm.Type != "dm" || dm.PeerID != "bob" || dm.DisplayName != "Bob" {
+		t.Fatalf("私聊应显示对端最近的昵称: %+v", dm)
+	}
+	if dm.UnreadCount != 2 || dm.LastMessageID != "dm_3" || dm.LastMessagePreview != "好的" || dm.LastSenderNickname != "Me" {
+		t.Fatalf("私聊摘要不正确: %+v", dm)
+	}
+	grp := list[0]
+	if grp.DisplayName != "周末爬山" || grp.UnreadCount != 2 || grp.LastSenderNickname != "Dave" {
+		t.Fatalf("群聊摘要不正确: %+v", grp)
+	}
+	if grp.LastMessagePreview != strings.Repeat("山", 60)+"…" {
+		t.Fatalf("预览应截断: %q", grp.LastMessagePreview)
+	}
+	if grp.Pinned || grp.Muted || grp.MutedUntil != nil {
+		t.Fatalf("默认不置顶、不免打扰: %+v", grp)
+	}
+	t.Log("✅ 摘要字段和排序正确")
+
+	// ===== Step 2: 乱序到达的旧消息不改变最后一条消息 =====
+	t.Log("Step 2: 离线同步补到更早的消息...")
+	save(&storage.StoredMessage{ID: "dm_0", ConversationID: "cid_dm", SenderID: "bob", SenderNickname: "Bob", Content: "早上好", Timestamp: at(0)})
+	if dm := find("cid_dm"); dm.UnreadCount != 3 || dm.LastMessageID != "dm_3" {
+		t.Fatalf("旧消息只应增加未读: %+v", dm)
+	}
+	t.Log("✅ 最后一条消息按时间维护")
+
+	// ===== Step 3: 标记已读、撤回和删除时扣减 =====
+	t.Log("Step 3: 已读、撤回、删除...")
+	if err := s.MarkAsRead("cid_dm", at(1)); err != nil {
+		t.Fatalf("标记已读失败: %v", err)
+	}
+	if dm := find("cid_dm"); dm.UnreadCount != 1 {
+		t.Fatalf("标记已读后未读数应为1: %d", dm.UnreadCount)
+	}
+	// 重复标记不会多扣
+	if err := s.MarkAsRead("cid_dm", at(1)); err != nil {
+		t.Fatalf("标记已读失败: %v", err)
+	}
+	if err := s.MarkMessagesRead([]string{"dm_2"}); err != nil {
+		t.Fatalf("标记消息已读失败: %v", err)
+	}
+	if dm := find("cid_dm"); dm.UnreadCount != 0 {
+		t.Fatalf("全部已读后未读数应为0: %d", dm.UnreadCount)
+	}
+
+	if changed, err := s.TombstoneMessage("grp_1_b", time.Now()); err != nil || !changed {
+		t.Fatalf("撤回消息失败: changed=%v err=%v", changed, err)
+	}
+	grp = find("grp_1")
+	if grp.UnreadCount != 1 || !grp.LastMessageDeleted || grp.LastMessagePreview != "" {
+		t.Fatalf("撤回未读消息后应扣减并显示墓碑: %+v", grp)
+	}
+	if err := s.DeleteMessage("grp_1_b"); err != nil {
+		t.Fatalf("删除消息失败: %v", err)
+	}
+	grp = find("grp_1")
+	if grp.UnreadCount != 1 || grp.LastMessageID != "grp_1_a" || grp.LastMessagePreview != "集合时间？" {
+		t.Fatalf("删除最后一条消息后应回退到上一条: %+v", grp)
+	}
+	if err := s.DeleteMessage("grp_1_a"); err != nil {
+		t.Fatalf("删除消息失败: %v", err)
+	}
+	if grp = find("grp_1"); grp.UnreadCount != 0 || grp.LastMessageID != "" {
+		t.Fatalf("消息删空后不应有未读和预览: %+v", grp)
+	}
+	t.Log("✅ 未读数增量维护正确")
+
+	// ===== Step 4: 加密后预览解密 =====
+	t.Log("Step 4: 静态加密...")
+	if err := s.EnableEncryption(storage.SeedKey("SUSUMMARYTESTSEED")); err != nil {
+		t.Fatalf("开启加密失败: %v", err)
+	}
+	save(&storage.StoredMessage{ID: "dm_4", ConversationID: "cid_dm", SenderID: "bob", SenderNickname: "Bob", Content: "加密后的消息", Timestamp: at(6)})
+	if dm := find("cid_dm"); dm.UnreadCount != 1 || dm.LastMessagePreview != "加密后的消息" {
+		t.Fatalf("加密后预览应为明文: %+v", dm)
+	}
+	t.Log("✅ 加密数据库的预览正常")
+}
+
+func TestSQLiteStorage_ConversationManagement_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 会话管理 ===")
+	t.Log("")
+
+	tmpDir := t.TempDir()
+	s, err := storage.NewSQLiteStorage(filepath.Join(tmpDir, "chat_manage_test.db"))
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, id := range []string{"m1", "m2", "m3"} {
+		if err := s.SaveMessage(&storage.StoredMessage{
+			ID: id, ConversationID: "cid_1", SenderID: "bob", Content: "消息" + id, Timestamp: base.Add(time.Duration(i) * time.Minute),
+		}); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	if _, err := s.SaveMessageReceipt(&storage.MessageReceipt{MessageID: "m1", UserID: "bob", State: storage.DeliveryRead, UpdatedAt: base}); err != nil {
+		t.Fatalf("保存回执失败: %v", err)
+	}
+
+	// ===== Step 1: 置顶、归档、免打扰 =====
+	t.Log("Step 1: 会话设置...")
+	if err := s.SetConversationPinned("cid_1", true); err != nil {
+		t.Fatalf("置顶失败: %v", err)
+	}
+	if err := s.SetConversationArchived("cid_1", true); err != nil {
+		t.Fatalf("归档失败: %v", err)
+	}
+	if err := s.SetConversationMuted("cid_1", &storage.MuteForever); err != nil {
+		t.Fatalf("免打扰失败: %v", err)
+	}
+	conv, err := s.GetConversation("cid_1")
+	if err != nil || conv == nil {
+		t.Fatalf("读取会话失败: %v", err)
+	}
+	if !conv.Pinned || !conv.Archived || conv.MutedUntil == nil || !conv.MutedUntil.Equal(storage.MuteForever) {
+		t.Fatalf("会话设置不正确: %+v", conv)
+	}
+	if err := s.SetConversationMuted("cid_1", nil); err != nil {
+		t.Fatalf("取消免打扰失败: %v", err)
+	}
+	if conv, _ = s.GetConversation("cid_1"); conv.MutedUntil != nil {
+		t.Fatalf("取消免打扰后截止时间应为空: %v", conv.MutedUntil)
+	}
+	if err := s.SetConversationPinned("cid_missing", true); err == nil {
+		t.Fatal("不存在的会话应报错")
+	}
+	t.Log("✅ 会话设置正常")
+
+	// ===== Step 2: 清空记录后旧消息重新送达不再保存 =====
+	t.Log("Step 2: 清空记录...")
+	if err := s.ClearConversation("cid_1", base.Add(2*time.Minute)); err != nil {
+		t.Fatalf("清空记录失败: %v", err)
+	}
+	if msgs, _ := s.GetMessages("cid_1", 10, nil); len(msgs) != 0 {
+		t.Fatalf("清空后不应有消息: %d", len(msgs))
+	}
+	if receipts, _ := s.GetMessageReceipts("m1"); len(receipts) != 0 {
+		t.Fatalf("清空后回执应一并删除: %d", len(receipts))
+	}
+	_ = s.SaveMessage(&storage.StoredMessage{ID: "m2", ConversationID: "cid_1", SenderID: "bob", Content: "重新送达", Timestamp: base.Add(time.Minute)})
+	_ = s.SaveMessage(&storage.StoredMessage{ID: "m4", ConversationID: "cid_1", SenderID: "bob", Content: "新消息", Timestamp: base.Add(3 * time.Minute)})
+	msgs, _ := s.GetMessages("cid_1", 10, nil)
+	if len(msgs) != 1 || msgs[0].ID != "m4" {
+		t.Fatalf("只应保存清空之后的消息: %+v", msgs)
+	}
+	if conv, _ = s.GetConversation("cid_1"); conv == nil || !conv.Pinned {
+		t.Fatalf("清空记录应保留会话设置: %+v", conv)
+	}
+	t.Log("✅ 清空记录正常")
+
+	// ===== Step 3: 删除会话和密钥 =====
+	t.Log("Step 3: 删除会话和密钥...")
+	if err := s.DeleteConversation("cid_1"); err != nil {
+		t.Fatalf("删除会话失败: %v", err)
+	}
+	if conv, _ = s.GetConversation("cid_1"); conv != nil {
+		t.Fatal("删除后不应再查到会话")
+	}
+	if msgs, _ := s.GetMessages("cid_1", 10, nil); len(msgs) != 0 {
+		t.Fatalf("删除后不应有消息: %d", len(msgs))
+	}
+
+	_ = s.SaveFriendPubKey("bob", "bob_pub")
+	_ = s.SaveGroupSymKey("grp_1", "grp_key")
+	_ = s.SaveGroupKeyEpoch(&storage.GroupKeyEpoch{GroupID: "grp_1", Epoch: 1, SymKey: "grp_key_1", CreatedAt: time.Now()})
+	if err := s.DeleteFriendPubKey("bob"); err != nil {
+		t.Fatalf("删除好友公钥失败: %v", err)
+	}
+	if err := s.DeleteGroupKeys("grp_1"); err != nil {
+		t.Fatalf("删除群密钥失败: %v", err)
+	}
+	if friends, _ := s.GetAllFriends(); len(friends) != 0 {
+		t.Fatalf("好友公钥应已删除: %v", friends)
+	}
+	if groups, _ := s.GetAllGroups(); len(groups) != 0 {
+		t.Fatalf("群密钥应已删除: %v", groups)
+	}
+	if epochs, _ := s.GetGroupKeyEpochs("grp_1"); len(epochs) != 0 {
+		t.Fatalf("群密钥纪元应已删除: %d", len(epochs))
+	}
+	t.Log("✅ 删除会话和密钥正常")
+
+	// ===== Step 4: 离开的会话重启后仍记得 =====
+	t.Log("Step 4: 离开会话...")
+	for _, cid := range []string{"cid_1", "grp_1", "cid_1"} {
+		if err := s.SetConversationLeft(cid, true); err != nil {
+			t.Fatalf("记录离开失败: %v", err)
+		}
+	}
+	if err := s.SetConversationLeft("grp_1", false); err != nil {
+		t.Fatalf("清除离开失败: %v", err)
+	}
+	s.Close()
+	s, err = storage.NewSQLiteStorage(filepath.Join(tmpDir, "chat_manage_test.db"))
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	defer s.Close()
+	if left, err := s.GetLeftConversations(); err != nil || len(left) != 1 || !left["cid_1"] {
+		t.Fatalf("离开的会话不正确: %v %v", left, err)
+	}
+	t.Log("✅ 离开状态持久保存")
+}
+
+// 测试离线同步检查点只前进不后退、重启后仍在、可以删除
+func TestSQLiteStorage_SyncCheckpoints_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 离线同步检查点 ===")
+	t.Log("")
+
+	dbPath := filepath.Join(t.TempDir(), "chat_checkpoint_test.db")
+	s, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+
+	// ===== Step 1: 保存和推进 =====
+	t.Log("Step 1: 保存检查点...")
+	for _, cp := range []struct {
+		cid    string
+		stream string
+		seq    uint64
+	}{
+		{"cid_dm", "DChatDirect", 5},
+		{"cid_dm", "DChatDirect", 12},
+		{"cid_dm", "DChatDirect", 9}, // 乱序重投不回退
+		{"grp_1", "DChatGroups", 3},
+	} {
+		if err := s.SaveSyncCheckpoint(cp.cid, cp.stream, cp.seq); err != nil {
+			t.Fatalf("保存检查点失败: %v", err)
+		}
+	}
+	t.Log("✅ 检查点已保存")
+
+	// ===== Step 2: 重新打开后读取 =====
+	t.Log("Step 2: 重新打开数据库...")
+	s.Close()
+	if s, err = storage.NewSQLiteStorage(dbPath); err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	defer s.Close()
+	checkpoints, err := s.GetSyncCheckpoints()
+	if err != nil {
+		t.Fatalf("读取检查点失败: %v", err)
+	}
+	got := map[string]uint64{}
+	for _, cp := range checkpoints {
+		got[cp.ConversationID] = cp.LastSeq
+		if cp.UpdatedAt.IsZero() {
+			t.Fatalf("检查点缺少更新时间: %+v", cp)
+		}
+	}
+	if len(got) != 2 || got["cid_dm"] != 12 || got["grp_1"] != 3 {
+		t.Fatalf("检查点不正确: %v", got)
+	}
+	t.Log("✅ 检查点只前进不后退")
+
+	// ===== Step 3: 删除 =====
+	t.Log("Step 3: 删除检查点...")
+	if err := s.DeleteSyncCheckpoint("cid_dm"); err != nil {
+		t.Fatalf("删除检查点失败: %v", err)
+	}
+	if checkpoints, _ = s.GetSyncCheckpoints(); len(checkpoints) != 1 || checkpoints[0].ConversationID != "grp_1" {
+		t.Fatalf("删除后应只剩群聊检查点: %+v", checkpoints)
+	}
+	if err := s.SaveSyncCheckpoint("cid_dm", "DChatDirect", 2); err != nil {
+		t.Fatalf("保存检查点失败: %v", err)
+	}
+	checkpoints, _ = s.GetSyncCheckpoints()
+	for _, cp := range checkpoints {
+		if cp.ConversationID == "cid_dm" && cp.LastSeq != 2 {
+			t.Fatalf("删除后重新记录的检查点应为 2: %d", cp.LastSeq)
+		}
+	}
+	t.Log("✅ 删除后可以按新流的序列号重新记录")
+}
+
+// 测试离线同步隔离表：隔离、重复隔离累加次数、按缺少的密钥查询、移出
+func TestSQLiteStorage_SyncQuarantine_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 离线同步隔离表 ===")
+	t.Log("")
+
+	s, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "chat_quarantine_test.db"))
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	// ===== Step 1: 隔离 =====
+	t.Log("Step 1: 隔离解密失败的消息...")
+	for _, q := range []*storage.QuarantinedMessage{
+		{Subject: "dchat.grp.g1.msg", NatsSeq: 7, ConversationID: "g1", SenderID: "bob", KeyKind: storage.QuarantineGroupKey, KeyID: "g1", Reason: "epoch 1 not available", Payload: []byte(`{"cid":"g1"}`)},
+		{Subject: "dchat.grp.g1.msg", NatsSeq: 3, ConversationID: "g1", SenderID: "bob", KeyKind: storage.QuarantineGroupKey, KeyID: "g1", Reason: "epoch 1 not available", Payload: []byte(`{"cid":"g1","n":3}`)},
+		{Subject: "dchat.dm.c1.msg", NatsSeq: 5, ConversationID: "c1", SenderID: "carol", Reason: "message authentication failed", Payload: []byte(`{"cid":"c1"}`)},
+	} {
+		if err := s.QuarantineMessage(q); err != nil {
+			t.Fatalf("隔离消息失败: %v", err)
+		}
+	}
+	all, err := s.GetQuarantinedMessages("", "")
+	if err != nil {
+		t.Fatalf("读取隔离消息失败: %v", err)
+	}
+	if len(all) != 3 || all[0].NatsSeq != 3 || all[2].NatsSeq != 7 {
+		t.Fatalf("隔离消息应按序列号排列: %+v", all)
+	}
+	if string(all[0].Payload) != `{"cid":"g1","n":3}` || all[0].Attempts != 1 || all[0].CreatedAt.IsZero() {
+		t.Fatalf("隔离消息内容不正确: %+v", all[0])
+	}
+	t.Log("✅ 已隔离 3 条消息")
+
+	// ===== Step 2: 重复隔离 =====
+	t.Log("Step 2: 同一条消息再次隔离...")
+	if err := s.QuarantineMessage(&storage.QuarantinedMessage{
+		Subject: "dchat.grp.g1.msg", NatsSeq: 7, ConversationID: "g1", SenderID: "bob",
+		KeyKind: storage.QuarantineGroupKey, KeyID: "g1", Reason: "epoch 2 not available", Payload: []byte(`{"cid":"g1"}`),
+	}); err != nil {
+		t.Fatalf("隔离消息失败: %v", err)
+	}
+	q, err := s.GetQuarantinedMessage("dchat.grp.g1.msg", 7)
+	if err != nil || q == nil {
+		t.Fatalf("读取隔离消息失败: %v", err)
+	}
+	if q.Attempts != 2 || q.Reason != "epoch 2 not available" {
+		t.Fatalf("重复隔离应累加次数并更新原因: %+v", q)
+	}
+	t.Log("✅ 尝试次数累加")
+
+	// ===== Step 3: 按缺少的密钥查询 =====
+	t.Log("Step 3: 按缺少的密钥查询...")
+	group, err := s.GetQuarantinedMessages(storage.QuarantineGroupKey, "g1")
+	if err != nil {
+		t.Fatalf("读取隔离消息失败: %v", err)
+	}
+	if len(group) != 2 {
+		t.Fatalf("缺少群 g1 密钥的消息应有 2 条: %+v", group)
+	}
+	if friend, _ := s.GetQuarantinedMessages(storage.QuarantineFriendKey, "carol"); len(friend) != 0 {
+		t.Fatalf("密钥齐全仍解不开的消息不应按密钥查到: %+v", friend)
+	}
+	t.Log("✅ 按密钥查询正确")
+
+	// ===== Step 4: 移出 =====
+	t.Log("Step 4: 移出隔离...")
+	if err := s.DeleteQuarantinedMessage("dchat.grp.g1.msg", 7); err != nil {
+		t.Fatalf("移出隔离失败: %v", err)
+	}
+	if q, err = s.GetQuarantinedMessage("dchat.grp.g1.msg", 7); err != nil || q != nil {
+		t.Fatalf("移出后不应再查到: %+v, %v", q, err)
+	}
+	if all, _ = s.GetQuarantinedMessages("", ""); len(all) != 2 {
+		t.Fatalf("移出后应剩 2 条: %+v", all)
+	}
+	t.Log("✅ 移出隔离成功")
+
+	// ===== Step 5: 清理过期和超出上限的 =====
+	t.Log("Step 5: 清理隔离表...")
+	for _, seq := range []uint64{8, 9} {
+		if err := s.QuarantineMessage(&storage.QuarantinedMessage{
+			Subject: "dchat.dm.c1.msg", NatsSeq: seq, ConversationID: "c1", SenderID: "carol", Reason: "bad", Payload: []byte(`{}`),
+		}); err != nil {
+			t.Fatalf("隔离消息失败: %v", err)
+		}
+	}
+	if n, err := s.PurgeQuarantine(time.Now().Add(-time.Hour), 3); err != nil || n != 1 {
+		t.Fatalf("超出上限应删除最早隔离的 1 条: %d, %v", n, err)
+	}
+	if q, _ = s.GetQuarantinedMessage("dchat.grp.g1.msg", 3); q != nil {
+		t.Fatalf("最早隔离的消息应被删除: %+v", q)
+	}
+	if n, err := s.PurgeQuarantine(time.Now().Add(time.Second), 100); err != nil || n != 3 {
+		t.Fatalf("过期的消息应全部删除: %d, %v", n, err)
+	}
+	if all, _ = s.GetQuarantinedMessages("", ""); len(all) != 0 {
+		t.Fatalf("清理后不应有隔离消息: %+v", all)
+	}
+	t.Log("✅ 隔离表有上限")
+}
+
+// 测试发件箱：按放入的先后取出、更新状态、移出，以及发出后补上消息的流序列号
+func TestSQLiteStorage_Outbox_E2E(t *testing.T) {
+	t.Log("=== E2E 测试: 发件箱 ===")
+	t.Log("")
+
+	s, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "chat_outbox_test.db"))
+	if err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	defer s.Close()
+
+	// ===== Step 1: 放进发件箱 =====
+	t.Log("Step 1: 放进发件箱...")
+	now := time.Now().Truncate(time.Second)
+	for _, id := range []string{"msg_b", "msg_a", "msg_c"} {
+		if err := s.EnqueueOutbox(&storage.OutboxEntry{
+			MessageID:      id,
+			ConversationID: "cid_1",
+			Subject:        "dchat.dm.cid_1.msg",
+			Payload:        []byte(`{"id":"` + id + `"}`),
+			State:          storage.DeliveryPending,
+			CreatedAt:      now,
+			NextAttemptAt:  now,
+		}); err != nil {
+			t.Fatalf("放进发件箱失败: %v", err)
+		}
+	}
+	entries, err := s.GetOutbox()
+	if err != nil {
+		t.Fatalf("读取发件箱失败: %v", err)
+	}
+	if len(entries) != 3 || entries[0].MessageID != "msg_b" || entries[1].MessageID != "msg_a" || entries[2].MessageID != "msg_c" {
+		t.Fatalf("发件箱应按放入的先后排列: %+v", entries)
+	}
+	if string(entries[0].Payload) != `{"id":"msg_b"}` || !entries[0].NextAttemptAt.Equal(now) {
+		t.Fatalf("发件箱内容不正确: %+v", entries[0])
+	}
+	t.Log("✅ 按放入的先后排列")
+
+	// ===== Step 2: 更新状态 =====
+	t.Log("Step 2: 发布失败后更新状态...")
+	e := entries[1]
+	e.State, e.Attempts, e.LastError = storage.DeliveryFailed, 3, "maximum payload exceeded"
+	e.NextAttemptAt = now.Add(30 * time.Second)
+	if err := s.UpdateOutbox(e); err != nil {
+		t.Fatalf("更新发件箱失败: %v", err)
+	}
+	got, err := s.GetOutboxEntry("msg_a")
+	if err != nil || got == nil {
+		t.Fatalf("读取发件箱消息失败: %v", err)
+	}
+	if got.State != storage.DeliveryFailed || got.Attempts != 3 || got.LastError != "maximum payload exceeded" || !got.NextAttemptAt.Equal(e.NextAttemptAt) {
+		t.Fatalf("发件箱状态不正确: %+v", got)
+	}
+	if got, err = s.GetOutboxEntry("msg_x"); err != nil || got != nil {
+		t.Fatalf("不在发件箱里的消息应返回 nil: %+v, %v", got, err)
+	}
+	t.Log("✅ 状态已更新")
+
+	// ===== Step 3: 发出后移出并补上序列号 =====
+	t.Log("Step 3: 移出发件箱...")
+	if err := s.SaveMessage(&storage.StoredMessage{ID: "msg_b", ConversationID: "cid_1", SenderID: "alice", Content: "hi", Timestamp: now}); err != nil {
+		t.Fatalf("保存消息失败: %v", err)
+	}
+	if err := s.SetMessageNatsSeq("msg_b", 42); err != nil {
+		t.Fatalf("保存序列号失败: %v", err)
+	}
+	if err := s.DeleteOutbox("msg_b"); err != nil {
+		t.Fatalf("移出发件箱失败: %v", err)
+	}
+	if entries, _ = s.GetOutbox(); len(entries) != 2 || entries[0].MessageID != "msg_a" {
+		t.Fatalf("移出后应剩 2 条: %+v", entries)
+	}
+	t.Log("✅ 移出发件箱成功")
+}
@@ -0,0 +1,47 @@
+-- 引入迁移之前的数据库：没有 schema_version 表，只有最初的几张表，
+-- 消息按 (cid, nats_seq) 唯一索引去重
+CREATE TABLE conversations (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    last_message_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE messages (
+    id TEXT PRIMARY KEY,
+    cid TEXT NOT NULL,
+    sender_id TEXT NOT NULL,
+    sender_nickname TEXT,
+    content TEXT NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    is_read BOOLEAN DEFAULT 0,
+    is_group BOOLEAN DEFAULT 0,
+    nats_seq INTEGER DEFAULT 0, -- NATS消息序列ID，用于去重
+    FOREIGN KEY (cid) REFERENCES conversations(id)
+);
+
+CREATE INDEX idx_messages_cid_time ON messages(cid, timestamp DESC);
+CREATE INDEX idx_messages_sender ON messages(sender_id);
+CREATE UNIQUE INDEX idx_messages_unique ON messages(cid, nats_seq);
+
+CREATE TABLE friend_pub_keys (
+    user_id TEXT PRIMARY KEY,
+    pub_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE group_sym_keys (
+    group_id TEXT PRIMARY KEY,
+    sym_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO conversations (id, type, last_message_at) VALUES
+    ('cid_dm', 'direct', '2024-05-01 10:01:00'),
+    ('grp_legacy', 'group', '2024-05-01 10:02:00');
+INSERT INTO messages (id, cid, sender_id, sender_nickname, content, timestamp, is_read, is_group, nats_seq) VALUES
+    ('msg_legacy_1', 'cid_dm', 'alice', 'Alice', '升级之前的私聊消息', '2024-05-01 10:00:00', 1, 0, 1),
+    ('msg_legacy_2', 'cid_dm', 'bob', 'Bob', '升级之前的第二条私聊', '2024-05-01 10:01:00', 0, 0, 2),
+    ('msg_legacy_3', 'grp_legacy', 'alice', 'Alice', '升级之前的群消息', '2024-05-01 10:02:00', 0, 1, 1);
+INSERT INTO friend_pub_keys (user_id, pub_key) VALUES ('bob', 'bob_pub_key');
+INSERT INTO group_sym_keys (group_id, sym_key) VALUES ('grp_legacy', 'legacy_group_key');
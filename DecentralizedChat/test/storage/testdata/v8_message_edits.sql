@@ -0,0 +1,143 @@
+-- v8（message_edits）数据库：messages 已有 edited_at/deleted 列，
+-- 还没有回复、表情回应和全文索引，(cid, nats_seq) 唯一索引还在
+CREATE TABLE schema_version (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+);
+INSERT INTO schema_version (version, name, applied_at) VALUES
+    (1, 'initial', '2025-01-01 00:00:00'),
+    (2, 'group_key_epochs', '2025-01-01 00:00:00'),
+    (3, 'group_invites', '2025-01-01 00:00:00'),
+    (4, 'group_roster', '2025-01-01 00:00:00'),
+    (5, 'ratchet', '2025-01-01 00:00:00'),
+    (6, 'attachments', '2025-01-01 00:00:00'),
+    (7, 'receipts', '2025-01-01 00:00:00'),
+    (8, 'message_edits', '2025-01-01 00:00:00');
+
+CREATE TABLE conversations (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    last_message_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE messages (
+    id TEXT PRIMARY KEY,
+    cid TEXT NOT NULL,
+    sender_id TEXT NOT NULL,
+    sender_nickname TEXT,
+    content TEXT NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    is_read BOOLEAN DEFAULT 0,
+    is_group BOOLEAN DEFAULT 0,
+    nats_seq INTEGER DEFAULT 0, edited_at TIMESTAMP, deleted BOOLEAN DEFAULT 0, -- NATS消息序列ID
+    FOREIGN KEY (cid) REFERENCES conversations(id)
+);
+CREATE INDEX idx_messages_cid_time ON messages(cid, timestamp DESC);
+CREATE INDEX idx_messages_sender ON messages(sender_id);
+CREATE UNIQUE INDEX idx_messages_unique ON messages(cid, nats_seq);
+CREATE TABLE friend_pub_keys (
+    user_id TEXT PRIMARY KEY,
+    pub_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE group_sym_keys (
+    group_id TEXT PRIMARY KEY,
+    sym_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE group_key_epochs (
+    group_id TEXT NOT NULL,
+    epoch INTEGER NOT NULL,
+    sym_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    retired_at TIMESTAMP,
+    PRIMARY KEY (group_id, epoch)
+);
+CREATE TABLE group_invites (
+    group_id TEXT PRIMARY KEY,
+    group_name TEXT,
+    sym_key TEXT NOT NULL,
+    key_epoch INTEGER DEFAULT 0,
+    inviter_id TEXT NOT NULL,
+    inviter_nickname TEXT,
+    status TEXT NOT NULL DEFAULT 'pending',
+    meta TEXT,
+    received_at TIMESTAMP NOT NULL
+);
+CREATE TABLE group_info (
+    group_id TEXT PRIMARY KEY,
+    name TEXT,
+    description TEXT,
+    creator_id TEXT,
+    version INTEGER DEFAULT 0,
+    updated_by TEXT,
+    updated_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE group_members (
+    group_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'member',
+    PRIMARY KEY (group_id, user_id)
+);
+CREATE TABLE ratchet_prekeys (
+    prekey_id INTEGER PRIMARY KEY,
+    priv_key TEXT NOT NULL,
+    pub_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE ratchet_one_time_prekeys (
+    prekey_id INTEGER PRIMARY KEY,
+    priv_key TEXT NOT NULL,
+    pub_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE ratchet_peer_prekeys (
+    peer_id TEXT PRIMARY KEY,
+    prekey_id INTEGER NOT NULL,
+    pub_key TEXT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE ratchet_sessions (
+    peer_id TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    state TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (peer_id, session_id)
+);
+CREATE TABLE attachments (
+    message_id TEXT PRIMARY KEY,
+    cid TEXT NOT NULL,
+    bucket TEXT NOT NULL,
+    object_name TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    mime_type TEXT,
+    size INTEGER NOT NULL,
+    file_key TEXT NOT NULL,
+    chunk_size INTEGER NOT NULL,
+    local_path TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_attachments_cid ON attachments(cid);
+CREATE TABLE message_delivery (
+    message_id TEXT PRIMARY KEY,
+    state TEXT NOT NULL DEFAULT 'sent',
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE message_receipts (
+    message_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    state TEXT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id)
+);
+
+INSERT INTO conversations (id, type, last_message_at) VALUES ('cid_dm', 'direct', '2025-02-01 09:01:00');
+INSERT INTO messages (id, cid, sender_id, sender_nickname, content, timestamp, is_read, nats_seq, edited_at, deleted) VALUES
+    ('01JKV8A0000000000000000001', 'cid_dm', 'alice', 'Alice', '编辑过的消息内容', '2025-02-01 09:00:00', 1, 5, '2025-02-01 09:05:00', 0),
+    ('01JKV8A0000000000000000002', 'cid_dm', 'bob', 'Bob', '', '2025-02-01 09:01:00', 0, 6, '2025-02-01 09:06:00', 1);
+INSERT INTO group_sym_keys (group_id, sym_key) VALUES ('grp_v8', 'v8_group_key');
+INSERT INTO group_key_epochs (group_id, epoch, sym_key) VALUES ('grp_v8', 0, 'v8_group_key');
+INSERT INTO message_delivery (message_id, state) VALUES ('01JKV8A0000000000000000001', 'read');
@@ -0,0 +1,11 @@
+-- 更新版本程序写入的数据库，当前版本不认识它的表结构
+CREATE TABLE schema_version (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+);
+INSERT INTO schema_version (version, name, applied_at) VALUES (99, 'from_the_future', '2030-01-01 00:00:00');
+CREATE TABLE messages (
+    id TEXT PRIMARY KEY,
+    body BLOB NOT NULL
+);